@@ -0,0 +1,109 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// This exports the client database (the scanned items, favorites,
+// vendors, or scan history) as csv or json files, and imports them
+// again, e.g. to move the data from one Pi to another
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Banrai/PiScan/client/database"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	exportCommand = "export"
+	importCommand = "import"
+)
+
+func usage() {
+	fmt.Println("Backup usage:")
+	fmt.Println(fmt.Sprintf("  Backup %s [options] [file]  (writes to stdout if there is no file)", exportCommand))
+	fmt.Println(fmt.Sprintf("  Backup %s [options] file", importCommand))
+	fmt.Println(fmt.Sprintf("Data sets: %s", strings.Join(database.DATA_SETS, ", ")))
+	fmt.Println(fmt.Sprintf("Formats: %s", strings.Join(database.FORMATS, ", ")))
+}
+
+func main() {
+	var (
+		sqlitePath, sqliteFile, data, format string
+	)
+
+	if len(os.Args) < 2 || (os.Args[1] != exportCommand && os.Args[1] != importCommand) {
+		usage()
+		os.Exit(2)
+	}
+	command := os.Args[1]
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.StringVar(&sqlitePath, "sqlitePath", database.SQLITE_PATH, fmt.Sprintf("Path to the sqlite file (defaults to '%s')", database.SQLITE_PATH))
+	flags.StringVar(&sqliteFile, "sqliteFile", database.SQLITE_FILE, fmt.Sprintf("The sqlite database file (defaults to '%s')", database.SQLITE_FILE))
+	flags.StringVar(&data, "data", database.DATA_ITEMS, fmt.Sprintf("The data set (defaults to '%s')", database.DATA_ITEMS))
+	flags.StringVar(&format, "format", "", "The file format (defaults to the file extension, or 'csv')")
+	flags.Parse(os.Args[2:])
+
+	filename := flags.Arg(0)
+	if format == "" {
+		format = strings.ToLower(strings.TrimPrefix(path.Ext(filename), "."))
+		if !database.IsFormat(format) {
+			format = database.FORMAT_CSV
+		}
+	}
+	if !database.IsDataSet(data) || !database.IsFormat(format) || (command == importCommand && filename == "") {
+		usage()
+		os.Exit(2)
+	}
+
+	// create the client db, or apply the schema changes it is missing (as
+	// the WebApp and PiScanner do at startup, since this may run first)
+	dbCoordinates := database.ConnCoordinates{DBPath: sqlitePath, DBFile: sqliteFile}
+	if _, _, migrateErr := database.MigrateDB(dbCoordinates); migrateErr != nil {
+		log.Fatal(migrateErr)
+	}
+
+	db, dbErr := database.InitializeDB(dbCoordinates)
+	if dbErr != nil {
+		log.Fatal(dbErr)
+	}
+	defer db.Close()
+
+	acc, accErr := database.GetDesignatedAccount(db)
+	if accErr != nil {
+		log.Fatal(accErr)
+	}
+
+	if command == exportCommand {
+		var out io.Writer = os.Stdout
+		if filename != "" {
+			file, fileErr := os.Create(filename)
+			if fileErr != nil {
+				log.Fatal(fileErr)
+			}
+			defer file.Close()
+			out = file
+		}
+		if err := database.Export(db, acc, data, format, out); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	file, fileErr := os.Open(filename)
+	if fileErr != nil {
+		log.Fatal(fileErr)
+	}
+	defer file.Close()
+
+	result, err := database.Import(db, acc, data, format, file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println(fmt.Sprintf("Imported %s: %d added, %d merged, %d skipped", filename, result.Added, result.Merged, result.Skipped))
+}
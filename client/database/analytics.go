@@ -0,0 +1,260 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"fmt"
+	"github.com/Banrai/PiScan/server/commerce"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"time"
+)
+
+const (
+	// Scan count periods
+	PERIOD_DAY  = "day"
+	PERIOD_WEEK = "week" // starting on Monday
+
+	// sqlite date format, for the period labels
+	SQLITE_DATE = "2006-01-02"
+
+	// Aggregation queries, over the scan_event rows matching historyFilter
+	// (each scan is matched to the first Item with its barcode, if any)
+	SCAN_PRODUCT    = "scan_event e left join product p on p.id = (select fp.id from product fp where fp.account = e.account and fp.barcode = e.barcode order by fp.product_ind limit 1)"
+	SCANS_PER_DAY   = "select date(e.scanned, 'localtime') as period, count(*) from scan_event e where %s group by period order by period"
+	SCANS_PER_WEEK  = "select date(e.scanned, 'localtime', 'weekday 0', '-6 days') as period, count(*) from scan_event e where %s group by period order by period"
+	SCAN_OUTCOMES   = "select e.outcome, count(*) from scan_event e where %s group by e.outcome"
+	TOP_BARCODES    = "select e.barcode, count(*) as scans, max(p.id) as product, max(p.product_desc) as product_desc from " + SCAN_PRODUCT + " where %s group by e.barcode order by scans desc, max(e.scanned) desc limit %d"
+	TOP_CATEGORIES  = "select coalesce(p.category, '') as category, count(*) as scans from " + SCAN_PRODUCT + " where %s and p.id is not null group by category order by scans desc, category limit %d"
+	FAVORITE_SCANS  = "select count(*), coalesce(sum(p.is_favorite), 0) from " + SCAN_PRODUCT + " where %s"
+	FAVORITE_ITEMS  = "select count(*), coalesce(sum(is_favorite), 0) from product where account = $a"
+	SPEND_BY_VENDOR = "select v.vendor_id, v.display_name, pa.currency, sum(pa.price) as amount, count(*) as scans from " + SCAN_PRODUCT + " join product_availability pa on pa.product = p.id join vendor v on v.id = pa.vendor where %s and pa.price > 0 and pa.currency != '' group by v.id, pa.currency order by v.display_name, pa.currency"
+)
+
+// PeriodCount is how many scans there were on the day, or in the week
+// starting on the day, of Period (e.g. "2015-03-02")
+type PeriodCount struct {
+	Period string `json:"period"`
+	Scans  int64  `json:"scans"`
+}
+
+// BarcodeCount is how many times the barcode was scanned, with the Item
+// it matches today (if any)
+type BarcodeCount struct {
+	Barcode string `json:"barcode"`
+	Product int64  `json:"product"` // the Item id, or BAD_PK if there is none
+	Desc    string `json:"desc"`
+	Scans   int64  `json:"scans"`
+}
+
+// CategoryCount is how many scans were of Items in the category (which
+// is empty for the Items without one)
+type CategoryCount struct {
+	Category string `json:"category"`
+	Scans    int64  `json:"scans"`
+}
+
+// FavoriteUsage compares the favorite Items with the rest, both in the
+// product list, and in the scans
+type FavoriteUsage struct {
+	Items         int64 `json:"items"`
+	Favorites     int64 `json:"favorites"`
+	Scans         int64 `json:"scans"` // of known Items
+	FavoriteScans int64 `json:"favoriteScans"`
+}
+
+// VendorSpend is what the scans would have cost at the vendor, at its
+// last known prices (in the smallest unit of the currency)
+type VendorSpend struct {
+	Vendor      string `json:"vnd"`
+	DisplayName string `json:"name"`
+	Currency    string `json:"currency"`
+	Amount      int64  `json:"amount"`
+	Display     string `json:"display"`
+	Scans       int64  `json:"scans"` // how many of the scans it sells
+}
+
+// Analytics summarizes the Account's scans between From and To
+type Analytics struct {
+	From        string           `json:"from"`
+	To          string           `json:"to"`
+	Scans       int64            `json:"scans"`
+	Found       int64            `json:"found"`
+	Unknown     int64            `json:"unknown"`
+	Errors      int64            `json:"errors"`
+	UnknownRate float64          `json:"unknownRate"` // of the successful lookups
+	PerDay      []*PeriodCount   `json:"perDay"`
+	PerWeek     []*PeriodCount   `json:"perWeek"`
+	TopBarcodes []*BarcodeCount  `json:"topBarcodes"`
+	Categories  []*CategoryCount `json:"categories"`
+	Favorites   *FavoriteUsage   `json:"favorites"`
+	Spend       []*VendorSpend   `json:"spend"`
+}
+
+// ScansPerPeriod returns how many scans there were each day or week
+// (according to the period) between the From and To of the HistoryQuery,
+// including the periods without any scans
+func ScansPerPeriod(db *sqlite3.Conn, a *Account, q *HistoryQuery, period string) ([]*PeriodCount, error) {
+	sql, step := SCANS_PER_DAY, 1
+	if period == PERIOD_WEEK {
+		sql, step = SCANS_PER_WEEK, 7
+	}
+
+	where, args := historyFilter(a, q)
+	counts := make(map[string]int64)
+	var first, last string
+	for s, err := db.Query(fmt.Sprintf(sql, where), args); err == nil; err = s.Next() {
+		var label string
+		var n int64
+		s.Scan(&label, &n)
+		counts[label] = n
+		if first == "" {
+			first = label
+		}
+		last = label
+	}
+
+	// fill in the empty periods, over the whole range if it is known
+	results := make([]*PeriodCount, 0)
+	start, startErr := time.ParseInLocation(SQLITE_DATE, first, time.Local)
+	end, endErr := time.ParseInLocation(SQLITE_DATE, last, time.Local)
+	if !q.From.IsZero() {
+		start, startErr = periodStart(q.From, period), nil
+	}
+	if !q.To.IsZero() {
+		end, endErr = periodStart(q.To.Add(-time.Second), period), nil
+	}
+	if startErr != nil || endErr != nil {
+		return results, nil
+	}
+	for day := start; !day.After(end); day = day.AddDate(0, 0, step) {
+		label := day.Format(SQLITE_DATE)
+		results = append(results, &PeriodCount{Period: label, Scans: counts[label]})
+	}
+	return results, nil
+}
+
+// periodStart returns the (local) date of the day or week containing t
+func periodStart(t time.Time, period string) time.Time {
+	y, m, d := t.Local().Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+	if period == PERIOD_WEEK {
+		day = day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return day
+}
+
+// TopBarcodes returns the most often scanned barcodes, at most limit of them
+func TopBarcodes(db *sqlite3.Conn, a *Account, q *HistoryQuery, limit int) ([]*BarcodeCount, error) {
+	results := make([]*BarcodeCount, 0)
+	where, args := historyFilter(a, q)
+	row := make(sqlite3.RowMap)
+	for s, err := db.Query(fmt.Sprintf(TOP_BARCODES, where, limit), args); err == nil; err = s.Next() {
+		var barcode string
+		s.Scan(&barcode, row)
+		result := &BarcodeCount{Barcode: barcode, Product: BAD_PK, Desc: rowString(row, "product_desc")}
+		if scans, scansOk := row["scans"].(int64); scansOk {
+			result.Scans = scans
+		}
+		if product, productOk := row["product"].(int64); productOk {
+			result.Product = product
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// TopCategories returns the categories of the most often scanned Items,
+// at most limit of them
+func TopCategories(db *sqlite3.Conn, a *Account, q *HistoryQuery, limit int) ([]*CategoryCount, error) {
+	results := make([]*CategoryCount, 0)
+	where, args := historyFilter(a, q)
+	for s, err := db.Query(fmt.Sprintf(TOP_CATEGORIES, where, limit), args); err == nil; err = s.Next() {
+		result := new(CategoryCount)
+		s.Scan(&result.Category, &result.Scans)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// GetFavoriteUsage returns how many of the Account's Items, and of its
+// scans, are favorites
+func GetFavoriteUsage(db *sqlite3.Conn, a *Account, q *HistoryQuery) (*FavoriteUsage, error) {
+	result := new(FavoriteUsage)
+	for s, err := db.Query(FAVORITE_ITEMS, sqlite3.NamedArgs{"$a": a.Id}); err == nil; err = s.Next() {
+		s.Scan(&result.Items, &result.Favorites)
+	}
+
+	where, args := historyFilter(a, q)
+	for s, err := db.Query(fmt.Sprintf(FAVORITE_SCANS, where+" and p.id is not null"), args); err == nil; err = s.Next() {
+		s.Scan(&result.Scans, &result.FavoriteScans)
+	}
+	return result, nil
+}
+
+// SpendByVendor returns what the scans would have cost at each vendor
+// (and in each currency), according to their last known prices
+func SpendByVendor(db *sqlite3.Conn, a *Account, q *HistoryQuery) ([]*VendorSpend, error) {
+	results := make([]*VendorSpend, 0)
+	where, args := historyFilter(a, q)
+	for s, err := db.Query(fmt.Sprintf(SPEND_BY_VENDOR, where), args); err == nil; err = s.Next() {
+		result := new(VendorSpend)
+		s.Scan(&result.Vendor, &result.DisplayName, &result.Currency, &result.Amount, &result.Scans)
+		result.Display = commerce.FormatPrice(result.Amount, result.Currency)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// GetAnalytics computes all the aggregates for the Account's scans
+// between the From and To of the HistoryQuery, with at most top entries
+// in the lists of barcodes and categories
+func GetAnalytics(db *sqlite3.Conn, a *Account, q *HistoryQuery, top int) (*Analytics, error) {
+	result := new(Analytics)
+	if !q.From.IsZero() {
+		result.From = q.From.Format(SQLITE_DATE)
+	}
+	if !q.To.IsZero() {
+		result.To = q.To.AddDate(0, 0, -1).Format(SQLITE_DATE)
+	}
+
+	where, args := historyFilter(a, q)
+	for s, err := db.Query(fmt.Sprintf(SCAN_OUTCOMES, where), args); err == nil; err = s.Next() {
+		var outcome string
+		var n int64
+		s.Scan(&outcome, &n)
+		switch outcome {
+		case SCAN_FOUND:
+			result.Found = n
+		case SCAN_UNKNOWN:
+			result.Unknown = n
+		default:
+			result.Errors += n
+		}
+		result.Scans += n
+	}
+	if lookups := result.Found + result.Unknown; lookups > 0 {
+		result.UnknownRate = float64(result.Unknown) / float64(lookups)
+	}
+
+	var err error
+	if result.PerDay, err = ScansPerPeriod(db, a, q, PERIOD_DAY); err != nil {
+		return result, err
+	}
+	if result.PerWeek, err = ScansPerPeriod(db, a, q, PERIOD_WEEK); err != nil {
+		return result, err
+	}
+	if result.TopBarcodes, err = TopBarcodes(db, a, q, top); err != nil {
+		return result, err
+	}
+	if result.Categories, err = TopCategories(db, a, q, top); err != nil {
+		return result, err
+	}
+	if result.Favorites, err = GetFavoriteUsage(db, a, q); err != nil {
+		return result, err
+	}
+	result.Spend, err = SpendByVendor(db, a, q)
+	return result, err
+}
@@ -0,0 +1,183 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"github.com/Banrai/PiScan/server/commerce"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const ANALYTICS_FIXTURE = "testdata/analytics.sql"
+
+// migratedDB creates a new, fully migrated, database in a temporary folder
+func migratedDB(t *testing.T) *sqlite3.Conn {
+	coords := ConnCoordinates{DBPath: t.TempDir(), DBFile: SQLITE_FILE}
+	if _, _, err := MigrateDB(coords); err != nil {
+		t.Fatal(err)
+	}
+	db, err := InitializeDB(coords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// fixtureDB creates a new, fully migrated, database in a temporary
+// folder, and loads the fixture file into it
+func fixtureDB(t *testing.T, fixture string) *sqlite3.Conn {
+	db := migratedDB(t)
+	data, err := ioutil.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range (&Migration{Name: fixture, SQL: string(data)}).Statements() {
+		if err = db.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+	return db
+}
+
+// fixtureQuery is the HistoryQuery for the fixture scans between March
+// 2nd (a Monday) and 11th 2015, inclusive
+func fixtureQuery() *HistoryQuery {
+	return &HistoryQuery{
+		From: time.Date(2015, time.March, 2, 0, 0, 0, 0, time.Local),
+		To:   time.Date(2015, time.March, 12, 0, 0, 0, 0, time.Local)}
+}
+
+var fixtureAccount = &Account{Id: 1, Email: "me@example.org", APICode: "0123456789abcdef"}
+
+func TestScansPerDay(t *testing.T) {
+	db := fixtureDB(t, ANALYTICS_FIXTURE)
+
+	counts, err := ScansPerPeriod(db, fixtureAccount, fixtureQuery(), PERIOD_DAY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every day in the range, including those without any scans
+	expected := []*PeriodCount{
+		{"2015-03-02", 0}, {"2015-03-03", 2}, {"2015-03-04", 2}, {"2015-03-05", 0}, {"2015-03-06", 1},
+		{"2015-03-07", 0}, {"2015-03-08", 0}, {"2015-03-09", 0}, {"2015-03-10", 2}, {"2015-03-11", 0}}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("ScansPerPeriod(day) = %v, expected %v", counts, expected)
+	}
+}
+
+func TestScansPerWeek(t *testing.T) {
+	db := fixtureDB(t, ANALYTICS_FIXTURE)
+
+	counts, err := ScansPerPeriod(db, fixtureAccount, fixtureQuery(), PERIOD_WEEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []*PeriodCount{{"2015-03-02", 5}, {"2015-03-09", 2}}; !reflect.DeepEqual(counts, expected) {
+		t.Errorf("ScansPerPeriod(week) = %v, expected %v", counts, expected)
+	}
+
+	// with no From or To, the range is that of the scans themselves
+	counts, err = ScansPerPeriod(db, fixtureAccount, new(HistoryQuery), PERIOD_WEEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*PeriodCount{{"2015-02-16", 1}, {"2015-02-23", 0}, {"2015-03-02", 5}, {"2015-03-09", 2}}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("ScansPerPeriod(week, all) = %v, expected %v", counts, expected)
+	}
+}
+
+func TestTopBarcodes(t *testing.T) {
+	db := fixtureDB(t, ANALYTICS_FIXTURE)
+
+	top, err := TopBarcodes(db, fixtureAccount, fixtureQuery(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the single scans are in most recent order, and the scan of an
+	// unknown barcode has no Item
+	expected := []*BarcodeCount{
+		{Barcode: "0001", Product: 1, Desc: "Oat Milk", Scans: 3},
+		{Barcode: "0004", Product: BAD_PK, Desc: "", Scans: 1},
+		{Barcode: "0003", Product: 4, Desc: "Coffee Beans", Scans: 1}}
+	if !reflect.DeepEqual(top, expected) {
+		t.Errorf("TopBarcodes = %v, expected %v", top, expected)
+	}
+}
+
+func TestTopCategories(t *testing.T) {
+	db := fixtureDB(t, ANALYTICS_FIXTURE)
+
+	categories, err := TopCategories(db, fixtureAccount, fixtureQuery(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the 0001 scans only count as the first Item with that barcode
+	expected := []*CategoryCount{{"Dairy alternatives", 3}, {"", 1}, {"Coffee", 1}}
+	if !reflect.DeepEqual(categories, expected) {
+		t.Errorf("TopCategories = %v, expected %v", categories, expected)
+	}
+}
+
+func TestGetFavoriteUsage(t *testing.T) {
+	db := fixtureDB(t, ANALYTICS_FIXTURE)
+
+	usage, err := GetFavoriteUsage(db, fixtureAccount, fixtureQuery())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (&FavoriteUsage{Items: 4, Favorites: 2, Scans: 5, FavoriteScans: 4}); !reflect.DeepEqual(usage, expected) {
+		t.Errorf("GetFavoriteUsage = %+v, expected %+v", usage, expected)
+	}
+}
+
+func TestSpendByVendor(t *testing.T) {
+	db := fixtureDB(t, ANALYTICS_FIXTURE)
+
+	spend, err := SpendByVendor(db, fixtureAccount, fixtureQuery())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*VendorSpend{
+		{Vendor: "AMZ", DisplayName: "Amazon", Currency: "USD", Amount: 3*199 + 1299, Display: commerce.FormatPrice(3*199+1299, "USD"), Scans: 4},
+		{Vendor: "SHOP", DisplayName: "Corner Shop", Currency: "EUR", Amount: 3 * 250, Display: commerce.FormatPrice(3*250, "EUR"), Scans: 3}}
+	if !reflect.DeepEqual(spend, expected) {
+		t.Errorf("SpendByVendor = %+v, expected %+v", spend, expected)
+	}
+}
+
+func TestGetAnalytics(t *testing.T) {
+	db := fixtureDB(t, ANALYTICS_FIXTURE)
+
+	result, err := GetAnalytics(db, fixtureAccount, fixtureQuery(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.From != "2015-03-02" || result.To != "2015-03-11" {
+		t.Errorf("From, To = %q, %q", result.From, result.To)
+	}
+	if result.Scans != 7 || result.Found != 5 || result.Unknown != 1 || result.Errors != 1 {
+		t.Errorf("Scans, Found, Unknown, Errors = %d, %d, %d, %d, expected 7, 5, 1, 1", result.Scans, result.Found, result.Unknown, result.Errors)
+	}
+	if result.UnknownRate != 1.0/6 {
+		t.Errorf("UnknownRate = %v, expected %v", result.UnknownRate, 1.0/6)
+	}
+	if len(result.PerDay) != 10 || len(result.PerWeek) != 2 || len(result.TopBarcodes) != 5 || len(result.Categories) != 3 || len(result.Spend) != 2 {
+		t.Errorf("GetAnalytics = %+v", result)
+	}
+
+	// a single barcode
+	q := fixtureQuery()
+	q.Barcode = "0001"
+	if result, err = GetAnalytics(db, fixtureAccount, q, 10); err != nil {
+		t.Fatal(err)
+	}
+	if result.Scans != 3 || result.Found != 3 || result.UnknownRate != 0 || len(result.TopBarcodes) != 1 {
+		t.Errorf("GetAnalytics(0001) = %+v", result)
+	}
+}
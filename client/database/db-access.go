@@ -7,12 +7,11 @@ package database
 
 import (
 	"fmt"
+	"github.com/Banrai/PiScan/server/commerce"
 	"github.com/Banrai/PiScan/server/database/barcodes"
 	"github.com/mxk/go-sqlite/sqlite3"
-	"io/ioutil"
 	"math"
 	"path"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -22,38 +21,40 @@ const (
 	SQLITE_PATH = "/data"
 	SQLITE_FILE = "PiScanDB.sqlite"
 
-	// Default sql definitions file
-	TABLE_SQL_DEFINITIONS = "tables.sql"
-
 	// Execution constants
 	BAD_PK = -1
 
+	// separator for lists stored in a single column
+	LIST_SEPARATOR = ","
+
 	// Default Account (for those who don't want to register)
 	ANONYMOUS_EMAIL = "anonymous@example.org"
 
 	// Prepared Statements
 	// User accounts
-	ADD_ACCOUNT    = "insert into account (email, api_code) values ($e, $a)"
-	GET_ACCOUNT    = "select id, api_code from account where email = $e"
-	GET_ACCOUNTS   = "select id, email, api_code from account"
-	UPDATE_ACCOUNT = "update account set email = $e, api_code = $a where id = $i"
+	ADD_ACCOUNT          = "insert into account (email, api_code) values ($e, $a)"
+	GET_ACCOUNT          = "select id, api_code, language from account where email = $e"
+	GET_ACCOUNTS         = "select id, email, api_code, language from account"
+	UPDATE_ACCOUNT       = "update account set email = $e, api_code = $a where id = $i"
+	SET_ACCOUNT_LANGUAGE = "update account set language = $l where id = $i"
 
 	// Products
-	ADD_ITEM           = "insert into product (barcode, product_desc, product_ind, is_edit, account) values ($b, $d, $i, $e, $a)"
-	UPDATE_ITEM        = "update product set product_desc = $d, product_ind = $n, is_edit = $e where id = $i"
+	ADD_ITEM           = "insert into product (barcode, product_desc, product_ind, is_edit, account, brand, brand_url, image_url, category, ingredients, allergens, nutri_score, authors, publisher) values ($b, $d, $i, $e, $a, $br, $bu, $im, $c, $in, $al, $ns, $au, $pu)"
+	UPDATE_ITEM        = "update product set product_desc = $d, product_ind = $n, is_edit = $e, brand = $br, brand_url = $bu where id = $i"
 	GET_EXISTING_ITEM  = "select id from product where barcode = $b and product_desc = $d"
-	GET_ITEMS          = "select id, barcode, product_desc, product_ind, strftime('%s', posted) from product where account = $a order by posted desc"
-	GET_FAVORITE_ITEMS = "select id, barcode, product_desc, product_ind, strftime('%s', posted) from product where is_favorite = 1 and account = $a order by posted desc"
+	ADD_ITEM_SCAN      = "update product set scans = scans + 1 where id = $i"
 	DELETE_ITEM        = "delete from product where id = $i"
+	SET_ITEM_THUMBNAIL = "update product set thumbnail = $t where id = $i"
 	FAVORITE_ITEM      = "update product set is_favorite = 1 where id = $i"
 	UNFAVORITE_ITEM    = "update product set is_favorite = 0 where id = $i"
 
 	// Commerce
 	ADD_VENDOR         = "insert into vendor (vendor_id, display_name) values ($v, $n)"
-	ADD_VENDOR_PRODUCT = "insert into product_availability (vendor, product_code, product) values ($v, $p, $i)"
+	ADD_VENDOR_PRODUCT = "insert into product_availability (vendor, product_code, product, price, currency) values ($v, $p, $i, $pr, $c)"
+	SET_VENDOR_PRICE   = "update product_availability set price = $pr, currency = $c where vendor = $v and product_code = $p and product = $i"
 	GET_VENDOR         = "select id, vendor_id, display_name from vendor where id = $i"
 	GET_VENDORS        = "select distinct id, vendor_id, display_name from vendor"
-	GET_VENDOR_PRODUCT = "select pa.id, v.id, pa.product_code from vendor v, product_availability pa where v.id = pa.vendor and pa.product = $i"
+	GET_VENDOR_PRODUCT = "select pa.id, v.id as v_id, v.vendor_id, v.display_name, pa.product_code, pa.price, pa.currency from vendor v, product_availability pa where v.id = pa.vendor and pa.product = $i"
 )
 
 var (
@@ -61,41 +62,20 @@ var (
 	SECONDS_PER = map[string]int64{"minute": 60, "hour": 3600, "day": 86400, "month": 2592000, "year": 31536000}
 )
 
-func calculateTimeSince(posted string) string {
-	result := "just now" // default reply
-
-	// try to convert the posted string into unix time
-	i, err := strconv.ParseInt(posted, 10, 64)
-	if err == nil {
-		tm := time.Unix(i, 0)
-
-		// calculate the time since posted
-		// and return a human readable
-		// '[interval] ago' string
-		duration := time.Since(tm)
-		if duration.Seconds() < 60.0 {
-			if duration.Seconds() == 1.0 {
-				result = fmt.Sprintf("%2.0f second ago", duration.Seconds())
-			} else {
-				result = fmt.Sprintf("%2.0f seconds ago", duration.Seconds())
-			}
-		} else {
-			for _, interval := range INTERVALS {
-				v := math.Trunc(duration.Seconds() / float64(SECONDS_PER[interval]))
-				if v > 0.0 {
-					if v == 1.0 {
-						result = fmt.Sprintf("%2.0f %s ago", v, interval)
-					} else {
-						// plularize the interval label
-						result = fmt.Sprintf("%2.0f %ss ago", v, interval)
-					}
-					break
-				}
-			}
+// TimeSince returns how long ago the posted time was, as a whole number
+// of the largest interval which fits (seconds, if less than a minute)
+func TimeSince(posted time.Time) (int64, string) {
+	duration := time.Since(posted)
+	if duration.Seconds() < 60.0 {
+		return int64(math.Max(duration.Seconds(), 0)), "second"
+	}
+	for _, interval := range INTERVALS {
+		v := math.Trunc(duration.Seconds() / float64(SECONDS_PER[interval]))
+		if v > 0.0 {
+			return int64(v), interval
 		}
 	}
-
-	return result
+	return 0, "second"
 }
 
 func getPK(db *sqlite3.Conn, table string) int64 {
@@ -111,15 +91,15 @@ func getPK(db *sqlite3.Conn, table string) int64 {
 }
 
 type ConnCoordinates struct {
-	DBPath       string
-	DBFile       string
-	DBTablesPath string
+	DBPath string
+	DBFile string
 }
 
 type Account struct {
-	Id      int64
-	Email   string
-	APICode string
+	Id       int64
+	Email    string
+	APICode  string
+	Language string // the WebApp language chosen, if any (see ui.Translation)
 }
 
 type Vendor struct {
@@ -132,6 +112,17 @@ type VendorProduct struct {
 	Id          int64
 	ProductCode string
 	Vendor      *Vendor
+	Price       int64 // in the smallest unit of the Currency, zero if unknown
+	Currency    string
+}
+
+// DisplayPrice returns the formatted price string, or the empty string if
+// the price is unknown
+func (vp *VendorProduct) DisplayPrice() string {
+	if vp.Price <= 0 || vp.Currency == "" {
+		return ""
+	}
+	return commerce.FormatPrice(vp.Price, vp.Currency)
 }
 
 type Item struct {
@@ -139,9 +130,45 @@ type Item struct {
 	Desc            string
 	Barcode         string
 	Index           int64
-	Since           string
+	Posted          time.Time
+	Scans           int64 // how many times it has been scanned
 	UserContributed bool
 	ForSale         []*VendorProduct
+
+	// Optional product details
+	Brand       string
+	BrandURL    string
+	ImageURL    string
+	Thumbnail   string
+	Category    string
+	Ingredients string
+	Allergens   []string
+	NutriScore  string
+
+	// Optional book details
+	Authors   []string
+	Publisher string
+}
+
+// IsBook is true if the Item barcode is an ISBN
+func (i *Item) IsBook() bool {
+	return barcodes.IsISBN(i.Barcode)
+}
+
+// HasDetails is true if any of the optional product details are known
+func (i *Item) HasDetails() bool {
+	return i.Brand != "" || i.ImageURL != "" || i.Category != "" || i.Ingredients != "" || len(i.Allergens) > 0 || i.NutriScore != "" || len(i.Authors) > 0 || i.Publisher != ""
+}
+
+// rowString returns the column value from the row as a string, or the
+// empty string if the column is missing or null
+func rowString(row sqlite3.RowMap, column string) string {
+	if val, found := row[column]; found {
+		if str, ok := val.(string); ok {
+			return str
+		}
+	}
+	return ""
 }
 
 func getExistingItem(db *sqlite3.Conn, barcode, desc string) int64 {
@@ -163,19 +190,31 @@ func (i *Item) Add(db *sqlite3.Conn, a *Account) (int64, error) {
 	// insert the Item object
 
 	// but first check if it's a duplicate or not
+	// (if so, it has just been scanned again)
 	itemPk := getExistingItem(db, i.Barcode, i.Desc)
 	if itemPk != BAD_PK {
-		return itemPk, nil
+		return itemPk, db.Exec(ADD_ITEM_SCAN, sqlite3.NamedArgs{"$i": itemPk})
 	}
 
 	args := sqlite3.NamedArgs{"$b": i.Barcode,
-		"$d": i.Desc,
-		"$i": i.Index,
-		"$e": i.UserContributed,
-		"$a": a.Id}
+		"$d":  i.Desc,
+		"$i":  i.Index,
+		"$e":  i.UserContributed,
+		"$a":  a.Id,
+		"$br": i.Brand,
+		"$bu": i.BrandURL,
+		"$im": i.ImageURL,
+		"$c":  i.Category,
+		"$in": i.Ingredients,
+		"$al": strings.Join(i.Allergens, LIST_SEPARATOR),
+		"$ns": i.NutriScore,
+		"$au": strings.Join(i.Authors, LIST_SEPARATOR),
+		"$pu": i.Publisher}
 	result := db.Exec(ADD_ITEM, args)
 	if result == nil {
 		pk := getPK(db, "product")
+		i.Id = pk
+		i.index(db)
 		return pk, result
 	}
 
@@ -183,18 +222,35 @@ func (i *Item) Add(db *sqlite3.Conn, a *Account) (int64, error) {
 }
 
 func (i *Item) Update(db *sqlite3.Conn) error {
-	// update the Item with with user contribution (description)
+	// update the Item with with user contribution (description, brand)
 	args := sqlite3.NamedArgs{"$d": i.Desc,
-		"$n": i.Index,
-		"$e": i.UserContributed,
-		"$i": i.Id}
-	return db.Exec(UPDATE_ITEM, args)
+		"$n":  i.Index,
+		"$e":  i.UserContributed,
+		"$br": i.Brand,
+		"$bu": i.BrandURL,
+		"$i":  i.Id}
+	err := db.Exec(UPDATE_ITEM, args)
+	if err == nil {
+		i.index(db)
+	}
+	return err
+}
+
+func (i *Item) SetThumbnail(db *sqlite3.Conn, filename string) error {
+	// record the cached image file name for this Item
+	args := sqlite3.NamedArgs{"$t": filename, "$i": i.Id}
+	return db.Exec(SET_ITEM_THUMBNAIL, args)
 }
 
 func (i *Item) Delete(db *sqlite3.Conn) error {
 	// delete the Item
 	args := sqlite3.NamedArgs{"$i": i.Id}
-	return db.Exec(DELETE_ITEM, args)
+	err := db.Exec(DELETE_ITEM, args)
+	if err == nil {
+		i.unindex(db)
+		db.Exec(DELETE_UNITS, args)
+	}
+	return err
 }
 
 func (i *Item) Favorite(db *sqlite3.Conn) error {
@@ -209,58 +265,23 @@ func (i *Item) Unfavorite(db *sqlite3.Conn) error {
 	return db.Exec(UNFAVORITE_ITEM, args)
 }
 
-func fetchItems(db *sqlite3.Conn, a *Account, sql string) ([]*Item, error) {
-	// find all the items for this account
-	results := make([]*Item, 0)
-
-	args := sqlite3.NamedArgs{"$a": a.Id}
-	row := make(sqlite3.RowMap)
-	for s, err := db.Query(sql, args); err == nil; err = s.Next() {
-		var rowid int64
-		s.Scan(&rowid, row)
-
-		barcode, barcodeFound := row["barcode"]
-		desc, descFound := row["product_desc"]
-		ind, indFound := row["product_ind"]
-		since, sinceFound := row["strftime('%s', posted)"]
-		if barcodeFound {
-			result := new(Item)
-			result.Id = rowid
-			result.Barcode = barcode.(string)
-			if descFound {
-				result.Desc = desc.(string)
-			}
-			if indFound {
-				result.Index = ind.(int64)
-			}
-			if sinceFound {
-				result.Since = calculateTimeSince(since.(string))
-			}
-			result.ForSale = GetVendorProducts(db, rowid)
-			results = append(results, result)
-		}
-	}
-
-	return results, nil
-}
-
 func GetItems(db *sqlite3.Conn, a *Account) ([]*Item, error) {
-	return fetchItems(db, a, GET_ITEMS)
+	items, _, err := QueryItems(db, a, &ItemQuery{})
+	return items, err
 }
 
 func GetFavoriteItems(db *sqlite3.Conn, a *Account) ([]*Item, error) {
-	return fetchItems(db, a, GET_FAVORITE_ITEMS)
+	items, _, err := QueryItems(db, a, &ItemQuery{Favorites: true})
+	return items, err
 }
 
 func GetSingleItem(db *sqlite3.Conn, a *Account, id int64) (*Item, error) {
+	items, _, err := QueryItems(db, a, &ItemQuery{Id: id})
+	if len(items) > 0 {
+		return items[0], err
+	}
 	item := new(Item)
 	item.Id = BAD_PK // if not found
-	items, err := GetItems(db, a)
-	for _, i := range items {
-		if i.Id == id {
-			return i, err
-		}
-	}
 	return item, err
 }
 
@@ -275,11 +296,21 @@ func AddVendor(db *sqlite3.Conn, vendorId, vendorDisplayName string) (int64, err
 	return BAD_PK, result
 }
 
-func AddVendorProduct(db *sqlite3.Conn, productCode string, vendorId, itemId int64) error {
+// AddVendorProduct records the vendor product code and its current price
+// (if any) for the given item, or updates the price if the vendor product
+// code already exists
+func AddVendorProduct(db *sqlite3.Conn, productCode string, vendorId, itemId, price int64, currency string) error {
 	args := sqlite3.NamedArgs{"$v": vendorId,
-		"$p": productCode,
-		"$i": itemId}
-	return db.Exec(ADD_VENDOR_PRODUCT, args)
+		"$p":  productCode,
+		"$i":  itemId,
+		"$pr": price,
+		"$c":  currency}
+	err := db.Exec(ADD_VENDOR_PRODUCT, args)
+	if err != nil && price > 0 {
+		// already exists, so just update its price
+		err = db.Exec(SET_VENDOR_PRICE, args)
+	}
+	return err
 }
 
 func GetVendor(db *sqlite3.Conn, vendorId int64) *Vendor {
@@ -325,13 +356,17 @@ func GetVendorProducts(db *sqlite3.Conn, itemId int64) []*VendorProduct {
 		var rowid int64
 		s.Scan(&rowid, row)
 
-		vendorPk, vendorPkFound := row["id"]
+		vendorPk, vendorPkFound := row["v_id"]
 		productCode, productCodeFound := row["product_code"]
 		if vendorPkFound && productCodeFound {
 			result := new(VendorProduct)
 			result.Id = rowid
 			result.ProductCode = productCode.(string)
-			result.Vendor = GetVendor(db, vendorPk.(int64))
+			result.Vendor = &Vendor{Id: vendorPk.(int64), VendorId: rowString(row, "vendor_id"), DisplayName: rowString(row, "display_name")}
+			if price, priceOk := row["price"].(int64); priceOk {
+				result.Price = price
+			}
+			result.Currency = rowString(row, "currency")
 			results = append(results, result)
 		}
 	}
@@ -351,6 +386,12 @@ func (a *Account) Update(db *sqlite3.Conn, newEmail, newApi string) error {
 	return db.Exec(UPDATE_ACCOUNT, args)
 }
 
+func (a *Account) SetLanguage(db *sqlite3.Conn, language string) error {
+	// update this Account's WebApp language (empty for automatic)
+	args := sqlite3.NamedArgs{"$i": a.Id, "$l": language}
+	return db.Exec(SET_ACCOUNT_LANGUAGE, args)
+}
+
 func GetAccount(db *sqlite3.Conn, email string) (*Account, error) {
 	// get the account corresponding to this email
 	result := new(Account)
@@ -366,6 +407,7 @@ func GetAccount(db *sqlite3.Conn, email string) (*Account, error) {
 			result.APICode = api.(string)
 			result.Id = rowid
 			result.Email = email
+			result.Language = rowString(row, "language")
 			break
 		}
 	}
@@ -389,6 +431,7 @@ func GetAllAccounts(db *sqlite3.Conn) ([]*Account, error) {
 			result.APICode = api.(string)
 			result.Id = rowid
 			result.Email = email.(string)
+			result.Language = rowString(row, "language")
 			results = append(results, result)
 		}
 	}
@@ -435,22 +478,6 @@ func InitializeDB(coords ConnCoordinates) (*sqlite3.Conn, error) {
 		return db, dbErr
 	}
 
-	// load the table definitions file, if coords.DBTablesPath is defined
-	if len(coords.DBTablesPath) > 0 {
-		content, err := ioutil.ReadFile(path.Join(coords.DBTablesPath, TABLE_SQL_DEFINITIONS))
-		if err != nil {
-			return db, err
-		}
-
-		// attempt to create (if not exists) each table
-		tables := strings.Split(string(content), ";")
-		for _, table := range tables {
-			err = db.Exec(table)
-			if err != nil {
-				return db, err
-			}
-		}
-	}
-
+	// (the tables are created and kept up to date by MigrateDB)
 	return db, nil
 }
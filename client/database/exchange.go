@@ -0,0 +1,643 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The data sets which can be exported and imported
+	DATA_ITEMS     = "items"
+	DATA_FAVORITES = "favorites" // the favorite items only (imported as items)
+	DATA_VENDORS   = "vendors"   // with the vendor product codes and prices
+	DATA_HISTORY   = "history"
+
+	// The exchange formats
+	FORMAT_CSV  = "csv"
+	FORMAT_JSON = "json"
+
+	// Exports
+	EXPORT_ITEMS   = "select id, barcode, product_desc, product_ind, is_favorite, is_edit, strftime('%s', posted) as posted, scans, brand, brand_url, image_url, category, ingredients, allergens, nutri_score, authors, publisher from product where account = $a and is_favorite >= $f order by id"
+	EXPORT_VENDORS = "select v.id, v.vendor_id, v.display_name, pa.product_code, p.barcode, p.product_desc, pa.price, pa.currency from vendor v left join (product_availability pa join product p on p.id = pa.product and p.account = $a) on pa.vendor = v.id order by v.vendor_id, pa.id"
+	EXPORT_HISTORY = "select id, barcode, strftime('%s', scanned) as scanned, mode, device, outcome from scan_event where account = $a order by scanned, id"
+
+	// Imports (an existing item keeps its details, but gets any it lacks)
+	MERGE_ITEM        = "update product set is_favorite = max(is_favorite, $f), is_edit = max(is_edit, $e), scans = max(scans, $s), posted = min(posted, coalesce($p, posted)), brand = coalesce(nullif(brand, ''), $br), brand_url = coalesce(nullif(brand_url, ''), $bu), image_url = coalesce(nullif(image_url, ''), $im), category = coalesce(nullif(category, ''), $c), ingredients = coalesce(nullif(ingredients, ''), $in), allergens = coalesce(nullif(allergens, ''), $al), nutri_score = coalesce(nullif(nutri_score, ''), $ns), authors = coalesce(nullif(authors, ''), $au), publisher = coalesce(nullif(publisher, ''), $pu) where id = $i"
+	GET_VENDOR_BY_ID  = "select id from vendor where vendor_id = $v"
+	IMPORT_SCAN_EVENT = "insert into scan_event (barcode, account, scanned, mode, device, outcome) select $b, $a, $s, $m, $d, $o where not exists (select 1 from scan_event where account = $a and barcode = $b and scanned = $s and outcome = $o)"
+)
+
+var (
+	DATA_SETS = []string{DATA_ITEMS, DATA_FAVORITES, DATA_VENDORS, DATA_HISTORY}
+	FORMATS   = []string{FORMAT_CSV, FORMAT_JSON}
+
+	// The csv header rows, which match the json field names
+	ITEM_CSV_COLUMNS   = []string{"barcode", "desc", "index", "favorite", "contributed", "posted", "scans", "brand", "brand_url", "image_url", "category", "ingredients", "allergens", "nutri_score", "authors", "publisher"}
+	VENDOR_CSV_COLUMNS = []string{"vendor_id", "vendor_name", "product_code", "barcode", "desc", "price", "currency"}
+	SCAN_CSV_COLUMNS   = []string{"barcode", "scanned", "mode", "device", "outcome"}
+)
+
+// ItemRecord is an exported Item, identified by its barcode and
+// description (as in getExistingItem)
+type ItemRecord struct {
+	Barcode     string    `json:"barcode"`
+	Desc        string    `json:"desc"`
+	Index       int64     `json:"index"`
+	Favorite    bool      `json:"favorite"`
+	Contributed bool      `json:"contributed"`
+	Posted      time.Time `json:"posted"`
+	Scans       int64     `json:"scans"`
+	Brand       string    `json:"brand"`
+	BrandURL    string    `json:"brand_url"`
+	ImageURL    string    `json:"image_url"`
+	Category    string    `json:"category"`
+	Ingredients string    `json:"ingredients"`
+	Allergens   []string  `json:"allergens"`
+	NutriScore  string    `json:"nutri_score"`
+	Authors     []string  `json:"authors"`
+	Publisher   string    `json:"publisher"`
+}
+
+// VendorRecord is an exported vendor, with one of the Items it sells (or
+// none, if the vendor has no known products)
+type VendorRecord struct {
+	VendorId    string `json:"vendor_id"`
+	DisplayName string `json:"vendor_name"`
+	ProductCode string `json:"product_code"`
+	Barcode     string `json:"barcode"`
+	Desc        string `json:"desc"`
+	Price       int64  `json:"price"`
+	Currency    string `json:"currency"`
+}
+
+// ScanRecord is an exported ScanEvent
+type ScanRecord struct {
+	Barcode string    `json:"barcode"`
+	Scanned time.Time `json:"scanned"`
+	Mode    string    `json:"mode"`
+	Device  string    `json:"device"`
+	Outcome string    `json:"outcome"`
+}
+
+// ImportResult counts the imported records: those added as new rows,
+// those merged into existing ones (or, for scans, already there), and
+// those which could not be imported (e.g., vendor products of unknown
+// items)
+type ImportResult struct {
+	Added   int64
+	Merged  int64
+	Skipped int64
+}
+
+// IsDataSet is true if the data set can be exported and imported
+func IsDataSet(data string) bool {
+	for _, d := range DATA_SETS {
+		if d == data {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFormat is true if the format is one of the exchange FORMATS
+func IsFormat(format string) bool {
+	return format == FORMAT_CSV || format == FORMAT_JSON
+}
+
+/* csv conversions */
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// csvRow is a record read from csv, by column name
+type csvRow map[string]string
+
+func (row csvRow) intValue(column string) (int64, error) {
+	val := strings.TrimSpace(row[column])
+	if val == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s: '%s'", column, val)
+	}
+	return n, nil
+}
+
+func (row csvRow) boolValue(column string) (bool, error) {
+	val := strings.TrimSpace(row[column])
+	if val == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s: '%s'", column, val)
+	}
+	return b, nil
+}
+
+func (row csvRow) timeValue(column string) (time.Time, error) {
+	val := strings.TrimSpace(row[column])
+	if val == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid %s: '%s'", column, val)
+	}
+	return t, nil
+}
+
+// splitList returns the values of a list stored in a single column
+func splitList(list string) []string {
+	results := make([]string, 0)
+	for _, val := range strings.Split(list, LIST_SEPARATOR) {
+		if val = strings.TrimSpace(val); val != "" {
+			results = append(results, val)
+		}
+	}
+	return results
+}
+
+// readCSV returns the rows after the header, by its column names (so
+// the columns can be in any order, and any missing are just empty)
+func readCSV(r io.Reader) ([]csvRow, error) {
+	results := make([]csvRow, 0)
+	in := csv.NewReader(r)
+	in.FieldsPerRecord = -1
+	lines, err := in.ReadAll()
+	if err != nil || len(lines) == 0 {
+		return results, err
+	}
+	header := lines[0]
+	for i, column := range header {
+		// (spreadsheets may start the file with a byte order mark)
+		header[i] = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")))
+	}
+	for _, line := range lines[1:] {
+		row := make(csvRow)
+		for i, val := range line {
+			if i < len(header) {
+				row[header[i]] = val
+			}
+		}
+		results = append(results, row)
+	}
+	return results, nil
+}
+
+func (rec *ItemRecord) csv() []string {
+	return []string{rec.Barcode, rec.Desc, strconv.FormatInt(rec.Index, 10),
+		formatBool(rec.Favorite), formatBool(rec.Contributed), formatTime(rec.Posted),
+		strconv.FormatInt(rec.Scans, 10), rec.Brand, rec.BrandURL, rec.ImageURL,
+		rec.Category, rec.Ingredients, strings.Join(rec.Allergens, LIST_SEPARATOR),
+		rec.NutriScore, strings.Join(rec.Authors, LIST_SEPARATOR), rec.Publisher}
+}
+
+func itemFromCSV(row csvRow) (*ItemRecord, error) {
+	var err error
+	rec := &ItemRecord{Barcode: strings.TrimSpace(row["barcode"]),
+		Desc:        row["desc"],
+		Brand:       row["brand"],
+		BrandURL:    row["brand_url"],
+		ImageURL:    row["image_url"],
+		Category:    row["category"],
+		Ingredients: row["ingredients"],
+		Allergens:   splitList(row["allergens"]),
+		NutriScore:  row["nutri_score"],
+		Authors:     splitList(row["authors"]),
+		Publisher:   row["publisher"]}
+	if rec.Index, err = row.intValue("index"); err != nil {
+		return rec, err
+	}
+	if rec.Favorite, err = row.boolValue("favorite"); err != nil {
+		return rec, err
+	}
+	if rec.Contributed, err = row.boolValue("contributed"); err != nil {
+		return rec, err
+	}
+	if rec.Posted, err = row.timeValue("posted"); err != nil {
+		return rec, err
+	}
+	rec.Scans, err = row.intValue("scans")
+	return rec, err
+}
+
+func (rec *VendorRecord) csv() []string {
+	price := ""
+	if rec.Price > 0 {
+		price = strconv.FormatInt(rec.Price, 10)
+	}
+	return []string{rec.VendorId, rec.DisplayName, rec.ProductCode, rec.Barcode, rec.Desc, price, rec.Currency}
+}
+
+func vendorFromCSV(row csvRow) (*VendorRecord, error) {
+	var err error
+	rec := &VendorRecord{VendorId: strings.TrimSpace(row["vendor_id"]),
+		DisplayName: row["vendor_name"],
+		ProductCode: strings.TrimSpace(row["product_code"]),
+		Barcode:     strings.TrimSpace(row["barcode"]),
+		Desc:        row["desc"],
+		Currency:    strings.TrimSpace(row["currency"])}
+	rec.Price, err = row.intValue("price")
+	return rec, err
+}
+
+func (rec *ScanRecord) csv() []string {
+	return []string{rec.Barcode, formatTime(rec.Scanned), rec.Mode, rec.Device, rec.Outcome}
+}
+
+func scanFromCSV(row csvRow) (*ScanRecord, error) {
+	var err error
+	rec := &ScanRecord{Barcode: strings.TrimSpace(row["barcode"]),
+		Mode:    row["mode"],
+		Device:  row["device"],
+		Outcome: strings.TrimSpace(row["outcome"])}
+	rec.Scanned, err = row.timeValue("scanned")
+	return rec, err
+}
+
+/* Export */
+
+// exportRecord is any record which Export can write
+type exportRecord interface {
+	csv() []string
+}
+
+func exportItems(db *sqlite3.Conn, a *Account, favorites bool) []exportRecord {
+	results := make([]exportRecord, 0)
+	row := make(sqlite3.RowMap)
+	args := sqlite3.NamedArgs{"$a": a.Id, "$f": 0}
+	if favorites {
+		args["$f"] = 1
+	}
+	for s, err := db.Query(EXPORT_ITEMS, args); err == nil; err = s.Next() {
+		var rowid int64
+		s.Scan(&rowid, row)
+
+		rec := &ItemRecord{Barcode: rowString(row, "barcode"),
+			Desc:        rowString(row, "product_desc"),
+			Brand:       rowString(row, "brand"),
+			BrandURL:    rowString(row, "brand_url"),
+			ImageURL:    rowString(row, "image_url"),
+			Category:    rowString(row, "category"),
+			Ingredients: rowString(row, "ingredients"),
+			Allergens:   splitList(rowString(row, "allergens")),
+			NutriScore:  rowString(row, "nutri_score"),
+			Authors:     splitList(rowString(row, "authors")),
+			Publisher:   rowString(row, "publisher")}
+		if index, indexOk := row["product_ind"].(int64); indexOk {
+			rec.Index = index
+		}
+		if favorite, favoriteOk := row["is_favorite"].(int64); favoriteOk {
+			rec.Favorite = favorite == 1
+		}
+		if edit, editOk := row["is_edit"].(int64); editOk {
+			rec.Contributed = edit == 1
+		}
+		if posted, postedErr := strconv.ParseInt(rowString(row, "posted"), 10, 64); postedErr == nil {
+			rec.Posted = time.Unix(posted, 0)
+		}
+		if scans, scansOk := row["scans"].(int64); scansOk {
+			rec.Scans = scans
+		}
+		results = append(results, rec)
+	}
+	return results
+}
+
+func exportVendors(db *sqlite3.Conn, a *Account) []exportRecord {
+	results := make([]exportRecord, 0)
+	row := make(sqlite3.RowMap)
+	for s, err := db.Query(EXPORT_VENDORS, sqlite3.NamedArgs{"$a": a.Id}); err == nil; err = s.Next() {
+		var rowid int64
+		s.Scan(&rowid, row)
+
+		rec := &VendorRecord{VendorId: rowString(row, "vendor_id"),
+			DisplayName: rowString(row, "display_name"),
+			ProductCode: rowString(row, "product_code"),
+			Barcode:     rowString(row, "barcode"),
+			Desc:        rowString(row, "product_desc"),
+			Currency:    rowString(row, "currency")}
+		if price, priceOk := row["price"].(int64); priceOk {
+			rec.Price = price
+		}
+		results = append(results, rec)
+	}
+	return results
+}
+
+func exportHistory(db *sqlite3.Conn, a *Account) []exportRecord {
+	results := make([]exportRecord, 0)
+	row := make(sqlite3.RowMap)
+	for s, err := db.Query(EXPORT_HISTORY, sqlite3.NamedArgs{"$a": a.Id}); err == nil; err = s.Next() {
+		var rowid int64
+		s.Scan(&rowid, row)
+
+		rec := &ScanRecord{Barcode: rowString(row, "barcode"),
+			Mode:    rowString(row, "mode"),
+			Device:  rowString(row, "device"),
+			Outcome: rowString(row, "outcome")}
+		if scanned, scannedErr := strconv.ParseInt(rowString(row, "scanned"), 10, 64); scannedErr == nil {
+			rec.Scanned = time.Unix(scanned, 0)
+		}
+		results = append(results, rec)
+	}
+	return results
+}
+
+// Export writes the Account's data set (one of the DATA_SETS) in the
+// format: csv, with a header row, or json, as an array of objects
+func Export(db *sqlite3.Conn, a *Account, data, format string, w io.Writer) error {
+	var (
+		records []exportRecord
+		header  []string
+	)
+	switch data {
+	case DATA_ITEMS, DATA_FAVORITES:
+		records, header = exportItems(db, a, data == DATA_FAVORITES), ITEM_CSV_COLUMNS
+	case DATA_VENDORS:
+		records, header = exportVendors(db, a), VENDOR_CSV_COLUMNS
+	case DATA_HISTORY:
+		records, header = exportHistory(db, a), SCAN_CSV_COLUMNS
+	default:
+		return fmt.Errorf("Invalid data set: '%s'", data)
+	}
+
+	switch format {
+	case FORMAT_JSON:
+		out, err := json.MarshalIndent(records, "", " ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(out)
+		return err
+	case FORMAT_CSV:
+		out := csv.NewWriter(w)
+		out.Write(header)
+		for _, rec := range records {
+			out.Write(rec.csv())
+		}
+		out.Flush()
+		return out.Error()
+	}
+	return fmt.Errorf("Invalid format: '%s'", format)
+}
+
+/* Import */
+
+func decodeItems(r io.Reader, format string) ([]*ItemRecord, error) {
+	results := make([]*ItemRecord, 0)
+	if format == FORMAT_JSON {
+		err := json.NewDecoder(r).Decode(&results)
+		return results, err
+	}
+	rows, err := readCSV(r)
+	for _, row := range rows {
+		rec, recErr := itemFromCSV(row)
+		if recErr != nil {
+			return results, recErr
+		}
+		results = append(results, rec)
+	}
+	return results, err
+}
+
+func decodeVendors(r io.Reader, format string) ([]*VendorRecord, error) {
+	results := make([]*VendorRecord, 0)
+	if format == FORMAT_JSON {
+		err := json.NewDecoder(r).Decode(&results)
+		return results, err
+	}
+	rows, err := readCSV(r)
+	for _, row := range rows {
+		rec, recErr := vendorFromCSV(row)
+		if recErr != nil {
+			return results, recErr
+		}
+		results = append(results, rec)
+	}
+	return results, err
+}
+
+func decodeHistory(r io.Reader, format string) ([]*ScanRecord, error) {
+	results := make([]*ScanRecord, 0)
+	if format == FORMAT_JSON {
+		err := json.NewDecoder(r).Decode(&results)
+		return results, err
+	}
+	rows, err := readCSV(r)
+	for _, row := range rows {
+		rec, recErr := scanFromCSV(row)
+		if recErr != nil {
+			return results, recErr
+		}
+		results = append(results, rec)
+	}
+	return results, err
+}
+
+// importItem adds the Item, or merges it into the existing one with the
+// same barcode and description
+func importItem(db *sqlite3.Conn, a *Account, rec *ItemRecord, result *ImportResult) error {
+	if rec.Barcode == "" {
+		result.Skipped += 1
+		return nil
+	}
+
+	pk := getExistingItem(db, rec.Barcode, rec.Desc)
+	if pk == BAD_PK {
+		item := &Item{Barcode: rec.Barcode,
+			Desc:            rec.Desc,
+			Index:           rec.Index,
+			UserContributed: rec.Contributed,
+			Brand:           rec.Brand,
+			BrandURL:        rec.BrandURL,
+			ImageURL:        rec.ImageURL,
+			Category:        rec.Category,
+			Ingredients:     rec.Ingredients,
+			Allergens:       rec.Allergens,
+			NutriScore:      rec.NutriScore,
+			Authors:         rec.Authors,
+			Publisher:       rec.Publisher}
+		var err error
+		if pk, err = item.Add(db, a); err != nil {
+			return err
+		}
+		result.Added += 1
+	} else {
+		result.Merged += 1
+	}
+
+	var posted interface{}
+	if !rec.Posted.IsZero() {
+		posted = rec.Posted.UTC().Format(SQLITE_DATETIME)
+	}
+	args := sqlite3.NamedArgs{"$i": pk,
+		"$f":  rec.Favorite,
+		"$e":  rec.Contributed,
+		"$s":  rec.Scans,
+		"$p":  posted,
+		"$br": rec.Brand,
+		"$bu": rec.BrandURL,
+		"$im": rec.ImageURL,
+		"$c":  rec.Category,
+		"$in": rec.Ingredients,
+		"$al": strings.Join(rec.Allergens, LIST_SEPARATOR),
+		"$ns": rec.NutriScore,
+		"$au": strings.Join(rec.Authors, LIST_SEPARATOR),
+		"$pu": rec.Publisher}
+	if err := db.Exec(MERGE_ITEM, args); err != nil {
+		return err
+	}
+
+	// the merged brand may be new to the search index
+	item, err := GetSingleItem(db, a, pk)
+	if err == nil && item.Id == pk {
+		item.index(db)
+	}
+	return err
+}
+
+// importVendor adds the vendor, if it is new, and the vendor product code
+// and price for the Item with the same barcode and description, if any
+func importVendor(db *sqlite3.Conn, rec *VendorRecord, result *ImportResult) error {
+	if rec.VendorId == "" {
+		result.Skipped += 1
+		return nil
+	}
+
+	vendorPk := int64(BAD_PK)
+	for s, err := db.Query(GET_VENDOR_BY_ID, sqlite3.NamedArgs{"$v": rec.VendorId}); err == nil; err = s.Next() {
+		s.Scan(&vendorPk)
+	}
+	isNew := vendorPk == BAD_PK // (or the vendor product code, if any)
+	if isNew {
+		name := rec.DisplayName
+		if name == "" {
+			name = rec.VendorId
+		}
+		var err error
+		if vendorPk, err = AddVendor(db, rec.VendorId, name); err != nil {
+			return err
+		}
+	}
+
+	if rec.ProductCode != "" {
+		itemPk := getExistingItem(db, rec.Barcode, rec.Desc)
+		if itemPk == BAD_PK {
+			result.Skipped += 1
+			return nil
+		}
+		isNew = true
+		for _, vp := range GetVendorProducts(db, itemPk) {
+			if vp.Vendor.Id == vendorPk && vp.ProductCode == rec.ProductCode {
+				isNew = false
+				break
+			}
+		}
+		if err := AddVendorProduct(db, rec.ProductCode, vendorPk, itemPk, rec.Price, rec.Currency); err != nil && rec.Price > 0 {
+			return err
+		}
+	}
+
+	if isNew {
+		result.Added += 1
+	} else {
+		result.Merged += 1
+	}
+	return nil
+}
+
+// importScan adds the ScanEvent, unless it is already in the history
+func importScan(db *sqlite3.Conn, a *Account, rec *ScanRecord, result *ImportResult) error {
+	if rec.Barcode == "" || rec.Scanned.IsZero() || rec.Outcome == "" {
+		result.Skipped += 1
+		return nil
+	}
+	args := sqlite3.NamedArgs{"$b": rec.Barcode,
+		"$a": a.Id,
+		"$s": rec.Scanned.UTC().Format(SQLITE_DATETIME),
+		"$m": rec.Mode,
+		"$d": rec.Device,
+		"$o": rec.Outcome}
+	if err := db.Exec(IMPORT_SCAN_EVENT, args); err != nil {
+		return err
+	}
+	if db.RowsAffected() > 0 {
+		result.Added += 1
+	} else {
+		result.Merged += 1
+	}
+	return nil
+}
+
+// Import reads the data set (in the same format as Export writes it) into
+// the Account, merging Items on their barcode and description, vendors on
+// their vendor id, and skipping scans already in the history, all in a
+// single transaction
+func Import(db *sqlite3.Conn, a *Account, data, format string, r io.Reader) (*ImportResult, error) {
+	result := new(ImportResult)
+	if !IsDataSet(data) {
+		return result, fmt.Errorf("Invalid data set: '%s'", data)
+	}
+	if !IsFormat(format) {
+		return result, fmt.Errorf("Invalid format: '%s'", format)
+	}
+
+	var (
+		items   []*ItemRecord
+		vendors []*VendorRecord
+		scans   []*ScanRecord
+		err     error
+	)
+	switch data {
+	case DATA_VENDORS:
+		vendors, err = decodeVendors(r, format)
+	case DATA_HISTORY:
+		scans, err = decodeHistory(r, format)
+	default:
+		items, err = decodeItems(r, format)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	err = db.Begin()
+	for i := 0; err == nil && i < len(items); i++ {
+		err = importItem(db, a, items[i], result)
+	}
+	for i := 0; err == nil && i < len(vendors); i++ {
+		err = importVendor(db, vendors[i], result)
+	}
+	for i := 0; err == nil && i < len(scans); i++ {
+		err = importScan(db, a, scans[i], result)
+	}
+	if err != nil {
+		db.Rollback()
+		return new(ImportResult), err
+	}
+	return result, db.Commit()
+}
@@ -0,0 +1,203 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"github.com/mxk/go-sqlite/sqlite3"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// Product units, and their expiry dates (in SQLITE_DATE format)
+	ADD_UNIT           = "insert into product_unit (product, account, expires) values ($p, $a, $e)"
+	UNIT_COLUMNS       = "u.id, u.product, u.expires, strftime('%s', u.added) as added, p.barcode, p.product_desc, p.brand"
+	GET_UNITS          = "select " + UNIT_COLUMNS + " from product_unit u, product p where p.id = u.product and u.account = $a and u.product = $p and u.is_used = 0 order by u.expires is null, u.expires, u.id"
+	GET_EXPIRING_UNITS = "select " + UNIT_COLUMNS + " from product_unit u, product p where p.id = u.product and u.account = $a and u.is_used = 0 and u.expires is not null and u.expires <= $d order by u.expires, p.product_desc collate nocase, u.id"
+	SET_UNIT_EXPIRY    = "update product_unit set expires = $e where id = $i and account = $a"
+	USE_UNIT           = "update product_unit set is_used = 1 where id = $i and account = $a"
+	DELETE_UNITS       = "delete from product_unit where product = $i"
+	GET_SHELF_LIFE     = "select keyword, days from shelf_life"
+
+	// the shelf life keyword which overrides all others in the category,
+	// e.g. "Frozen fish" keeps as long as anything else frozen
+	SHELF_LIFE_FROZEN = "frozen"
+)
+
+// Unit is a single scanned unit of an Item, which is in stock until it is
+// used up, with its expiry (or best before) date, if known
+type Unit struct {
+	Id      int64
+	Product int64
+	Expires time.Time
+	Added   time.Time
+
+	// the Item details, for lists of Units
+	Barcode string
+	Desc    string
+	Brand   string
+}
+
+// today returns the start of the current (local) day
+func today() time.Time {
+	y, m, d := time.Now().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+// expiryArg converts the expiry date to the column value (null if unknown)
+func expiryArg(expires time.Time) interface{} {
+	if expires.IsZero() {
+		return nil
+	}
+	return expires.Format(SQLITE_DATE)
+}
+
+// DaysLeft is how many days remain until the Unit expires: zero on the
+// expiry date itself, and negative once it has expired
+func (u *Unit) DaysLeft() int64 {
+	return int64(math.Floor(u.Expires.Sub(today()).Hours()/24 + 0.5))
+}
+
+// Expired is true after the expiry date
+func (u *Unit) Expired() bool {
+	return !u.Expires.IsZero() && u.DaysLeft() < 0
+}
+
+// DisplayExpires returns the expiry date (as in an <input type="date">),
+// or the empty string if it is unknown
+func (u *Unit) DisplayExpires() string {
+	if u.Expires.IsZero() {
+		return ""
+	}
+	return u.Expires.Format(SQLITE_DATE)
+}
+
+// SetExpiry changes (or, with the zero time, clears) the expiry date
+func (u *Unit) SetExpiry(db *sqlite3.Conn, a *Account, expires time.Time) error {
+	args := sqlite3.NamedArgs{"$i": u.Id, "$a": a.Id, "$e": expiryArg(expires)}
+	err := db.Exec(SET_UNIT_EXPIRY, args)
+	if err == nil {
+		u.Expires = expires
+	}
+	return err
+}
+
+// Use marks the Unit as used up, so that it is no longer in stock
+func (u *Unit) Use(db *sqlite3.Conn, a *Account) error {
+	return db.Exec(USE_UNIT, sqlite3.NamedArgs{"$i": u.Id, "$a": a.Id})
+}
+
+// AddUnit records a new unit of the Item, with its expiry date (which can
+// be the zero time, if unknown)
+func AddUnit(db *sqlite3.Conn, a *Account, product int64, expires time.Time) (int64, error) {
+	args := sqlite3.NamedArgs{"$p": product, "$a": a.Id, "$e": expiryArg(expires)}
+	result := db.Exec(ADD_UNIT, args)
+	if result == nil {
+		return getPK(db, "product_unit"), result
+	}
+	return BAD_PK, result
+}
+
+// categoryWords returns the text as its lowercase words, separated and
+// surrounded by single spaces, e.g. " frozen fish " for "en:frozen-fish"
+func categoryWords(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return " " + strings.Join(words, " ") + " "
+}
+
+// matchesKeyword is true if the category words contain the shelf life
+// keyword as whole words, or its plural (so "egg" matches "Eggs", but not
+// "Eggplant")
+func matchesKeyword(words, keyword string) bool {
+	kw := strings.TrimSpace(categoryWords(keyword))
+	if kw == "" {
+		return false
+	}
+	for _, form := range []string{kw, kw + "s", kw + "es"} {
+		if strings.Contains(words, " "+form+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultExpiry returns the expiry date of a unit bought today, according
+// to the shelf life of the category, or the zero time if there is none:
+// "frozen" wins if it matches, otherwise the shortest matching shelf life
+func DefaultExpiry(db *sqlite3.Conn, category string) time.Time {
+	if category == "" {
+		return time.Time{}
+	}
+	words := categoryWords(category)
+	var days, frozen int64
+	for s, err := db.Query(GET_SHELF_LIFE); err == nil; err = s.Next() {
+		var (
+			keyword string
+			d       int64
+		)
+		s.Scan(&keyword, &d)
+		if d <= 0 || !matchesKeyword(words, keyword) {
+			continue
+		}
+		if strings.ToLower(keyword) == SHELF_LIFE_FROZEN {
+			frozen = d
+		} else if days <= 0 || d < days {
+			days = d
+		}
+	}
+	if frozen > 0 {
+		days = frozen
+	}
+	if days <= 0 {
+		return time.Time{}
+	}
+	return today().AddDate(0, 0, int(days))
+}
+
+// getUnits returns the Units from the query, in the order it defines
+func getUnits(db *sqlite3.Conn, sql string, args sqlite3.NamedArgs) []*Unit {
+	results := make([]*Unit, 0)
+	row := make(sqlite3.RowMap)
+	for s, err := db.Query(sql, args); err == nil; err = s.Next() {
+		var rowid int64
+		s.Scan(&rowid, row)
+
+		result := &Unit{Id: rowid,
+			Barcode: rowString(row, "barcode"),
+			Desc:    rowString(row, "product_desc"),
+			Brand:   rowString(row, "brand")}
+		if product, productOk := row["product"].(int64); productOk {
+			result.Product = product
+		}
+		if expires, expiresErr := time.ParseInLocation(SQLITE_DATE, rowString(row, "expires"), time.Local); expiresErr == nil {
+			result.Expires = expires
+		}
+		if added, addedErr := strconv.ParseInt(rowString(row, "added"), 10, 64); addedErr == nil {
+			result.Added = time.Unix(added, 0)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// GetUnits returns the Units of the Item which are in stock, soonest to
+// expire first (and those without an expiry date last)
+func GetUnits(db *sqlite3.Conn, a *Account, product int64) []*Unit {
+	return getUnits(db, GET_UNITS, sqlite3.NamedArgs{"$a": a.Id, "$p": product})
+}
+
+// GetExpiringUnits returns the Account's Units in stock which expire
+// within the given number of days (including those already expired),
+// soonest first
+func GetExpiringUnits(db *sqlite3.Conn, a *Account, days int) []*Unit {
+	limit := today().AddDate(0, 0, days).Format(SQLITE_DATE)
+	return getUnits(db, GET_EXPIRING_UNITS, sqlite3.NamedArgs{"$a": a.Id, "$d": limit})
+}
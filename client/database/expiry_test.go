@@ -0,0 +1,38 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"testing"
+)
+
+func TestDefaultExpiry(t *testing.T) {
+	db := migratedDB(t)
+
+	// with the shelf life defaults in the 0004 migration
+	tests := map[string]int{
+		"Frozen fish":                 90,
+		"en:frozen-seafood":           90,
+		"Fish":                        2,
+		"Fresh vegetables, Eggs":      7,
+		"Eggs":                        21,
+		"Eggplant":                    0,
+		"Eggplants, Vegetables":       7,
+		"Cheeses, Dairies":            7,
+		"Plant-based milk substitute": 7,
+		"Buttermilk":                  0,
+		"Coffee":                      0,
+		"":                            0,
+	}
+	for category, days := range tests {
+		expires := DefaultExpiry(db, category)
+		if days == 0 {
+			if !expires.IsZero() {
+				t.Errorf("DefaultExpiry(%q) = %v, expected none", category, expires)
+			}
+		} else if expected := today().AddDate(0, 0, days); !expires.Equal(expected) {
+			t.Errorf("DefaultExpiry(%q) = %v, expected %v", category, expires, expected)
+		}
+	}
+}
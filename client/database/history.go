@@ -0,0 +1,131 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"fmt"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// What the scanner did with the barcode
+	SCAN_MODE_ADD = "add" // added to the scanned items (the only mode, for now)
+
+	// How the barcode lookup went
+	SCAN_FOUND   = "found"   // the API server knew at least one product
+	SCAN_UNKNOWN = "unknown" // no products, so the item needs to be input
+	SCAN_ERROR   = "error"   // the API server could not be reached, or replied badly
+
+	// sqlite datetime format (the scanned column is in UTC)
+	SQLITE_DATETIME = "2006-01-02 15:04:05"
+
+	ADD_SCAN_EVENT = "insert into scan_event (barcode, account, mode, device, outcome) values ($b, $a, $m, $d, $o)"
+
+	// Scan history queries (see GetScanHistory)
+	SCAN_EVENT_COLUMNS = "e.id, e.barcode, strftime('%s', e.scanned) as scanned, e.mode, e.device, e.outcome, (select p.id from product p where p.account = e.account and p.barcode = e.barcode order by p.product_ind limit 1) as product, (select p.product_desc from product p where p.account = e.account and p.barcode = e.barcode order by p.product_ind limit 1) as product_desc"
+	GET_SCAN_EVENTS    = "select %s from scan_event e where %s order by e.scanned desc, e.id desc"
+	COUNT_SCAN_EVENTS  = "select count(*) from scan_event e where %s"
+)
+
+// ScanEvent is a single read of a barcode by the scanner, along with the
+// Item it matches today (if any, since the Item can be deleted later)
+type ScanEvent struct {
+	Id      int64
+	Barcode string
+	Scanned time.Time
+	Mode    string
+	Device  string
+	Outcome string
+	Product int64  // the Item id, or BAD_PK if there is none
+	Desc    string // the Item description, empty if unknown
+}
+
+// HistoryQuery defines which of an Account's ScanEvents to fetch: those
+// between From (inclusive) and To (exclusive), when not zero, optionally
+// for a single barcode, and which page of them (if Limit is more than zero)
+type HistoryQuery struct {
+	From    time.Time
+	To      time.Time
+	Barcode string
+	Limit   int64
+	Offset  int64
+}
+
+// AddScanEvent logs the barcode read for the Account
+func AddScanEvent(db *sqlite3.Conn, a *Account, barcode, mode, device, outcome string) error {
+	args := sqlite3.NamedArgs{"$b": barcode,
+		"$a": a.Id,
+		"$m": mode,
+		"$d": device,
+		"$o": outcome}
+	return db.Exec(ADD_SCAN_EVENT, args)
+}
+
+// historyFilter returns the where clause (and its arguments) matching the
+// ScanEvents for the Account and HistoryQuery
+func historyFilter(a *Account, q *HistoryQuery) (string, sqlite3.NamedArgs) {
+	clauses := []string{"e.account = $a"}
+	args := sqlite3.NamedArgs{"$a": a.Id}
+
+	if q.Barcode != "" {
+		clauses = append(clauses, "e.barcode = $b")
+		args["$b"] = q.Barcode
+	}
+	if !q.From.IsZero() {
+		clauses = append(clauses, "e.scanned >= $f")
+		args["$f"] = q.From.UTC().Format(SQLITE_DATETIME)
+	}
+	if !q.To.IsZero() {
+		clauses = append(clauses, "e.scanned < $t")
+		args["$t"] = q.To.UTC().Format(SQLITE_DATETIME)
+	}
+
+	return strings.Join(clauses, " and "), args
+}
+
+// GetScanHistory returns the Account's ScanEvents matching the
+// HistoryQuery, most recent first, and how many match in all (i.e.,
+// regardless of the Limit and Offset)
+func GetScanHistory(db *sqlite3.Conn, a *Account, q *HistoryQuery) ([]*ScanEvent, int64, error) {
+	results := make([]*ScanEvent, 0)
+
+	where, args := historyFilter(a, q)
+	var total int64
+	for s, err := db.Query(fmt.Sprintf(COUNT_SCAN_EVENTS, where), args); err == nil; err = s.Next() {
+		s.Scan(&total)
+	}
+
+	sql := fmt.Sprintf(GET_SCAN_EVENTS, SCAN_EVENT_COLUMNS, where)
+	if q.Limit > 0 {
+		sql = fmt.Sprintf("%s limit %d offset %d", sql, q.Limit, q.Offset)
+	}
+
+	row := make(sqlite3.RowMap)
+	for s, err := db.Query(sql, args); err == nil; err = s.Next() {
+		var rowid int64
+		s.Scan(&rowid, row)
+
+		result := &ScanEvent{Id: rowid,
+			Barcode: rowString(row, "barcode"),
+			Mode:    rowString(row, "mode"),
+			Device:  rowString(row, "device"),
+			Outcome: rowString(row, "outcome"),
+			Product: BAD_PK,
+			Desc:    rowString(row, "product_desc")}
+		if scanned, scannedErr := strconv.ParseInt(rowString(row, "scanned"), 10, 64); scannedErr == nil {
+			result.Scanned = time.Unix(scanned, 0)
+		}
+		if product, productOk := row["product"].(int64); productOk {
+			result.Product = product
+		}
+		results = append(results, result)
+	}
+
+	return results, total, nil
+}
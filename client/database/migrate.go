@@ -0,0 +1,227 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"fmt"
+	"github.com/Banrai/PiScan/client/database/migrations"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Schema versions
+	CREATE_SCHEMA_VERSION = "create table if not exists schema_version (version integer primary key, name text NOT NULL, applied datetime DEFAULT (datetime('now')))"
+	GET_SCHEMA_VERSION    = "select coalesce(max(version), 0) from schema_version"
+	SET_SCHEMA_VERSION    = "insert into schema_version (version, name) values ($v, $n)"
+	COUNT_TABLES          = "select count(*) from sqlite_master where type = 'table' and name not in ('schema_version', 'sqlite_sequence')"
+
+	// the write lock, so that only one client binary migrates at a time
+	BEGIN_MIGRATION = "begin immediate"
+
+	// how long to wait for another client binary to finish migrating
+	MIGRATION_TIMEOUT = 30 * time.Second
+
+	// the copy of the database file made before migrating it, e.g.
+	// PiScanDB.sqlite.v4-20261019080000.bak
+	MIGRATION_BACKUP = "%s.v%d-%s.bak"
+
+	// the "add column" statements of columns which already exist fail with
+	// this error (see migrations/0002_product_details.sql)
+	DUPLICATE_COLUMN = "duplicate column name"
+)
+
+var (
+	// the versions of the Migrations which add the columns that databases
+	// created before the migrations may have already (0002_product_details),
+	// and so the only ones where DUPLICATE_COLUMN errors are skipped
+	UPGRADE_MIGRATIONS = map[int64]bool{2: true}
+)
+
+// Migration is one of the schema changes in the migrations package
+type Migration struct {
+	Version int64
+	Name    string
+	SQL     string
+}
+
+// Statements splits the Migration into its sql statements, after removing
+// the comments (so the comments can contain semicolons, but the string
+// values in the statements cannot have any, or a "--")
+func (m *Migration) Statements() []string {
+	lines := strings.Split(m.SQL, "\n")
+	for i, line := range lines {
+		if comment := strings.Index(line, "--"); comment >= 0 {
+			lines[i] = line[:comment]
+		}
+	}
+	results := make([]string, 0)
+	for _, statement := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			results = append(results, statement)
+		}
+	}
+	return results
+}
+
+// apply runs each of the Migration statements, except for adding any
+// columns which are already there (in the UPGRADE_MIGRATIONS only)
+func (m *Migration) apply(db *sqlite3.Conn) error {
+	for _, statement := range m.Statements() {
+		err := db.Exec(statement)
+		if err != nil && !(UPGRADE_MIGRATIONS[m.Version] && strings.Contains(err.Error(), DUPLICATE_COLUMN)) {
+			return fmt.Errorf("Migration %d (%s) failed: %s", m.Version, m.Name, err)
+		}
+	}
+	return db.Exec(SET_SCHEMA_VERSION, sqlite3.NamedArgs{"$v": m.Version, "$n": m.Name})
+}
+
+// Migrations returns all the Migrations, in version order
+func Migrations() ([]*Migration, error) {
+	results := make([]*Migration, 0)
+	files, err := fs.Glob(migrations.Files, "*.sql")
+	if err != nil {
+		return results, err
+	}
+	versions := make(map[int64]string)
+	for _, file := range files {
+		name := strings.TrimSuffix(file, ".sql")
+		parts := strings.SplitN(name, "_", 2)
+		version, versionErr := strconv.ParseInt(parts[0], 10, 64)
+		if versionErr != nil || version <= 0 || len(parts) < 2 {
+			return results, fmt.Errorf("Invalid migration file name: '%s'", file)
+		}
+		if other, exists := versions[version]; exists {
+			return results, fmt.Errorf("Migrations '%s' and '%s' have the same version", other, file)
+		}
+		versions[version] = file
+
+		content, readErr := migrations.Files.ReadFile(file)
+		if readErr != nil {
+			return results, readErr
+		}
+		results = append(results, &Migration{Version: version, Name: parts[1], SQL: string(content)})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Version < results[j].Version })
+	return results, nil
+}
+
+// SchemaVersion returns the version of the last Migration applied to the
+// database, or zero if there is none
+func SchemaVersion(db *sqlite3.Conn) int64 {
+	var version int64
+	for s, err := db.Query(GET_SCHEMA_VERSION); err == nil; err = s.Next() {
+		s.Scan(&version)
+	}
+	return version
+}
+
+// hasTables is true if the database has any tables of its own
+func hasTables(db *sqlite3.Conn) bool {
+	var n int64
+	for s, err := db.Query(COUNT_TABLES); err == nil; err = s.Next() {
+		s.Scan(&n)
+	}
+	return n > 0
+}
+
+// backupDB copies the database file alongside itself, and returns the
+// name of the copy
+func backupDB(coords ConnCoordinates, version int64) (string, error) {
+	backup := path.Join(coords.DBPath, fmt.Sprintf(MIGRATION_BACKUP, coords.DBFile, version, time.Now().Format("20060102150405")))
+
+	src, err := os.Open(path.Join(coords.DBPath, coords.DBFile))
+	if err != nil {
+		return backup, err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(backup)
+	if err != nil {
+		return backup, err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return backup, err
+	}
+	return backup, dst.Close()
+}
+
+// MigrateDB creates the database, or brings an existing one up to date,
+// by applying the Migrations it has yet to have (after making a copy of
+// the database file, if it has any data to lose), all in one transaction,
+// so the database is either fully migrated or left as it was; it returns
+// the Migrations applied, if any, and the name of the backup copy
+func MigrateDB(coords ConnCoordinates) ([]*Migration, string, error) {
+	applied := make([]*Migration, 0)
+
+	all, err := Migrations()
+	if err != nil {
+		return applied, "", err
+	}
+
+	db, err := InitializeDB(coords)
+	if err != nil {
+		return applied, "", err
+	}
+	defer db.Close()
+
+	// wait for any other client binary migrating at the same time, which
+	// leaves nothing more to do here
+	db.BusyTimeout(MIGRATION_TIMEOUT)
+	if err = db.Exec(CREATE_SCHEMA_VERSION); err != nil {
+		return applied, "", err
+	}
+	if err = db.Exec(BEGIN_MIGRATION); err != nil {
+		return applied, "", err
+	}
+
+	version := SchemaVersion(db)
+	pending := make([]*Migration, 0)
+	for _, m := range all {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+
+	var backup string
+	if len(pending) > 0 {
+		// (no other connection can write to the file while this one holds
+		// the write lock, so the copy is consistent)
+		if hasTables(db) {
+			if backup, err = backupDB(coords, version); err != nil {
+				db.Rollback()
+				return applied, "", fmt.Errorf("Could not back up the database before migrating it: %s", err)
+			}
+		}
+
+		for _, m := range pending {
+			if err = m.apply(db); err != nil {
+				db.Rollback()
+				return make([]*Migration, 0), backup, err
+			}
+			applied = append(applied, m)
+		}
+		if err = db.Commit(); err != nil {
+			return make([]*Migration, 0), backup, err
+		}
+	} else {
+		db.Rollback()
+	}
+
+	// and the full text search index, if the sqlite library has FTS5
+	// (if not, the item searches are slower, but still work)
+	InitializeSearch(db)
+
+	return applied, backup, nil
+}
@@ -0,0 +1,155 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"github.com/mxk/go-sqlite/sqlite3"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// legacyDB creates a database the way the old tables.sql file did, i.e.,
+// with the original tables, and some of the columns added since, but no
+// schema_version table
+func legacyDB(t *testing.T) (ConnCoordinates, *sqlite3.Conn) {
+	coords := ConnCoordinates{DBPath: t.TempDir(), DBFile: SQLITE_FILE}
+	db, err := InitializeDB(coords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	all, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := append(all[0].Statements(),
+		"ALTER TABLE product ADD COLUMN brand text",
+		"ALTER TABLE product ADD COLUMN image_url text",
+		"INSERT INTO account (email, api_code) VALUES ('me@example.org', '0123456789abcdef')",
+		"INSERT INTO product (barcode, product_desc, brand, account) VALUES ('0001', 'Oat Milk', 'Oatly', 1)")
+	for _, statement := range legacy {
+		if err = db.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+	return coords, db
+}
+
+// versions returns the version numbers of the Migrations
+func versions(migrations []*Migration) []int64 {
+	results := make([]int64, 0)
+	for _, m := range migrations {
+		results = append(results, m.Version)
+	}
+	return results
+}
+
+func TestMigrations(t *testing.T) {
+	all, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) == 0 {
+		t.Fatal("no migrations")
+	}
+	for i, m := range all {
+		if m.Version != int64(i+1) || m.Name == "" || len(m.Statements()) == 0 {
+			t.Errorf("migration %d = version %d, %q, %d statements", i, m.Version, m.Name, len(m.Statements()))
+		}
+	}
+}
+
+func TestMigrationStatements(t *testing.T) {
+	m := &Migration{SQL: `-- a comment; with a semicolon
+CREATE TABLE a (
+	id integer, -- the key; also commented
+	name text
+);
+
+INSERT INTO a (id, name) VALUES (1, 'one');;
+`}
+	expected := []string{"CREATE TABLE a (\n\tid integer, \n\tname text\n)", "INSERT INTO a (id, name) VALUES (1, 'one')"}
+	if statements := m.Statements(); !reflect.DeepEqual(statements, expected) {
+		t.Errorf("Statements = %q, expected %q", statements, expected)
+	}
+}
+
+func TestMigrateDB(t *testing.T) {
+	all, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	coords := ConnCoordinates{DBPath: t.TempDir(), DBFile: SQLITE_FILE}
+
+	// a new database has nothing to back up
+	applied, backup, err := MigrateDB(coords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(versions(applied), versions(all)) || backup != "" {
+		t.Errorf("MigrateDB = %v, %q, expected %v and no backup", versions(applied), backup, versions(all))
+	}
+
+	// and once it is up to date, there is nothing more to do
+	applied, backup, err = MigrateDB(coords)
+	if err != nil || len(applied) != 0 || backup != "" {
+		t.Errorf("MigrateDB again = %v, %q, %v, expected nothing", versions(applied), backup, err)
+	}
+
+	db, err := InitializeDB(coords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if version := SchemaVersion(db); version != all[len(all)-1].Version {
+		t.Errorf("SchemaVersion = %d, expected %d", version, all[len(all)-1].Version)
+	}
+}
+
+func TestMigrateLegacyDB(t *testing.T) {
+	coords, db := legacyDB(t)
+
+	// the columns already there are skipped, and the data is kept
+	applied, backup, err := MigrateDB(coords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, _ := Migrations()
+	if !reflect.DeepEqual(versions(applied), versions(all)) {
+		t.Errorf("MigrateDB = %v, expected %v", versions(applied), versions(all))
+	}
+	if backup == "" {
+		t.Error("the legacy database was not backed up")
+	} else if _, statErr := os.Stat(backup); statErr != nil || path.Dir(backup) != coords.DBPath {
+		t.Errorf("backup %q: %v", backup, statErr)
+	}
+
+	var desc, brand string
+	var scans int64
+	for s, qErr := db.Query("select product_desc, brand, scans from product where barcode = '0001'"); qErr == nil; qErr = s.Next() {
+		s.Scan(&desc, &brand, &scans)
+	}
+	if desc != "Oat Milk" || brand != "Oatly" || scans != 1 {
+		t.Errorf("product = %q, %q, %d scans", desc, brand, scans)
+	}
+}
+
+func TestMigrationDuplicateColumn(t *testing.T) {
+	_, db := legacyDB(t)
+	if err := db.Exec(CREATE_SCHEMA_VERSION); err != nil {
+		t.Fatal(err)
+	}
+	addBrand := "ALTER TABLE product ADD COLUMN brand text;"
+
+	// only the upgrade migration may add a column which is already there
+	if err := (&Migration{Version: 2, Name: "product_details", SQL: addBrand}).apply(db); err != nil {
+		t.Errorf("the upgrade migration failed: %v", err)
+	}
+	if err := (&Migration{Version: 99, Name: "brand_again", SQL: addBrand}).apply(db); err == nil {
+		t.Error("a later migration added a column which is already there")
+	}
+}
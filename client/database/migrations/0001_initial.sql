@@ -4,6 +4,8 @@
 -- datatypes (https://www.sqlite.org/datatype3.html), so the analogous
 -- server database columns have been adjusted accordingly.
 
+-- This is the original schema, which the later migrations build on
+
 -- `account` defines basic end-user information, corresponding to the
 -- account table in the server database
 
@@ -27,7 +29,7 @@ CREATE TABLE IF NOT EXISTS product (
 	posted       datetime DEFAULT (datetime('now')),
 	account      integer REFERENCES account(id),
 	UNIQUE(barcode, product_desc)
-); 
+);
 
 -- `vendor` defines the list of commercial vendors for products.
 -- vendor_id is the description/result of the vendor's API, and
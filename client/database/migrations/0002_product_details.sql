@@ -0,0 +1,26 @@
+-- The columns added to the original tables before the migrations were
+-- available (databases created from the old tables.sql file may have any
+-- number of them already, and MigrateDB skips those)
+
+-- the WebApp language, if not automatic (Accept-Language)
+ALTER TABLE account ADD COLUMN language text;
+
+-- the optional product details
+ALTER TABLE product ADD COLUMN brand text;
+ALTER TABLE product ADD COLUMN brand_url text;
+ALTER TABLE product ADD COLUMN image_url text;
+ALTER TABLE product ADD COLUMN thumbnail text; -- the cached image file name, under the thumbnails folder
+ALTER TABLE product ADD COLUMN category text;
+ALTER TABLE product ADD COLUMN ingredients text;
+ALTER TABLE product ADD COLUMN allergens text; -- comma-separated list
+ALTER TABLE product ADD COLUMN nutri_score text; -- 'a' through 'e'
+ALTER TABLE product ADD COLUMN authors text; -- comma-separated list (books only)
+ALTER TABLE product ADD COLUMN publisher text; -- books only
+
+-- how many times each product has been scanned
+ALTER TABLE product ADD COLUMN scans integer DEFAULT 1;
+
+-- the last known price, in the smallest unit of the currency, and its
+-- ISO 4217 currency code
+ALTER TABLE product_availability ADD COLUMN price integer;
+ALTER TABLE product_availability ADD COLUMN currency text;
@@ -0,0 +1,16 @@
+-- `scan_event` logs every barcode read by the scanner (it is only ever
+-- appended to), whether or not the lookup found any products, so that
+-- the history survives edits and deletions in the product table
+
+CREATE TABLE IF NOT EXISTS scan_event (
+	id       integer primary key AUTOINCREMENT,
+	barcode  text NOT NULL,
+	account  integer REFERENCES account(id),
+	scanned  datetime DEFAULT (datetime('now')),
+	mode     text, -- what the scan was for, e.g. 'add'
+	device   text, -- the input device which read the barcode
+	outcome  text NOT NULL -- 'found', 'unknown', or 'error' (the lookup failed)
+);
+
+CREATE INDEX IF NOT EXISTS scan_event_scanned ON scan_event (account, scanned);
+CREATE INDEX IF NOT EXISTS scan_event_barcode ON scan_event (account, barcode, scanned);
@@ -0,0 +1,29 @@
+-- `product_unit` tracks each scanned unit of a product while it is in
+-- the household, with its expiry (or best before) date, if known
+
+CREATE TABLE IF NOT EXISTS product_unit (
+	id       integer primary key AUTOINCREMENT,
+	product  integer REFERENCES product(id),
+	account  integer REFERENCES account(id),
+	expires  date,    -- YYYY-MM-DD, can be null: means unknown
+	added    datetime DEFAULT (datetime('now')),
+	is_used  integer DEFAULT 0 -- 0 = in stock, 1 = used up (or thrown away)
+);
+
+CREATE INDEX IF NOT EXISTS product_unit_expires ON product_unit (account, is_used, expires);
+
+-- `shelf_life` defines the default number of days until a unit expires,
+-- for products whose category contains the keyword as a whole word (or
+-- its plural), where "frozen" wins over any other match, and otherwise the
+-- shortest of those matching; it can be edited to suit the household
+
+CREATE TABLE IF NOT EXISTS shelf_life (
+	keyword  text primary key, -- lowercase
+	days     integer NOT NULL
+);
+
+INSERT OR IGNORE INTO shelf_life (keyword, days) VALUES
+	('fish', 2), ('seafood', 2), ('meat', 3), ('poultry', 3), ('salad', 3),
+	('pastries', 3), ('bread', 4), ('milk', 7), ('dairies', 7), ('fruit', 7),
+	('vegetable', 7), ('juice', 7), ('yogurt', 14), ('cheese', 21), ('egg', 21),
+	('frozen', 90);
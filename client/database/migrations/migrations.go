@@ -0,0 +1,17 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package migrations holds the schema of the sqlite database on the Pi
+// client, as the ordered series of changes which build it up, compiled
+// into the client binaries so that they can upgrade existing databases
+
+package migrations
+
+import "embed"
+
+// Files are the *.sql files in this folder, named <version>_<name>.sql,
+// and applied in version order (see database.MigrateDB); once released,
+// a migration must never change, so every schema change is a new file
+//
+//go:embed *.sql
+var Files embed.FS
@@ -0,0 +1,227 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"fmt"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Item sort orders
+	SORT_DATE  = "date"  // most recently scanned first (the default)
+	SORT_NAME  = "name"  // alphabetical, with the unknown items last
+	SORT_COUNT = "count" // most often scanned first
+
+	// Full text search of the product description, barcode, and brand
+	// (needs a sqlite library with FTS5; otherwise QueryItems falls back
+	// to substring matches)
+	CREATE_SEARCH_INDEX = "create virtual table if not exists product_search using fts5(product_desc, barcode, brand)"
+	FILL_SEARCH_INDEX   = "insert into product_search (rowid, product_desc, barcode, brand) select id, product_desc, barcode, brand from product where id not in (select rowid from product_search)"
+	FIND_SEARCH_INDEX   = "select count(*) from sqlite_master where type = 'table' and name = 'product_search'"
+	ADD_SEARCH_ENTRY    = "insert into product_search (rowid, product_desc, barcode, brand) values ($i, $d, $b, $br)"
+	DELETE_SEARCH_ENTRY = "delete from product_search where rowid = $i"
+
+	// Item queries (see QueryItems)
+	ITEM_COLUMNS = "p.id, p.barcode, p.product_desc, p.product_ind, strftime('%s', p.posted) as posted, p.scans, p.brand, p.brand_url, p.image_url, p.thumbnail, p.category, p.ingredients, p.allergens, p.nutri_score, p.authors, p.publisher, pa.id as pa_id, pa.product_code, pa.price, pa.currency, v.id as v_id, v.vendor_id, v.display_name"
+	ITEM_JOINS   = "product p left join product_availability pa on pa.product = p.id left join vendor v on v.id = pa.vendor"
+	COUNT_ITEMS  = "select count(*) from product p where %s"
+	GET_BRANDS   = "select distinct p.brand from product p where %s and p.brand != '' order by p.brand collate nocase"
+)
+
+var (
+	ITEM_SORT_ORDERS = map[string]string{
+		SORT_DATE:  "p.posted desc, p.id desc",
+		SORT_NAME:  "p.product_desc = '', p.product_desc collate nocase, p.id desc",
+		SORT_COUNT: "p.scans desc, p.posted desc, p.id desc"}
+)
+
+// ItemQuery defines which of an Account's Items to fetch, in what order,
+// and which page of them (if Limit is more than zero)
+type ItemQuery struct {
+	Id        int64  // a single Item, if more than zero
+	Search    string // words in the description, barcode, or brand
+	Brand     string
+	Vendor    string // the vendor id (e.g., "AMZN:us") selling the Items
+	Favorites bool
+	Sort      string // SORT_DATE by default
+	Limit     int64
+	Offset    int64
+}
+
+// InitializeSearch creates the full text search index, if the sqlite
+// library supports it, and adds any products missing from it
+func InitializeSearch(db *sqlite3.Conn) error {
+	if err := db.Exec(CREATE_SEARCH_INDEX); err != nil {
+		return err
+	}
+	return db.Exec(FILL_SEARCH_INDEX)
+}
+
+// hasSearchIndex is true if InitializeSearch created the index
+func hasSearchIndex(db *sqlite3.Conn) bool {
+	var n int64
+	for s, err := db.Query(FIND_SEARCH_INDEX); err == nil; err = s.Next() {
+		s.Scan(&n)
+	}
+	return n > 0
+}
+
+// index adds (or replaces) the Item in the full text search index, if any
+func (i *Item) index(db *sqlite3.Conn) {
+	if hasSearchIndex(db) {
+		i.unindex(db)
+		args := sqlite3.NamedArgs{"$i": i.Id, "$d": i.Desc, "$b": i.Barcode, "$br": i.Brand}
+		db.Exec(ADD_SEARCH_ENTRY, args)
+	}
+}
+
+// unindex removes the Item from the full text search index, if any
+func (i *Item) unindex(db *sqlite3.Conn) {
+	if hasSearchIndex(db) {
+		db.Exec(DELETE_SEARCH_ENTRY, sqlite3.NamedArgs{"$i": i.Id})
+	}
+}
+
+// searchTerms converts what was typed into an FTS5 query which matches
+// every word (as a prefix), with any FTS5 syntax quoted away
+func searchTerms(search string) string {
+	terms := make([]string, 0)
+	for _, word := range strings.Fields(search) {
+		terms = append(terms, fmt.Sprintf("\"%s\"*", strings.Replace(word, "\"", "\"\"", -1)))
+	}
+	return strings.Join(terms, " ")
+}
+
+// itemFilter returns the where clause (and its arguments) matching the
+// Items for the Account and ItemQuery
+func itemFilter(db *sqlite3.Conn, a *Account, q *ItemQuery) (string, sqlite3.NamedArgs) {
+	clauses := []string{"p.account = $a"}
+	args := sqlite3.NamedArgs{"$a": a.Id}
+
+	if q.Id > 0 {
+		clauses = append(clauses, "p.id = $i")
+		args["$i"] = q.Id
+	}
+	if q.Favorites {
+		clauses = append(clauses, "p.is_favorite = 1")
+	}
+	if q.Brand != "" {
+		clauses = append(clauses, "p.brand = $br")
+		args["$br"] = q.Brand
+	}
+	if q.Vendor != "" {
+		clauses = append(clauses, "p.id in (select fa.product from product_availability fa, vendor fv where fv.id = fa.vendor and fv.vendor_id = $v)")
+		args["$v"] = q.Vendor
+	}
+	if terms := searchTerms(q.Search); terms != "" {
+		if hasSearchIndex(db) {
+			clauses = append(clauses, "p.id in (select rowid from product_search where product_search match $q)")
+			args["$q"] = terms
+		} else {
+			clauses = append(clauses, "(p.product_desc like $q or p.barcode like $q or p.brand like $q)")
+			args["$q"] = "%" + strings.TrimSpace(q.Search) + "%"
+		}
+	}
+
+	return strings.Join(clauses, " and "), args
+}
+
+// QueryItems returns the Account's Items matching the ItemQuery, with
+// their vendor products (in a single query), and how many Items match
+// in all (i.e., regardless of the Limit and Offset)
+func QueryItems(db *sqlite3.Conn, a *Account, q *ItemQuery) ([]*Item, int64, error) {
+	results := make([]*Item, 0)
+
+	where, args := itemFilter(db, a, q)
+	var total int64
+	for s, err := db.Query(fmt.Sprintf(COUNT_ITEMS, where), args); err == nil; err = s.Next() {
+		s.Scan(&total)
+	}
+
+	order, orderExists := ITEM_SORT_ORDERS[q.Sort]
+	if !orderExists {
+		order = ITEM_SORT_ORDERS[SORT_DATE]
+	}
+	// page through the products first, and then join their vendor products
+	page := fmt.Sprintf("select p.id from product p where %s order by %s", where, order)
+	if q.Limit > 0 {
+		page = fmt.Sprintf("%s limit %d offset %d", page, q.Limit, q.Offset)
+	}
+	sql := fmt.Sprintf("select %s from %s where p.id in (%s) order by %s, pa.id", ITEM_COLUMNS, ITEM_JOINS, page, order)
+
+	lookup := make(map[int64]*Item)
+	row := make(sqlite3.RowMap)
+	for s, err := db.Query(sql, args); err == nil; err = s.Next() {
+		var rowid int64
+		s.Scan(&rowid, row)
+
+		result, seen := lookup[rowid]
+		if !seen {
+			result = new(Item)
+			result.Id = rowid
+			result.Barcode = rowString(row, "barcode")
+			result.Desc = rowString(row, "product_desc")
+			if ind, indOk := row["product_ind"].(int64); indOk {
+				result.Index = ind
+			}
+			if since, sinceErr := strconv.ParseInt(rowString(row, "posted"), 10, 64); sinceErr == nil {
+				result.Posted = time.Unix(since, 0)
+			}
+			if scans, scansOk := row["scans"].(int64); scansOk {
+				result.Scans = scans
+			}
+			result.Brand = rowString(row, "brand")
+			result.BrandURL = rowString(row, "brand_url")
+			result.ImageURL = rowString(row, "image_url")
+			result.Thumbnail = rowString(row, "thumbnail")
+			result.Category = rowString(row, "category")
+			result.Ingredients = rowString(row, "ingredients")
+			if allergens := rowString(row, "allergens"); allergens != "" {
+				result.Allergens = strings.Split(allergens, LIST_SEPARATOR)
+			}
+			result.NutriScore = rowString(row, "nutri_score")
+			if authors := rowString(row, "authors"); authors != "" {
+				result.Authors = strings.Split(authors, LIST_SEPARATOR)
+			}
+			result.Publisher = rowString(row, "publisher")
+			result.ForSale = make([]*VendorProduct, 0)
+			lookup[rowid] = result
+			results = append(results, result)
+		}
+
+		// each row has one of the Item's vendor products, if any
+		if paId, paIdOk := row["pa_id"].(int64); paIdOk {
+			vp := &VendorProduct{Id: paId, ProductCode: rowString(row, "product_code"), Currency: rowString(row, "currency")}
+			if price, priceOk := row["price"].(int64); priceOk {
+				vp.Price = price
+			}
+			vp.Vendor = &Vendor{VendorId: rowString(row, "vendor_id"), DisplayName: rowString(row, "display_name")}
+			if vId, vIdOk := row["v_id"].(int64); vIdOk {
+				vp.Vendor.Id = vId
+			}
+			result.ForSale = append(result.ForSale, vp)
+		}
+	}
+
+	return results, total, nil
+}
+
+// GetBrands returns the distinct brands of the Account's Items (or of
+// just its favorites), in alphabetical order
+func GetBrands(db *sqlite3.Conn, a *Account, favorites bool) []string {
+	results := make([]string, 0)
+	where, args := itemFilter(db, a, &ItemQuery{Favorites: favorites})
+	for s, err := db.Query(fmt.Sprintf(GET_BRANDS, where), args); err == nil; err = s.Next() {
+		var brand string
+		s.Scan(&brand)
+		results = append(results, brand)
+	}
+	return results
+}
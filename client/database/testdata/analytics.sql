@@ -0,0 +1,34 @@
+-- The fixture for analytics_test.go: two accounts' products, prices and
+-- scans (all at midday UTC, so the local dates are the same in any
+-- timezone within 11 hours of UTC)
+
+INSERT INTO account (id, email, api_code) VALUES (1, 'me@example.org', '0123456789abcdef');
+INSERT INTO account (id, email, api_code) VALUES (2, 'other@example.org', 'fedcba9876543210');
+
+-- two Items with the 0001 barcode: scans only count as the first one
+INSERT INTO product (id, barcode, product_desc, product_ind, is_favorite, category, account) VALUES (1, '0001', 'Oat Milk', 0, 1, 'Dairy alternatives', 1);
+INSERT INTO product (id, barcode, product_desc, product_ind, is_favorite, category, account) VALUES (2, '0001', 'Oat Milk Barista', 1, 0, 'Coffee', 1);
+INSERT INTO product (id, barcode, product_desc, product_ind, is_favorite, category, account) VALUES (3, '0002', 'Rye Bread', 0, 0, NULL, 1);
+INSERT INTO product (id, barcode, product_desc, product_ind, is_favorite, category, account) VALUES (4, '0003', 'Coffee Beans', 0, 1, 'Coffee', 1);
+INSERT INTO product (id, barcode, product_desc, product_ind, is_favorite, category, account) VALUES (5, '0002', 'Dark Rye Bread', 0, 1, 'Bakery', 2);
+
+INSERT INTO vendor (id, vendor_id, display_name) VALUES (1, 'AMZ', 'Amazon');
+INSERT INTO vendor (id, vendor_id, display_name) VALUES (2, 'SHOP', 'Corner Shop');
+
+-- (a zero price is unknown, so it is not counted)
+INSERT INTO product_availability (product_code, product, vendor, price, currency) VALUES ('B0001', 1, 1, 199, 'USD');
+INSERT INTO product_availability (product_code, product, vendor, price, currency) VALUES ('S0001', 1, 2, 250, 'EUR');
+INSERT INTO product_availability (product_code, product, vendor, price, currency) VALUES ('B0001B', 2, 1, 999, 'USD');
+INSERT INTO product_availability (product_code, product, vendor, price, currency) VALUES ('B0002', 3, 1, 0, 'USD');
+INSERT INTO product_availability (product_code, product, vendor, price, currency) VALUES ('B0003', 4, 1, 1299, 'USD');
+INSERT INTO product_availability (product_code, product, vendor, price, currency) VALUES ('B0002X', 5, 1, 350, 'USD');
+
+INSERT INTO scan_event (barcode, account, scanned, mode, outcome) VALUES ('0003', 1, '2015-02-20 12:00:00', 'add', 'found');
+INSERT INTO scan_event (barcode, account, scanned, mode, outcome) VALUES ('0001', 1, '2015-03-03 12:00:00', 'add', 'found');
+INSERT INTO scan_event (barcode, account, scanned, mode, outcome) VALUES ('0002', 1, '2015-03-03 12:30:00', 'add', 'found');
+INSERT INTO scan_event (barcode, account, scanned, mode, outcome) VALUES ('0001', 1, '2015-03-04 12:00:00', 'add', 'found');
+INSERT INTO scan_event (barcode, account, scanned, mode, outcome) VALUES ('9999', 1, '2015-03-04 13:00:00', 'add', 'unknown');
+INSERT INTO scan_event (barcode, account, scanned, mode, outcome) VALUES ('0003', 1, '2015-03-06 12:00:00', 'add', 'found');
+INSERT INTO scan_event (barcode, account, scanned, mode, outcome) VALUES ('0001', 1, '2015-03-10 12:00:00', 'add', 'found');
+INSERT INTO scan_event (barcode, account, scanned, mode, outcome) VALUES ('0004', 1, '2015-03-10 12:10:00', 'add', 'error');
+INSERT INTO scan_event (barcode, account, scanned, mode, outcome) VALUES ('0002', 2, '2015-03-04 12:00:00', 'add', 'found');
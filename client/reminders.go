@@ -0,0 +1,116 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// This sends the daily "use soon" reminder: an email (via the API server)
+// listing the scanned units which expire within the next few days. Run it
+// once a day, e.g. from cron.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/Banrai/PiScan/server/api"
+	"github.com/Banrai/PiScan/server/digest"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const (
+	apiServerHost = "https://api.saruzai.com"
+	apiServerPort = 443
+
+	// how many days ahead to look, by default
+	reminderDays = 3
+)
+
+// expiringItems lists the units which expire within the days, as the
+// items for the email, with the units of the same item expiring on the
+// same day counted together
+func expiringItems(units []*database.Unit) []*api.EmailedItem {
+	items := make([]*api.EmailedItem, 0)
+	lookup := make(map[string]*api.EmailedItem)
+	for _, u := range units {
+		key := strconv.FormatInt(u.Product, 10) + ":" + u.DisplayExpires()
+		if item, exists := lookup[key]; exists {
+			item.Quantity += 1
+			continue
+		}
+		item := &api.EmailedItem{Desc: u.Desc, Barcode: u.Barcode, Brand: u.Brand, Quantity: 1, Expires: u.DisplayExpires()}
+		if item.Desc == "" {
+			item.Desc = u.Barcode
+		}
+		lookup[key] = item
+		items = append(items, item)
+	}
+	return items
+}
+
+func main() {
+	var (
+		apiServer, sqlitePath, sqliteFile string
+		apiPort, days                     int
+	)
+
+	flag.StringVar(&apiServer, "apiHost", apiServerHost, fmt.Sprintf("The hostname or IP address of the API server (defaults to '%s')", apiServerHost))
+	flag.IntVar(&apiPort, "apiPort", apiServerPort, fmt.Sprintf("The API server port (defaults to '%d')", apiServerPort))
+	flag.StringVar(&sqlitePath, "sqlitePath", database.SQLITE_PATH, fmt.Sprintf("Path to the sqlite file (defaults to '%s')", database.SQLITE_PATH))
+	flag.StringVar(&sqliteFile, "sqliteFile", database.SQLITE_FILE, fmt.Sprintf("The sqlite database file (defaults to '%s')", database.SQLITE_FILE))
+	flag.IntVar(&days, "days", reminderDays, fmt.Sprintf("Remind about the items expiring within this many days (defaults to '%d')", reminderDays))
+	flag.Parse()
+
+	// create the client db, or apply the schema changes it is missing (as
+	// the WebApp and PiScanner do at startup, since this may run first)
+	dbCoordinates := database.ConnCoordinates{DBPath: sqlitePath, DBFile: sqliteFile}
+	if _, _, migrateErr := database.MigrateDB(dbCoordinates); migrateErr != nil {
+		log.Fatal(migrateErr)
+	}
+
+	db, dbErr := database.InitializeDB(dbCoordinates)
+	if dbErr != nil {
+		log.Fatal(dbErr)
+	}
+	defer db.Close()
+
+	acc, accErr := database.GetDesignatedAccount(db)
+	if accErr != nil {
+		log.Fatal(accErr)
+	}
+	if acc.Email == database.ANONYMOUS_EMAIL {
+		// only registered accounts can be emailed
+		log.Println("The account is not registered, so there is no one to remind")
+		return
+	}
+
+	items := expiringItems(database.GetExpiringUnits(db, acc, days))
+	if len(items) == 0 {
+		log.Println(fmt.Sprintf("Nothing expires within %d days", days))
+		return
+	}
+
+	list, listErr := json.Marshal(items)
+	if listErr != nil {
+		log.Fatal(listErr)
+	}
+	v := url.Values{"email": {acc.Email}, "items": {string(list)}, "days": {strconv.Itoa(days)}}
+
+	// sign the request with the account api code
+	res, err := digest.NewSigner(acc.APICode).PostForm(fmt.Sprintf("%s:%d/expiring/", apiServer, apiPort), v)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	// the server error messages do not survive json encoding, so an
+	// empty ack is the only sign of failure
+	m := new(api.SimpleMessage)
+	json.NewDecoder(res.Body).Decode(&m)
+	if res.StatusCode != http.StatusOK || m.Ack == "" {
+		log.Fatal(fmt.Sprintf("The API server did not send the reminder (%s)", res.Status))
+	}
+	log.Println(fmt.Sprintf("Reminded %s of %d expiring items", acc.Email, len(items)))
+}
@@ -10,23 +10,54 @@ import (
 	"flag"
 	"fmt"
 	"github.com/Banrai/PiScan/client/database"
+	"github.com/Banrai/PiScan/client/thumbnails"
 	"github.com/Banrai/PiScan/scanner"
 	"github.com/Banrai/PiScan/server/commerce"
+	"github.com/Banrai/PiScan/server/digest"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"time"
 )
 
 const (
 	apiServerHost = "https://api.saruzai.com"
 	apiServerPort = 443
+
+	// how long the thumbnail update waits for the scan loop (or the
+	// WebApp) to release the sqlite db
+	thumbnailDBTimeout = 10 * time.Second
 )
 
+// fetchThumbnail caches the product image, and records it for the item,
+// with its own connection to the sqlite db, since it runs in the background
+// (so that a slow image host does not hold up the next scan)
+func fetchThumbnail(coords database.ConnCoordinates, item database.Item) {
+	thumbnail, thumbnailErr := thumbnails.Fetch(item.ImageURL, thumbnails.Folder(coords.DBPath))
+	if thumbnailErr != nil {
+		fmt.Println(fmt.Sprintf("Product image error: %s", thumbnailErr))
+		return
+	}
+
+	db, dbErr := database.InitializeDB(coords)
+	if dbErr != nil {
+		fmt.Println(fmt.Sprintf("Client db thumbnail error: %s", dbErr))
+		return
+	}
+	defer db.Close()
+	db.BusyTimeout(thumbnailDBTimeout)
+
+	if err := item.SetThumbnail(db, thumbnail); err != nil {
+		fmt.Println(fmt.Sprintf("Client db thumbnail error: %s", err))
+	}
+}
+
 func main() {
 	var (
-		device, apiServer, sqlitePath, sqliteFile, sqliteTablesDefinitionPath string
-		apiPort                                                               int
+		device, apiServer, sqlitePath, sqliteFile string
+		apiPort                                   int
+		migrateOnly                               bool
 	)
 
 	flag.StringVar(&device, "device", scanner.SCANNER_DEVICE, fmt.Sprintf("The '/dev/input/event' device associated with your scanner (defaults to '%s')", scanner.SCANNER_DEVICE))
@@ -34,24 +65,29 @@ func main() {
 	flag.IntVar(&apiPort, "apiPort", apiServerPort, fmt.Sprintf("The API server port (defaults to '%d')", apiServerPort))
 	flag.StringVar(&sqlitePath, "sqlitePath", database.SQLITE_PATH, fmt.Sprintf("Path to the sqlite file (defaults to '%s')", database.SQLITE_PATH))
 	flag.StringVar(&sqliteFile, "sqliteFile", database.SQLITE_FILE, fmt.Sprintf("The sqlite database file (defaults to '%s')", database.SQLITE_FILE))
-	flag.StringVar(&sqliteTablesDefinitionPath, "sqliteTables", "", fmt.Sprintf("Path to the sqlite database definitions file, %s, (use only if creating the client db for the first time)", database.TABLE_SQL_DEFINITIONS))
+	flag.BoolVar(&migrateOnly, "migrateOnly", false, "Create the client db, or bring it up to date, and exit without scanning")
 	flag.Parse()
 
-	if len(sqliteTablesDefinitionPath) > 0 {
-		// this is a request to create the client db for the first time
-		initDb, initErr := database.InitializeDB(database.ConnCoordinates{sqlitePath, sqliteFile, sqliteTablesDefinitionPath})
-		if initErr != nil {
-			log.Fatal(initErr)
-		}
-		defer initDb.Close()
+	// coordinates for connecting to the sqlite database (from the command line options)
+	dbCoordinates := database.ConnCoordinates{DBPath: sqlitePath, DBFile: sqliteFile}
+
+	// create the client db, or apply the schema changes it is missing
+	migrated, backup, migrateErr := database.MigrateDB(dbCoordinates)
+	if migrateErr != nil {
+		log.Fatal(migrateErr)
+	}
+	if backup != "" {
+		log.Println(fmt.Sprintf("Client database '%s' migrated to version %d (the previous version is in '%s')", sqliteFile, migrated[len(migrated)-1].Version, backup))
+	} else if len(migrated) > 0 {
 		log.Println(fmt.Sprintf("Client database '%s' created in '%s'", sqliteFile, sqlitePath))
+	}
+
+	if migrateOnly {
+		log.Println(fmt.Sprintf("Client database '%s' is up to date in '%s'", sqliteFile, sqlitePath))
 
 	} else {
 		// a regular scanner processing event
 
-		// coordinates for connecting to the sqlite database (from the command line options)
-		dbCoordinates := database.ConnCoordinates{DBPath: sqlitePath, DBFile: sqliteFile}
-
 		// attempt to connect to the sqlite db
 		db, dbErr := database.InitializeDB(dbCoordinates)
 		if dbErr != nil {
@@ -59,9 +95,44 @@ func main() {
 		}
 		defer db.Close()
 
-		processScanFn := func(barcode string) {
+		processScanFn := func(scanned string) {
+			// GS1 barcodes (e.g., on fresh food) hold the product code to
+			// look up, and often the expiry date of this particular unit
+			barcode := scanned
+			var expires time.Time
+			if gs1, isGS1 := scanner.ParseGS1(scanned); isGS1 {
+				barcode = gs1.Barcode()
+				expires = gs1.Expires
+			}
+
+			// get the Account for this request
+			acc, accErr := database.GetDesignatedAccount(db)
+			if accErr != nil {
+				fmt.Println(fmt.Sprintf("Client db account access error: %s", accErr))
+				return
+			}
+
+			// log the scan in the history, however the lookup turns out
+			outcome := database.SCAN_ERROR
+			defer func() {
+				logErr := database.AddScanEvent(db, acc, barcode, database.SCAN_MODE_ADD, device, outcome)
+				if logErr != nil {
+					fmt.Println(fmt.Sprintf("Client db scan history error: %s", logErr))
+				}
+			}()
+
 			// Lookup the barcode in the API server
-			apiResponse, apiErr := http.PostForm(fmt.Sprintf("%s:%d/lookup", apiServer, apiPort), url.Values{"barcode": {barcode}})
+			// (including the account's own contributions, if registered)
+			lookup := url.Values{"barcode": {barcode}}
+			lookupUrl := fmt.Sprintf("%s:%d/lookup", apiServer, apiPort)
+			var apiResponse *http.Response
+			var apiErr error
+			if acc.Email != database.ANONYMOUS_EMAIL {
+				lookup.Set("email", acc.Email)
+				apiResponse, apiErr = digest.NewSigner(acc.APICode).PostForm(lookupUrl, lookup)
+			} else {
+				apiResponse, apiErr = http.PostForm(lookupUrl, lookup)
+			}
 			if apiErr != nil {
 				fmt.Println(fmt.Sprintf("API access error: %s", apiErr))
 				return
@@ -76,13 +147,6 @@ func main() {
 				return
 			}
 
-			// get the Account for this request
-			acc, accErr := database.GetDesignatedAccount(db)
-			if accErr != nil {
-				fmt.Println(fmt.Sprintf("Client db account access error: %s", accErr))
-				return
-			}
-
 			// get the list of current Vendors according to the Pi client database
 			// and map them according to their API vendor id string
 			vendors := make(map[string]*database.Vendor)
@@ -91,13 +155,19 @@ func main() {
 			}
 
 			productsFound := 0
+			unitProduct, unitCategory := int64(database.BAD_PK), ""
 			for i, product := range products {
 				v, exists := vendors[product.Vendor]
 				if !exists {
 					if len(product.Vendor) > 0 {
-						amazonId, amazonErr := database.AddVendor(db, product.Vendor, "Amazon")
-						if amazonErr == nil {
-							v = database.GetVendor(db, amazonId)
+						// use the vendor's display name, as defined by the API server
+						displayName := product.VendorName
+						if displayName == "" {
+							displayName = product.Vendor
+						}
+						vendorPk, vendorErr := database.AddVendor(db, product.Vendor, displayName)
+						if vendorErr == nil {
+							v = database.GetVendor(db, vendorPk)
 							vendors[product.Vendor] = v
 							exists = true
 						}
@@ -111,12 +181,32 @@ func main() {
 						Index:           int64(i),
 						Barcode:         barcode,
 						Desc:            product.ProductName,
-						UserContributed: false}
+						UserContributed: false,
+						Brand:           product.Brand,
+						BrandURL:        product.BrandURL,
+						ImageURL:        product.ImageURL,
+						Category:        product.Category,
+						Ingredients:     product.Ingredients,
+						Allergens:       product.Allergens,
+						NutriScore:      product.NutriScore,
+						Authors:         product.Authors,
+						Publisher:       product.Publisher}
 					pk, insertErr := item.Add(db, acc)
 					if insertErr == nil {
+						// the unit scanned is of the first product found
+						if unitProduct == database.BAD_PK {
+							unitProduct, unitCategory = pk, item.Category
+						}
+
 						// also log the vendor/product code combination
 						if exists {
-							database.AddVendorProduct(db, product.SKU, v.Id, pk)
+							database.AddVendorProduct(db, product.SKU, v.Id, pk, product.Price, product.Currency)
+						}
+
+						// and cache the product image, if any, in the background
+						if len(product.ImageURL) > 0 {
+							item.Id = pk
+							go fetchThumbnail(dbCoordinates, item)
 						}
 					}
 					productsFound += 1
@@ -127,7 +217,21 @@ func main() {
 				// add it to the Pi client sqlite db as "unknown"
 				// so that it can be manually edited/input
 				unknownItem := database.Item{Index: 0, Barcode: barcode}
-				unknownItem.Add(db, acc)
+				unitProduct, _ = unknownItem.Add(db, acc)
+				outcome = database.SCAN_UNKNOWN
+			} else {
+				outcome = database.SCAN_FOUND
+			}
+
+			// keep track of the unit in stock, and when it expires (if
+			// the barcode did not say, going by the product category)
+			if unitProduct != database.BAD_PK {
+				if expires.IsZero() {
+					expires = database.DefaultExpiry(db, unitCategory)
+				}
+				if _, unitErr := database.AddUnit(db, acc, unitProduct, expires); unitErr != nil {
+					fmt.Println(fmt.Sprintf("Client db unit error: %s", unitErr))
+				}
 			}
 		}
 
@@ -0,0 +1,198 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package thumbnails provides functions for downloading product images,
+// and saving them as small jpeg files on the Pi client, so that the WebApp
+// can show them without fetching the full-sized originals every time
+
+package thumbnails
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // register the gif and png decoders (jpeg is also used to encode)
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	// Default thumbnail folder, under the sqlite database path
+	THUMBNAIL_FOLDER = "thumbnails"
+
+	// Thumbnails fit within a square of this many pixels
+	THUMBNAIL_SIZE = 96
+
+	JPEG_QUALITY = 85
+
+	DOWNLOAD_TIMEOUT = 20 * time.Second
+
+	// The largest image downloaded (in bytes), and decoded (in pixels), so
+	// that the vendor images cannot use up the memory on the Pi
+	MAX_DOWNLOAD_SIZE = 8 << 20
+	MAX_IMAGE_PIXELS  = 12 << 20
+)
+
+var (
+	client = &http.Client{Timeout: DOWNLOAD_TIMEOUT}
+
+	ERR_IMAGE_TOO_LARGE = errors.New("The image is too large to make a thumbnail")
+)
+
+// Folder returns the thumbnail folder under the given sqlite database path
+func Folder(dbPath string) string {
+	return path.Join(dbPath, THUMBNAIL_FOLDER)
+}
+
+// Filename returns the thumbnail file name corresponding to the given
+// image url, so the same image is only ever downloaded once
+func Filename(imageURL string) string {
+	return fmt.Sprintf("%x.jpg", sha1.Sum([]byte(imageURL)))
+}
+
+// scale returns the dimensions of the given bounds, reduced (if necessary)
+// to fit within a square of max pixels, keeping the aspect ratio
+func scale(bounds image.Rectangle, max int) (int, int) {
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= max && h <= max {
+		return w, h
+	}
+	if w > h {
+		return max, (h*max + w/2) / w
+	}
+	return (w*max + h/2) / h, max
+}
+
+// Resize shrinks the image to fit within a square of max pixels, by
+// averaging the source pixels which correspond to each target pixel
+func Resize(src image.Image, max int) image.Image {
+	bounds := src.Bounds()
+	w, h := scale(bounds, max)
+	if w == 0 || h == 0 {
+		return src
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/h
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/h
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/w
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/w
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// flatten draws the image over a white background, since jpeg files
+// have no transparency
+func flatten(src image.Image) image.Image {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := src.At(x, y).RGBA()
+			white := 0xffff - a
+			dst.Set(x, y, color.RGBA64{uint16(r + white), uint16(g + white), uint16(b + white), 0xffff})
+		}
+	}
+	return dst
+}
+
+// Fetch downloads the image from the url, and saves it as a thumbnail
+// jpeg in the given folder, returning the thumbnail file name. If the
+// thumbnail already exists, it is not downloaded again.
+func Fetch(imageURL, folder string) (string, error) {
+	filename := Filename(imageURL)
+	target := path.Join(folder, filename)
+	if _, err := os.Stat(target); err == nil {
+		return filename, nil
+	}
+
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return "", err
+	}
+
+	res, resErr := client.Get(imageURL)
+	if resErr != nil {
+		return "", resErr
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("image download error: %s", res.Status)
+	}
+	if res.ContentLength > MAX_DOWNLOAD_SIZE {
+		return "", ERR_IMAGE_TOO_LARGE
+	}
+
+	// read at most one byte more than allowed, to tell if there is more
+	data, readErr := ioutil.ReadAll(io.LimitReader(res.Body, MAX_DOWNLOAD_SIZE+1))
+	if readErr != nil {
+		return "", readErr
+	}
+	if len(data) > MAX_DOWNLOAD_SIZE {
+		return "", ERR_IMAGE_TOO_LARGE
+	}
+
+	// check the dimensions in the header before decoding the pixels, since
+	// a small (compressed) file can still be a huge image
+	config, _, configErr := image.DecodeConfig(bytes.NewReader(data))
+	if configErr != nil {
+		return "", configErr
+	}
+	if config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > MAX_IMAGE_PIXELS {
+		return "", ERR_IMAGE_TOO_LARGE
+	}
+
+	img, _, imgErr := image.Decode(bytes.NewReader(data))
+	if imgErr != nil {
+		return "", imgErr
+	}
+
+	// write to a temporary file first, so the WebApp
+	// never serves a partially-written thumbnail
+	tmp, tmpErr := ioutil.TempFile(folder, "tmp")
+	if tmpErr != nil {
+		return "", tmpErr
+	}
+	defer os.Remove(tmp.Name())
+
+	encErr := jpeg.Encode(tmp, flatten(Resize(img, THUMBNAIL_SIZE)), &jpeg.Options{Quality: JPEG_QUALITY})
+	closeErr := tmp.Close()
+	if encErr != nil {
+		return "", encErr
+	}
+	if closeErr != nil {
+		return "", closeErr
+	}
+
+	return filename, os.Rename(tmp.Name(), target)
+}
@@ -7,9 +7,12 @@ package ui
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/Banrai/PiScan/client/database"
 	"github.com/Banrai/PiScan/server/api"
+	"github.com/Banrai/PiScan/server/database/barcodes"
 	"github.com/Banrai/PiScan/server/digest"
+	"github.com/mxk/go-sqlite/sqlite3"
 	"html/template"
 	"net/http"
 	"net/url"
@@ -17,7 +20,21 @@ import (
 	"strings"
 )
 
+const (
+	// Account lifecycle actions (see manageServerAccount)
+	ACCOUNT_ACTION_REKEY   = "rekey"
+	ACCOUNT_ACTION_RESEND  = "resend"
+	ACCOUNT_ACTION_DISABLE = "disable"
+	ACCOUNT_ACTION_DELETE  = "delete"
+)
+
 var (
+	ACCOUNT_ACTION_MESSAGES = map[string]string{
+		ACCOUNT_ACTION_REKEY:   ACCOUNT_REKEYED,
+		ACCOUNT_ACTION_RESEND:  VERIFICATION_RESENT,
+		ACCOUNT_ACTION_DISABLE: ACCOUNT_DISABLED,
+		ACCOUNT_ACTION_DELETE:  ACCOUNT_DELETED}
+
 	ACCOUNT_EDIT_TEMPLATE_FILES = []string{"account.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
 	ACCOUNT_EDIT_TEMPLATES      *template.Template
 )
@@ -26,17 +43,33 @@ type AccountForm struct {
 	Title        string
 	ActiveTab    *ActiveTab
 	Account      *database.Account
+	Languages    []*Language
 	CancelUrl    string
 	FormError    string
+	FormMessage  string
 	Unregistered bool
 }
 
 /* HTML Response Functions (via templates) */
 
-func renderAccountEditTemplate(w http.ResponseWriter, a *AccountForm) {
+func renderAccountEditTemplate(w http.ResponseWriter, a *AccountForm, tr *Catalogue) {
 	if TEMPLATES_INITIALIZED {
-		ACCOUNT_EDIT_TEMPLATES.Execute(w, a)
+		executeTemplate(w, ACCOUNT_EDIT_TEMPLATES, tr, a)
+	}
+}
+
+// supportedLanguage is true if the language code is one of the LANGUAGES,
+// or empty (i.e., automatic)
+func supportedLanguage(code string) bool {
+	if code == "" {
+		return true
+	}
+	for _, lang := range LANGUAGES {
+		if lang.Code == code {
+			return true
+		}
 	}
+	return false
 }
 
 // EditAccount presents the form for editing Account information (in
@@ -57,11 +90,12 @@ func EditAccount(w http.ResponseWriter, r *http.Request, dbCoords database.ConnC
 		http.Error(w, accErr.Error(), http.StatusInternalServerError)
 		return
 	}
+	tr := Translation(r, acc)
 
 	// get the api server + port from the optional parameters
 	apiHost, apiHostOk := opts[0].(string)
 	if !apiHostOk {
-		http.Error(w, BAD_REQUEST, http.StatusInternalServerError)
+		http.Error(w, tr.T(BAD_REQUEST), http.StatusInternalServerError)
 		return
 	}
 
@@ -72,14 +106,51 @@ func EditAccount(w http.ResponseWriter, r *http.Request, dbCoords database.ConnC
 		cancelUrl = ACCOUNT_URL
 	}
 
-	form := &AccountForm{Title: "My Account",
+	form := &AccountForm{Title: tr.T("My Account"),
 		ActiveTab:    &ActiveTab{Scanned: false, Favorites: false, Account: true, ShowTabs: true},
 		Account:      acc,
+		Languages:    LANGUAGES,
 		CancelUrl:    cancelUrl,
 		Unregistered: regStatus}
 
-	if "POST" == r.Method {
-		form.FormError = BAD_POST // in event of problems
+	// check for any message to display on page load
+	r.ParseForm()
+	if msg, exists := ACCOUNT_ACTION_MESSAGES[r.Form.Get("ack")]; exists {
+		form.FormMessage = tr.T(msg)
+	}
+
+	if _, langPosted := r.PostForm["language"]; "POST" == r.Method && langPosted {
+		form.FormError = tr.T(BAD_POST) // in event of problems
+
+		// make sure the hidden account id value matches the Account
+		accId, accIdErr := strconv.ParseInt(r.PostForm.Get("account"), 10, 64)
+		language := r.PostForm.Get("language")
+		if accIdErr == nil && acc.Id == accId && supportedLanguage(language) {
+			langErr := acc.SetLanguage(db, language)
+			if langErr != nil {
+				form.FormError = langErr.Error()
+			} else {
+				http.Redirect(w, r, ACCOUNT_URL, http.StatusFound)
+				return
+			}
+		}
+	} else if "POST" == r.Method && r.PostForm.Get("action") != "" {
+		form.FormError = tr.T(BAD_POST) // in event of problems
+
+		// make sure the hidden account id value matches the Account
+		accId, accIdErr := strconv.ParseInt(r.PostForm.Get("account"), 10, 64)
+		if accIdErr == nil && acc.Id == accId && !regStatus {
+			action := r.PostForm.Get("action")
+			actionErr := manageServerAccount(db, acc, apiHost, action, r.PostForm.Get("contributions"))
+			if actionErr != nil {
+				form.FormError = tr.T(actionErr.Error())
+			} else {
+				http.Redirect(w, r, ACCOUNT_URL+"?ack="+action, http.StatusFound)
+				return
+			}
+		}
+	} else if "POST" == r.Method {
+		form.FormError = tr.T(BAD_POST) // in event of problems
 
 		// get the item id from the posted data
 		r.ParseForm()
@@ -102,12 +173,10 @@ func EditAccount(w http.ResponseWriter, r *http.Request, dbCoords database.ConnC
 							v := url.Values{}
 							v.Set("email", emailVal[0])
 							v.Set("api", acc.APICode)
+							v.Set("lang", tr.Language) // for the emails from the server
 
-							// use the email address as the digest key
-							hmac := digest.GenerateDigest(emailVal[0], v.Encode())
-							v.Set("hmac", hmac)
-
-							res, err := http.Get(strings.Join([]string{apiHost, "/register?", v.Encode()}, ""))
+							// sign the request with the account api code
+							res, err := digest.NewSigner(acc.APICode).Get(strings.Join([]string{apiHost, "/register"}, ""), v)
 							if err == nil {
 								res.Body.Close()
 							}
@@ -124,7 +193,57 @@ func EditAccount(w http.ResponseWriter, r *http.Request, dbCoords database.ConnC
 		}
 	}
 
-	renderAccountEditTemplate(w, form)
+	renderAccountEditTemplate(w, form, tr)
+}
+
+// postServerAccount makes the signed POST request to the API Server
+// route on behalf of the Account, returning the server's ack message
+func postServerAccount(acc *database.Account, apiHost, route string, v url.Values) (string, error) {
+	v.Set("email", acc.Email)
+	res, err := digest.NewSigner(acc.APICode).PostForm(strings.Join([]string{apiHost, route}, ""), v)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	// the server error messages do not survive json encoding, so an
+	// empty ack is the only sign of failure
+	m := new(api.SimpleMessage)
+	dec := json.NewDecoder(res.Body)
+	dec.Decode(&m)
+	if res.StatusCode != http.StatusOK || m.Ack == "" {
+		return "", fmt.Errorf(SERVER_REFUSED)
+	}
+	return m.Ack, nil
+}
+
+// manageServerAccount applies the lifecycle action to the Account on the
+// API Server, and then updates the local client db to match: a new api
+// code is used from then on, and a deleted account reverts to anonymous
+func manageServerAccount(db *sqlite3.Conn, acc *database.Account, apiHost, action, contributions string) error {
+	v := url.Values{}
+	switch action {
+	case ACCOUNT_ACTION_REKEY:
+		apiCode := barcodes.GenerateUUID(barcodes.UndashedUUID)
+		v.Set("api", apiCode)
+		if _, err := postServerAccount(acc, apiHost, "/account/rekey", v); err != nil {
+			return err
+		}
+		return acc.Update(db, acc.Email, apiCode)
+	case ACCOUNT_ACTION_RESEND:
+		_, err := postServerAccount(acc, apiHost, "/account/resend", v)
+		return err
+	case ACCOUNT_ACTION_DISABLE:
+		_, err := postServerAccount(acc, apiHost, "/account/disable", v)
+		return err
+	case ACCOUNT_ACTION_DELETE:
+		v.Set("contributions", contributions)
+		if _, err := postServerAccount(acc, apiHost, "/account/delete", v); err != nil {
+			return err
+		}
+		return acc.Update(db, database.ANONYMOUS_EMAIL, barcodes.GenerateUUID(barcodes.UndashedUUID))
+	}
+	return fmt.Errorf(BAD_REQUEST)
 }
 
 // ConfirmServerAccount responds to the ajax request from the client to
@@ -143,7 +262,7 @@ func ConfirmServerAccount(r *http.Request, dbCoords database.ConnCoordinates, op
 	// get the api server + port from the optional parameters
 	apiHost, apiHostOk := opts[0].(string)
 	if !apiHostOk {
-		ack.Error = BAD_REQUEST
+		ack.Error = Translation(r, nil).T(BAD_REQUEST)
 	}
 
 	if ack.Error == "" {
@@ -152,6 +271,7 @@ func ConfirmServerAccount(r *http.Request, dbCoords database.ConnCoordinates, op
 		if accErr != nil {
 			ack.Error = accErr.Error()
 		}
+		tr := Translation(r, acc)
 
 		// get the account from the POST values
 		if "POST" == r.Method {
@@ -163,22 +283,19 @@ func ConfirmServerAccount(r *http.Request, dbCoords database.ConnCoordinates, op
 						ack.Error = idErr.Error()
 					} else {
 						if acc.Id != id {
-							ack.Error = BAD_REQUEST
+							ack.Error = tr.T(BAD_REQUEST)
 						} else {
 							// prepare the API Server request
 							v := url.Values{}
 							v.Set("email", acc.Email)
 
-							// use the email address as the digest key
-							hmac := digest.GenerateDigest(acc.Email, v.Encode())
-							v.Set("hmac", hmac)
-
 							// ping the API Server for the status of this account
-							res, resErr := http.Get(strings.Join([]string{apiHost, "/status?", v.Encode()}, ""))
-							defer res.Body.Close()
+							// (signing the request with the account api code)
+							res, resErr := digest.NewSigner(acc.APICode).Get(strings.Join([]string{apiHost, "/status"}, ""), v)
 							if resErr != nil {
 								ack.Error = resErr.Error()
 							} else {
+								defer res.Body.Close()
 								// read and parse the json message from the API Server
 								m := new(api.SimpleMessage)
 								dec := json.NewDecoder(res.Body)
@@ -194,13 +311,13 @@ func ConfirmServerAccount(r *http.Request, dbCoords database.ConnCoordinates, op
 						}
 					}
 				} else {
-					ack.Error = "Missing account id"
+					ack.Error = tr.T("Missing account id")
 				}
 			} else {
-				ack.Error = BAD_POST
+				ack.Error = tr.T(BAD_POST)
 			}
 		} else {
-			ack.Error = BAD_REQUEST
+			ack.Error = tr.T(BAD_REQUEST)
 		}
 	}
 
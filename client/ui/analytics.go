@@ -0,0 +1,137 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"encoding/json"
+	"github.com/Banrai/PiScan/client/database"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// The analytics cover this many weeks, unless a date range is chosen
+	ANALYTICS_WEEKS = 12
+
+	// How many barcodes and categories to rank
+	ANALYTICS_TOP = 10
+)
+
+var (
+	ANALYTICS_TEMPLATE_FILES = []string{"analytics.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	ANALYTICS_TEMPLATES      *template.Template
+)
+
+type AnalyticsPage struct {
+	Title     string
+	ActiveTab *ActiveTab
+	From      string
+	To        string
+	DataUrl   string // where the page fetches the aggregates (as json)
+}
+
+/* JSON response struct */
+type AnalyticsReply struct {
+	Analytics *database.Analytics `json:"analytics,omitempty"`
+	Error     string              `json:"err,omitempty"`
+}
+
+// analyticsQuery returns the date range in the request params (the to
+// date is inclusive), which starts ANALYTICS_WEEKS ago by default
+func analyticsQuery(r *http.Request) *database.HistoryQuery {
+	r.ParseForm()
+	query := &database.HistoryQuery{From: parseDate(r.Form.Get("from"))}
+	if query.From.IsZero() {
+		y, m, d := time.Now().Date()
+		query.From = time.Date(y, m, d, 0, 0, 0, 0, time.Local).AddDate(0, 0, 1-7*ANALYTICS_WEEKS)
+	}
+	if to := parseDate(r.Form.Get("to")); !to.IsZero() {
+		query.To = to.AddDate(0, 0, 1)
+	}
+	return query
+}
+
+/* HTML Response Functions (via templates) */
+
+func renderAnalyticsTemplate(w http.ResponseWriter, p *AnalyticsPage, tr *Catalogue) {
+	if TEMPLATES_INITIALIZED {
+		executeTemplate(w, ANALYTICS_TEMPLATES, tr, p)
+	}
+}
+
+// ShowAnalytics presents the charts of the scans in the date range, which
+// the page fetches from ScanAnalytics
+func ShowAnalytics(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// get the Account for this request
+	acc, accErr := database.GetDesignatedAccount(db)
+	if accErr != nil {
+		http.Error(w, accErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	tr := Translation(r, acc)
+
+	query := analyticsQuery(r)
+	v := url.Values{"from": {query.From.Format(DATE_PARAM)}}
+	p := &AnalyticsPage{Title: tr.T("Analytics"),
+		ActiveTab: &ActiveTab{Analytics: true, ShowTabs: true},
+		From:      query.From.Format(DATE_PARAM)}
+	if !query.To.IsZero() {
+		p.To = query.To.AddDate(0, 0, -1).Format(DATE_PARAM)
+		v.Set("to", p.To)
+	}
+	p.DataUrl = "/stats/?" + v.Encode()
+
+	renderAnalyticsTemplate(w, p, tr)
+}
+
+/* Ajax Response Functions (as strings via MakeHandler) */
+
+// ScanAnalytics responds to the ajax request for the aggregates of the
+// scans in the date range: scans per day and per week, the most scanned
+// barcodes and categories, the use of favorites, and the spend by vendor
+func ScanAnalytics(r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) string {
+	// prepare the ajax reply object
+	reply := AnalyticsReply{}
+
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	defer db.Close()
+
+	if err == nil {
+		// get the Account for this request
+		acc, accErr := database.GetDesignatedAccount(db)
+		if accErr != nil {
+			reply.Error = accErr.Error()
+		} else {
+			analytics, analyticsErr := database.GetAnalytics(db, acc, analyticsQuery(r), ANALYTICS_TOP)
+			if analyticsErr != nil {
+				reply.Error = analyticsErr.Error()
+			} else {
+				reply.Analytics = analytics
+			}
+		}
+	}
+
+	// convert the ajax reply object to json
+	replyObj, replyObjErr := json.Marshal(reply)
+	if replyObjErr != nil {
+		return replyObjErr.Error()
+	}
+	return string(replyObj)
+}
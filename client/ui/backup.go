@@ -0,0 +1,173 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Banrai/PiScan/client/database"
+	"html/template"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BACKUP_URL = "/backup/"
+
+	// The largest file accepted for import (in bytes)
+	IMPORT_MAX_SIZE = 32 << 20
+)
+
+var (
+	BACKUP_TEMPLATE_FILES = []string{"backup.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	BACKUP_TEMPLATES      *template.Template
+
+	// the data sets, as labelled in the WebApp
+	DATA_SET_LABELS = map[string]string{
+		database.DATA_ITEMS:     "Scanned items",
+		database.DATA_FAVORITES: "Favorites",
+		database.DATA_VENDORS:   "Vendors and prices",
+		database.DATA_HISTORY:   "Scan history"}
+
+	EXPORT_MEDIA_TYPES = map[string]string{
+		database.FORMAT_CSV:  "text/csv",
+		database.FORMAT_JSON: "application/json"}
+)
+
+type DataSet struct {
+	Name  string
+	Label string
+}
+
+type BackupPage struct {
+	Title       string
+	ActiveTab   *ActiveTab
+	Account     *database.Account
+	DataSets    []*DataSet
+	Formats     []string
+	FormError   string
+	FormMessage string
+}
+
+// dataSets lists the database.DATA_SETS, with their (translated) labels
+func dataSets(tr *Catalogue) []*DataSet {
+	results := make([]*DataSet, 0)
+	for _, name := range database.DATA_SETS {
+		results = append(results, &DataSet{Name: name, Label: tr.T(DATA_SET_LABELS[name])})
+	}
+	return results
+}
+
+/* HTML Response Functions (via templates) */
+
+func renderBackupTemplate(w http.ResponseWriter, p *BackupPage, tr *Catalogue) {
+	if TEMPLATES_INITIALIZED {
+		executeTemplate(w, BACKUP_TEMPLATES, tr, p)
+	}
+}
+
+// ExportData sends the data set in the request as a file download, in
+// the format requested (csv, by default)
+func ExportData(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// get the Account for this request
+	acc, accErr := database.GetDesignatedAccount(db)
+	if accErr != nil {
+		http.Error(w, accErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	tr := Translation(r, acc)
+
+	r.ParseForm()
+	data := r.Form.Get("data")
+	format := r.Form.Get("format")
+	if format == "" {
+		format = database.FORMAT_CSV
+	}
+	if !database.IsDataSet(data) || !database.IsFormat(format) {
+		http.Error(w, tr.T(BAD_REQUEST), http.StatusBadRequest)
+		return
+	}
+
+	var out bytes.Buffer
+	if exportErr := database.Export(db, acc, data, format, &out); exportErr != nil {
+		http.Error(w, exportErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("piscan-%s-%s.%s", data, time.Now().Format(database.SQLITE_DATE), format)
+	w.Header().Set("Content-Type", fmt.Sprintf("%s; charset=utf-8", EXPORT_MEDIA_TYPES[format]))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	w.Header().Set("Content-Length", strconv.Itoa(out.Len()))
+	w.Write(out.Bytes())
+}
+
+// BackupData presents the export links and the import form (in response
+// to a GET request) and imports the uploaded file (in response to a POST
+// request), merging it into the existing data
+func BackupData(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// get the Account for this request
+	acc, accErr := database.GetDesignatedAccount(db)
+	if accErr != nil {
+		http.Error(w, accErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	tr := Translation(r, acc)
+
+	p := &BackupPage{Title: tr.T("Export and Import"),
+		ActiveTab: &ActiveTab{Account: true, ShowTabs: true},
+		Account:   acc,
+		DataSets:  dataSets(tr),
+		Formats:   database.FORMATS}
+
+	if "POST" == r.Method {
+		p.FormError = tr.T(BAD_POST) // in event of problems
+
+		// make sure the hidden account id value matches the Account
+		r.ParseMultipartForm(IMPORT_MAX_SIZE)
+		if r.PostFormValue("account") == strconv.FormatInt(acc.Id, 10) {
+			file, header, fileErr := r.FormFile("file")
+			if fileErr != nil {
+				p.FormError = tr.T("Please choose a file to import")
+			} else {
+				defer file.Close()
+
+				// the format is the file extension, unless chosen
+				format := r.PostFormValue("format")
+				if format == "" {
+					format = strings.ToLower(strings.TrimPrefix(path.Ext(header.Filename), "."))
+				}
+				result, importErr := database.Import(db, acc, r.PostFormValue("data"), format, file)
+				if importErr != nil {
+					p.FormError = tr.T("The file could not be imported: %s", importErr.Error())
+				} else {
+					p.FormError = ""
+					p.FormMessage = tr.T("Imported %s: %d added, %d merged, %d skipped", header.Filename, result.Added, result.Merged, result.Skipped)
+				}
+			}
+		}
+	}
+
+	renderBackupTemplate(w, p, tr)
+}
@@ -0,0 +1,63 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"encoding/json"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/Banrai/PiScan/server/api"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/* JSON response struct */
+type BrandSuggestions struct {
+	Brands []*api.BrandSuggestion `json:"brands"`
+	Error  string                 `json:"err,omitempty"`
+}
+
+/* Ajax Response Functions (as strings via MakeHandler) */
+
+// SuggestBrands responds to the ajax request from the contribution form
+// for the brands matching what has been typed so far (the "q" parameter),
+// according to the API server
+func SuggestBrands(r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) string {
+	// prepare the ajax reply object
+	reply := BrandSuggestions{Brands: make([]*api.BrandSuggestion, 0)}
+
+	// get the api server + port from the optional parameters
+	apiHost, apiHostOk := opts[0].(string)
+	if !apiHostOk {
+		reply.Error = Translation(r, nil).T(BAD_REQUEST)
+	}
+
+	r.ParseForm()
+	query := strings.TrimSpace(r.Form.Get("q"))
+
+	if reply.Error == "" && len(query) > 0 {
+		// ask the API Server for the matching brands
+		v := url.Values{}
+		v.Set("q", query)
+		res, resErr := http.Get(strings.Join([]string{apiHost, "/brands/suggest?", v.Encode()}, ""))
+		if resErr != nil {
+			reply.Error = resErr.Error()
+		} else {
+			defer res.Body.Close()
+			dec := json.NewDecoder(res.Body)
+			if decErr := dec.Decode(&reply.Brands); decErr != nil {
+				reply.Error = decErr.Error()
+			}
+		}
+	}
+
+	// convert the ajax reply object to json
+	replyObj, replyObjErr := json.Marshal(reply)
+	if replyObjErr != nil {
+		return replyObjErr.Error()
+	}
+	return string(replyObj)
+}
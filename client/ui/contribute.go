@@ -6,6 +6,7 @@
 package ui
 
 import (
+	"fmt"
 	"github.com/Banrai/PiScan/client/database"
 	"github.com/Banrai/PiScan/server/digest"
 	"net/http"
@@ -18,6 +19,18 @@ import (
 // barcode scans: a GET presents the form, and a POST responds to the
 // user-contributed input
 func InputUnknownItem(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	contributeItem(w, r, dbCoords, false, opts...)
+}
+
+// CorrectItem handles the form for user corrections to the name and
+// description of known products, in the same way as InputUnknownItem
+func CorrectItem(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	contributeItem(w, r, dbCoords, true, opts...)
+}
+
+// contributeItem presents and processes the contribution form, either
+// for an unknown item, or, if correction is true, for a known one
+func contributeItem(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, correction bool, opts ...interface{}) {
 	// attempt to connect to the db
 	db, err := database.InitializeDB(dbCoords)
 	if err != nil {
@@ -32,18 +45,28 @@ func InputUnknownItem(w http.ResponseWriter, r *http.Request, dbCoords database.
 		http.Error(w, accErr.Error(), http.StatusInternalServerError)
 		return
 	}
+	tr := Translation(r, acc)
 
 	// get the api server + port from the optional parameters
 	apiHost, apiHostOk := opts[0].(string)
 	if !apiHostOk {
-		http.Error(w, BAD_REQUEST, http.StatusInternalServerError)
+		http.Error(w, tr.T(BAD_REQUEST), http.StatusInternalServerError)
 		return
 	}
 
 	// prepare the html page response
-	form := &ItemForm{Title: "Contribute Product Information",
+	form := &ItemForm{Title: tr.T("Contribute Product Information"),
 		CancelUrl:    HOME_URL,
+		Correction:   correction,
 		Unregistered: (acc.Email == database.ANONYMOUS_EMAIL)}
+	if correction {
+		form.Title = tr.T("Correct Product Information")
+	}
+
+	// only unknown items can be contributed, and only known ones corrected
+	itemAllowed := func(item *database.Item) bool {
+		return item.Id != database.BAD_PK && (item.Desc != "") == correction
+	}
 
 	//lookup the item from the request id
 	// and show the input form (if a GET)
@@ -56,9 +79,12 @@ func InputUnknownItem(w http.ResponseWriter, r *http.Request, dbCoords database.
 			if itemIdErr == nil {
 				item, itemErr := database.GetSingleItem(db, acc, itemId)
 				if itemErr == nil {
-					if item.Id != database.BAD_PK && item.Desc == "" {
+					if itemAllowed(item) {
 						// requested item has been found and is valid
 						form.Item = item
+						if correction {
+							form.CancelUrl = fmt.Sprintf("/item/%d", item.Id)
+						}
 					}
 				}
 			}
@@ -66,7 +92,7 @@ func InputUnknownItem(w http.ResponseWriter, r *http.Request, dbCoords database.
 
 		if form.Item == nil {
 			// no matching item was found
-			http.Error(w, BAD_REQUEST, http.StatusInternalServerError)
+			http.Error(w, tr.T(BAD_REQUEST), http.StatusInternalServerError)
 			return
 		}
 
@@ -86,10 +112,16 @@ func InputUnknownItem(w http.ResponseWriter, r *http.Request, dbCoords database.
 					form.FormError = itemErr.Error()
 				} else {
 					// the hidden barcode value must match the retrieved item
-					if item.Barcode == barcodeVal[0] {
+					if item.Barcode == barcodeVal[0] && itemAllowed(item) {
 						// update the item in the local client db
 						item.Desc = prodNameVal[0]
 						item.UserContributed = true
+						if brandNameVal, brandNameValExists := r.PostForm["brandName"]; brandNameValExists && len(brandNameVal[0]) > 0 {
+							item.Brand = brandNameVal[0]
+							if brandUrlVal, brandUrlValExists := r.PostForm["brandUrl"]; brandUrlValExists {
+								item.BrandURL = brandUrlVal[0]
+							}
+						}
 						item.Update(db)
 
 						// also need to mark the contribution to POD in the server
@@ -98,6 +130,12 @@ func InputUnknownItem(w http.ResponseWriter, r *http.Request, dbCoords database.
 							prodDesc, prodDescExists := r.PostForm["prodDesc"]
 							brandName, brandNameExists := r.PostForm["brandName"]
 							brandUrl, brandUrlExists := r.PostForm["brandUrl"]
+							bsin := r.PostForm.Get("bsin")       // chosen from the POD brand suggestions
+							brandId := r.PostForm.Get("brandId") // chosen from the contributed brand suggestions
+
+							// and the book metadata, if any
+							authors, authorsExist := r.PostForm["author"]
+							publisher, publisherExists := r.PostForm["publisher"]
 
 							// ping the server with the contribution data
 							ping := func() {
@@ -105,6 +143,9 @@ func InputUnknownItem(w http.ResponseWriter, r *http.Request, dbCoords database.
 								v.Set("email", acc.Email)
 								v.Set("barcode", barcodeVal[0])
 								v.Set("prodName", prodNameVal[0])
+								if correction {
+									v.Set("correction", "true")
+								}
 								if prodDescExists {
 									v.Set("prodDesc", prodDesc[0])
 								}
@@ -114,12 +155,24 @@ func InputUnknownItem(w http.ResponseWriter, r *http.Request, dbCoords database.
 								if brandUrlExists {
 									v.Set("brandUrl", brandUrl[0])
 								}
+								if bsin != "" {
+									v.Set("bsin", bsin)
+								} else if brandId != "" {
+									v.Set("brandId", brandId)
+								}
+								if authorsExist {
+									for _, author := range authors {
+										if len(strings.TrimSpace(author)) > 0 {
+											v.Add("author", author)
+										}
+									}
+								}
+								if publisherExists {
+									v.Set("publisher", publisher[0])
+								}
 
-								// use the account api code as the digest key
-								hmac := digest.GenerateDigest(acc.APICode, v.Encode())
-								v.Set("hmac", hmac)
-
-								res, err := http.PostForm(strings.Join([]string{apiHost, "/contribute/"}, ""), v)
+								// sign the request with the account api code
+								res, err := digest.NewSigner(acc.APICode).PostForm(strings.Join([]string{apiHost, "/contribute/"}, ""), v)
 								if err == nil {
 									res.Body.Close()
 								}
@@ -134,15 +187,15 @@ func InputUnknownItem(w http.ResponseWriter, r *http.Request, dbCoords database.
 						return
 					} else {
 						// bad form post: the hidden barcode value does not match the retrieved item
-						form.FormError = BAD_POST
+						form.FormError = tr.T(BAD_POST)
 					}
 				}
 			}
 		} else {
 			// required form parameters are missing
-			form.FormError = BAD_POST
+			form.FormError = tr.T(BAD_POST)
 		}
 	}
 
-	renderItemEditTemplate(w, form)
+	renderItemEditTemplate(w, form, tr)
 }
@@ -6,7 +6,9 @@
 package ui
 
 import (
+	"encoding/json"
 	"github.com/Banrai/PiScan/client/database"
+	"github.com/Banrai/PiScan/server/api"
 	"github.com/Banrai/PiScan/server/digest"
 	"net/http"
 	"net/url"
@@ -14,8 +16,22 @@ import (
 	"strings"
 )
 
+// emailedItem converts the Item to what the server needs for the email,
+// in the quantity chosen on the form (one, by default)
+func emailedItem(item *database.Item, quantity string) *api.EmailedItem {
+	e := &api.EmailedItem{Desc: item.Desc, Barcode: item.Barcode, Brand: item.Brand, Quantity: 1}
+	if qty, qtyErr := strconv.Atoi(quantity); qtyErr == nil && qty > 0 {
+		e.Quantity = qty
+	}
+	for _, vp := range item.ForSale {
+		e.Vendors = append(e.Vendors, &api.EmailedVendorProduct{Vendor: vp.Vendor.VendorId, VendorName: vp.Vendor.DisplayName, SKU: vp.ProductCode, Price: vp.DisplayPrice()})
+	}
+	return e
+}
+
 // EmailItems handles the client form post, to send a list of the selected
-// items via email to the given user
+// items via email to the given user, optionally with csv and/or pdf
+// attachments (the comma-separated "attach" parameter)
 func EmailItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
 	// attempt to connect to the db
 	db, err := database.InitializeDB(dbCoords)
@@ -28,7 +44,7 @@ func EmailItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCo
 	// get the api server + port from the optional parameters
 	apiHost, apiHostOk := opts[0].(string)
 	if !apiHostOk {
-		http.Error(w, BAD_REQUEST, http.StatusInternalServerError)
+		http.Error(w, Translation(r, nil).T(BAD_REQUEST), http.StatusInternalServerError)
 		return
 	}
 
@@ -38,6 +54,7 @@ func EmailItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCo
 		http.Error(w, accErr.Error(), http.StatusInternalServerError)
 		return
 	}
+	tr := Translation(r, acc)
 
 	// get the account from the POST values
 	if "POST" == r.Method {
@@ -56,7 +73,7 @@ func EmailItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCo
 					return
 				} else {
 					if acc.Id != id {
-						http.Error(w, BAD_REQUEST, http.StatusInternalServerError)
+						http.Error(w, tr.T(BAD_REQUEST), http.StatusInternalServerError)
 						return
 					} else {
 						// proceed with the send only if registered
@@ -70,21 +87,29 @@ func EmailItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCo
 									v := url.Values{}
 									v.Set("email", acc.Email)
 
-									// attach the list of descriptions for the selected items
+									// attach the details of the selected items
+									selected := make([]*api.EmailedItem, 0)
 									for _, accItem := range accountItems {
 										for _, item := range items {
 											if strconv.FormatInt(accItem.Id, 10) == item {
-												v.Add("item", accItem.Desc)
+												selected = append(selected, emailedItem(accItem, r.PostForm.Get("qty"+item)))
 												break
 											}
 										}
 									}
+									list, listErr := json.Marshal(selected)
+									if listErr != nil {
+										return
+									}
+									v.Set("items", string(list))
+									for _, attach := range strings.Split(r.Form.Get("attach"), ",") {
+										if attach == api.ATTACH_CSV || attach == api.ATTACH_PDF {
+											v.Add("attach", attach)
+										}
+									}
 
-									// use the account api code as the digest key
-									hmac := digest.GenerateDigest(acc.APICode, v.Encode())
-									v.Set("hmac", hmac)
-
-									res, err := http.PostForm(strings.Join([]string{apiHost, "/email/"}, ""), v)
+									// sign the request with the account api code
+									res, err := digest.NewSigner(acc.APICode).PostForm(strings.Join([]string{apiHost, "/email/"}, ""), v)
 									if err == nil {
 										res.Body.Close()
 									}
@@ -96,15 +121,15 @@ func EmailItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCo
 					}
 				}
 			} else {
-				http.Error(w, "Missing account id", http.StatusInternalServerError)
+				http.Error(w, tr.T("Missing account id"), http.StatusInternalServerError)
 				return
 			}
 		} else {
-			http.Error(w, BAD_POST, http.StatusInternalServerError)
+			http.Error(w, tr.T(BAD_POST), http.StatusInternalServerError)
 			return
 		}
 	} else {
-		http.Error(w, BAD_REQUEST, http.StatusInternalServerError)
+		http.Error(w, tr.T(BAD_REQUEST), http.StatusInternalServerError)
 		return
 	}
 
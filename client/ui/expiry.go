@@ -0,0 +1,201 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"github.com/Banrai/PiScan/client/database"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// How many days ahead the expiring list looks, by default, and the
+	// units which count as expiring soon (anywhere in the WebApp)
+	EXPIRY_DAYS = 7
+	SOON_DAYS   = 2
+
+	// Unit form actions
+	UNIT_ADD     = "add"
+	UNIT_EXPIRES = "expires"
+	UNIT_USE     = "use"
+
+	EXPIRING_URL = "/expiring/"
+)
+
+var (
+	EXPIRING_TEMPLATE_FILES = []string{"expiring.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	EXPIRING_TEMPLATES      *template.Template
+
+	// the choice of how many days ahead to look
+	EXPIRY_DAY_OPTIONS = []int{3, 7, 14, 30}
+)
+
+// UnitRow is a Unit in stock, with how soon it expires
+type UnitRow struct {
+	*database.Unit
+	Label  string
+	Status string // the bootstrap label class: danger (expired), warning (soon), or default
+}
+
+type ExpiringPage struct {
+	Title      string
+	ActiveTab  *ActiveTab
+	Account    *database.Account
+	Units      []*UnitRow
+	Days       int
+	DayOptions []int
+}
+
+// unitRows describes how soon each of the Units expires
+func unitRows(units []*database.Unit, tr *Catalogue) []*UnitRow {
+	rows := make([]*UnitRow, 0)
+	for _, u := range units {
+		row := &UnitRow{Unit: u, Status: "default"}
+		days := u.DaysLeft()
+		switch {
+		case u.Expires.IsZero():
+			row.Label = tr.T("No expiry date")
+		case days < 0:
+			row.Label = tr.N(-days, "Expired %d day ago", "Expired %d days ago")
+			row.Status = "danger"
+		case days == 0:
+			row.Label = tr.T("Expires today")
+			row.Status = "warning"
+		default:
+			row.Label = tr.N(days, "Expires in %d day", "Expires in %d days")
+			if days <= SOON_DAYS {
+				row.Status = "warning"
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// localTarget returns the url to go back to after a form post, as long as
+// it is a path within the WebApp, or else the fallback
+func localTarget(target, fallback string) string {
+	if strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") {
+		return target
+	}
+	return fallback
+}
+
+/* HTML Response Functions (via templates) */
+
+func renderExpiringTemplate(w http.ResponseWriter, p *ExpiringPage, tr *Catalogue) {
+	if TEMPLATES_INITIALIZED {
+		executeTemplate(w, EXPIRING_TEMPLATES, tr, p)
+	}
+}
+
+// ExpiringItems lists the units in stock which expire within the number
+// of days in the request (EXPIRY_DAYS by default), including those which
+// have already expired, soonest first
+func ExpiringItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// get the Account for this request
+	acc, accErr := database.GetDesignatedAccount(db)
+	if accErr != nil {
+		http.Error(w, accErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	tr := Translation(r, acc)
+
+	r.ParseForm()
+	days, daysErr := strconv.Atoi(r.Form.Get("days"))
+	if daysErr != nil || days < 0 {
+		days = EXPIRY_DAYS
+	}
+
+	p := &ExpiringPage{Title: tr.T("Expiring Soon"),
+		ActiveTab:  &ActiveTab{Expiring: true, ShowTabs: true},
+		Account:    acc,
+		Units:      unitRows(database.GetExpiringUnits(db, acc, days), tr),
+		Days:       days,
+		DayOptions: EXPIRY_DAY_OPTIONS}
+
+	renderExpiringTemplate(w, p, tr)
+}
+
+// UpdateUnits handles the unit form posts: adding a unit of an item,
+// changing the expiry date of a unit, or marking it as used up, and then
+// returns to the page which made the post
+func UpdateUnits(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// get the Account for this request
+	acc, accErr := database.GetDesignatedAccount(db)
+	if accErr != nil {
+		http.Error(w, accErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	tr := Translation(r, acc)
+
+	if "POST" != r.Method {
+		http.Error(w, tr.T(BAD_REQUEST), http.StatusInternalServerError)
+		return
+	}
+	r.ParseForm()
+
+	// make sure the hidden account id value matches the Account
+	if r.PostForm.Get("account") != strconv.FormatInt(acc.Id, 10) {
+		http.Error(w, tr.T(BAD_REQUEST), http.StatusInternalServerError)
+		return
+	}
+
+	expires := parseDate(r.PostForm.Get("expires"))
+	switch r.PostForm.Get("action") {
+	case UNIT_ADD:
+		id, idErr := strconv.ParseInt(r.PostForm.Get("item"), 10, 64)
+		if idErr != nil {
+			http.Error(w, tr.T(BAD_POST), http.StatusInternalServerError)
+			return
+		}
+		item, itemErr := database.GetSingleItem(db, acc, id)
+		if itemErr != nil || item.Id != id {
+			http.Error(w, tr.T("No such item"), http.StatusInternalServerError)
+			return
+		}
+		if expires.IsZero() {
+			expires = database.DefaultExpiry(db, item.Category)
+		}
+		database.AddUnit(db, acc, item.Id, expires)
+	case UNIT_EXPIRES, UNIT_USE:
+		id, idErr := strconv.ParseInt(r.PostForm.Get("unit"), 10, 64)
+		if idErr != nil {
+			http.Error(w, tr.T(BAD_POST), http.StatusInternalServerError)
+			return
+		}
+		// (the updates apply only to the units of this Account)
+		unit := &database.Unit{Id: id}
+		if r.PostForm.Get("action") == UNIT_USE {
+			unit.Use(db, acc)
+		} else {
+			unit.SetExpiry(db, acc, expires)
+		}
+	default:
+		http.Error(w, tr.T(BAD_POST), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, localTarget(r.PostForm.Get("return"), EXPIRING_URL), http.StatusFound)
+}
@@ -0,0 +1,183 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"github.com/Banrai/PiScan/client/database"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How many scans to show on each page of the history, and on the
+	// timeline of a single item
+	SCANS_PER_PAGE = 100
+	ITEM_TIMELINE  = 10
+
+	// the format of the history date range params (as in <input type="date">)
+	DATE_PARAM = "2006-01-02"
+
+	HISTORY_URL = "/history/"
+)
+
+var (
+	HISTORY_TEMPLATE_FILES = []string{"history.html", "head.html", "navigation_tabs.html", "pager.html", "modal.html", "scripts.html"}
+	HISTORY_TEMPLATES      *template.Template
+
+	// the history parameters which page links preserve
+	HISTORY_PARAMS = []string{"from", "to", "barcode", "page"}
+
+	// the label for each ScanEvent outcome
+	OUTCOME_LABELS = map[string]string{
+		database.SCAN_FOUND:   "Found",
+		database.SCAN_UNKNOWN: "Not found",
+		database.SCAN_ERROR:   "Lookup failed"}
+)
+
+// HistoryDay is the list of scans on a single (local) date
+type HistoryDay struct {
+	Date   time.Time
+	Events []*database.ScanEvent
+}
+
+type HistoryPage struct {
+	Title     string
+	ActiveTab *ActiveTab
+	Days      []*HistoryDay
+	From      string
+	To        string
+	Barcode   string
+	Summary   string // how many scans there are in all
+	Total     int64
+	Page      int64
+	Pages     int64
+	params    url.Values // the request parameters, for the page links
+}
+
+// Filtered is true if the page shows only some of the scans
+func (p *HistoryPage) Filtered() bool {
+	return p.From != "" || p.To != "" || p.Barcode != ""
+}
+
+// Link returns the url for this page with the key parameter changed to
+// the value (or removed, if the value is empty)
+func (p *HistoryPage) Link(key, value string) string {
+	return listLink(p.params, HISTORY_PARAMS, key, value)
+}
+
+// PageLink returns the url for the page of scans n pages away from this
+// one, or the empty string if there is no such page
+func (p *HistoryPage) PageLink(n int64) string {
+	target := p.Page + n
+	if target < 1 || target > p.Pages {
+		return ""
+	}
+	return p.Link("page", strconv.FormatInt(target, 10))
+}
+
+// Outcome returns the (untranslated) label for the ScanEvent lookup result
+func (p *HistoryPage) Outcome(e *database.ScanEvent) string {
+	if label, exists := OUTCOME_LABELS[e.Outcome]; exists {
+		return label
+	}
+	return e.Outcome
+}
+
+// parseDate reads the date param as the start of that day, in local time,
+// or returns the zero time (i.e., no limit) if it is missing or invalid
+func parseDate(value string) time.Time {
+	date, err := time.ParseInLocation(DATE_PARAM, strings.TrimSpace(value), time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return date
+}
+
+// groupByDay partitions the (time ordered) list of scans by local date
+func groupByDay(events []*database.ScanEvent) []*HistoryDay {
+	days := make([]*HistoryDay, 0)
+	var current *HistoryDay
+	for _, e := range events {
+		y, m, d := e.Scanned.Local().Date()
+		date := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+		if current == nil || !current.Date.Equal(date) {
+			current = &HistoryDay{Date: date}
+			days = append(days, current)
+		}
+		current.Events = append(current.Events, e)
+	}
+	return days
+}
+
+/* HTML Response Functions (via templates) */
+
+func renderHistoryTemplate(w http.ResponseWriter, p *HistoryPage, tr *Catalogue) {
+	if TEMPLATES_INITIALIZED {
+		executeTemplate(w, HISTORY_TEMPLATES, tr, p)
+	}
+}
+
+// ScanHistory lists every barcode scan, most recent first, between the
+// (optional) from and to dates, or just the timeline of a single barcode
+func ScanHistory(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// get the Account for this request
+	acc, accErr := database.GetDesignatedAccount(db)
+	if accErr != nil {
+		http.Error(w, accErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	tr := Translation(r, acc)
+
+	// check for any date range (the to date is inclusive) or barcode
+	r.ParseForm()
+	query := &database.HistoryQuery{From: parseDate(r.Form.Get("from")),
+		Barcode: strings.TrimSpace(r.Form.Get("barcode")),
+		Limit:   SCANS_PER_PAGE}
+	if to := parseDate(r.Form.Get("to")); !to.IsZero() {
+		query.To = to.AddDate(0, 0, 1)
+	}
+	page := pageNumber(r.Form)
+	query.Offset = (page - 1) * SCANS_PER_PAGE
+
+	events, total, eventsErr := database.GetScanHistory(db, acc, query)
+	if eventsErr != nil {
+		http.Error(w, eventsErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	p := &HistoryPage{Title: tr.T("Scan History"),
+		ActiveTab: &ActiveTab{History: true, ShowTabs: true},
+		Days:      groupByDay(events),
+		Barcode:   query.Barcode,
+		Summary:   tr.N(total, "%d scan", "%d scans"),
+		Total:     total,
+		Page:      page,
+		Pages:     (total + SCANS_PER_PAGE - 1) / SCANS_PER_PAGE,
+		params:    r.Form}
+	if !query.From.IsZero() {
+		p.From = query.From.Format(DATE_PARAM)
+	}
+	if !query.To.IsZero() {
+		p.To = query.To.AddDate(0, 0, -1).Format(DATE_PARAM)
+	}
+	if query.Barcode != "" {
+		p.Title = tr.T("Scan history for %s", query.Barcode)
+	}
+
+	renderHistoryTemplate(w, p, tr)
+}
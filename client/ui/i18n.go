@@ -0,0 +1,272 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Banrai/PiScan/client/database"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The language of the messages in the code and templates, which
+	// needs no catalogue file
+	DEFAULT_LANGUAGE = "en"
+
+	// Catalogue files are named for their language, e.g. "de.json"
+	CATALOGUE_EXTENSION = ".json"
+)
+
+var (
+	// LANGUAGES lists the languages the WebApp can be shown in, with
+	// their names (in that language) for the account form
+	LANGUAGES = []*Language{
+		&Language{Code: "en", Name: "English"},
+		&Language{Code: "de", Name: "Deutsch"},
+		&Language{Code: "es", Name: "Español"}}
+
+	// PLURAL_RULES map each language to the function which chooses the
+	// plural form (an index into the translations) for a count n
+	PLURAL_RULES = map[string]func(n int64) int{
+		"en": pluralOneOther,
+		"de": pluralOneOther,
+		"es": pluralOneOther}
+
+	// the "[n] [interval] ago" messages for each database.TimeSince interval
+	SINCE_MESSAGES = map[string][]string{
+		"second": []string{"%d second ago", "%d seconds ago"},
+		"minute": []string{"%d minute ago", "%d minutes ago"},
+		"hour":   []string{"%d hour ago", "%d hours ago"},
+		"day":    []string{"%d day ago", "%d days ago"},
+		"month":  []string{"%d month ago", "%d months ago"},
+		"year":   []string{"%d year ago", "%d years ago"}}
+
+	// the catalogues by language code (see InitializeCatalogues)
+	CATALOGUES = map[string]*Catalogue{DEFAULT_LANGUAGE: NewCatalogue(DEFAULT_LANGUAGE, nil)}
+)
+
+// pluralOneOther is the rule for languages with a singular form for one,
+// and a plural form for everything else (including zero)
+func pluralOneOther(n int64) int {
+	if n == 1 {
+		return 0
+	}
+	return 1
+}
+
+type Language struct {
+	Code string
+	Name string
+}
+
+// Catalogue holds the translations of the WebApp messages for a single
+// language, keyed by the original (english) message. Each translation
+// has one form, or, for messages which depend on a count, one form per
+// plural category of the language (in the order of its PLURAL_RULES)
+type Catalogue struct {
+	Language string
+	messages map[string][]string
+	plural   func(n int64) int
+}
+
+// NewCatalogue creates the Catalogue for the language from the messages
+// (for the DEFAULT_LANGUAGE, the messages can be nil)
+func NewCatalogue(language string, messages map[string][]string) *Catalogue {
+	if messages == nil {
+		messages = make(map[string][]string)
+	}
+	rule, ruleExists := PLURAL_RULES[language]
+	if !ruleExists {
+		rule = pluralOneOther
+	}
+	return &Catalogue{Language: language, messages: messages, plural: rule}
+}
+
+// ParseCatalogue reads the catalogue file contents, a json object whose
+// values are either a single translation or a list of plural forms, e.g.
+// {"Delete": "Löschen", "%d day ago": ["vor %d Tag", "vor %d Tagen"]}
+func ParseCatalogue(language string, data []byte) (*Catalogue, error) {
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("Invalid %s catalogue: %s", language, err)
+	}
+
+	messages := make(map[string][]string)
+	for message, translation := range raw {
+		switch t := translation.(type) {
+		case string:
+			messages[message] = []string{t}
+		case []interface{}:
+			forms := make([]string, 0)
+			for _, form := range t {
+				s, ok := form.(string)
+				if !ok {
+					return nil, fmt.Errorf("Invalid %s translation for '%s'", language, message)
+				}
+				forms = append(forms, s)
+			}
+			messages[message] = forms
+		default:
+			return nil, fmt.Errorf("Invalid %s translation for '%s'", language, message)
+		}
+	}
+	return NewCatalogue(language, messages), nil
+}
+
+// InitializeCatalogues loads the catalogue file for each of the LANGUAGES
+// (other than the DEFAULT_LANGUAGE) from the given folder
+func InitializeCatalogues(folder string) error {
+	for _, lang := range LANGUAGES {
+		if lang.Code == DEFAULT_LANGUAGE {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(folder, lang.Code+CATALOGUE_EXTENSION))
+		if err != nil {
+			return err
+		}
+		c, cErr := ParseCatalogue(lang.Code, data)
+		if cErr != nil {
+			return cErr
+		}
+		CATALOGUES[lang.Code] = c
+	}
+	return nil
+}
+
+// T returns the translation of the message, formatted with the args (if
+// any), or the original message if it has not been translated
+func (c *Catalogue) T(message string, args ...interface{}) string {
+	if forms, exists := c.messages[message]; exists && len(forms) > 0 && forms[0] != "" {
+		message = forms[0]
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(message, args...)
+	}
+	return message
+}
+
+// N returns the translation of the singular or plural message, as the
+// count n requires in this language, with n in place of any %d
+func (c *Catalogue) N(n int64, singular, plural string) string {
+	message := plural
+	if n == 1 {
+		message = singular
+	}
+	if forms, exists := c.messages[singular]; exists {
+		if i := c.plural(n); i < len(forms) && forms[i] != "" {
+			message = forms[i]
+		}
+	}
+	if strings.Contains(message, "%d") {
+		return fmt.Sprintf(message, n)
+	}
+	return message
+}
+
+// Since returns how long ago the posted time was, e.g. "3 days ago"
+func (c *Catalogue) Since(posted time.Time) string {
+	if posted.IsZero() {
+		return c.T("just now")
+	}
+	n, interval := database.TimeSince(posted)
+	return c.N(n, SINCE_MESSAGES[interval][0], SINCE_MESSAGES[interval][1])
+}
+
+// FuncMap defines the template functions which translate the page
+func (c *Catalogue) FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"T":     c.T,
+		"N":     func(n int, singular, plural string) string { return c.N(int64(n), singular, plural) },
+		"Since": c.Since,
+		"Lang":  func() string { return c.Language }}
+}
+
+// acceptedLanguage is a single Accept-Language header preference
+type acceptedLanguage struct {
+	code    string
+	quality float64
+}
+
+type byQuality []*acceptedLanguage
+
+func (a byQuality) Len() int           { return len(a) }
+func (a byQuality) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byQuality) Less(i, j int) bool { return a[i].quality > a[j].quality }
+
+// acceptedLanguages returns the primary language codes from the
+// Accept-Language header (e.g. "de-AT,de;q=0.9,en;q=0.5"), most
+// preferred first
+func acceptedLanguages(header string) []string {
+	accepted := make([]*acceptedLanguage, 0)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		a := &acceptedLanguage{code: strings.SplitN(tag, "-", 2)[0], quality: 1.0}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, qErr := strconv.ParseFloat(param[2:], 64); qErr == nil {
+					a.quality = q
+				}
+			}
+		}
+		if a.quality > 0 {
+			accepted = append(accepted, a)
+		}
+	}
+	sort.Stable(byQuality(accepted))
+
+	codes := make([]string, 0)
+	for _, a := range accepted {
+		codes = append(codes, a.code)
+	}
+	return codes
+}
+
+// Translation returns the Catalogue for the request: the language chosen
+// for the Account (if any), or else the browser's preferred language from
+// the Accept-Language header, if the WebApp has been translated into it
+func Translation(r *http.Request, acc *database.Account) *Catalogue {
+	if acc != nil && acc.Language != "" {
+		if c, exists := CATALOGUES[acc.Language]; exists {
+			return c
+		}
+	}
+	for _, code := range acceptedLanguages(r.Header.Get("Accept-Language")) {
+		if c, exists := CATALOGUES[code]; exists {
+			return c
+		}
+	}
+	return CATALOGUES[DEFAULT_LANGUAGE]
+}
+
+// executeTemplate renders the page with the template functions for the
+// Catalogue language (the templates are parsed once, and never executed
+// directly, so that every request can clone them); an error while
+// executing is logged, since part of the page may have been sent already
+func executeTemplate(w http.ResponseWriter, t *template.Template, c *Catalogue, data interface{}) {
+	page, err := t.Clone()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Language", c.Language)
+	if err = page.Funcs(c.FuncMap()).Execute(w, data); err != nil {
+		log.Println(fmt.Sprintf("Template %s: %s", t.Name(), err))
+	}
+}
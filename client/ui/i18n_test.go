@@ -0,0 +1,93 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"github.com/Banrai/PiScan/client/database"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAcceptedLanguages(t *testing.T) {
+	tests := map[string][]string{
+		"":                                    []string{},
+		"de":                                  []string{"de"},
+		"de-AT,de;q=0.9,en;q=0.5":             []string{"de", "de", "en"},
+		"en;q=0.5, ES-mx ; q=0.8":             []string{"es", "en"},
+		"fr;q=0.7,de;q=0.7,es":                []string{"es", "fr", "de"},
+		"*, en;q=0, de;q=bad":                 []string{"de"},
+		"en-US,en;q=0.9,*;q=0.8,de-DE;q=0.95": []string{"en", "de", "en"},
+	}
+	for header, expected := range tests {
+		if codes := acceptedLanguages(header); !reflect.DeepEqual(codes, expected) {
+			t.Errorf("%q = %q, expected %q", header, codes, expected)
+		}
+	}
+}
+
+func TestParseCatalogue(t *testing.T) {
+	c, err := ParseCatalogue("de", []byte(`{"Delete": "Löschen", "%d day ago": ["vor %d Tag", "vor %d Tagen"], "Save": ""}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Language != "de" || c.T("Delete") != "Löschen" || c.T("Cancel") != "Cancel" || c.T("Save") != "Save" {
+		t.Errorf("catalogue = %+v", c)
+	}
+	if s := c.T("%s from %s", "Milk", "Oatly"); s != "Milk from Oatly" {
+		t.Errorf("untranslated with args = %q", s)
+	}
+
+	for _, data := range []string{`["Delete"]`, `{"Delete": 1}`, `{"%d day ago": ["vor %d Tag", 2]}`, `{`} {
+		if _, err = ParseCatalogue("de", []byte(data)); err == nil {
+			t.Errorf("%s was accepted", data)
+		}
+	}
+}
+
+func TestCatalogueN(t *testing.T) {
+	c, err := ParseCatalogue("de", []byte(`{"%d day ago": ["vor %d Tag", "vor %d Tagen"], "one item": ["ein Artikel", ""]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		n                int64
+		singular, plural string
+		expected         string
+	}{
+		{1, "%d day ago", "%d days ago", "vor 1 Tag"},
+		{0, "%d day ago", "%d days ago", "vor 0 Tagen"},
+		{3, "%d day ago", "%d days ago", "vor 3 Tagen"},
+		{1, "one item", "many items", "ein Artikel"},
+		// an empty plural form falls back to the original message
+		{2, "one item", "many items", "many items"},
+		{1, "%d scan", "%d scans", "1 scan"},
+		{5, "%d scan", "%d scans", "5 scans"},
+	}
+	for _, test := range tests {
+		if s := c.N(test.n, test.singular, test.plural); s != test.expected {
+			t.Errorf("N(%d, %q) = %q, expected %q", test.n, test.singular, s, test.expected)
+		}
+	}
+}
+
+func TestInitializeCatalogues(t *testing.T) {
+	if err := InitializeCatalogues("locales"); err != nil {
+		t.Fatal(err)
+	}
+	for _, lang := range LANGUAGES {
+		if _, exists := CATALOGUES[lang.Code]; !exists {
+			t.Errorf("no %s catalogue", lang.Code)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Language", "fr-CH,fr;q=0.9,de;q=0.8")
+	if c := Translation(r, nil); c.Language != "de" {
+		t.Errorf("Translation = %s, expected de", c.Language)
+	}
+	if c := Translation(r, &database.Account{Language: "es"}); c.Language != "es" {
+		t.Errorf("account Translation = %s, expected es", c.Language)
+	}
+}
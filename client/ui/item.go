@@ -0,0 +1,94 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"github.com/Banrai/PiScan/client/database"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	ITEM_VIEW_TEMPLATE_FILES = []string{"item.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	ITEM_VIEW_TEMPLATES      *template.Template
+)
+
+type ItemPage struct {
+	Title      string
+	ActiveTab  *ActiveTab
+	Account    *database.Account
+	Item       *database.Item
+	Units      []*UnitRow            // the units in stock
+	Scans      []*database.ScanEvent // the most recent scans of the barcode
+	ScanCount  string
+	HistoryUrl string
+	CancelUrl  string
+}
+
+/* HTML Response Functions (via templates) */
+
+func renderItemViewTemplate(w http.ResponseWriter, p *ItemPage, tr *Catalogue) {
+	if TEMPLATES_INITIALIZED {
+		executeTemplate(w, ITEM_VIEW_TEMPLATES, tr, p)
+	}
+}
+
+// ShowItem presents all the known product details (brand, ingredients,
+// allergens, nutrition, etc.) for the single Item in the url path
+func ShowItem(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// get the Account for this request
+	acc, accErr := database.GetDesignatedAccount(db)
+	if accErr != nil {
+		http.Error(w, accErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	tr := Translation(r, acc)
+
+	// derive the item id from the url path
+	var item *database.Item
+	urlPaths := strings.Split(r.URL.Path[1:], "/")
+	if len(urlPaths) >= 2 {
+		itemId, itemIdErr := strconv.ParseInt(urlPaths[1], 10, 64)
+		if itemIdErr == nil {
+			found, foundErr := database.GetSingleItem(db, acc, itemId)
+			if foundErr == nil && found.Id != database.BAD_PK {
+				item = found
+			}
+		}
+	}
+
+	if item == nil {
+		// no matching item was found
+		http.Error(w, tr.T(BAD_REQUEST), http.StatusInternalServerError)
+		return
+	}
+
+	// and the timeline of its scans
+	scans, scanTotal, _ := database.GetScanHistory(db, acc, &database.HistoryQuery{Barcode: item.Barcode, Limit: ITEM_TIMELINE})
+
+	p := &ItemPage{Title: item.Desc,
+		ActiveTab:  &ActiveTab{ShowTabs: true},
+		Account:    acc,
+		Item:       item,
+		Units:      unitRows(database.GetUnits(db, acc, item.Id), tr),
+		Scans:      scans,
+		ScanCount:  tr.N(scanTotal, "Scanned %d time", "Scanned %d times"),
+		HistoryUrl: HISTORY_URL + "?" + url.Values{"barcode": {item.Barcode}}.Encode(),
+		CancelUrl:  HOME_URL}
+
+	renderItemViewTemplate(w, p, tr)
+}
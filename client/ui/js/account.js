@@ -8,6 +8,28 @@ $(function(){
         $(this).toggle();
     });
     $("#accountEmail").focus();
+
+    // the account actions name themselves, and the destructive ones must
+    // be confirmed first
+    $('#accountActions button[data-action]').click(function(event){
+	event.preventDefault();
+	var form = $('#accountActions'),
+	    question = $(this).data('confirm');
+	$('#accountAction').val($(this).data('action'));
+	if( question ) {
+	    showConfirmModal(msg('Account'), $(this).text(), question, '#', msg('Yes'), msg('Cancel'));
+	    $('#modalContinue').off('click').one('click', function(e){
+		e.preventDefault();
+		form.submit();
+	    });
+	    $('#modalWindow').one('hidden.bs.modal', function(){
+		$('#modalContinue').off('click');
+	    });
+	} else {
+	    form.submit();
+	}
+    });
+
     if( ACC_REG ) {
 	checkAccountStatus( $('input[type=hidden]#account').val() );
     }		
@@ -0,0 +1,90 @@
+function escapeHtml (s) {
+    return $('<div/>').text(s).html();
+}
+
+function percent (part, whole) {
+    if( !whole ) {
+	return "0%";
+    }
+    return Math.round(100 * part / whole) + "%";
+}
+
+// columnChart draws the list of {period, scans} as svg columns, with the
+// first and last periods as the axis labels
+function columnChart (el, series) {
+    if( !series || series.length === 0 ) {
+	$(el).html('<p class="timestamp">' + escapeHtml(msg("No scans in this period")) + '</p>');
+	return;
+    }
+    var width = 600, height = 150, top = 10, bottom = 20,
+	max = 1, gap = series.length > 60 ? 0 : 2,
+	step = width / series.length,
+	svg = [];
+    $.each(series, function(i, p) { max = Math.max(max, p["scans"]); });
+    $.each(series, function(i, p) {
+	var h = (height - top - bottom) * p["scans"] / max;
+	svg.push('<rect x="' + (i * step + gap / 2) + '" y="' + (height - bottom - h) + '" width="' + Math.max(step - gap, 1) + '" height="' + h + '"><title>' + escapeHtml(p["period"] + ": " + p["scans"]) + '</title></rect>');
+    });
+    svg.push('<line x1="0" y1="' + (height - bottom) + '" x2="' + width + '" y2="' + (height - bottom) + '" />');
+    svg.push('<text x="0" y="' + height + '">' + escapeHtml(series[0]["period"]) + '</text>');
+    svg.push('<text x="' + width + '" y="' + height + '" text-anchor="end">' + escapeHtml(series[series.length - 1]["period"]) + '</text>');
+    svg.push('<text x="0" y="' + top + '">' + max + '</text>');
+    $(el).html('<svg viewBox="0 0 ' + width + ' ' + height + '">' + svg.join("") + '</svg>');
+}
+
+// barList shows the list of {label, link, value, display} as horizontal
+// bars, relative to the largest value
+function barList (el, rows) {
+    if( !rows || rows.length === 0 ) {
+	$(el).html('<p class="timestamp">' + escapeHtml(msg("No scans in this period")) + '</p>');
+	return;
+    }
+    var max = 1, html = [];
+    $.each(rows, function(i, r) { max = Math.max(max, r["value"]); });
+    $.each(rows, function(i, r) {
+	var label = escapeHtml(r["label"]);
+	if( r["link"] ) {
+	    label = '<a href="' + escapeHtml(r["link"]) + '">' + label + '</a>';
+	}
+	html.push('<div class="analytics-row"><div class="analytics-label">' + label + ' <span class="badge">' + escapeHtml(r["display"]) + '</span></div>' +
+		  '<div class="progress"><div class="progress-bar" style="width:' + (100 * r["value"] / max) + '%"></div></div></div>');
+    });
+    $(el).html(html.join(""));
+}
+
+function showAnalytics (a) {
+    $('#totalScans').text(a["scans"]);
+    $('#unknownRate').text(percent(a["unknownRate"], 1));
+    $('#favoriteRate').text(percent(a["favorites"]["favoriteScans"], a["favorites"]["scans"]));
+    $('#lookupErrors').text(a["errors"]);
+
+    columnChart('#perDay', a["perDay"]);
+    columnChart('#perWeek', a["perWeek"]);
+
+    barList('#topBarcodes', $.map(a["topBarcodes"], function(b) {
+	return { label: (b["desc"] || msg("NOT FOUND")) + " (" + b["barcode"] + ")",
+		 link: b["product"] > 0 ? "/item/" + b["product"] : "/history/?barcode=" + encodeURIComponent(b["barcode"]),
+		 value: b["scans"], display: b["scans"] };
+    }));
+    barList('#categories', $.map(a["categories"], function(c) {
+	return { label: c["category"] || msg("Uncategorized"), value: c["scans"], display: c["scans"] };
+    }));
+    barList('#spend', $.map(a["spend"], function(s) {
+	return { label: s["name"], value: s["amount"], display: s["display"] };
+    }));
+}
+
+$(function(){
+    $('a.shutdown').click(confirmShutdown);
+    $.ajax({type: "GET",
+	    url: $('#analytics').data('url'),
+	    dataType: "json",
+	    success: function (d) {
+		if( d["err"] || !d["analytics"] ) {
+		    $('#analyticsError').show().find('span').text(d["err"] || msg("Error"));
+		} else {
+		    showAnalytics(d["analytics"]);
+		}
+	    }
+	   });
+});
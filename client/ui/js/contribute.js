@@ -1,4 +1,40 @@
 $(function(){
     $("#prodName").focus();
-});
 
+    // suggest existing brands as the brand name is typed, so that the
+    // contribution refers to a known brand whenever possible
+    var suggestions = {}, pending = null;
+
+    function chooseBrand () {
+	var brand = suggestions[$("#brandName").val()];
+	$("#bsin").val(brand && brand.bsin ? brand.bsin : "");
+	$("#brandId").val(brand && brand.id ? brand.id : "");
+	if (brand && brand.url && !$("#brandUrl").val()) {
+	    $("#brandUrl").val(brand.url);
+	}
+    }
+
+    $("#brandName").on("input", function () {
+	var q = $.trim($(this).val());
+	chooseBrand();
+	if (pending) {
+	    clearTimeout(pending);
+	}
+	if (q.length < 2) {
+	    return;
+	}
+	pending = setTimeout(function () {
+	    $.getJSON("/brands/", {q: q}, function (data) {
+		var list = $("#brandSuggestions").empty();
+		suggestions = {};
+		$.each(data.brands || [], function (i, brand) {
+		    suggestions[brand.brand] = brand;
+		    list.append($("<option>").attr("value", brand.brand));
+		});
+		chooseBrand();
+	    });
+	}, 250);
+    });
+
+    $("#brandName").on("change", chooseBrand);
+});
@@ -5,6 +5,10 @@ function anyItemChecked () {
 }
 
 function toggleActions () {
+    // only the selected items need a quantity
+    $(".chk_item").each(function() {
+	$(this).siblings(".qty").toggle($(this).is(":checked"));
+    });
     if( anyItemChecked() ) {
 	$("#id_actions").show();
     } else {
@@ -25,28 +29,62 @@ function buyAmzUS (targetClass) {
 	    var val = $(this).attr("value"),
 	       asin = amzItems[val];
 	    if( asin ) {
-		selectedItems.push(asin);
+		selectedItems.push([asin, $(this).siblings(".qty").val() || 1]);
 	    }
 	}
     });
     for(i=0, d=selectedItems.length; i<d; i++) {
 	q = i+1;
 	if( i>0 ) { cartUrl += "&"; }
-	cartUrl += "ASIN."+q+"="+selectedItems[i]+"&Quantity."+q+"=1";
+	cartUrl += "ASIN."+q+"="+selectedItems[i][0]+"&Quantity."+q+"="+selectedItems[i][1];
     }
     if( cartUrl.length > 0 ) {
 	location.href = "http://www.amazon.com/gp/aws/cart/add.html?" + cartUrl;
     } else {
 	// none of the selected items can be bought from amzUS
-	showModal("Sorry", "Unavailable", "None of the selected items can be purchased from Amazon (US)");
+	showModal(msg("Sorry"), msg("Unavailable"), msg("None of the selected items can be purchased from Amazon (US)"));
     }
 }
 
+function showPriceTrends () {
+    if( $(".price").length == 0 ) {
+	return;
+    }
+    $.ajax({type: "POST",
+	    url: "/prices/",
+	    dataType: "json",
+	    success: function (d) {
+		if( d["err"] || !d["prices"] ) {
+		    return;
+		}
+		$.each(d["prices"], function(i, p) {
+		    var icon = null;
+		    if( p["trend"] == "up" ) {
+			icon = '<i class="fa fa-arrow-up price-up"></i>';
+		    } else if( p["trend"] == "down" ) {
+			icon = '<i class="fa fa-arrow-down price-down"></i>';
+		    }
+		    $(".price").each(function() {
+			if( $(this).data("vnd") == p["vnd"] && $(this).data("sku") == p["sku"] ) {
+			    if( p["display"] ) {
+				$(this).find(".price-amount").text(p["display"]);
+			    }
+			    if( icon !== null ) {
+				$(this).find(".price-trend").html(icon);
+			    }
+			}
+		    });
+		});
+	    }
+	   });
+}
+
 $(function(){
     if( ! Modernizr.canvas || ! Modernizr.svg ) {
 	window.location.href = '/browser';
     }
     $('a.shutdown').click(confirmShutdown);
+    showPriceTrends();
     $("#id_actions_chk").on("click", function() {
 	var state = $(this).is(':checked');
 	$(".chk_item").each(function() {
@@ -69,19 +107,22 @@ $(function(){
 		    if( d["msg"] && d["msg"] == "Ok" && !d["err"] ) {
 			$("#Item_"+itemId).remove();
 		    } else {
-			showModal("Sorry", "Error", "That item could not be deleted");
+			showModal(msg("Sorry"), msg("Error"), msg("That item could not be deleted"));
 		    }
                 },
                 error: function (d) {
 		    if( d["err"] ) {
-			showModal("Sorry", "Error", d[err]);
+			showModal(msg("Sorry"), msg("Error"), d[err]);
 		    } else {
-			showModal("Sorry", "Error", "There was a problem deleting that item");
+			showModal(msg("Sorry"), msg("Error"), msg("There was a problem deleting that item"));
 		    }
 		}
 	       });
     });
-    $(".dropdown-menu li a").on("click", function(event) {
+    $("#itemSearch select").on("change", function() {
+	$("#itemSearch").submit();
+    });
+    $("#category li a").on("click", function(event) {
 	event.preventDefault();
 	if( anyItemChecked() ) {
 	    var target = $(this).attr('href');
@@ -92,7 +133,7 @@ $(function(){
 		    $('#bulkActions').attr('action', target);
 		    $("#bulkActions").submit();
 		};
-		if( "/email/" == target ) {
+		if( target.indexOf("/email/") === 0 ) {
 		    checkAccountStatus( $('input[type=hidden]#account').val(), submitOk );
 		} else {
 		    submitOk();
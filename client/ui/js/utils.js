@@ -1,3 +1,12 @@
+// msg returns the translation of the message for the page language (the
+// MESSAGES defined in the scripts template), or the message itself
+function msg (message) {
+    if( typeof MESSAGES !== "undefined" && MESSAGES[message] ) {
+	return MESSAGES[message];
+    }
+    return message;
+}
+
 function showModal (title, header, message) {
     $('#modalWindow').modal('show');
     $('#modalTitle').text(title);
@@ -16,7 +25,7 @@ function checkAccountStatus (accId) {
 	    dataType: "json",
 	    success: function (d) {
 		if( !d["msg"] || d["msg"] !== "true" || d["err"] ) {
-		    showModal("Warning", "Verification Pending", "Your email address is unverified. Please check your email for the link we sent you.");
+		    showModal(msg("Warning"), msg("Verification Pending"), msg("Your email address is unverified. Please check your email for the link we sent you."));
 		} else {
 		    if( fn !== null ) {
 			fn();
@@ -52,5 +61,5 @@ function showConfirmModal (title, header, message, continueAction) {
 
 var confirmShutdown = function(event){
     event.preventDefault();
-    showConfirmModal('Shutdown', 'Shutdown this scanner', 'Are you sure you want to shutdown?', $(this).attr('href'), 'Yes', 'Cancel');
+    showConfirmModal(msg('Shutdown'), msg('Shutdown this scanner'), msg('Are you sure you want to shutdown?'), $(this).attr('href'), msg('Yes'), msg('Cancel'));
 };
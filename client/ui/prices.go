@@ -0,0 +1,93 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"encoding/json"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/Banrai/PiScan/server/api"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/* JSON response struct */
+type PriceTrends struct {
+	Prices []*api.PriceHistory `json:"prices"`
+	Error  string              `json:"err,omitempty"`
+}
+
+/* Ajax Response Functions (as strings via MakeHandler) */
+
+// GetPriceTrends responds to the ajax request from the client for the
+// current price and trend of every vendor product of the scanned items,
+// according to the price history on the API server
+func GetPriceTrends(r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) string {
+	// prepare the ajax reply object
+	reply := PriceTrends{Prices: make([]*api.PriceHistory, 0)}
+
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	defer db.Close()
+
+	// get the api server + port from the optional parameters
+	apiHost, apiHostOk := opts[0].(string)
+	if !apiHostOk {
+		reply.Error = Translation(r, nil).T(BAD_REQUEST)
+	}
+
+	if reply.Error == "" {
+		// get the Account for this request
+		acc, accErr := database.GetDesignatedAccount(db)
+		if accErr != nil {
+			reply.Error = accErr.Error()
+		} else {
+			// collect the vendor products for all this Account's items
+			v := url.Values{}
+			items, itemsErr := database.GetItems(db, acc)
+			if itemsErr != nil {
+				reply.Error = itemsErr.Error()
+			}
+			seen := make(map[string]bool)
+			for _, item := range items {
+				for _, vp := range item.ForSale {
+					key := strings.Join([]string{vp.Vendor.VendorId, vp.ProductCode}, " ")
+					if !seen[key] {
+						seen[key] = true
+						v.Add("vnd", vp.Vendor.VendorId)
+						v.Add("sku", vp.ProductCode)
+					}
+				}
+			}
+
+			if len(v["sku"]) > 0 {
+				// ask the API Server for their price histories (posted,
+				// since the list is too long for a query string with
+				// larger inventories)
+				res, resErr := http.PostForm(strings.Join([]string{apiHost, "/prices"}, ""), v)
+				if resErr != nil {
+					reply.Error = resErr.Error()
+				} else {
+					defer res.Body.Close()
+					dec := json.NewDecoder(res.Body)
+					if decErr := dec.Decode(&reply.Prices); decErr != nil {
+						reply.Error = decErr.Error()
+					}
+				}
+			}
+		}
+	}
+
+	// convert the ajax reply object to json
+	replyObj, replyObjErr := json.Marshal(reply)
+	if replyObjErr != nil {
+		return replyObjErr.Error()
+	}
+	return string(replyObj)
+}
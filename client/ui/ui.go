@@ -6,7 +6,6 @@
 package ui
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/Banrai/PiScan/client/database"
@@ -14,7 +13,9 @@ import (
 	"html/template"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -24,8 +25,20 @@ const (
 	BAD_REQUEST = "Sorry, that is an invalid request"
 	BAD_POST    = "Sorry, we cannot respond to that request. Please try again."
 
+	SERVER_REFUSED = "The server did not accept that request"
+
 	// Info messages
-	EMAIL_SENT = "The selected items have been sent to your email address"
+	EMAIL_SENT          = "The selected items have been sent to your email address"
+	ACCOUNT_REKEYED     = "Your api code has been replaced"
+	VERIFICATION_RESENT = "The verification email has been sent again"
+	ACCOUNT_DISABLED    = "Your account has been disabled on the server"
+	ACCOUNT_DELETED     = "Your account has been deleted from the server"
+
+	// Item list labels
+	NO_BRAND = "Other Brands"
+
+	// How many items to show on each page of the list
+	ITEMS_PER_PAGE = 50
 
 	// urls
 	HOME_URL    = "/scanned/"
@@ -43,13 +56,16 @@ var (
 
 	UNSUPPORTED_TEMPLATE_FILE = "browser_not_supported.html"
 
-	ITEM_LIST_TEMPLATE_FILES = []string{"items.html", "head.html", "navigation_tabs.html", "actions.html", "modal.html", "scripts.html"}
+	ITEM_LIST_TEMPLATE_FILES = []string{"items.html", "head.html", "navigation_tabs.html", "actions.html", "pager.html", "modal.html", "scripts.html"}
 	ITEM_EDIT_TEMPLATE_FILES = []string{"define_item.html", "head.html", "scripts.html"}
 
 	ITEM_LIST_TEMPLATES *template.Template
 	ITEM_EDIT_TEMPLATES *template.Template
 
 	TEMPLATES_INITIALIZED = false
+
+	// the item list parameters which page links preserve
+	LIST_PARAMS = []string{"q", "sort", "brand", "vendor", "favorite", "group", "page"}
 )
 
 // Use this to redirect one request to another target (string)
@@ -98,6 +114,9 @@ type AjaxAck struct {
 type ActiveTab struct {
 	Scanned   bool
 	Favorites bool
+	Expiring  bool
+	History   bool
+	Analytics bool
 	Account   bool
 	ShowTabs  bool
 }
@@ -108,14 +127,147 @@ type Action struct {
 	Action string
 }
 
+type ItemGroup struct {
+	Label string
+	Items []*database.Item
+}
+
+type SortOption struct {
+	Value string
+	Label string
+}
+
 type ItemsPage struct {
-	Title       string
-	ActiveTab   *ActiveTab
-	Actions     []*Action
-	Items       []*database.Item
-	Account     *database.Account
-	Scanned     bool
-	PageMessage string
+	Title         string
+	ActiveTab     *ActiveTab
+	Actions       []*Action
+	Items         []*database.Item
+	Groups        []*ItemGroup
+	Brands        []string
+	Brand         string
+	GroupByBrand  bool
+	Account       *database.Account
+	Scanned       bool
+	PageMessage   string
+	Search        string
+	Sort          string
+	Sorts         []*SortOption
+	Vendor        string
+	Vendors       []*database.Vendor
+	FavoritesOnly bool
+	Total         int64
+	Page          int64
+	Pages         int64
+	params        url.Values // the request parameters, for the page links
+}
+
+// Filtered is true if the page shows only some of the items
+func (p *ItemsPage) Filtered() bool {
+	return p.Search != "" || p.Brand != "" || p.Vendor != "" || p.FavoritesOnly
+}
+
+// VendorName returns the display name of the vendor in the filter
+func (p *ItemsPage) VendorName() string {
+	for _, v := range p.Vendors {
+		if v.VendorId == p.Vendor {
+			return v.DisplayName
+		}
+	}
+	return p.Vendor
+}
+
+// Link returns the url for this page with the key parameter changed to
+// the value (or removed, if the value is empty), and back on the first
+// page of items, unless the key is the page itself
+func (p *ItemsPage) Link(key, value string) string {
+	return listLink(p.params, LIST_PARAMS, key, value)
+}
+
+// PageLink returns the url for the page of items n pages away from this
+// one, or the empty string if there is no such page
+func (p *ItemsPage) PageLink(n int64) string {
+	target := p.Page + n
+	if target < 1 || target > p.Pages {
+		return ""
+	}
+	return p.Link("page", strconv.FormatInt(target, 10))
+}
+
+// listLink returns the url for a page of a list with the key parameter
+// changed to the value (or removed, if the value is empty), keeping the
+// rest of the list params, except for the page number
+func listLink(params url.Values, listParams []string, key, value string) string {
+	v := url.Values{}
+	for _, param := range listParams {
+		if params.Get(param) != "" && param != key && param != "page" {
+			v.Set(param, params.Get(param))
+		}
+	}
+	if value != "" {
+		v.Set(key, value)
+	}
+	return "?" + v.Encode()
+}
+
+// pageNumber returns the page number in the request params, if any, or
+// else the first page
+func pageNumber(params url.Values) int64 {
+	page, pageErr := strconv.ParseInt(params.Get("page"), 10, 64)
+	if pageErr != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
+// sortOptions defines the choice of sort orders for the items
+func sortOptions(tr *Catalogue) []*SortOption {
+	return []*SortOption{
+		&SortOption{Value: database.SORT_DATE, Label: tr.T("Newest first")},
+		&SortOption{Value: database.SORT_NAME, Label: tr.T("Name")},
+		&SortOption{Value: database.SORT_COUNT, Label: tr.T("Most scanned")}}
+}
+
+// groupItems partitions the list of items by brand (in alphabetical
+// order, with the unbranded items last, under the noBrand label), or
+// returns them as a single group if byBrand is false
+func groupItems(items []*database.Item, byBrand bool, noBrand string) []*ItemGroup {
+	if !byBrand {
+		return []*ItemGroup{&ItemGroup{Items: items}}
+	}
+
+	groups := make([]*ItemGroup, 0)
+	lookup := make(map[string]*ItemGroup)
+	var unbranded *ItemGroup
+	for _, item := range items {
+		if item.Brand == "" {
+			if unbranded == nil {
+				unbranded = &ItemGroup{Label: noBrand}
+			}
+			unbranded.Items = append(unbranded.Items, item)
+			continue
+		}
+		group, exists := lookup[item.Brand]
+		if !exists {
+			group = &ItemGroup{Label: item.Brand}
+			lookup[item.Brand] = group
+			groups = append(groups, group)
+		}
+		group.Items = append(group.Items, item)
+	}
+	sort.Sort(byLabel(groups))
+	if unbranded != nil {
+		groups = append(groups, unbranded)
+	}
+
+	return groups
+}
+
+type byLabel []*ItemGroup
+
+func (g byLabel) Len() int      { return len(g) }
+func (g byLabel) Swap(i, j int) { g[i], g[j] = g[j], g[i] }
+func (g byLabel) Less(i, j int) bool {
+	return strings.ToLower(g[i].Label) < strings.ToLower(g[j].Label)
 }
 
 type ItemForm struct {
@@ -124,6 +276,7 @@ type ItemForm struct {
 	CancelUrl    string
 	FormError    string
 	FormMessage  string
+	Correction   bool
 	Unregistered bool
 }
 
@@ -146,72 +299,87 @@ func getItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoor
 		http.Error(w, accErr.Error(), http.StatusInternalServerError)
 		return
 	}
+	tr := Translation(r, acc)
 
-	// define the appropriate fetch item function
-	fetch := func(db *sqlite3.Conn, acc *database.Account) ([]*database.Item, error) {
-		if favorites {
-			return database.GetFavoriteItems(db, acc)
-		} else {
-			return database.GetItems(db, acc)
-		}
+	// check for any search, filters, sort order, or grouping
+	r.ParseForm()
+	query := &database.ItemQuery{Search: strings.TrimSpace(r.Form.Get("q")),
+		Brand:     r.Form.Get("brand"),
+		Vendor:    r.Form.Get("vendor"),
+		Favorites: favorites || r.Form.Get("favorite") == "1",
+		Sort:      r.Form.Get("sort"),
+		Limit:     ITEMS_PER_PAGE}
+	if _, sortOk := database.ITEM_SORT_ORDERS[query.Sort]; !sortOk {
+		query.Sort = database.SORT_DATE
 	}
+	groupByBrand := r.Form.Get("group") == "brand"
+	page := pageNumber(r.Form)
+	query.Offset = (page - 1) * ITEMS_PER_PAGE
 
-	// get all the desired items for this Account
-	items := make([]*database.Item, 0)
-	itemList, itemsErr := fetch(db, acc)
+	// get the desired page of items for this Account
+	items, total, itemsErr := database.QueryItems(db, acc, query)
 	if itemsErr != nil {
 		http.Error(w, itemsErr.Error(), http.StatusInternalServerError)
 		return
 	}
-	for _, item := range itemList {
-		items = append(items, item)
-	}
+	vendors := database.GetAllVendors(db)
 
 	// actions
 	actions := make([]*Action, 0)
 	// commerce options
-	for _, vendor := range database.GetAllVendors(db) {
-		actions = append(actions, &Action{Link: fmt.Sprintf("/buy%s/", vendor.VendorId), Icon: "fa fa-shopping-cart", Action: fmt.Sprintf("Buy from %s", vendor.DisplayName)})
+	for _, vendor := range vendors {
+		actions = append(actions, &Action{Link: fmt.Sprintf("/buy%s/", vendor.VendorId), Icon: "fa fa-shopping-cart", Action: tr.T("Buy from %s", vendor.DisplayName)})
 	}
 	if acc.Email != database.ANONYMOUS_EMAIL {
-		actions = append(actions, &Action{Link: "/email/", Icon: "fa fa-envelope", Action: "Email to me"})
+		actions = append(actions, &Action{Link: "/email/", Icon: "fa fa-envelope", Action: tr.T("Email to me")})
+		actions = append(actions, &Action{Link: "/email/?attach=csv,pdf", Icon: "fa fa-paperclip", Action: tr.T("Email to me, with spreadsheet and printable list")})
 	}
 	if favorites {
-		actions = append(actions, &Action{Link: "/unfavorite/", Icon: "fa fa-star-o", Action: "Remove from favorites"})
+		actions = append(actions, &Action{Link: "/unfavorite/", Icon: "fa fa-star-o", Action: tr.T("Remove from favorites")})
 	} else {
-		actions = append(actions, &Action{Link: "/favorite/", Icon: "fa fa-star", Action: "Add to favorites"})
+		actions = append(actions, &Action{Link: "/favorite/", Icon: "fa fa-star", Action: tr.T("Add to favorites")})
 	}
-	actions = append(actions, &Action{Link: "/delete/", Icon: "fa fa-trash", Action: "Delete"})
+	actions = append(actions, &Action{Link: "/delete/", Icon: "fa fa-trash", Action: tr.T("Delete")})
 
 	// define the page title
-	var titleBuffer bytes.Buffer
+	title := tr.N(total, "Scanned Item", "Scanned Items")
 	if favorites {
-		titleBuffer.WriteString("Favorite")
-	} else {
-		titleBuffer.WriteString("Scanned")
+		title = tr.N(total, "Favorite Item", "Favorite Items")
 	}
-	titleBuffer.WriteString(" Item")
-	if len(itemList) != 1 {
-		titleBuffer.WriteString("s")
+	if query.Brand != "" {
+		title = tr.T("%s from %s", title, query.Brand)
 	}
 
-	p := &ItemsPage{Title: titleBuffer.String(),
-		Scanned:   !favorites,
-		ActiveTab: &ActiveTab{Scanned: !favorites, Favorites: favorites, Account: false, ShowTabs: true},
-		Actions:   actions,
-		Account:   acc,
-		Items:     items}
+	p := &ItemsPage{Title: title,
+		Scanned:       !favorites,
+		ActiveTab:     &ActiveTab{Scanned: !favorites, Favorites: favorites, Account: false, ShowTabs: true},
+		Actions:       actions,
+		Account:       acc,
+		Items:         items,
+		Groups:        groupItems(items, groupByBrand, tr.T(NO_BRAND)),
+		Brands:        database.GetBrands(db, acc, favorites),
+		Brand:         query.Brand,
+		GroupByBrand:  groupByBrand,
+		Search:        query.Search,
+		Sort:          query.Sort,
+		Sorts:         sortOptions(tr),
+		Vendor:        query.Vendor,
+		Vendors:       vendors,
+		FavoritesOnly: !favorites && query.Favorites,
+		Total:         total,
+		Page:          page,
+		Pages:         (total + ITEMS_PER_PAGE - 1) / ITEMS_PER_PAGE,
+		params:        r.Form}
 
 	// check for any message to display on page load
-	r.ParseForm()
 	if msg, exists := r.Form["ack"]; exists {
 		ackType := strings.Join(msg, "")
 		if ackType == "email" {
-			p.PageMessage = EMAIL_SENT
+			p.PageMessage = tr.T(EMAIL_SENT)
 		}
 	}
 
-	renderItemListTemplate(w, p)
+	renderItemListTemplate(w, p, tr)
 }
 
 // deleteItem attempts to lookup and remove the Item for the Account and
@@ -284,24 +452,40 @@ func processItems(w http.ResponseWriter, r *http.Request, dbCoords database.Conn
 
 /* HTML Response Functions (via templates) */
 
-func renderItemListTemplate(w http.ResponseWriter, p *ItemsPage) {
+func renderItemListTemplate(w http.ResponseWriter, p *ItemsPage, tr *Catalogue) {
 	if TEMPLATES_INITIALIZED {
-		ITEM_LIST_TEMPLATES.Execute(w, p)
+		executeTemplate(w, ITEM_LIST_TEMPLATES, tr, p)
 	}
 }
 
-func renderItemEditTemplate(w http.ResponseWriter, f *ItemForm) {
+func renderItemEditTemplate(w http.ResponseWriter, f *ItemForm, tr *Catalogue) {
 	if TEMPLATES_INITIALIZED {
-		ITEM_EDIT_TEMPLATES.Execute(w, f)
+		executeTemplate(w, ITEM_EDIT_TEMPLATES, tr, f)
 	}
 }
 
+// parseTemplates parses the template files, which can use the message
+// catalogue functions (see Catalogue.FuncMap)
+func parseTemplates(folder string, templateFiles []string) *template.Template {
+	t := template.New(templateFiles[0]).Funcs(CATALOGUES[DEFAULT_LANGUAGE].FuncMap())
+	return template.Must(t.ParseFiles(TEMPLATE_LIST(folder, templateFiles)...))
+}
+
 // InitializeTemplates confirms the given folder string leads to the html
-// template files, otherwise templates.Must() will complain
+// template files, otherwise templates.Must() will complain, and loads the
+// message catalogues from the locales folder alongside it
 func InitializeTemplates(folder string) {
-	ITEM_LIST_TEMPLATES = template.Must(template.ParseFiles(TEMPLATE_LIST(folder, ITEM_LIST_TEMPLATE_FILES)...))
-	ITEM_EDIT_TEMPLATES = template.Must(template.ParseFiles(TEMPLATE_LIST(folder, ITEM_EDIT_TEMPLATE_FILES)...))
-	ACCOUNT_EDIT_TEMPLATES = template.Must(template.ParseFiles(TEMPLATE_LIST(folder, ACCOUNT_EDIT_TEMPLATE_FILES)...))
+	if err := InitializeCatalogues(path.Join(folder, "../locales/")); err != nil {
+		panic(err)
+	}
+	ITEM_LIST_TEMPLATES = parseTemplates(folder, ITEM_LIST_TEMPLATE_FILES)
+	ITEM_EDIT_TEMPLATES = parseTemplates(folder, ITEM_EDIT_TEMPLATE_FILES)
+	ACCOUNT_EDIT_TEMPLATES = parseTemplates(folder, ACCOUNT_EDIT_TEMPLATE_FILES)
+	ITEM_VIEW_TEMPLATES = parseTemplates(folder, ITEM_VIEW_TEMPLATE_FILES)
+	HISTORY_TEMPLATES = parseTemplates(folder, HISTORY_TEMPLATE_FILES)
+	ANALYTICS_TEMPLATES = parseTemplates(folder, ANALYTICS_TEMPLATE_FILES)
+	EXPIRING_TEMPLATES = parseTemplates(folder, EXPIRING_TEMPLATE_FILES)
+	BACKUP_TEMPLATES = parseTemplates(folder, BACKUP_TEMPLATE_FILES)
 	TEMPLATES_INITIALIZED = true
 }
 
@@ -368,6 +552,7 @@ func RemoveSingleItem(r *http.Request, dbCoords database.ConnCoordinates, opts .
 		if accErr != nil {
 			ack.Error = accErr.Error()
 		}
+		tr := Translation(r, acc)
 
 		// find the specific Item to remove
 		// get the item id from the POST values
@@ -386,18 +571,18 @@ func RemoveSingleItem(r *http.Request, dbCoords database.ConnCoordinates, opts .
 							if deleteErr != nil {
 								ack.Error = deleteErr.Error()
 							} else {
-								ack.Error = "No such item"
+								ack.Error = tr.T("No such item")
 							}
 						}
 					}
 				} else {
-					ack.Error = "Missing item id"
+					ack.Error = tr.T("Missing item id")
 				}
 			} else {
-				ack.Error = BAD_POST
+				ack.Error = tr.T(BAD_POST)
 			}
 		} else {
-			ack.Error = BAD_REQUEST
+			ack.Error = tr.T(BAD_REQUEST)
 		}
 	}
 
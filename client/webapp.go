@@ -9,6 +9,7 @@ import (
 	"flag"
 	"fmt"
 	"github.com/Banrai/PiScan/client/database"
+	"github.com/Banrai/PiScan/client/thumbnails"
 	"github.com/Banrai/PiScan/client/ui"
 	"log"
 	"net/http"
@@ -54,6 +55,17 @@ func main() {
 		// coordinates for connecting to the sqlite database (from the command line options)
 		dbCoordinates := database.ConnCoordinates{DBPath: dbPath, DBFile: dbFile}
 
+		// create the client db, or apply the schema changes it is missing
+		migrated, backup, migrateErr := database.MigrateDB(dbCoordinates)
+		if migrateErr != nil {
+			log.Fatal(migrateErr)
+		}
+		if backup != "" {
+			log.Println(fmt.Sprintf("Client database '%s' migrated to version %d (the previous version is in '%s')", dbFile, migrated[len(migrated)-1].Version, backup))
+		} else if len(migrated) > 0 {
+			log.Println(fmt.Sprintf("Client database '%s' created in '%s'", dbFile, dbPath))
+		}
+
 		// prepare the apiHost:apiPort for handler functions that need them
 		extraCoordinates := make([]interface{}, 1)
 		extraCoordinates[0] = fmt.Sprintf("%s:%d", apiHost, apiPort)
@@ -68,19 +80,31 @@ func main() {
 		http.HandleFunc("/delete/", ui.MakeHTMLHandler(ui.DeleteItems, dbCoordinates))
 		http.HandleFunc("/favorite/", ui.MakeHTMLHandler(ui.FavoriteItems, dbCoordinates))
 		http.HandleFunc("/unfavorite/", ui.MakeHTMLHandler(ui.UnfavoriteItems, dbCoordinates))
+		http.HandleFunc("/item/", ui.MakeHTMLHandler(ui.ShowItem, dbCoordinates))
+		http.HandleFunc("/expiring/", ui.MakeHTMLHandler(ui.ExpiringItems, dbCoordinates))
+		http.HandleFunc("/unit/", ui.MakeHTMLHandler(ui.UpdateUnits, dbCoordinates))
+		http.HandleFunc("/history/", ui.MakeHTMLHandler(ui.ScanHistory, dbCoordinates))
+		http.HandleFunc("/analytics/", ui.MakeHTMLHandler(ui.ShowAnalytics, dbCoordinates))
+		http.HandleFunc("/backup/", ui.MakeHTMLHandler(ui.BackupData, dbCoordinates))
+		http.HandleFunc("/export/", ui.MakeHTMLHandler(ui.ExportData, dbCoordinates))
 		http.HandleFunc("/input/", ui.MakeHTMLHandler(ui.InputUnknownItem, dbCoordinates, extraCoordinates...))
+		http.HandleFunc("/correct/", ui.MakeHTMLHandler(ui.CorrectItem, dbCoordinates, extraCoordinates...))
 		http.HandleFunc("/account/", ui.MakeHTMLHandler(ui.EditAccount, dbCoordinates, extraCoordinates...))
 		http.HandleFunc("/email/", ui.MakeHTMLHandler(ui.EmailItems, dbCoordinates, extraCoordinates...))
 
 		// ajax
 		http.HandleFunc("/remove/", ui.MakeHandler(ui.RemoveSingleItem, dbCoordinates, MIME_JSON))
 		http.HandleFunc("/status/", ui.MakeHandler(ui.ConfirmServerAccount, dbCoordinates, MIME_JSON, extraCoordinates...))
+		http.HandleFunc("/prices/", ui.MakeHandler(ui.GetPriceTrends, dbCoordinates, MIME_JSON, extraCoordinates...))
+		http.HandleFunc("/brands/", ui.MakeHandler(ui.SuggestBrands, dbCoordinates, MIME_JSON, extraCoordinates...))
+		http.HandleFunc("/stats/", ui.MakeHandler(ui.ScanAnalytics, dbCoordinates, MIME_JSON))
 
 		// static resources
 		http.Handle("/css/", http.StripPrefix("/css/", http.FileServer(http.Dir(path.Join(templatesFolder, "../css/")))))
 		http.Handle("/js/", http.StripPrefix("/js/", http.FileServer(http.Dir(path.Join(templatesFolder, "../js/")))))
 		http.Handle("/fonts/", http.StripPrefix("/fonts/", http.FileServer(http.Dir(path.Join(templatesFolder, "../fonts/")))))
 		http.Handle("/images/", http.StripPrefix("/images/", http.FileServer(http.Dir(path.Join(templatesFolder, "../images/")))))
+		http.Handle("/thumbnails/", http.StripPrefix("/thumbnails/", http.FileServer(http.Dir(thumbnails.Folder(dbPath)))))
 
 		/* start the server */
 		log.Println(fmt.Sprintf("Starting the WebApp %s", fmt.Sprintf("%s:%d", host, port)))
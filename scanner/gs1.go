@@ -0,0 +1,152 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package scanner provides functions for reading barcode scans from
+// usb-connected barcode scanner devices as if they were keyboards
+
+package scanner
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// GS1 Application Identifiers (AI) used by the PiScanner
+	GS1_GTIN        = "01"
+	GS1_BATCH       = "10"
+	GS1_BEST_BEFORE = "15"
+	GS1_EXPIRY      = "17"
+
+	// GS1 dates are YYMMDD, where a DD of 00 means the end of the month
+	GS1_DATE = "060102"
+
+	// the FNC1 separator after variable length fields, as it arrives from
+	// the scanner (GS, which lookupKeyCode does not know, so it reads "-")
+	GS1_SEPARATORS = "\x1d-"
+)
+
+var (
+	// the lengths of the fixed length AIs, by their first two digits
+	// (as in the GS1 General Specifications, figure 5.10.1-2)
+	GS1_FIXED_LENGTHS = map[string]int{
+		"00": 18, "01": 14, "02": 14, "03": 14, "04": 16,
+		"11": 6, "12": 6, "13": 6, "14": 2, "15": 6, "16": 6, "17": 6, "18": 6, "19": 2,
+		"20": 2, "31": 6, "32": 6, "33": 6, "34": 6, "35": 6, "36": 6, "41": 13}
+
+	// AIs with 3 or 4 digits, by their first two digits
+	GS1_LONG_AIS = map[string]int{
+		"23": 3, "24": 3, "25": 3, "31": 4, "32": 4, "33": 4, "34": 4, "35": 4, "36": 4,
+		"39": 4, "40": 3, "41": 3, "42": 3, "70": 4, "71": 3, "72": 4, "80": 4, "81": 4, "82": 4}
+
+	// the human readable form, e.g. "(01)09501101530003(17)250131(10)AB1"
+	GS1_HUMAN_READABLE = regexp.MustCompile(`\((\d{2,4})\)([^(]*)`)
+)
+
+// GS1Data is what the PiScanner needs from a GS1 element string (as found
+// in GS1-128 and GS1 DataMatrix barcodes): the product GTIN, and its
+// expiry date, if the barcode has one
+type GS1Data struct {
+	GTIN    string
+	Expires time.Time
+	Batch   string
+}
+
+// Barcode returns the GTIN in the shortest form the product databases use
+// for it, e.g. the EAN-13 "9501101530003" for "09501101530003"
+func (g *GS1Data) Barcode() string {
+	if len(g.GTIN) == 14 && strings.HasPrefix(g.GTIN, "0") {
+		return g.GTIN[1:]
+	}
+	return g.GTIN
+}
+
+// parseGS1Date reads the YYMMDD date, with the year in this century
+func parseGS1Date(value string) time.Time {
+	if len(value) != 6 {
+		return time.Time{}
+	}
+	endOfMonth := strings.HasSuffix(value, "00")
+	if endOfMonth {
+		value = value[:4] + "01"
+	}
+	date, err := time.ParseInLocation(GS1_DATE, value, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	if endOfMonth {
+		date = date.AddDate(0, 1, -1)
+	}
+	return date
+}
+
+// set records the value of the AI, if the PiScanner uses it
+func (g *GS1Data) set(ai, value string) {
+	switch ai {
+	case GS1_GTIN:
+		g.GTIN = value
+	case GS1_BATCH:
+		g.Batch = value
+	case GS1_EXPIRY:
+		g.Expires = parseGS1Date(value)
+	case GS1_BEST_BEFORE:
+		// only if there is no expiry date
+		if g.Expires.IsZero() {
+			g.Expires = parseGS1Date(value)
+		}
+	}
+}
+
+// ParseGS1 reads the scanned barcode as a GS1 element string, in either
+// its raw form (starting with the GTIN, AI 01) or its human readable one,
+// returning false if it is not one (i.e., it is a plain EAN or UPC code).
+// Since "-" is both the separator and a valid character in variable length
+// values, the raw form is read up to the first element which does not fit,
+// keeping what was found before it
+func ParseGS1(barcode string) (*GS1Data, bool) {
+	g := new(GS1Data)
+
+	if strings.HasPrefix(barcode, "(") {
+		for _, match := range GS1_HUMAN_READABLE.FindAllStringSubmatch(barcode, -1) {
+			g.set(match[1], strings.TrimSpace(match[2]))
+		}
+		return g, len(g.GTIN) == 14
+	}
+
+	// the raw form must have more than just the GTIN, or it could be
+	// any other barcode which happens to start with 01
+	if !strings.HasPrefix(barcode, GS1_GTIN) || len(barcode) <= 2+GS1_FIXED_LENGTHS[GS1_GTIN] {
+		return g, false
+	}
+	for rest := barcode; len(rest) >= 2; {
+		prefix := rest[:2]
+		aiLength, long := GS1_LONG_AIS[prefix]
+		if !long {
+			aiLength = 2
+		}
+		if len(rest) < aiLength {
+			break
+		}
+		ai := rest[:aiLength]
+		rest = rest[aiLength:]
+
+		var value string
+		if length, fixed := GS1_FIXED_LENGTHS[prefix]; fixed {
+			if len(rest) < length {
+				break
+			}
+			value, rest = rest[:length], rest[length:]
+		} else {
+			end := strings.IndexAny(rest, GS1_SEPARATORS)
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = rest[:end], rest[end:]
+		}
+		g.set(ai, value)
+		rest = strings.TrimLeft(rest, GS1_SEPARATORS)
+	}
+
+	return g, len(g.GTIN) == 14
+}
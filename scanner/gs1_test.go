@@ -0,0 +1,56 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package scanner
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseGS1(t *testing.T) {
+	jan31 := time.Date(2025, time.January, 31, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		name, barcode string
+		isGS1         bool
+		gtin, batch   string
+		expires       time.Time
+	}{
+		{"raw", "01095011015300031725013110AB1", true, "09501101530003", "AB1", jan31},
+		{"raw with GS", "010950110153000310AB1\x1d17250131", true, "09501101530003", "AB1", jan31},
+		{"raw with FNC1 as -", "010950110153000310AB1-17250131", true, "09501101530003", "AB1", jan31},
+		{"human readable", "(01)09501101530003(17)250131(10)AB1", true, "09501101530003", "AB1", jan31},
+		{"best before", "(01)09501101530003(15)250131", true, "09501101530003", "", jan31},
+		{"expiry over best before", "(01)09501101530003(15)241231(17)250131", true, "09501101530003", "", jan31},
+		{"day 00", "(01)09501101530003(17)240200", true, "09501101530003", "", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.Local)},
+		{"raw day 00", "011950110153000317251200", true, "19501101530003", "", time.Date(2025, time.December, 31, 0, 0, 0, 0, time.Local)},
+		// the "-12" after the batch reads as a separator, then an AI 12
+		// with no date, which ends the parsing without losing the rest
+		{"hyphenated batch", "01095011015300031725013110AB-12", true, "09501101530003", "AB", jan31},
+		{"truncated date", "0109501101530003172501", true, "09501101530003", "", time.Time{}},
+		{"EAN-13", "9501101530003", false, "", "", time.Time{}},
+		{"GTIN only", "0109501101530003", false, "", "", time.Time{}},
+		{"short GTIN", "(01)9501101530003(17)250131", false, "9501101530003", "", jan31},
+	}
+	for _, test := range tests {
+		g, isGS1 := ParseGS1(test.barcode)
+		if isGS1 != test.isGS1 {
+			t.Errorf("%s: ParseGS1(%q) = %v, expected %v", test.name, test.barcode, isGS1, test.isGS1)
+			continue
+		}
+		if g.GTIN != test.gtin || g.Batch != test.batch || !g.Expires.Equal(test.expires) {
+			t.Errorf("%s: ParseGS1(%q) = %+v", test.name, test.barcode, g)
+		}
+	}
+}
+
+func TestGS1Barcode(t *testing.T) {
+	for gtin, expected := range map[string]string{
+		"09501101530003": "9501101530003",
+		"19501101530003": "19501101530003",
+		"00012345678905": "0012345678905"} {
+		if barcode := (&GS1Data{GTIN: gtin}).Barcode(); barcode != expected {
+			t.Errorf("Barcode(%q) = %q, expected %q", gtin, barcode, expected)
+		}
+	}
+}
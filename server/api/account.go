@@ -0,0 +1,265 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Banrai/PiScan/server/database/barcodes"
+	"net/http"
+)
+
+const (
+	// How contributions are removed when their account is deleted
+	CONTRIBUTIONS_ANONYMIZE = "anonymize" // the default
+	CONTRIBUTIONS_DELETE    = "delete"
+
+	// api codes are undashed uuids
+	API_CODE_LENGTH = 32
+)
+
+var (
+	ERR_ACCOUNT_DISABLED = errors.New("This account has been disabled")
+	ERR_BAD_API_CODE     = errors.New("Invalid api code")
+)
+
+// validAPICode is true if the code looks like an undashed uuid, which is
+// what the clients generate (see barcodes.GenerateUUID)
+func validAPICode(code string) bool {
+	if len(code) != API_CODE_LENGTH {
+		return false
+	}
+	_, err := hex.DecodeString(code)
+	return err == nil
+}
+
+// targetAccount returns the account the request applies to: the one
+// making it, unless an admin names another (by email) in the "account"
+// parameter
+func targetAccount(statements map[string]*sql.Stmt, acc *barcodes.ACCOUNT, target string) (*barcodes.ACCOUNT, error) {
+	if target == "" || target == acc.Email {
+		return acc, nil
+	}
+	if !acc.IsAdmin() {
+		return nil, ERR_NOT_AUTHORIZED
+	}
+
+	accountLookupStmt, accountLookupStmtExists := statements[barcodes.ACCOUNT_LOOKUP_BY_EMAIL]
+	if !accountLookupStmtExists {
+		return nil, ERR_UNKNOWN_ACCOUNT
+	}
+	targetAcc, targetErr := barcodes.LookupAccount(accountLookupStmt, target, false)
+	if targetErr != nil {
+		return nil, targetErr
+	}
+	if targetAcc.Id == "" {
+		return nil, ERR_UNKNOWN_ACCOUNT
+	}
+	return targetAcc, nil
+}
+
+// RekeyAccount replaces the account's api code with the new one given in
+// the "api" parameter (the request itself is signed with the old one)
+func RekeyAccount(r *http.Request, db DBConnection) string {
+	// the result is a simple json ack
+	ack := new(SimpleMessage)
+
+	// this function only responds to POST requests
+	if "POST" == r.Method {
+		r.ParseForm()
+
+		apiCode := r.PostForm.Get("api")
+		if apiCode == "" {
+			ack.Err = ERR_MISSING_PARAMETER
+		} else if !validAPICode(apiCode) {
+			ack.Err = ERR_BAD_API_CODE
+		} else {
+			rekeyFn := func(statements map[string]*sql.Stmt) {
+				acc, accErr := authenticateContributor(statements, r.PostForm)
+				if accErr != nil {
+					ack.Err = accErr
+					return
+				}
+
+				codeStmt, codeStmtExists := statements[barcodes.ACCOUNT_SET_CODE]
+				if codeStmtExists {
+					ack.Err = acc.SetAPICode(codeStmt, apiCode)
+					if ack.Err == nil {
+						ack.Ack = fmt.Sprintf("ok: %s", acc.Id)
+					}
+				}
+			}
+			WithServerDatabase(db, rekeyFn)
+		}
+	}
+
+	result, err := json.Marshal(ack)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return string(result)
+}
+
+// ResendVerification sends the verification email again, with a new link
+// (so any earlier ones stop working), if the account has yet to be verified
+func ResendVerification(r *http.Request, db DBConnection, serverLink string) string {
+	// the result is a simple json ack
+	ack := new(SimpleMessage)
+
+	// this function only responds to POST requests
+	if "POST" == r.Method {
+		r.ParseForm()
+
+		resendFn := func(statements map[string]*sql.Stmt) {
+			acc, accErr := authenticateContributor(statements, r.PostForm)
+			if accErr != nil {
+				ack.Err = accErr
+				return
+			}
+
+			if acc.Verified {
+				ack.Ack = "verified"
+			} else {
+				ack.Err = issueVerification(statements, serverLink, acc)
+				if ack.Err == nil {
+					ack.Ack = fmt.Sprintf("sent: %s", acc.Email)
+				}
+			}
+		}
+		WithServerDatabase(db, resendFn)
+	}
+
+	result, err := json.Marshal(ack)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return string(result)
+}
+
+// setAccountEnabled disables or re-enables the target account: accounts
+// may disable themselves, but only admins may disable others, or enable
+// any account again
+func setAccountEnabled(r *http.Request, db DBConnection, enabled bool) string {
+	// the result is a simple json ack
+	ack := new(SimpleMessage)
+
+	// this function only responds to POST requests
+	if "POST" == r.Method {
+		r.ParseForm()
+
+		target := r.PostForm.Get("account") // the email of the account to change (optional, admins only)
+		enableFn := func(statements map[string]*sql.Stmt) {
+			acc, accErr := authenticateContributor(statements, r.PostForm)
+			if accErr != nil {
+				ack.Err = accErr
+				return
+			}
+			if enabled && !acc.IsAdmin() {
+				ack.Err = ERR_NOT_AUTHORIZED
+				return
+			}
+
+			targetAcc, targetErr := targetAccount(statements, acc, target)
+			if targetErr != nil {
+				ack.Err = targetErr
+				return
+			}
+
+			enabledStmt, enabledStmtExists := statements[barcodes.ACCOUNT_SET_ENABLED]
+			if enabledStmtExists {
+				ack.Err = targetAcc.SetEnabled(enabledStmt, enabled)
+				if ack.Err == nil {
+					ack.Ack = fmt.Sprintf("%t: %s", enabled, targetAcc.Email)
+				}
+			}
+		}
+		WithServerDatabase(db, enableFn)
+	}
+
+	result, err := json.Marshal(ack)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return string(result)
+}
+
+func DisableAccount(r *http.Request, db DBConnection) string {
+	return setAccountEnabled(r, db, false)
+}
+
+func EnableAccount(r *http.Request, db DBConnection) string {
+	return setAccountEnabled(r, db, true)
+}
+
+// DeleteAccount removes the target account (the one making the request,
+// or, for admins, the one named in the "account" parameter), along with
+// its votes, and either anonymizes its contributions (by default) or
+// deletes them too (if "contributions" is "delete"); disabled accounts can
+// still delete themselves (see DeletionKey)
+func DeleteAccount(r *http.Request, db DBConnection) string {
+	// the result is a simple json ack
+	ack := new(SimpleMessage)
+
+	// this function only responds to POST requests
+	if "POST" == r.Method {
+		r.ParseForm()
+
+		target := r.PostForm.Get("account") // the email of the account to delete (optional, admins only)
+		removal := barcodes.ACCOUNT_ANONYMIZE_CONTRIBUTIONS
+		switch r.PostForm.Get("contributions") {
+		case "", CONTRIBUTIONS_ANONYMIZE:
+		case CONTRIBUTIONS_DELETE:
+			removal = barcodes.ACCOUNT_DELETE_CONTRIBUTIONS
+		default:
+			ack.Err = ERR_BAD_CONTRIBUTION
+		}
+
+		if ack.Err == nil {
+			deleteFn := func(conn *sql.DB, statements map[string]*sql.Stmt) {
+				acc, accErr := authenticateContributor(statements, r.PostForm)
+				if accErr != nil {
+					ack.Err = accErr
+					return
+				}
+				if !acc.Enabled && target != "" && target != acc.Email {
+					// disabled accounts may only delete themselves
+					ack.Err = ERR_ACCOUNT_DISABLED
+					return
+				}
+
+				targetAcc, targetErr := targetAccount(statements, acc, target)
+				if targetErr != nil {
+					ack.Err = targetErr
+					return
+				}
+
+				removalStmts := make([]*sql.Stmt, 0)
+				for _, s := range removal {
+					stmt, stmtExists := statements[s]
+					if !stmtExists {
+						return
+					}
+					removalStmts = append(removalStmts, stmt)
+				}
+				deleteStmt, deleteStmtExists := statements[barcodes.ACCOUNT_DELETE]
+				if deleteStmtExists {
+					ack.Err = targetAcc.Remove(conn, removalStmts, deleteStmt)
+					if ack.Err == nil {
+						ack.Ack = fmt.Sprintf("deleted: %s", targetAcc.Email)
+					}
+				}
+			}
+			withServerDatabase(db, deleteFn)
+		}
+	}
+
+	result, err := json.Marshal(ack)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return string(result)
+}
@@ -0,0 +1,70 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"database/sql"
+	"github.com/Banrai/PiScan/server/database/barcodes"
+	"github.com/Banrai/PiScan/server/digest"
+	"net/url"
+)
+
+// AccountKey returns the digest.KeyFunc for requests made on behalf of
+// an existing account (named by the "email" parameter), which must be
+// signed with that account's api code, and which must not be disabled
+func AccountKey(db DBConnection) digest.KeyFunc {
+	return accountKey(db, false)
+}
+
+// DeletionKey returns the digest.KeyFunc for account deletion requests,
+// which are like AccountKey, except that disabled accounts may make them
+// too (so that nobody is kept from deleting their own account)
+func DeletionKey(db DBConnection) digest.KeyFunc {
+	return accountKey(db, true)
+}
+
+// accountKey returns the api code of the account named by the "email"
+// parameter, unless it is disabled (and allowDisabled is false)
+func accountKey(db DBConnection, allowDisabled bool) digest.KeyFunc {
+	return func(params url.Values) (string, error) {
+		var key string
+		var err error
+		email := params.Get("email")
+		if email == "" {
+			return "", ERR_MISSING_PARAMETER
+		}
+		keyFn := func(statements map[string]*sql.Stmt) {
+			lookupStmt, lookupStmtExists := statements[barcodes.ACCOUNT_LOOKUP_BY_EMAIL]
+			if lookupStmtExists {
+				acc, accErr := barcodes.LookupAccount(lookupStmt, email, false)
+				if accErr != nil {
+					err = accErr
+				} else if acc.Id == "" {
+					err = ERR_UNKNOWN_ACCOUNT
+				} else if !acc.Enabled && !allowDisabled {
+					err = ERR_ACCOUNT_DISABLED
+				} else {
+					key = acc.APICode
+				}
+			}
+		}
+		WithServerDatabase(db, keyFn)
+		return key, err
+	}
+}
+
+// RegistrationKey returns the digest.KeyFunc for registration requests:
+// these are signed with the new api code (the "api" parameter), unless
+// the email is already registered, in which case only the existing api
+// code will do (so nobody else can trigger more verification emails)
+func RegistrationKey(db DBConnection) digest.KeyFunc {
+	accountKey := AccountKey(db)
+	return func(params url.Values) (string, error) {
+		key, err := accountKey(params)
+		if err == ERR_UNKNOWN_ACCOUNT {
+			return params.Get("api"), nil
+		}
+		return key, err
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/Banrai/PiScan/server/database/barcodes"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// how many brand suggestions to return, by default and at most
+	BRAND_SUGGEST_DEFAULT = 10
+	BRAND_SUGGEST_MAX     = 50
+
+	// how many candidates to consider from each source, before ranking
+	BRAND_SUGGEST_CANDIDATES = 100
+
+	// where the suggested brand came from
+	BRAND_SOURCE_POD         = "pod"
+	BRAND_SOURCE_CONTRIBUTED = "contributed"
+)
+
+type BrandSuggestion struct {
+	BSIN   string `json:"bsin,omitempty"` // POD brands only
+	Id     string `json:"id,omitempty"`   // contributed brands only
+	Name   string `json:"brand"`
+	URL    string `json:"url,omitempty"`
+	Source string `json:"source"`
+	rank   int
+}
+
+// brandRank scores how well the brand name matches the query: lower is
+// better, with exact matches first, then prefixes, then word prefixes,
+// and anything else containing the query last
+func brandRank(query, name string) int {
+	q := strings.ToLower(query)
+	n := strings.ToLower(name)
+	switch {
+	case n == q:
+		return 0
+	case strings.HasPrefix(n, q):
+		return 1
+	case strings.Contains(n, " "+q):
+		return 2
+	}
+	return 3
+}
+
+type byBrandRank []*BrandSuggestion
+
+func (b byBrandRank) Len() int      { return len(b) }
+func (b byBrandRank) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byBrandRank) Less(i, j int) bool {
+	if b[i].rank != b[j].rank {
+		return b[i].rank < b[j].rank
+	}
+	if b[i].Source != b[j].Source {
+		// prefer the authoritative POD brands
+		return b[i].Source == BRAND_SOURCE_POD
+	}
+	if len(b[i].Name) != len(b[j].Name) {
+		return len(b[i].Name) < len(b[j].Name)
+	}
+	return strings.ToLower(b[i].Name) < strings.ToLower(b[j].Name)
+}
+
+// rankBrandSuggestions merges the POD and contributed brand matches,
+// dropping contributed brands which duplicate a POD brand name, and
+// returns the best limit of them
+func rankBrandSuggestions(query string, pod []*barcodes.BRAND, contributed []*barcodes.CONTRIBUTED_BRAND, limit int) []*BrandSuggestion {
+	results := make([]*BrandSuggestion, 0)
+	seen := make(map[string]bool)
+
+	for _, b := range pod {
+		seen[strings.ToLower(b.Name)] = true
+		results = append(results, &BrandSuggestion{BSIN: b.Id, Name: b.Name, URL: b.URL, Source: BRAND_SOURCE_POD, rank: brandRank(query, b.Name)})
+	}
+	for _, b := range contributed {
+		if seen[strings.ToLower(b.Name)] {
+			continue
+		}
+		seen[strings.ToLower(b.Name)] = true
+		results = append(results, &BrandSuggestion{Id: b.Uuid, Name: b.Name, URL: b.URL, Source: BRAND_SOURCE_CONTRIBUTED, rank: brandRank(query, b.Name)})
+	}
+
+	sort.Stable(byBrandRank(results))
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// SuggestBrands responds to GET requests with a "q" parameter, with the
+// list of POD and (approved) contributed brands matching it, best first
+func SuggestBrands(r *http.Request, db DBConnection) string {
+	// the result is a json list of BrandSuggestion structs
+	results := make([]*BrandSuggestion, 0)
+
+	if "GET" == r.Method {
+		params, paramErr := url.ParseQuery(r.URL.RawQuery)
+		if paramErr == nil {
+			query := strings.TrimSpace(params.Get("q"))
+
+			limit := BRAND_SUGGEST_DEFAULT
+			if n, nErr := strconv.Atoi(params.Get("n")); nErr == nil && n > 0 && n <= BRAND_SUGGEST_MAX {
+				limit = n
+			}
+
+			if len(query) > 0 {
+				suggestFn := func(statements map[string]*sql.Stmt) {
+					podSuggest, podSuggestExists := statements[barcodes.BRAND_SUGGEST]
+					contribSuggest, contribSuggestExists := statements[barcodes.CONTRIBUTED_BRAND_SUGGEST]
+					if podSuggestExists && contribSuggestExists {
+						pod, podErr := barcodes.SuggestBrand(podSuggest, query, BRAND_SUGGEST_CANDIDATES)
+						if podErr != nil {
+							fmt.Println(podErr)
+						}
+						contributed, contributedErr := barcodes.SuggestContributedBrand(contribSuggest, query, BRAND_SUGGEST_CANDIDATES)
+						if contributedErr != nil {
+							fmt.Println(contributedErr)
+						}
+						results = rankBrandSuggestions(query, pod, contributed, limit)
+					}
+				}
+				WithServerDatabase(db, suggestFn)
+			}
+		}
+	}
+
+	result, err := json.Marshal(results)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return string(result)
+}
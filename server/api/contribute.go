@@ -6,12 +6,107 @@ package api
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/Banrai/PiScan/server/database/barcodes"
-	"github.com/Banrai/PiScan/server/digest"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
+var (
+	ERR_NOTHING_TO_CORRECT = errors.New("There is no POD product to correct for this barcode")
+	ERR_MISSING_TITLE      = errors.New("The book title is missing")
+)
+
+// contributeBook saves the book metadata (title, authors, publisher) from
+// the posted form, for the given isbn barcode and contributor account
+func contributeBook(conn *sql.DB, statements map[string]*sql.Stmt, isbn string, form url.Values, acc *barcodes.ACCOUNT) (string, error) {
+	title := strings.TrimSpace(form.Get("prodName"))
+	if title == "" {
+		return "", ERR_MISSING_TITLE
+	}
+
+	bookInsertStmt, bookInsertStmtExists := statements[barcodes.BOOK_INSERT]
+	authorLookupStmt, authorLookupStmtExists := statements[barcodes.AUTHOR_LOOKUP]
+	authorInsertStmt, authorInsertStmtExists := statements[barcodes.AUTHOR_INSERT]
+	bookAuthorInsertStmt, bookAuthorInsertStmtExists := statements[barcodes.BOOK_AUTHOR_INSERT]
+	if !(bookInsertStmtExists && authorLookupStmtExists && authorInsertStmtExists && bookAuthorInsertStmtExists) {
+		return "", nil
+	}
+
+	book := &barcodes.BOOK{ISBN: isbn, Title: title, Publisher: form.Get("publisher")}
+	if authors, authorsExist := form["author"]; authorsExist {
+		book.Authors = authors
+	}
+
+	return barcodes.ContributeBook(conn, bookInsertStmt, authorLookupStmt, authorInsertStmt, bookAuthorInsertStmt, book, acc)
+}
+
+// contributeBarcodeBrand associates the contributed barcode item with
+// its brand, using, in order of preference: the explicit POD brand id
+// ("bsin") or contributed brand id ("brandId") chosen from the brand
+// suggestions, or else the brand name, which is added as a new
+// contributed brand unless it matches a POD brand exactly
+func contributeBarcodeBrand(statements map[string]*sql.Stmt, item barcodes.BARCODE, form url.Values, acc *barcodes.ACCOUNT) error {
+	brandLookupStmt, brandLookupStmtExists := statements[barcodes.BRAND_LOOKUP]
+	brandNameLookupStmt, brandNameLookupStmtExists := statements[barcodes.BRAND_NAME_LOOKUP]
+	contribLookupStmt, contribLookupStmtExists := statements[barcodes.CONTRIBUTED_BRAND_BY_ID]
+	brandInsertStmt, brandInsertStmtExists := statements[barcodes.CONTRIBUTED_BRAND_INSERT]
+	brandSupplementStmt, brandSuplementStmtExists := statements[barcodes.BARCODE_BRAND_INSERT]
+	brandContribStmt, brandContribStmtExists := statements[barcodes.BARCODE_CONTRIB_INSERT]
+	if !(brandLookupStmtExists && brandNameLookupStmtExists && contribLookupStmtExists && brandInsertStmtExists && brandSuplementStmtExists && brandContribStmtExists) {
+		return nil
+	}
+
+	if bsin := form.Get("bsin"); bsin != "" {
+		// an existing POD brand
+		brands, brandsErr := barcodes.LookupBrand(brandLookupStmt, bsin)
+		if brandsErr != nil {
+			return brandsErr
+		}
+		if len(brands) == 0 {
+			return ERR_UNKNOWN_BRAND
+		}
+		return barcodes.ContributeBarcodeBrand(brandSupplementStmt, item, brands[0])
+	}
+
+	if brandId := form.Get("brandId"); brandId != "" {
+		// an existing contributed brand
+		brands, brandsErr := barcodes.LookupContributedBrandById(contribLookupStmt, brandId, acc.Id)
+		if brandsErr != nil {
+			return brandsErr
+		}
+		if len(brands) == 0 {
+			return ERR_UNKNOWN_BRAND
+		}
+		return barcodes.ContributeBarcodeContributedBrand(brandContribStmt, item, brands[0])
+	}
+
+	brandName := strings.TrimSpace(form.Get("brandName"))
+	if brandName == "" {
+		return nil
+	}
+
+	// see if the brand already exists in POD, under exactly this name
+	existingBrands, existingBrandsErr := barcodes.LookupBrandByName(brandNameLookupStmt, brandName)
+	if existingBrandsErr != nil {
+		return existingBrandsErr
+	}
+	for _, existing := range existingBrands {
+		if strings.EqualFold(existing.Name, brandName) {
+			return barcodes.ContributeBarcodeBrand(brandSupplementStmt, item, existing)
+		}
+	}
+
+	// this brand is completely unknown to POD
+	brand := &barcodes.CONTRIBUTED_BRAND{Name: brandName, URL: form.Get("brandUrl")}
+	if _, err := barcodes.ContributeBrand(brandInsertStmt, brand, acc); err != nil {
+		return err
+	}
+	return barcodes.ContributeBarcodeContributedBrand(brandContribStmt, item, brand)
+}
+
 func ContributeData(r *http.Request, db DBConnection) string {
 	// the result is a simple json ack
 	ack := new(SimpleMessage)
@@ -22,10 +117,10 @@ func ContributeData(r *http.Request, db DBConnection) string {
 
 		emailVal, emailValExists := r.PostForm["email"]
 		barcode, barcodeExists := r.PostForm["barcode"]
-		hmacDigest, hmacDigestExists := r.PostForm["hmac"]
 
-		if emailValExists && barcodeExists && hmacDigestExists {
-			processFn := func(statements map[string]*sql.Stmt) {
+		// the request signature has already been verified (see digest.Verifier)
+		if emailValExists && barcodeExists {
+			processFn := func(conn *sql.DB, statements map[string]*sql.Stmt) {
 				// see if the account exists
 				accountLookupStmt, accountLookupStmtExists := statements[barcodes.ACCOUNT_LOOKUP_BY_EMAIL]
 				itemInsertStmt, itemInsertStmtExists := statements[barcodes.BARCODE_INSERT]
@@ -35,68 +130,64 @@ func ContributeData(r *http.Request, db DBConnection) string {
 					if accErr != nil {
 						ack.Err = accErr
 					} else {
-						// check the hmac digest
-						r.PostForm.Del("hmac") // separate the digest from the rest
-						if digest.DigestMatches(acc.APICode, r.PostForm.Encode(), hmacDigest[0]) {
-							// hmac is correct
-
-							// add the contributed barcode data
-							prodName, prodNameExists := r.PostForm["prodName"]
-							prodDesc, prodDescExists := r.PostForm["prodDesc"]
-
-							item := barcodes.BARCODE{Barcode: barcode[0], GtinEdit: false}
-							if prodNameExists {
-								item.ProductName = prodName[0]
-							}
-							if prodDescExists {
-								item.ProductDesc = prodDesc[0]
-							}
-							pk, insertErr := barcodes.ContributeBarcode(itemInsertStmt, item, acc)
-							if insertErr != nil {
-								ack.Err = insertErr
+						if barcodes.IsISBN(barcode[0]) {
+							// add the contributed book data instead
+							pk, bookErr := contributeBook(conn, statements, barcode[0], r.PostForm, acc)
+							if bookErr != nil {
+								ack.Err = bookErr
 							} else {
-								item.Uuid = pk
 								ack.Ack = fmt.Sprintf("ok: %s", pk)
+							}
+							return
+						}
 
-								// contribute the brand information, if any
-								brandName, brandNameExists := r.PostForm["brandName"]
-								brandUrl, brandUrlExists := r.PostForm["brandUrl"]
-								if brandNameExists || brandUrlExists {
-									// TO-DO: use an autocomplete/autosuggestion at the UI form,
-									// so that what gets posted here is either definitely an existing BSIN or not ...
-									// but instead, for now, use the name to lookup possible matches
-									brandLookupStmt, brandLookupStmtExists := statements[barcodes.BRAND_NAME_LOOKUP]
-									brandInsertStmt, brandInsertStmtExists := statements[barcodes.CONTRIBUTED_BRAND_INSERT]
-									brandSupplementStmt, brandSuplementStmtExists := statements[barcodes.BARCODE_BRAND_INSERT]
-									if brandLookupStmtExists && brandInsertStmtExists && brandSuplementStmtExists {
-										// see if the brand already exists in POD
-										existingBrands, existingBrandsErr := barcodes.LookupBrandByName(brandLookupStmt, brandName[0])
-										if existingBrandsErr != nil {
-											ack.Err = existingBrandsErr
-										}
-										if len(existingBrands) > 0 {
-											// for now, just take the first match, and use it as the existing POD brand
-											// mark the contributed barcode item as belonging to this brand
-											ack.Err = barcodes.ContributeBarcodeBrand(brandSupplementStmt, item, existingBrands[0])
-										} else {
-											// this brand is completely unknown to POD
-											brand := new(barcodes.CONTRIBUTED_BRAND)
-											if brandNameExists {
-												brand.Name = brandName[0]
-											}
-											if brandUrlExists {
-												brand.URL = brandUrl[0]
-											}
-											ack.Err = barcodes.ContributeBrand(brandInsertStmt, brand, acc)
-										}
-									}
-								}
+						// add the contributed barcode data
+						prodName, prodNameExists := r.PostForm["prodName"]
+						prodDesc, prodDescExists := r.PostForm["prodDesc"]
+
+						item := barcodes.BARCODE{Barcode: barcode[0], GtinEdit: false}
+						if r.PostForm.Get("correction") == "true" {
+							// this is a correction to an existing POD product,
+							// so keep track of what it is replacing (and refuse
+							// it if there is none, rather than storing it as a
+							// new product)
+							podLookupStmt, podLookupStmtExists := statements[barcodes.GTIN_LOOKUP]
+							if !podLookupStmtExists {
+								ack.Err = ERR_NOTHING_TO_CORRECT
+								return
+							}
+							podMatches, podMatchErr := barcodes.LookupGtin(podLookupStmt, barcode[0])
+							if podMatchErr != nil {
+								ack.Err = podMatchErr
+								return
 							}
+							if len(podMatches) == 0 {
+								ack.Err = ERR_NOTHING_TO_CORRECT
+								return
+							}
+							item.GtinEdit = true
+							item.OriginalName = podMatches[0].ProductName
+						}
+						if prodNameExists {
+							item.ProductName = prodName[0]
+						}
+						if prodDescExists {
+							item.ProductDesc = prodDesc[0]
+						}
+						pk, insertErr := barcodes.ContributeBarcode(itemInsertStmt, item, acc)
+						if insertErr != nil {
+							ack.Err = insertErr
+						} else {
+							item.Uuid = pk
+							ack.Ack = fmt.Sprintf("ok: %s", pk)
+
+							// contribute the brand information, if any
+							ack.Err = contributeBarcodeBrand(statements, item, r.PostForm, acc)
 						}
 					}
 				}
 			}
-			WithServerDatabase(db, processFn)
+			withServerDatabase(db, processFn)
 
 		}
 	}
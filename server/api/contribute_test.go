@@ -0,0 +1,27 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"github.com/Banrai/PiScan/server/database/barcodes"
+	"github.com/Banrai/PiScan/server/database/dbtest"
+	"net/url"
+	"testing"
+)
+
+func TestContributeBookTitle(t *testing.T) {
+	db := dbtest.New(t)
+	statements := db.Statements(t, barcodes.BOOK_INSERT, barcodes.AUTHOR_LOOKUP, barcodes.AUTHOR_INSERT, barcodes.BOOK_AUTHOR_INSERT)
+	acc := &barcodes.ACCOUNT{Id: "FEDCBA9876543210FEDCBA9876543210", Verified: true}
+
+	for _, title := range []string{"", "  "} {
+		form := url.Values{"prodName": {title}, "author": {"Joyce, James"}}
+		if _, err := contributeBook(db.DB, statements, "9780140186475", form, acc); err != ERR_MISSING_TITLE {
+			t.Errorf("contributeBook(%q): %v, expected %v", title, err, ERR_MISSING_TITLE)
+		}
+	}
+	if calls := db.Calls(); len(calls) != 0 {
+		t.Errorf("a book without a title made %d calls", len(calls))
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/Banrai/PiScan/server/emailer"
+	"github.com/Banrai/PiScan/server/emails"
+	htmltemplate "html/template"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"text/template"
+)
+
+const (
+	// Email template names (see the emails package)
+	EMAIL_VERIFY   = "verify"
+	EMAIL_ITEMS    = "items"
+	EMAIL_EXPIRING = "expiring"
+
+	EMAIL_TEMPLATE_SUFFIX = ".tmpl"
+
+	// the blocks each email template file defines ("text" is optional:
+	// if missing, the plain text body is derived from the html one)
+	EMAIL_SUBJECT_BLOCK = "subject"
+	EMAIL_HTML_BLOCK    = "html"
+	EMAIL_TEXT_BLOCK    = "text"
+
+	// the locale of the <template>.tmpl files
+	DEFAULT_LOCALE = ""
+)
+
+var (
+	ERR_UNKNOWN_EMAIL = errors.New("Unknown email template")
+
+	// the loaded email templates, by name and then locale
+	EMAIL_TEMPLATES = map[string]map[string]*EmailTemplate{}
+
+	// sample data for previewing each email template
+	EMAIL_SAMPLES = map[string]interface{}{
+		EMAIL_VERIFY: RegistrationLink{APIServer: "https://api.example.org", Token: "0123456789abcdef0123456789abcdef", ExpiryHours: VERIFY_TOKEN_EXPIRY / 3600},
+		EMAIL_ITEMS: EmailedItems{Email: "someone@example.org", Items: []*EmailedItem{
+			{Desc: "Whole Milk, 1 l", Barcode: "4000000000000", Brand: "Example Dairy", Quantity: 2},
+			{Desc: "Coffee Beans", Barcode: "0012345678905", Brand: "Example Roasters", Quantity: 1,
+				Vendors: []*EmailedVendorProduct{{Vendor: "AMZN:us", VendorName: "Amazon (US)", SKU: "B000000000", Price: "9.99 USD", BuyURL: "http://www.amazon.com/gp/aws/cart/add.html?ASIN.1=B000000000&Quantity.1=1"}}},
+		}},
+		EMAIL_EXPIRING: EmailedItems{Email: "someone@example.org", Days: 3, Items: []*EmailedItem{
+			{Desc: "Whole Milk, 1 l", Barcode: "4000000000000", Brand: "Example Dairy", Quantity: 1, Expires: "2015-03-01"},
+			{Desc: "Greek Yogurt", Barcode: "4000000000017", Brand: "Example Dairy", Quantity: 2, Expires: "2015-03-03"},
+		}},
+	}
+)
+
+// EmailTemplate is one email, in one locale
+type EmailTemplate struct {
+	html *htmltemplate.Template
+	text *template.Template
+}
+
+// parseEmailTemplate parses the template file content twice: as html (for
+// the html block, with escaping) and as plain text (for the others)
+func parseEmailTemplate(name, content string) (*EmailTemplate, error) {
+	h, hErr := htmltemplate.New(name).Funcs(htmltemplate.FuncMap(TEMPLATE_FUNCTIONS)).Parse(content)
+	if hErr != nil {
+		return nil, hErr
+	}
+	t, tErr := template.New(name).Funcs(TEMPLATE_FUNCTIONS).Parse(content)
+	if tErr != nil {
+		return nil, tErr
+	}
+	for _, block := range []string{EMAIL_SUBJECT_BLOCK, EMAIL_HTML_BLOCK} {
+		if t.Lookup(block) == nil {
+			return nil, fmt.Errorf("Email template %s does not define '%s'", name, block)
+		}
+	}
+	return &EmailTemplate{html: h, text: t}, nil
+}
+
+// loadEmailTemplates parses every template file in the folder, replacing
+// any already loaded for the same name and locale
+func loadEmailTemplates(folder fs.FS) error {
+	files, err := fs.Glob(folder, "*"+EMAIL_TEMPLATE_SUFFIX)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		content, readErr := fs.ReadFile(folder, file)
+		if readErr != nil {
+			return readErr
+		}
+
+		// <template>.tmpl or <template>.<locale>.tmpl
+		parts := strings.SplitN(strings.TrimSuffix(file, EMAIL_TEMPLATE_SUFFIX), ".", 2)
+		name, locale := parts[0], DEFAULT_LOCALE
+		if len(parts) > 1 {
+			locale = strings.ToLower(parts[1])
+		}
+
+		t, parseErr := parseEmailTemplate(file, string(content))
+		if parseErr != nil {
+			return parseErr
+		}
+		if _, exists := EMAIL_TEMPLATES[name]; !exists {
+			EMAIL_TEMPLATES[name] = make(map[string]*EmailTemplate)
+		}
+		EMAIL_TEMPLATES[name][locale] = t
+	}
+	return nil
+}
+
+// LoadEmailTemplates loads the default email templates, and then those in
+// the given folder (if any), which override them, or add more locales
+func LoadEmailTemplates(folder string) error {
+	EMAIL_TEMPLATES = map[string]map[string]*EmailTemplate{}
+	if err := loadEmailTemplates(emails.Defaults); err != nil {
+		return err
+	}
+	if len(folder) > 0 {
+		if _, err := os.Stat(folder); err != nil {
+			return err
+		}
+		return loadEmailTemplates(os.DirFS(folder))
+	}
+	return nil
+}
+
+// findEmailTemplate returns the template for the most specific matching
+// locale (e.g., "de-at", then "de"), or the default one
+func findEmailTemplate(name, locale string) (*EmailTemplate, error) {
+	if len(EMAIL_TEMPLATES) == 0 {
+		if err := LoadEmailTemplates(""); err != nil {
+			return nil, err
+		}
+	}
+	locales, exists := EMAIL_TEMPLATES[name]
+	if !exists {
+		return nil, ERR_UNKNOWN_EMAIL
+	}
+
+	locale = strings.ToLower(strings.Replace(locale, "_", "-", -1))
+	for len(locale) > 0 {
+		if t, found := locales[locale]; found {
+			return t, nil
+		}
+		if i := strings.LastIndex(locale, "-"); i > 0 {
+			locale = locale[:i]
+		} else {
+			break
+		}
+	}
+	if t, found := locales[DEFAULT_LOCALE]; found {
+		return t, nil
+	}
+	return nil, ERR_UNKNOWN_EMAIL
+}
+
+// RenderEmail produces the subject, html body, and plain text body of the
+// named email, in the given locale, with the data
+func RenderEmail(name, locale string, data interface{}) (string, string, string, error) {
+	t, err := findEmailTemplate(name, locale)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	var subject, html, text bytes.Buffer
+	if err = t.text.ExecuteTemplate(&subject, EMAIL_SUBJECT_BLOCK, data); err != nil {
+		return "", "", "", err
+	}
+	if err = t.html.ExecuteTemplate(&html, EMAIL_HTML_BLOCK, data); err != nil {
+		return "", "", "", err
+	}
+	if t.text.Lookup(EMAIL_TEXT_BLOCK) != nil {
+		if err = t.text.ExecuteTemplate(&text, EMAIL_TEXT_BLOCK, data); err != nil {
+			return "", "", "", err
+		}
+	} else {
+		text.WriteString(emailer.HTMLToText(html.String()))
+	}
+
+	return strings.TrimSpace(subject.String()), html.String(), text.String(), nil
+}
+
+// NewEmail renders the named email, in the given locale, as a Message
+// from the server to the recipient
+func NewEmail(name, locale, recipient string, data interface{}) (*emailer.Message, error) {
+	subject, html, text, err := RenderEmail(name, locale, data)
+	if err != nil {
+		return nil, err
+	}
+	return &emailer.Message{From: &emailer.EmailAddress{Address: SERVER_SENDER},
+		To:      []*emailer.EmailAddress{{Address: recipient}},
+		Subject: subject,
+		HTML:    html,
+		Text:    text}, nil
+}
+
+// PreviewEmail renders the named email (in the given locale) with its
+// sample data, writing the subject and both bodies to w
+func PreviewEmail(w io.Writer, name, locale string) error {
+	sample, exists := EMAIL_SAMPLES[name]
+	if !exists {
+		return ERR_UNKNOWN_EMAIL
+	}
+	subject, html, text, err := RenderEmail(name, locale, sample)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Subject: %s\n\n--- text ---\n%s\n\n--- html ---\n%s\n", subject, text, html)
+	return nil
+}
+
+// EmailTemplateNames lists the templates which can be previewed
+func EmailTemplateNames() []string {
+	return []string{EMAIL_VERIFY, EMAIL_ITEMS, EMAIL_EXPIRING}
+}
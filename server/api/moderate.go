@@ -0,0 +1,308 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Banrai/PiScan/server/database/barcodes"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const (
+	// How many contributions to return in the moderation queue
+	DEFAULT_QUEUE_SIZE = 50
+	MAX_QUEUE_SIZE     = 500
+
+	// Vote form values
+	VOTE_UP_PARAM   = "up"
+	VOTE_FLAG_PARAM = "flag"
+)
+
+var (
+	ERR_UNKNOWN_ACCOUNT   = errors.New("Unknown account")
+	ERR_NOT_AUTHORIZED    = errors.New("This account is not allowed to make that request")
+	ERR_BAD_CONTRIBUTION  = errors.New("Unknown contribution type")
+	ERR_MISSING_PARAMETER = errors.New("Missing request parameter")
+	ERR_UNKNOWN_BRAND     = errors.New("Unknown brand")
+)
+
+type ModerationQueue struct {
+	Barcodes []*barcodes.PENDING_BARCODE `json:"barcodes"`
+	Brands   []*barcodes.PENDING_BRAND   `json:"brands"`
+	Books    []*barcodes.PENDING_BOOK    `json:"books"`
+	Err      string                      `json:"err,omitempty"`
+}
+
+// authenticateContributor finds the account matching the email in the
+// posted form (whose signature has already been verified by its api code,
+// see digest.Verifier)
+func authenticateContributor(statements map[string]*sql.Stmt, form url.Values) (*barcodes.ACCOUNT, error) {
+	email := form.Get("email")
+	if email == "" {
+		return nil, ERR_MISSING_PARAMETER
+	}
+
+	accountLookupStmt, accountLookupStmtExists := statements[barcodes.ACCOUNT_LOOKUP_BY_EMAIL]
+	if !accountLookupStmtExists {
+		return nil, ERR_UNKNOWN_ACCOUNT
+	}
+	acc, accErr := barcodes.LookupAccount(accountLookupStmt, email, false)
+	if accErr != nil {
+		return nil, accErr
+	}
+	if acc.Id == "" {
+		return nil, ERR_UNKNOWN_ACCOUNT
+	}
+
+	return acc, nil
+}
+
+// contributionStatusStatements returns the prepared statements which
+// change the status of the given type of contribution, and count it
+func contributionStatusStatements(statements map[string]*sql.Stmt, contributionType string) (*sql.Stmt, *sql.Stmt, error) {
+	var stmt, countStmt *sql.Stmt
+	var exists, countExists bool
+	switch contributionType {
+	case barcodes.CONTRIBUTION_BARCODE:
+		stmt, exists = statements[barcodes.BARCODE_SET_STATUS]
+		countStmt, countExists = statements[barcodes.BARCODE_COUNT]
+	case barcodes.CONTRIBUTION_BRAND:
+		stmt, exists = statements[barcodes.BRAND_SET_STATUS]
+		countStmt, countExists = statements[barcodes.BRAND_COUNT]
+	case barcodes.CONTRIBUTION_BOOK:
+		stmt, exists = statements[barcodes.BOOK_SET_STATUS]
+		countStmt, countExists = statements[barcodes.BOOK_COUNT]
+	}
+	if !exists || !countExists {
+		return nil, nil, ERR_BAD_CONTRIBUTION
+	}
+	return stmt, countStmt, nil
+}
+
+// VoteContribution lets a verified account upvote or flag a pending
+// contribution
+func VoteContribution(r *http.Request, db DBConnection) string {
+	// the result is a simple json ack
+	ack := new(SimpleMessage)
+
+	// this function only responds to POST requests
+	if "POST" == r.Method {
+		r.ParseForm()
+
+		contributionId := r.PostForm.Get("id")
+		voteVal := r.PostForm.Get("vote")
+		if contributionId == "" || voteVal == "" {
+			ack.Err = ERR_MISSING_PARAMETER
+		} else {
+			voteFn := func(statements map[string]*sql.Stmt) {
+				acc, accErr := authenticateContributor(statements, r.PostForm)
+				if accErr != nil {
+					ack.Err = accErr
+					return
+				}
+				if !acc.CanVote() {
+					ack.Err = ERR_NOT_AUTHORIZED
+					return
+				}
+
+				vote := 0
+				switch voteVal {
+				case VOTE_UP_PARAM:
+					vote = barcodes.VOTE_UP
+				case VOTE_FLAG_PARAM:
+					vote = barcodes.VOTE_FLAG
+				}
+
+				voteStmt, voteStmtExists := statements[barcodes.VOTE_INSERT]
+				if voteStmtExists {
+					ack.Err = barcodes.VoteOnContribution(voteStmt, contributionId, vote, acc)
+					if ack.Err == nil {
+						ack.Ack = fmt.Sprintf("ok: %s", contributionId)
+					}
+				}
+			}
+			WithServerDatabase(db, voteFn)
+		}
+	}
+
+	result, err := json.Marshal(ack)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return string(result)
+}
+
+// GetModerationQueue returns the contributions in the requested status
+// (pending, by default), oldest first, for trusted contributors and admins
+func GetModerationQueue(r *http.Request, db DBConnection) string {
+	// the result is a json representation of the queue
+	queue := &ModerationQueue{Barcodes: make([]*barcodes.PENDING_BARCODE, 0), Brands: make([]*barcodes.PENDING_BRAND, 0), Books: make([]*barcodes.PENDING_BOOK, 0)}
+
+	// this function only responds to POST requests
+	if "POST" == r.Method {
+		r.ParseForm()
+
+		status := r.PostForm.Get("status")
+		if status == "" {
+			status = barcodes.STATUS_PENDING
+		}
+		contributionType := r.PostForm.Get("type") // optional: all types by default
+		limit := DEFAULT_QUEUE_SIZE
+		if n, nErr := strconv.Atoi(r.PostForm.Get("n")); nErr == nil && n > 0 && n <= MAX_QUEUE_SIZE {
+			limit = n
+		}
+
+		queueFn := func(statements map[string]*sql.Stmt) {
+			acc, accErr := authenticateContributor(statements, r.PostForm)
+			if accErr != nil {
+				queue.Err = accErr.Error()
+				return
+			}
+			if !acc.CanModerate() {
+				queue.Err = ERR_NOT_AUTHORIZED.Error()
+				return
+			}
+
+			barcodeStmt, barcodeStmtExists := statements[barcodes.PENDING_BARCODES]
+			if barcodeStmtExists && (contributionType == "" || contributionType == barcodes.CONTRIBUTION_BARCODE) {
+				items, itemsErr := barcodes.LookupContributedBarcodesByStatus(barcodeStmt, status, limit)
+				if itemsErr != nil {
+					queue.Err = itemsErr.Error()
+				} else {
+					queue.Barcodes = items
+				}
+			}
+			brandStmt, brandStmtExists := statements[barcodes.PENDING_BRANDS]
+			if brandStmtExists && (contributionType == "" || contributionType == barcodes.CONTRIBUTION_BRAND) {
+				brands, brandsErr := barcodes.LookupContributedBrandsByStatus(brandStmt, status, limit)
+				if brandsErr != nil {
+					queue.Err = brandsErr.Error()
+				} else {
+					queue.Brands = brands
+				}
+			}
+			bookStmt, bookStmtExists := statements[barcodes.PENDING_BOOKS]
+			if bookStmtExists && (contributionType == "" || contributionType == barcodes.CONTRIBUTION_BOOK) {
+				books, booksErr := barcodes.LookupContributedBooksByStatus(bookStmt, status, limit)
+				if booksErr != nil {
+					queue.Err = booksErr.Error()
+				} else {
+					queue.Books = books
+				}
+			}
+		}
+		WithServerDatabase(db, queueFn)
+	}
+
+	result, err := json.Marshal(queue)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return string(result)
+}
+
+// ReviewContribution lets trusted contributors and admins approve or
+// reject a contribution
+func ReviewContribution(r *http.Request, db DBConnection) string {
+	// the result is a simple json ack
+	ack := new(SimpleMessage)
+
+	// this function only responds to POST requests
+	if "POST" == r.Method {
+		r.ParseForm()
+
+		contributionId := r.PostForm.Get("id")
+		contributionType := r.PostForm.Get("type")
+		status := r.PostForm.Get("status")
+		if contributionId == "" || contributionType == "" || status == "" {
+			ack.Err = ERR_MISSING_PARAMETER
+		} else {
+			reviewFn := func(statements map[string]*sql.Stmt) {
+				acc, accErr := authenticateContributor(statements, r.PostForm)
+				if accErr != nil {
+					ack.Err = accErr
+					return
+				}
+				if !acc.CanModerate() {
+					ack.Err = ERR_NOT_AUTHORIZED
+					return
+				}
+
+				statusStmt, countStmt, statusStmtErr := contributionStatusStatements(statements, contributionType)
+				if statusStmtErr != nil {
+					ack.Err = statusStmtErr
+					return
+				}
+				ack.Err = barcodes.SetContributionStatus(statusStmt, countStmt, contributionId, status)
+				if ack.Err == nil {
+					ack.Ack = fmt.Sprintf("%s: %s", status, contributionId)
+				}
+			}
+			WithServerDatabase(db, reviewFn)
+		}
+	}
+
+	result, err := json.Marshal(ack)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return string(result)
+}
+
+// SetContributorRole lets admins promote (or demote) other accounts
+func SetContributorRole(r *http.Request, db DBConnection) string {
+	// the result is a simple json ack
+	ack := new(SimpleMessage)
+
+	// this function only responds to POST requests
+	if "POST" == r.Method {
+		r.ParseForm()
+
+		target := r.PostForm.Get("account") // the email of the account to change
+		role := r.PostForm.Get("role")
+		if target == "" || role == "" {
+			ack.Err = ERR_MISSING_PARAMETER
+		} else {
+			roleFn := func(statements map[string]*sql.Stmt) {
+				acc, accErr := authenticateContributor(statements, r.PostForm)
+				if accErr != nil {
+					ack.Err = accErr
+					return
+				}
+				if !acc.IsAdmin() {
+					ack.Err = ERR_NOT_AUTHORIZED
+					return
+				}
+
+				accountLookupStmt, accountLookupStmtExists := statements[barcodes.ACCOUNT_LOOKUP_BY_EMAIL]
+				roleStmt, roleStmtExists := statements[barcodes.ACCOUNT_SET_ROLE]
+				if accountLookupStmtExists && roleStmtExists {
+					targetAcc, targetErr := barcodes.LookupAccount(accountLookupStmt, target, false)
+					if targetErr != nil {
+						ack.Err = targetErr
+					} else if targetAcc.Id == "" {
+						ack.Err = ERR_UNKNOWN_ACCOUNT
+					} else {
+						ack.Err = barcodes.SetAccountRole(roleStmt, targetAcc, role)
+						if ack.Err == nil {
+							ack.Ack = fmt.Sprintf("%s: %s", role, target)
+						}
+					}
+				}
+			}
+			WithServerDatabase(db, roleFn)
+		}
+	}
+
+	result, err := json.Marshal(ack)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return string(result)
+}
@@ -6,54 +6,196 @@ package api
 import (
 	"bytes"
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"github.com/Banrai/PiScan/server/commerce"
 	"github.com/Banrai/PiScan/server/database/barcodes"
-	"github.com/Banrai/PiScan/server/digest"
 	"github.com/Banrai/PiScan/server/emailer"
+	"github.com/Banrai/PiScan/server/pdf"
 	"net/http"
+	"strconv"
+	"strings"
 	"text/template"
 )
 
 const (
-	SHOPPING_LIST_SUBJECT = "My Items"
-	SHOPPING_LIST_MESSAGE = `<p>Here are the items you selected to send to {{.Email}}</p>
-
-	{{range $i, $item := .Items}}
-	<p>
-	  {{(plus1 $i)}}. {{$item}}
-	</p>
-	{{end}}`
+	// Optional attachments (the "attach" request parameter)
+	ATTACH_CSV = "csv"
+	ATTACH_PDF = "pdf"
+
+	SHOPPING_LIST_FILE = "my-items"
+)
+
+var (
+	TEMPLATE_FUNCTIONS = template.FuncMap{
+		// Thanks to Russ Cox, for demonstrating how to use template functions
+		// http://play.golang.org/p/V94BPN0uKD
+		// via http://stackoverflow.com/questions/22367337/last-item-in-a-golang-template-range#comment34044021_22375000
+
+		"plus1": func(x int) int { // use this to increment a range value (which starts at zero) within a template
+			return x + 1
+		},
+	}
+
+	CSV_HEADER = []string{"Quantity", "Item", "Brand", "Barcode", "Vendor", "Product Code", "Price", "Buy"}
 )
 
+// EmailedVendorProduct is where an emailed item can be bought
+type EmailedVendorProduct struct {
+	Vendor     string `json:"vnd"` // an API.Vendor string
+	VendorName string `json:"vndName,omitempty"`
+	SKU        string `json:"sku"`
+	Price      string `json:"price,omitempty"` // formatted, see commerce.FormatPrice
+	BuyURL     string `json:"-"`               // filled in by the server
+}
+
+// Label is how the vendor is presented in the email
+func (vp *EmailedVendorProduct) Label() string {
+	if vp.VendorName != "" {
+		return vp.VendorName
+	}
+	return vp.Vendor
+}
+
+// EmailedItem is one of the items sent by the client
+type EmailedItem struct {
+	Desc     string                  `json:"desc"`
+	Barcode  string                  `json:"barcode,omitempty"`
+	Brand    string                  `json:"brand,omitempty"`
+	Quantity int                     `json:"qty,omitempty"`
+	Expires  string                  `json:"expires,omitempty"` // YYYY-MM-DD (expiry reminders only)
+	Vendors  []*EmailedVendorProduct `json:"vendors,omitempty"`
+}
+
 type EmailedItems struct {
-	Items []string
-	Email string
+	Items    []*EmailedItem
+	Email    string
+	Language string   // the account's locale for emails
+	Attach   []string // any of ATTACH_CSV and ATTACH_PDF
+	Days     int      // how far ahead the expiry reminder looks
+}
+
+// ParseEmailedItems reads the json list of items in the "items" request
+// parameter, or else the plain list of descriptions in the "item"
+// parameters (sent by older clients), filling in the default quantity
+// and the vendor buy links
+func ParseEmailedItems(form map[string][]string) ([]*EmailedItem, error) {
+	items := make([]*EmailedItem, 0)
+	if list, exists := form["items"]; exists && len(list) > 0 {
+		if err := json.Unmarshal([]byte(list[0]), &items); err != nil {
+			return items, err
+		}
+	} else {
+		for _, desc := range form["item"] {
+			items = append(items, &EmailedItem{Desc: desc})
+		}
+	}
+
+	for _, item := range items {
+		if item.Quantity < 1 {
+			item.Quantity = 1
+		}
+		for _, vp := range item.Vendors {
+			vp.BuyURL = commerce.BuyURL(vp.Vendor, []string{vp.SKU})
+		}
+	}
+	return items, nil
+}
+
+// ItemsCSV returns the list of items as a spreadsheet, with one row for
+// each vendor of each item
+func ItemsCSV(items []*EmailedItem) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(CSV_HEADER)
+	for _, item := range items {
+		row := []string{strconv.Itoa(item.Quantity), item.Desc, item.Brand, item.Barcode}
+		if len(item.Vendors) == 0 {
+			w.Write(append(row, "", "", "", ""))
+		}
+		for _, vp := range item.Vendors {
+			w.Write(append(row, vp.Label(), vp.SKU, vp.Price, vp.BuyURL))
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
 }
 
-var TEMPLATE_FUNCTIONS = template.FuncMap{
-	// Thanks to Russ Cox, for demonstrating how to use template functions
-	// http://play.golang.org/p/V94BPN0uKD
-	// via http://stackoverflow.com/questions/22367337/last-item-in-a-golang-template-range#comment34044021_22375000
+// ItemsPDF returns the list of items as a printable document
+func ItemsPDF(title string, context EmailedItems) []byte {
+	doc := pdf.New(title)
+	doc.Heading(title)
+	doc.Blank()
+	for i, item := range context.Items {
+		title := fmt.Sprintf("%d. [ ] %d x %s", i+1, item.Quantity, item.Desc)
+		if item.Brand != "" {
+			title = fmt.Sprintf("%s (%s)", title, item.Brand)
+		}
+		doc.Text(title)
+		details := make([]string, 0)
+		if item.Barcode != "" {
+			details = append(details, item.Barcode)
+		}
+		for _, vp := range item.Vendors {
+			if vp.Price != "" {
+				details = append(details, fmt.Sprintf("%s: %s", vp.Label(), vp.Price))
+			}
+		}
+		if len(details) > 0 {
+			doc.Text(strings.Join(details, " | "))
+		}
+	}
+	return doc.Bytes()
+}
 
-	"plus1": func(x int) int { // use this to increment a range value (which starts at zero) within a template
-		return x + 1
-	},
+// attachments returns the requested attachments for the list of items
+func (context EmailedItems) attachments(title string) ([]*emailer.EmailAttachment, error) {
+	attachments := make([]*emailer.EmailAttachment, 0)
+	for _, kind := range context.Attach {
+		switch kind {
+		case ATTACH_CSV:
+			data, err := ItemsCSV(context.Items)
+			if err != nil {
+				return attachments, err
+			}
+			attachments = append(attachments, &emailer.EmailAttachment{ContentType: "text/csv", FileName: SHOPPING_LIST_FILE + ".csv", Data: data})
+		case ATTACH_PDF:
+			attachments = append(attachments, &emailer.EmailAttachment{ContentType: "application/pdf", FileName: SHOPPING_LIST_FILE + ".pdf", Data: ItemsPDF(title, context)})
+		}
+	}
+	return attachments, nil
 }
 
-func SendEmailedItems(context EmailedItems) error {
-	var msg bytes.Buffer
-	t := template.Must(template.New("SHOPPING_LIST_MESSAGE").Funcs(TEMPLATE_FUNCTIONS).Parse(SHOPPING_LIST_MESSAGE))
-	err := t.Execute(&msg, context)
-	if err == nil {
-		sender := emailer.EmailAddress{Address: SERVER_SENDER}
-		recipient := emailer.EmailAddress{Address: context.Email}
-		err = emailer.Send(SHOPPING_LIST_SUBJECT, msg.String(), "text/html", &sender, &recipient, []*emailer.EmailAttachment{})
+// SendEmailedItems sends the named email (EMAIL_ITEMS or EMAIL_EXPIRING)
+// with the list of items, and any attachments
+func SendEmailedItems(name string, context EmailedItems) error {
+	m, err := NewEmail(name, context.Language, context.Email, context)
+	if err != nil {
+		return err
 	}
-	return err
+	m.Attachments, err = context.attachments(m.Subject)
+	if err != nil {
+		return err
+	}
+	return emailer.SendMessage(m)
 }
 
+// EmailSelectedItems emails the list of items the client selected to
+// the account
 func EmailSelectedItems(r *http.Request, db DBConnection) string {
+	return emailItems(r, db, EMAIL_ITEMS)
+}
+
+// EmailExpiringItems emails the client's reminder of the items expiring
+// within the number of days in the request to the account
+func EmailExpiringItems(r *http.Request, db DBConnection) string {
+	return emailItems(r, db, EMAIL_EXPIRING)
+}
+
+// emailItems sends the named email with the list of items in the request
+// to the account which signed it
+func emailItems(r *http.Request, db DBConnection, name string) string {
 	// the result is a simple json ack
 	ack := new(SimpleMessage)
 
@@ -62,10 +204,13 @@ func EmailSelectedItems(r *http.Request, db DBConnection) string {
 		r.ParseForm()
 
 		emailVal, emailValExists := r.PostForm["email"]
-		items, itemsExist := r.PostForm["item"]
-		hmacDigest, hmacDigestExists := r.PostForm["hmac"]
+		items, itemsErr := ParseEmailedItems(r.PostForm)
+		if itemsErr != nil {
+			ack.Err = itemsErr
+		}
 
-		if emailValExists && itemsExist && hmacDigestExists {
+		// the request signature has already been verified (see digest.Verifier)
+		if emailValExists && itemsErr == nil && len(items) > 0 {
 			processFn := func(statements map[string]*sql.Stmt) {
 				// see if the account exists
 				accountLookupStmt, accountLookupStmtExists := statements[barcodes.ACCOUNT_LOOKUP_BY_EMAIL]
@@ -75,16 +220,14 @@ func EmailSelectedItems(r *http.Request, db DBConnection) string {
 					if accErr != nil {
 						ack.Err = accErr
 					} else {
-						// check the hmac digest
-						r.PostForm.Del("hmac") // separate the digest from the rest
-						if digest.DigestMatches(acc.APICode, r.PostForm.Encode(), hmacDigest[0]) {
-							// hmac is correct
-
-							// email the list of items
-							content := EmailedItems{Email: acc.Email, Items: items}
-							ack.Err = SendEmailedItems(content)
+						// email the list of items
+						content := EmailedItems{Email: acc.Email, Language: acc.Language, Items: items, Attach: r.PostForm["attach"]}
+						content.Days, _ = strconv.Atoi(r.PostForm.Get("days"))
+						ack.Err = SendEmailedItems(name, content)
 
-							// and update this json reply
+						// and update this json reply, only if it was sent,
+						// since the error itself does not survive encoding
+						if ack.Err == nil {
 							ack.Ack = "ok"
 						}
 					}
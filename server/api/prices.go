@@ -0,0 +1,135 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/Banrai/PiScan/server/commerce"
+	"github.com/Banrai/PiScan/server/database/barcodes"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// how many past prices to return, by default and at most
+	PRICE_HISTORY_DEFAULT = 10
+	PRICE_HISTORY_MAX     = 100
+
+	// price trends
+	PRICE_UP   = "up"
+	PRICE_DOWN = "down"
+	PRICE_SAME = "same"
+)
+
+type PriceHistory struct {
+	Vendor   string            `json:"vnd"`
+	SKU      string            `json:"sku"`
+	Price    int64             `json:"price,omitempty"`
+	Currency string            `json:"currency,omitempty"`
+	Display  string            `json:"display,omitempty"`
+	Previous int64             `json:"previous,omitempty"`
+	Trend    string            `json:"trend,omitempty"`
+	History  []*barcodes.PRICE `json:"history"`
+}
+
+// recordPrices adds every vendor product price found in the lookup to the
+// price history, and fills in the most recent known price for the vendor
+// products which did not have one
+func recordPrices(statements map[string]*sql.Stmt, products []*commerce.API) {
+	priceLookup, priceLookupExists := statements[barcodes.PRICE_LOOKUP]
+	priceInsert, priceInsertExists := statements[barcodes.PRICE_INSERT]
+	if !priceLookupExists || !priceInsertExists {
+		return
+	}
+
+	for _, product := range products {
+		if product.Vendor == "" {
+			continue
+		}
+		if product.Price > 0 && product.Currency != "" {
+			price := barcodes.PRICE{Vendor: product.Vendor, SKU: product.SKU, Price: product.Price, Currency: product.Currency}
+			barcodes.InsertPrice(priceInsert, price)
+		} else {
+			prices, pricesErr := barcodes.LookupPrices(priceLookup, product.Vendor, product.SKU, 1)
+			if pricesErr == nil && len(prices) > 0 {
+				product.Price = prices[0].Price
+				product.Currency = prices[0].Currency
+			}
+		}
+	}
+}
+
+// priceTrend compares the most recent price in the history to the last
+// different one (in the same currency), and returns it along with the
+// corresponding trend string
+func priceTrend(history []*barcodes.PRICE) (int64, string) {
+	if len(history) == 0 {
+		return 0, ""
+	}
+	current := history[0]
+	for _, past := range history[1:] {
+		if past.Currency != current.Currency || past.Price == current.Price {
+			continue
+		}
+		if past.Price < current.Price {
+			return past.Price, PRICE_UP
+		}
+		return past.Price, PRICE_DOWN
+	}
+	return 0, PRICE_SAME
+}
+
+// GetPrices responds to requests with parallel lists of "vnd" (vendor id)
+// and "sku" parameters, with the current price, trend, and history of each
+// of those vendor products; the lists can be long, so they are posted as a
+// form, though GET requests with them in the query string also work
+func GetPrices(r *http.Request, db DBConnection) string {
+	// the result is a json list of PriceHistory structs
+	results := make([]*PriceHistory, 0)
+
+	if "GET" == r.Method || "POST" == r.Method {
+		paramErr := r.ParseForm()
+		params := r.Form
+		if paramErr == nil {
+			vendors := params["vnd"]
+			skus := params["sku"]
+
+			limit := PRICE_HISTORY_DEFAULT
+			if n, nErr := strconv.Atoi(params.Get("n")); nErr == nil && n > 0 && n <= PRICE_HISTORY_MAX {
+				limit = n
+			}
+
+			if len(vendors) > 0 && len(vendors) == len(skus) {
+				priceFn := func(statements map[string]*sql.Stmt) {
+					priceLookup, priceLookupExists := statements[barcodes.PRICE_LOOKUP]
+					if priceLookupExists {
+						for i, vendor := range vendors {
+							history, historyErr := barcodes.LookupPrices(priceLookup, vendor, skus[i], limit)
+							if historyErr != nil {
+								continue
+							}
+							result := &PriceHistory{Vendor: vendor, SKU: skus[i], History: history}
+							if len(history) > 0 {
+								result.Price = history[0].Price
+								result.Currency = history[0].Currency
+								result.Display = commerce.FormatPrice(result.Price, result.Currency)
+								result.Previous, result.Trend = priceTrend(history)
+							}
+							results = append(results, result)
+						}
+					}
+				}
+				WithServerDatabase(db, priceFn)
+			}
+		}
+	}
+
+	result, err := json.Marshal(results)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return string(result)
+}
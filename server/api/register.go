@@ -4,52 +4,60 @@
 package api
 
 import (
-	"bytes"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"github.com/Banrai/PiScan/server/database/barcodes"
-	"github.com/Banrai/PiScan/server/digest"
 	"github.com/Banrai/PiScan/server/emailer"
 	"net/http"
 	"net/url"
-	"text/template"
 )
 
 const (
 	SERVER_SENDER = "openproductdata@saruzai.com" // used by other email notifications
 
-	VERIFY_SUBJECT = "Please verify your email address"
-	VERIFY_MESSAGE = `<p>Thank you for registering to contribute to the Open Product Database.</p>
-<p>Please confirm your email address by clicking on this link:</p>
-<p><a href="{{.APIServer}}/verify/{{.APICode}}">{{.APIServer}}/verify/{{.APICode}}</a></p>
-<p>You only have to do this once per email address.</p>`
+	// How long the verification links work, in seconds
+	VERIFY_TOKEN_EXPIRY = 48 * 60 * 60
 )
 
+// RegistrationLink is the data for the verification email template
 type RegistrationLink struct {
-	APIServer string
-	APICode   string
+	APIServer   string
+	Token       string // the verification token
+	ExpiryHours int
 }
 
-func SendVerificationEmail(serverLink, email, code string) error {
-	var msg bytes.Buffer
-	t := template.Must(template.New("VERIFY_MESSAGE").Parse(VERIFY_MESSAGE))
-	context := RegistrationLink{serverLink, code}
-	err := t.Execute(&msg, context)
-	if err == nil {
-		sender := emailer.EmailAddress{Address: SERVER_SENDER}
-		recipient := emailer.EmailAddress{Address: email}
-		err = emailer.Send(VERIFY_SUBJECT, msg.String(), "text/html", &sender, &recipient, []*emailer.EmailAttachment{})
+// SendVerificationEmail sends the link to verify the email address, using
+// the given verification token, in the given locale
+func SendVerificationEmail(serverLink, email, token, locale string) error {
+	context := RegistrationLink{serverLink, token, VERIFY_TOKEN_EXPIRY / 3600}
+	m, err := NewEmail(EMAIL_VERIFY, locale, email, context)
+	if err != nil {
+		return err
 	}
-	return err
+	return emailer.SendMessage(m)
+}
+
+// issueVerification replaces any previous verification token for the
+// account with a new one, and emails the corresponding link
+func issueVerification(statements map[string]*sql.Stmt, serverLink string, acc *barcodes.ACCOUNT) error {
+	tokenStmt, tokenStmtExists := statements[barcodes.ACCOUNT_SET_VERIFY_TOKEN]
+	if !tokenStmtExists {
+		return ERR_UNKNOWN_ACCOUNT
+	}
+	token, err := acc.IssueVerificationToken(tokenStmt, VERIFY_TOKEN_EXPIRY)
+	if err != nil {
+		return err
+	}
+	return SendVerificationEmail(serverLink, acc.Email, token, acc.Language)
 }
 
 func RegisterAccount(r *http.Request, db DBConnection, serverLink string) string {
 	// the result is a simple json ack
 	ack := new(SimpleMessage)
 
-	// this function only responds to GET requests with
-	// an hmac digest of the contents
+	// this function only responds to GET requests, signed
+	// with the api code (see RegistrationKey)
 	if "GET" == r.Method {
 		params, paramErr := url.ParseQuery(r.URL.RawQuery)
 		if paramErr != nil {
@@ -57,52 +65,56 @@ func RegisterAccount(r *http.Request, db DBConnection, serverLink string) string
 		} else {
 			email := params.Get("email")
 			apiCode := params.Get("api")
-			hmacDigest := params.Get("hmac")
+			language := params.Get("lang") // optional: the locale for emails
 
 			if email != "" && apiCode != "" {
-				// confirm the digest matches
-				params.Del("hmac") // separate the digest from the rest
-				if digest.DigestMatches(email, params.Encode(), hmacDigest) {
-					// the request is valid
-					registerFn := func(statements map[string]*sql.Stmt) {
-						lookupStmt, lookupStmtExists := statements[barcodes.ACCOUNT_LOOKUP_BY_EMAIL]
-						insertStmt, insertStmtExists := statements[barcodes.ACCOUNT_INSERT]
-						if lookupStmtExists && insertStmtExists {
-							// see if the email is available
-							acc, accErr := barcodes.LookupAccount(lookupStmt, email, false)
-							if accErr != nil {
-								ack.Err = accErr
+				// the request is valid
+				registerFn := func(statements map[string]*sql.Stmt) {
+					lookupStmt, lookupStmtExists := statements[barcodes.ACCOUNT_LOOKUP_BY_EMAIL]
+					insertStmt, insertStmtExists := statements[barcodes.ACCOUNT_INSERT]
+					if lookupStmtExists && insertStmtExists {
+						// see if the email is available
+						acc, accErr := barcodes.LookupAccount(lookupStmt, email, false)
+						if accErr != nil {
+							ack.Err = accErr
+						} else {
+							if acc.Id != "" {
+								// this account has already been registered
+								ack.Ack = fmt.Sprintf("exists: %s", acc.Id)
+
+								// (but its email locale may have changed)
+								languageStmt, languageStmtExists := statements[barcodes.ACCOUNT_SET_LANGUAGE]
+								if language != "" && language != acc.Language && languageStmtExists {
+									ack.Err = acc.SetLanguage(languageStmt, language)
+								}
+
+								if ack.Err == nil && !acc.Verified {
+									// but it has yet to be verified, so send an email (with a new link)
+									ack.Err = issueVerification(statements, serverLink, acc)
+								}
 							} else {
-								if acc.Id != "" {
-									// this account has already been registered
-									ack.Ack = fmt.Sprintf("exists: %s", acc.Id)
-
-									if !acc.Verified {
-										// but it has yet to be verified, so send an email
-										ack.Err = SendVerificationEmail(serverLink, email, acc.Id)
-									}
+								// can proceed with the registration (add this email + api combination)
+								acc.Email = email
+								acc.APICode = apiCode
+								acc.Language = language
+								pk, addErr := acc.Add(insertStmt)
+								if addErr != nil {
+									ack.Err = addErr
 								} else {
-									// can proceed with the registration (add this email + api combination)
-									acc.Email = email
-									acc.APICode = apiCode
-									pk, addErr := acc.Add(insertStmt)
-									if addErr != nil {
-										ack.Err = accErr
-									} else {
-										// the account is created, but unverified
-
-										// send an email for verfication
-										ack.Err = SendVerificationEmail(serverLink, email, pk)
-
-										// and update this json reply
-										ack.Ack = fmt.Sprintf("ok: %s", pk)
-									}
+									// the account is created, but unverified
+
+									// send an email for verfication
+									acc.Id = pk
+									ack.Err = issueVerification(statements, serverLink, acc)
+
+									// and update this json reply
+									ack.Ack = fmt.Sprintf("ok: %s", pk)
 								}
 							}
 						}
 					}
-					WithServerDatabase(db, registerFn)
 				}
+				WithServerDatabase(db, registerFn)
 			}
 		}
 	}
@@ -114,85 +126,43 @@ func RegisterAccount(r *http.Request, db DBConnection, serverLink string) string
 	return string(result)
 }
 
-func VerifyAccount(r *http.Request, db DBConnection) string {
-	// accumulate the result in a simple ack struct
-	ack := new(SimpleMessage)
-
-	// this function only responds to GET requests
-	if "GET" == r.Method {
-		// get the verification code from the query string
-		code := r.URL.Path[len("/verify/"):]
-
-		verifyFn := func(statements map[string]*sql.Stmt) {
-			lookupStmt, lookupStmtExists := statements[barcodes.ACCOUNT_LOOKUP_BY_ID]
-			updateStmt, updateStmtExists := statements[barcodes.ACCOUNT_UPDATE]
-			if lookupStmtExists && updateStmtExists {
-				// see if the account for this code exists
-				acc, accErr := barcodes.LookupAccount(lookupStmt, code, true)
-				if accErr != nil {
-					ack.Err = accErr
-				} else {
-					if acc.Id == code {
-						// can proceed with the verification
-						acc.Verified = true
-						ack.Err = acc.Update(updateStmt)
-					}
-				}
-			}
-		}
-		WithServerDatabase(db, verifyFn)
-	}
-
-	// need to return a simple html string in reply
-	if ack.Err != nil {
-		return ack.Err.Error()
-	} else {
-		return "Thank you for verifying your email address"
-	}
-}
-
 func GetAccountStatus(r *http.Request, db DBConnection) string {
 	// the result is a simple json ack
 	ack := new(SimpleMessage)
 
-	// this function only responds to GET requests with
-	// an hmac digest of the contents
+	// this function only responds to GET requests, signed
+	// with the account's api code (see AccountKey)
 	if "GET" == r.Method {
 		params, paramErr := url.ParseQuery(r.URL.RawQuery)
 		if paramErr != nil {
 			ack.Err = paramErr
 		} else {
 			email := params.Get("email")
-			hmacDigest := params.Get("hmac")
-
-			if email != "" && hmacDigest != "" {
-				// confirm the digest matches
-				params.Del("hmac") // separate the digest from the rest
-				if digest.DigestMatches(email, params.Encode(), hmacDigest) {
-					// the request is valid
-					statusFn := func(statements map[string]*sql.Stmt) {
-						lookupStmt, lookupStmtExists := statements[barcodes.ACCOUNT_LOOKUP_BY_EMAIL]
-						if lookupStmtExists {
-							// see if the email corresponds to an account
-							acc, accErr := barcodes.LookupAccount(lookupStmt, email, false)
-							if accErr != nil {
-								ack.Err = accErr
-							} else {
-								if acc.Id != "" {
-									// this account has already been registered
-									// so return its verified status in the message
-									if acc.Verified {
-										ack.Ack = "true"
-									} else {
-										ack.Ack = "false"
-									}
-									ack.Err = nil
+
+			if email != "" {
+				// the request is valid
+				statusFn := func(statements map[string]*sql.Stmt) {
+					lookupStmt, lookupStmtExists := statements[barcodes.ACCOUNT_LOOKUP_BY_EMAIL]
+					if lookupStmtExists {
+						// see if the email corresponds to an account
+						acc, accErr := barcodes.LookupAccount(lookupStmt, email, false)
+						if accErr != nil {
+							ack.Err = accErr
+						} else {
+							if acc.Id != "" {
+								// this account has already been registered
+								// so return its verified status in the message
+								if acc.Verified {
+									ack.Ack = "true"
+								} else {
+									ack.Ack = "false"
 								}
+								ack.Err = nil
 							}
 						}
 					}
-					WithServerDatabase(db, statusFn)
 				}
+				WithServerDatabase(db, statusFn)
 			}
 		}
 	}
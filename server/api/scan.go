@@ -8,16 +8,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/Banrai/PiScan/server/commerce"
-	"github.com/Banrai/PiScan/server/commerce/amazon"
+	_ "github.com/Banrai/PiScan/server/commerce/amazon"        // registers the Amazon provider
+	_ "github.com/Banrai/PiScan/server/commerce/openfoodfacts" // registers the Open Food Facts provider
 	"github.com/Banrai/PiScan/server/database/barcodes"
 	"net/http"
 	"strings"
 )
 
-// Lookup the barcode, using both the barcodes database, and the Amazon API
+// Lookup the barcode, using both the barcodes database, and every enabled
+// commerce.Provider
 func LookupBarcode(r *http.Request, db DBConnection) string {
 	// the result is a json representation of the list of found products
 	products := make([]*commerce.API, 0)
+	productData := make([]*commerce.API, 0)
 
 	// this function only responds to POST requests
 	if "POST" == r.Method {
@@ -28,9 +31,24 @@ func LookupBarcode(r *http.Request, db DBConnection) string {
 			queryFn := func(statements map[string]*sql.Stmt) {
 				barcode := strings.Join(barcodeVal, "")
 
+				// identify the caller (optional), so that their own
+				// contributions are included even while pending moderation
+				callerId := ""
+				if email := r.PostForm.Get("email"); email != "" {
+					accountLookupStmt, accountLookupStmtExists := statements[barcodes.ACCOUNT_LOOKUP_BY_EMAIL]
+					if accountLookupStmtExists {
+						acc, accErr := barcodes.LookupAccount(accountLookupStmt, email, false)
+						if accErr == nil {
+							callerId = acc.Id
+						}
+					}
+				}
+
 				// lookup the barcode versus the regular POD db
+				podProducts := make([]*commerce.API, 0)
 				podLookup, podLookupExists := statements[barcodes.GTIN_LOOKUP]
-				if podLookupExists {
+				brandLookup, brandLookupExists := statements[barcodes.BRAND_LOOKUP]
+				if podLookupExists && brandLookupExists {
 					podMatches, podMatchErr := barcodes.LookupGtin(podLookup, barcode)
 					if podMatchErr == nil {
 						for _, podMatch := range podMatches {
@@ -38,29 +56,74 @@ func LookupBarcode(r *http.Request, db DBConnection) string {
 							m := new(commerce.API)
 							m.SKU = barcode
 							m.ProductName = podMatch.ProductName
+							if podMatch.BrandId != "" {
+								// include the POD brand information
+								brands, brandsErr := barcodes.LookupBrand(brandLookup, podMatch.BrandId)
+								if brandsErr == nil && len(brands) > 0 {
+									m.Brand = brands[0].Name
+									m.BrandURL = brands[0].URL
+								}
+							}
+							podProducts = append(podProducts, m)
 							products = append(products, m)
 						}
 					}
 				}
 
-				// lookup the barcode versus the Amazon db table/API
-				asinLookup, asinLookupExists := statements[barcodes.ASIN_LOOKUP]
-				asinInsert, asinInsertExists := statements[barcodes.ASIN_INSERT]
-				if asinLookupExists && asinInsertExists {
-					prods, prodErr := amazon.Lookup(barcode, asinLookup, asinInsert)
-					if prodErr == nil {
-						for _, prod := range prods {
-							products = append(products, prod)
+				// lookup isbn barcodes versus the books db
+				bookLookup, bookLookupExists := statements[barcodes.BOOK_LOOKUP]
+				if bookLookupExists && barcodes.IsISBN(barcode) {
+					books, booksErr := barcodes.LookupBook(bookLookup, barcode, callerId)
+					if booksErr == nil {
+						for _, book := range books {
+							// convert each BOOK struct to a commerce.API struct
+							b := new(commerce.API)
+							b.SKU = barcode
+							b.ProductName = book.Title
+							b.ProductType = barcodes.ISBN
+							b.Authors = book.Authors
+							b.Publisher = book.Publisher
+							products = append(products, b)
 						}
 					}
 				}
 
-				// supplement the list of results by looking at the user contributions
+				// lookup the barcode versus all the vendor db tables/APIs
+				for _, prod := range commerce.LookupAll(r.Context(), barcode, statements) {
+					if prod.Vendor == "" {
+						// product data only (nothing to buy)
+						productData = append(productData, prod)
+					} else {
+						products = append(products, prod)
+					}
+				}
+
+				// keep track of the vendor product prices
+				recordPrices(statements, products)
+
+				// supplement the list of results by looking at the (approved) user contributions
 				contribLookup, contribLookupExists := statements[barcodes.BARCODE_LOOKUP]
-				if contribLookupExists {
-					contribMatches, contribMatchErr := barcodes.LookupContributedBarcode(contribLookup, barcode)
+				contribBrandLookup, contribBrandLookupExists := statements[barcodes.BARCODE_BRAND_LOOKUP]
+				if contribLookupExists && contribBrandLookupExists {
+					contribMatches, contribMatchErr := barcodes.LookupContributedBarcode(contribLookup, barcode, callerId)
 					if contribMatchErr == nil {
+						corrected := false
 						for _, contrib := range contribMatches {
+							if contrib.GtinEdit && len(podProducts) > 0 {
+								// this is a correction to the POD product name:
+								// use the most recent one instead of what POD says
+								if !corrected {
+									for _, m := range podProducts {
+										m.ProductName = contrib.ProductName
+										if contrib.ProductDesc != "" {
+											m.ProductType = contrib.ProductDesc
+										}
+									}
+									corrected = true
+								}
+								continue
+							}
+
 							// convert each contribMatch BARCODE struct to a commerce.API struct
 							c := new(commerce.API)
 							c.SKU = barcode
@@ -68,6 +131,12 @@ func LookupBarcode(r *http.Request, db DBConnection) string {
 							if contrib.ProductDesc != "" {
 								c.ProductType = contrib.ProductDesc
 							}
+							// include the brand information, if it was also contributed
+							brands, brandsErr := barcodes.LookupBarcodeBrand(contribBrandLookup, contrib.Uuid, callerId)
+							if brandsErr == nil && len(brands) > 0 {
+								c.Brand = brands[0].Name
+								c.BrandURL = brands[0].URL
+							}
 							products = append(products, c)
 						}
 					}
@@ -77,6 +146,18 @@ func LookupBarcode(r *http.Request, db DBConnection) string {
 		}
 	}
 
+	// use the product data results to supplement the rest, unless they
+	// are the only information found about this barcode
+	if len(products) == 0 {
+		products = productData
+	} else {
+		for _, prod := range products {
+			for _, data := range productData {
+				prod.Supplement(data)
+			}
+		}
+	}
+
 	result, err := json.Marshal(products)
 	if err != nil {
 		fmt.Println(err)
@@ -0,0 +1,103 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/Banrai/PiScan/server/database/barcodes"
+	"log"
+)
+
+const (
+	// the server database is created (if need be) before migrating it
+	CREATE_SERVER_DATABASE = "create database if not exists %s character set utf8mb4"
+)
+
+// openServerDatabase connects to the server database, after creating it,
+// if it does not exist yet
+func openServerDatabase(dbCoords DBConnection) (*sql.DB, error) {
+	server, err := sql.Open("mysql", dbCoords.dataSource(""))
+	if err != nil {
+		return nil, err
+	}
+	_, err = server.Exec(fmt.Sprintf(CREATE_SERVER_DATABASE, SERVER_DATABASE))
+	server.Close()
+	if err != nil {
+		return nil, err
+	}
+	return sql.Open("mysql", dbCoords.dataSource(SERVER_DATABASE))
+}
+
+// migrateServerDatabase applies the schema migrations the server database
+// has yet to have, logging each one
+func migrateServerDatabase(db *sql.DB) error {
+	applied, err := barcodes.MigrateDB(db)
+	for _, m := range applied {
+		log.Println(fmt.Sprintf("Applied migration %d (%s)", m.Version, m.Name))
+	}
+	if err != nil {
+		return err
+	}
+	version, err := barcodes.SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	log.Println(fmt.Sprintf("The %s database is at version %d", SERVER_DATABASE, version))
+	return nil
+}
+
+// MigrateServerDatabase creates the server database, if it does not exist
+// yet, and brings its schema up to date
+func MigrateServerDatabase(dbCoords DBConnection) error {
+	db, err := openServerDatabase(dbCoords)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return migrateServerDatabase(db)
+}
+
+// ImportPODFiles loads the published POD csv files into the server
+// database (after migrating it, so that it has the POD tables) in batches
+// of the given size, resuming any earlier import of the same files which
+// was interrupted, unless restart is true
+func ImportPODFiles(dbCoords DBConnection, files []string, batchSize int, restart bool) error {
+	db, err := openServerDatabase(dbCoords)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err = migrateServerDatabase(db); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		result, importErr := barcodes.ImportPOD(db, file, batchSize, restart, log.Default())
+		if importErr != nil {
+			return importErr
+		}
+		log.Println(fmt.Sprintf("Imported %s into %s: %d rows loaded, %d skipped, %d from an earlier import", file, result.Table, result.Loaded, result.Skipped, result.Resumed))
+	}
+	return nil
+}
+
+// CheckServerDatabase logs a warning if the server database is missing
+// any schema migrations (or cannot be reached), since the API requests
+// which use the tables or columns it is missing will fail
+func CheckServerDatabase(dbCoords DBConnection) {
+	db, err := sql.Open("mysql", dbCoords.dataSource(SERVER_DATABASE))
+	if err == nil {
+		defer db.Close()
+		var pending []*barcodes.Migration
+		if pending, err = barcodes.PendingMigrations(db); err == nil && len(pending) > 0 {
+			log.Println(fmt.Sprintf("Warning: the %s database is missing %d migrations (run \"APIServer migrate\" to apply them)", SERVER_DATABASE, len(pending)))
+		}
+	}
+	if err != nil {
+		log.Println(fmt.Sprintf("Warning: could not check the %s database schema: %s", SERVER_DATABASE, err))
+	}
+}
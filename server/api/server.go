@@ -30,11 +30,22 @@ type DBConnection struct {
 	Port int
 }
 
+// dataSource is the mysql driver connection string for the named database
+// (or for the server itself, if the name is empty)
+func (c DBConnection) dataSource(name string) string {
+	return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", c.User, c.Pass, c.Host, c.Port, name)
+}
+
 type SimpleMessage struct {
 	Ack string
 	Err error
 }
 
+const (
+	// The mysql database holding the POD clone and the additional tables
+	SERVER_DATABASE = "product_open_data"
+)
+
 var (
 	Srv                      *Server
 	DefaultServerReadTimeout = 30 // in seconds
@@ -42,24 +53,76 @@ var (
 )
 
 func WithServerDatabase(dbCoords DBConnection, fn func(map[string]*sql.Stmt)) {
+	withServerDatabase(dbCoords, func(db *sql.DB, statements map[string]*sql.Stmt) {
+		fn(statements)
+	})
+}
+
+// withServerDatabase is WithServerDatabase, for the functions which also
+// need the database connection itself (e.g., to use a transaction)
+func withServerDatabase(dbCoords DBConnection, fn func(*sql.DB, map[string]*sql.Stmt)) {
 	preparedStatements := []string{barcodes.GTIN_LOOKUP,
 		barcodes.BRAND_LOOKUP,
 		barcodes.BRAND_NAME_LOOKUP,
+		barcodes.BRAND_SUGGEST,
 		barcodes.BARCODE_LOOKUP,
 		barcodes.BARCODE_INSERT,
 		barcodes.BARCODE_BRAND_INSERT,
+		barcodes.BARCODE_CONTRIB_INSERT,
+		barcodes.BARCODE_BRAND_LOOKUP,
 		barcodes.CONTRIBUTED_BRAND_LOOKUP,
 		barcodes.CONTRIBUTED_BRAND_INSERT,
+		barcodes.CONTRIBUTED_BRAND_BY_ID,
+		barcodes.CONTRIBUTED_BRAND_SUGGEST,
 		barcodes.ASIN_LOOKUP,
 		barcodes.ASIN_INSERT,
+		barcodes.ASIN_PRICES_CHECKED,
+		barcodes.PRICE_LOOKUP,
+		barcodes.PRICE_INSERT,
+		barcodes.OFF_LOOKUP,
+		barcodes.OFF_INSERT,
+		barcodes.BOOK_LOOKUP,
+		barcodes.BOOK_INSERT,
+		barcodes.AUTHOR_LOOKUP,
+		barcodes.AUTHOR_INSERT,
+		barcodes.BOOK_AUTHOR_INSERT,
 		barcodes.ACCOUNT_INSERT,
 		barcodes.ACCOUNT_UPDATE,
 		barcodes.ACCOUNT_DELETE,
 		barcodes.ACCOUNT_LOOKUP_BY_EMAIL,
-		barcodes.ACCOUNT_LOOKUP_BY_ID}
+		barcodes.ACCOUNT_LOOKUP_BY_ID,
+		barcodes.ACCOUNT_LOOKUP_BY_TOKEN,
+		barcodes.ACCOUNT_SET_VERIFY_TOKEN,
+		barcodes.ACCOUNT_VERIFY,
+		barcodes.ACCOUNT_SET_ROLE,
+		barcodes.ACCOUNT_SET_CODE,
+		barcodes.ACCOUNT_SET_ENABLED,
+		barcodes.ACCOUNT_SET_LANGUAGE,
+		barcodes.ACCOUNT_DELETE_VOTES,
+		barcodes.ACCOUNT_ANONYMIZE_BARCODES,
+		barcodes.ACCOUNT_ANONYMIZE_BRANDS,
+		barcodes.ACCOUNT_ANONYMIZE_BOOKS,
+		barcodes.ACCOUNT_DELETE_BARCODE_VOTES,
+		barcodes.ACCOUNT_DELETE_BRAND_VOTES,
+		barcodes.ACCOUNT_DELETE_BOOK_VOTES,
+		barcodes.ACCOUNT_DELETE_BARCODE_BRANDS,
+		barcodes.ACCOUNT_DELETE_BRAND_BARCODES,
+		barcodes.ACCOUNT_DELETE_BARCODES,
+		barcodes.ACCOUNT_DELETE_BRANDS,
+		barcodes.ACCOUNT_DELETE_BOOK_AUTHORS,
+		barcodes.ACCOUNT_DELETE_BOOKS,
+		barcodes.PENDING_BARCODES,
+		barcodes.PENDING_BRANDS,
+		barcodes.PENDING_BOOKS,
+		barcodes.BARCODE_SET_STATUS,
+		barcodes.BRAND_SET_STATUS,
+		barcodes.BOOK_SET_STATUS,
+		barcodes.BARCODE_COUNT,
+		barcodes.BRAND_COUNT,
+		barcodes.BOOK_COUNT,
+		barcodes.VOTE_INSERT}
 
-	connection := fmt.Sprintf("%s:%s@tcp(%s:%d)/product_open_data", dbCoords.User, dbCoords.Pass, dbCoords.Host, dbCoords.Port)
-	db, err := sql.Open("mysql", connection)
+	db, err := sql.Open("mysql", dbCoords.dataSource(SERVER_DATABASE))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -75,7 +138,7 @@ func WithServerDatabase(dbCoords DBConnection, fn func(map[string]*sql.Stmt)) {
 		}
 	}
 
-	fn(statements)
+	fn(db, statements)
 }
 
 func Respond(mediaType string, charset string, fn func(w http.ResponseWriter, r *http.Request) string) http.HandlerFunc {
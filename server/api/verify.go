@@ -0,0 +1,135 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/Banrai/PiScan/server/database/barcodes"
+	"html/template"
+	"net/http"
+)
+
+const (
+	// Verification outcomes
+	VERIFY_OK       = "ok"
+	VERIFY_ALREADY  = "already"
+	VERIFY_EXPIRED  = "expired"
+	VERIFY_UNKNOWN  = "unknown"
+	VERIFY_DISABLED = "disabled"
+	VERIFY_ERROR    = "error"
+
+	VERIFY_PAGE = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}} - Open Product Database</title>
+<style>
+body { font-family: "Helvetica Neue", Helvetica, Arial, sans-serif; color: #333; margin: 0; padding: 2em; }
+div.message { max-width: 36em; margin: 2em auto; padding: 1em 1.5em; border-radius: 4px; }
+div.ok { background-color: #dff0d8; border: 1px solid #d6e9c6; color: #3c763d; }
+div.fail { background-color: #f2dede; border: 1px solid #ebccd1; color: #a94442; }
+</style>
+</head>
+<body>
+<div class="message {{if .Success}}ok{{else}}fail{{end}}">
+<h2>{{.Title}}</h2>
+<p>{{.Message}}</p>
+{{if .Email}}<p><strong>{{.Email}}</strong></p>{{end}}
+</div>
+</body>
+</html>`
+)
+
+var (
+	VERIFY_TEMPLATE = template.Must(template.New("VERIFY_PAGE").Parse(VERIFY_PAGE))
+
+	VERIFY_RESULTS = map[string]*VerificationResult{
+		VERIFY_OK:       {Success: true, Title: "Email address verified", Message: "Thank you for verifying your email address. Your contributions can now be shared with everyone."},
+		VERIFY_ALREADY:  {Success: true, Title: "Email address verified", Message: "This email address has already been verified."},
+		VERIFY_EXPIRED:  {Title: "Verification link expired", Message: "This link has expired. Please use the account page on your scanner to send a new one."},
+		VERIFY_UNKNOWN:  {Title: "Verification link not recognized", Message: "This link is invalid, or has been replaced by a newer one. Please use the most recent link we sent you, or send a new one from the account page on your scanner."},
+		VERIFY_DISABLED: {Title: "Account disabled", Message: "This account has been disabled, so its email address cannot be verified."},
+		VERIFY_ERROR:    {Title: "Verification failed", Message: "Sorry, we could not verify your email address just now. Please try the link again later."},
+	}
+)
+
+// VerificationResult is the context for the VERIFY_PAGE template
+type VerificationResult struct {
+	Success bool
+	Title   string
+	Message string
+	Email   string
+}
+
+// verifyToken checks the token from the verification link, and verifies
+// the corresponding account if it is still current, returning one of the
+// verification outcomes
+func verifyToken(statements map[string]*sql.Stmt, token string) (string, *barcodes.ACCOUNT) {
+	lookupStmt, lookupStmtExists := statements[barcodes.ACCOUNT_LOOKUP_BY_TOKEN]
+	verifyStmt, verifyStmtExists := statements[barcodes.ACCOUNT_VERIFY]
+	if !lookupStmtExists || !verifyStmtExists {
+		return VERIFY_ERROR, nil
+	}
+
+	acc, current, err := barcodes.LookupAccountByToken(lookupStmt, token)
+	switch {
+	case err != nil:
+		fmt.Println(err)
+		return VERIFY_ERROR, nil
+	case acc.Id == "":
+		return VERIFY_UNKNOWN, nil
+	case !acc.Enabled:
+		return VERIFY_DISABLED, acc
+	case acc.Verified:
+		return VERIFY_ALREADY, acc
+	case !current:
+		return VERIFY_EXPIRED, acc
+	}
+
+	if verifyErr := acc.Verify(verifyStmt); verifyErr != nil {
+		fmt.Println(verifyErr)
+		return VERIFY_ERROR, acc
+	}
+	return VERIFY_OK, acc
+}
+
+// renderVerificationPage returns the html page for the verification outcome
+func renderVerificationPage(outcome string, acc *barcodes.ACCOUNT) string {
+	result := *VERIFY_RESULTS[outcome]
+	if acc != nil && result.Success {
+		result.Email = acc.Email
+	}
+
+	var page bytes.Buffer
+	if err := VERIFY_TEMPLATE.Execute(&page, result); err != nil {
+		fmt.Println(err)
+		return result.Message
+	}
+	return page.String()
+}
+
+// VerifyAccount responds to the link in the verification email, with an
+// html page saying whether or not the email address is now verified
+func VerifyAccount(r *http.Request, db DBConnection) string {
+	outcome := VERIFY_UNKNOWN
+	var acc *barcodes.ACCOUNT
+
+	// this function only responds to GET requests
+	if "GET" == r.Method {
+		// get the verification token from the url
+		token := r.URL.Path[len("/verify/"):]
+
+		if len(token) > 0 {
+			verifyFn := func(statements map[string]*sql.Stmt) {
+				outcome, acc = verifyToken(statements, token)
+			}
+			WithServerDatabase(db, verifyFn)
+		}
+	}
+
+	return renderVerificationPage(outcome, acc)
+}
@@ -0,0 +1,134 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"github.com/Banrai/PiScan/server/database/barcodes"
+	"github.com/Banrai/PiScan/server/database/dbtest"
+	"testing"
+	"time"
+)
+
+// tokenAccount is an account row, as far as the verification tokens go
+type tokenAccount struct {
+	acc     *barcodes.ACCOUNT
+	token   string
+	expires time.Time
+}
+
+// tokenDatabase fakes the account table for the verification statements
+func tokenDatabase(t *testing.T, accounts ...*tokenAccount) map[string]*sql.Stmt {
+	byId := func(id driver.Value) *tokenAccount {
+		for _, a := range accounts {
+			if a.acc.Id == id {
+				return a
+			}
+		}
+		t.Fatalf("unknown account id %v", id)
+		return nil
+	}
+
+	db := dbtest.New(t)
+	db.Handle(barcodes.ACCOUNT_SET_VERIFY_TOKEN, func(args []driver.Value) (*dbtest.Result, error) {
+		// (verify_token, expiry in seconds, id)
+		a := byId(args[2])
+		a.token = args[0].(string)
+		a.expires = time.Now().Add(time.Duration(args[1].(int64)) * time.Second)
+		return &dbtest.Result{RowsAffected: 1}, nil
+	})
+	db.Handle(barcodes.ACCOUNT_LOOKUP_BY_TOKEN, func(args []driver.Value) (*dbtest.Result, error) {
+		rows := make([][]driver.Value, 0)
+		for _, a := range accounts {
+			if a.token != "" && a.token == args[0] {
+				rows = append(rows, []driver.Value{a.acc.Id, a.acc.Email, a.acc.Verified, a.acc.Enabled, a.expires.After(time.Now())})
+			}
+		}
+		return &dbtest.Result{Rows: rows}, nil
+	})
+	db.Handle(barcodes.ACCOUNT_VERIFY, func(args []driver.Value) (*dbtest.Result, error) {
+		byId(args[0]).acc.Verified = true
+		return &dbtest.Result{RowsAffected: 1}, nil
+	})
+	return db.Statements(t, barcodes.ACCOUNT_SET_VERIFY_TOKEN, barcodes.ACCOUNT_LOOKUP_BY_TOKEN, barcodes.ACCOUNT_VERIFY)
+}
+
+// issueToken gives the account a new verification token, which expires
+// after the given number of seconds
+func issueToken(t *testing.T, statements map[string]*sql.Stmt, a *tokenAccount, expiry int) string {
+	token, err := a.acc.IssueVerificationToken(statements[barcodes.ACCOUNT_SET_VERIFY_TOKEN], expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestVerifyToken(t *testing.T) {
+	a := &tokenAccount{acc: &barcodes.ACCOUNT{Id: "0123456789ABCDEF0123456789ABCDEF", Email: "someone@example.org", Enabled: true}}
+	statements := tokenDatabase(t, a)
+	token := issueToken(t, statements, a, VERIFY_TOKEN_EXPIRY)
+
+	outcome, acc := verifyToken(statements, token)
+	if outcome != VERIFY_OK || acc == nil || acc.Email != a.acc.Email || !a.acc.Verified {
+		t.Fatalf("verifyToken = %q, %+v, expected %q and the account verified", outcome, acc, VERIFY_OK)
+	}
+
+	// following the link again
+	if outcome, _ = verifyToken(statements, token); outcome != VERIFY_ALREADY {
+		t.Errorf("verifyToken again = %q, expected %q", outcome, VERIFY_ALREADY)
+	}
+}
+
+func TestVerifyTokenExpired(t *testing.T) {
+	a := &tokenAccount{acc: &barcodes.ACCOUNT{Id: "0123456789ABCDEF0123456789ABCDEF", Email: "someone@example.org", Enabled: true}}
+	statements := tokenDatabase(t, a)
+	token := issueToken(t, statements, a, -60)
+
+	if outcome, _ := verifyToken(statements, token); outcome != VERIFY_EXPIRED || a.acc.Verified {
+		t.Errorf("verifyToken = %q (verified %v), expected %q", outcome, a.acc.Verified, VERIFY_EXPIRED)
+	}
+}
+
+func TestVerifyTokenUnknown(t *testing.T) {
+	a := &tokenAccount{acc: &barcodes.ACCOUNT{Id: "0123456789ABCDEF0123456789ABCDEF", Email: "someone@example.org", Enabled: true}}
+	statements := tokenDatabase(t, a)
+	issueToken(t, statements, a, VERIFY_TOKEN_EXPIRY)
+
+	if outcome, acc := verifyToken(statements, "FFEEDDCCBBAA99887766554433221100"); outcome != VERIFY_UNKNOWN || acc != nil || a.acc.Verified {
+		t.Errorf("verifyToken = %q, %+v, expected %q", outcome, acc, VERIFY_UNKNOWN)
+	}
+}
+
+func TestVerifyTokenDisabled(t *testing.T) {
+	a := &tokenAccount{acc: &barcodes.ACCOUNT{Id: "0123456789ABCDEF0123456789ABCDEF", Email: "someone@example.org"}}
+	statements := tokenDatabase(t, a)
+	token := issueToken(t, statements, a, VERIFY_TOKEN_EXPIRY)
+
+	if outcome, _ := verifyToken(statements, token); outcome != VERIFY_DISABLED || a.acc.Verified {
+		t.Errorf("verifyToken = %q (verified %v), expected %q", outcome, a.acc.Verified, VERIFY_DISABLED)
+	}
+}
+
+func TestVerifyTokenReplaced(t *testing.T) {
+	a := &tokenAccount{acc: &barcodes.ACCOUNT{Id: "0123456789ABCDEF0123456789ABCDEF", Email: "someone@example.org", Enabled: true}}
+	statements := tokenDatabase(t, a)
+	old := issueToken(t, statements, a, VERIFY_TOKEN_EXPIRY)
+	current := issueToken(t, statements, a, VERIFY_TOKEN_EXPIRY)
+
+	if outcome, _ := verifyToken(statements, old); outcome != VERIFY_UNKNOWN || a.acc.Verified {
+		t.Errorf("verifyToken(replaced) = %q (verified %v), expected %q", outcome, a.acc.Verified, VERIFY_UNKNOWN)
+	}
+	if outcome, _ := verifyToken(statements, current); outcome != VERIFY_OK {
+		t.Errorf("verifyToken(current) = %q, expected %q", outcome, VERIFY_OK)
+	}
+}
+
+func TestRenderVerificationPage(t *testing.T) {
+	for outcome := range VERIFY_RESULTS {
+		if page := renderVerificationPage(outcome, &barcodes.ACCOUNT{Email: "someone@example.org"}); len(page) == 0 {
+			t.Errorf("empty page for %q", outcome)
+		}
+	}
+}
@@ -10,25 +10,105 @@ package amazon
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"github.com/Banrai/PiScan/server/commerce"
 	"github.com/Banrai/PiScan/server/database/barcodes"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
+	"sort"
 	"strings"
+	"time"
 )
 
+const (
+	VENDOR_ID      = "AMZN"
+	VENDOR_NAME    = "Amazon"
+	DEFAULT_LOCALE = "us"
+
+	// cached products are re-checked with the Product API for their
+	// current prices once the last check is older than this (whether or
+	// not it found any prices)
+	PRICE_MAX_AGE = 24 * time.Hour
+)
+
+// CART_HOSTS maps each Product API locale to its corresponding Amazon site
+var CART_HOSTS = map[string]string{
+	"us": "www.amazon.com",
+	"ca": "www.amazon.ca",
+	"uk": "www.amazon.co.uk",
+	"de": "www.amazon.de",
+	"fr": "www.amazon.fr",
+	"it": "www.amazon.it",
+	"es": "www.amazon.es",
+	"jp": "www.amazon.co.jp",
+	"cn": "www.amazon.cn",
+}
+
+// Provider implements the commerce.Provider interface for Amazon
+type Provider struct{}
+
+func init() {
+	commerce.Register(new(Provider), commerce.DEFAULT_TIMEOUT)
+}
+
+func (p *Provider) Id() string {
+	return VENDOR_ID
+}
+
+func (p *Provider) DisplayName() string {
+	return VENDOR_NAME
+}
+
+func (p *Provider) Locales() []string {
+	locales := make([]string, 0)
+	for locale := range CART_HOSTS {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Lookup uses the ASIN_LOOKUP, ASIN_INSERT, and ASIN_PRICES_CHECKED
+// prepared statements to find the barcode in either the barcodes database
+// or the Product API
+func (p *Provider) Lookup(ctx context.Context, barcode string, statements map[string]*sql.Stmt) ([]*commerce.API, error) {
+	asinLookup, asinLookupExists := statements[barcodes.ASIN_LOOKUP]
+	asinInsert, asinInsertExists := statements[barcodes.ASIN_INSERT]
+	if !asinLookupExists || !asinInsertExists {
+		return make([]*commerce.API, 0), nil
+	}
+	return Lookup(ctx, barcode, asinLookup, asinInsert, statements[barcodes.ASIN_PRICES_CHECKED])
+}
+
+// BuyURL returns the Amazon "add to cart" link for the list of ASINs
+func (p *Provider) BuyURL(locale string, skus []string) string {
+	host, hostExists := CART_HOSTS[locale]
+	if !hostExists || len(skus) == 0 {
+		return ""
+	}
+
+	v := url.Values{}
+	for i, sku := range skus {
+		v.Set(fmt.Sprintf("ASIN.%d", i+1), sku)
+		v.Set(fmt.Sprintf("Quantity.%d", i+1), "1")
+	}
+	return fmt.Sprintf("http://%s/gp/aws/cart/add.html?%s", host, v.Encode())
+}
+
 // The apiLookup function provides a simple interface to the python
 // amazon_api_lookup.py script using os/exec and returns the string result
-// and error (if any) as-is
-func apiLookup(barcode string) (string, error) {
+// and error (if any) as-is; the script is killed once the context is done
+func apiLookup(ctx context.Context, barcode string) (string, error) {
 	// the path to the API lookup script is relative to where the server runs
 	// so pass the barcode string to it as the first command line argument and
 	// capture and return the result
 	lookupCmd := []string{"python", path.Join(path.Dir(os.Args[0]), "/commerce/amazon/amazon_api_lookup.py"), barcode}
-	cmd := exec.Command(lookupCmd[0], lookupCmd[1:]...)
+	cmd := exec.CommandContext(ctx, lookupCmd[0], lookupCmd[1:]...)
 
 	var out bytes.Buffer
 	cmd.Stdout = &out
@@ -37,11 +117,49 @@ func apiLookup(barcode string) (string, error) {
 	return out.String(), err
 }
 
+// pricesStale is true if the prices of any of the products have never
+// been checked, or were last checked longer ago than the PRICE_MAX_AGE
+// (products which have no price are not checked again any sooner)
+func pricesStale(products []*barcodes.AMAZON) bool {
+	for _, product := range products {
+		if product.Checked == 0 || time.Since(time.Unix(product.Checked, 0)) > PRICE_MAX_AGE {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshPrices uses the Product API to update the current price of each
+// of the (previously found) products
+func refreshPrices(ctx context.Context, barcode string, products []*commerce.API) {
+	api, err := apiLookup(ctx, barcode)
+	if err != nil {
+		return
+	}
+	var apiList []commerce.API
+	if json.Unmarshal([]byte(api), &apiList) != nil {
+		return
+	}
+	for _, product := range products {
+		for _, apiResult := range apiList {
+			if apiResult.SKU == product.SKU && apiResult.Vendor == product.Vendor {
+				product.Price = apiResult.Price
+				product.Currency = apiResult.Currency
+				break
+			}
+		}
+	}
+}
+
 // The Lookup function first looks for the given barcode in the barcodes
 // database. If not found there, it tries the Amazon Product API, and save
-// all those results into the barcodes database for future reference. It
-// returns the json (a list of API structs, one per product) and error.
-func Lookup(barcode string, asinLookup, asinInsert *sql.Stmt) ([]*commerce.API, error) {
+// all those results into the barcodes database for future reference. If
+// found in the database, and the pricesChecked statement is defined, the
+// Product API is used to refresh any stale prices (at most once every
+// PRICE_MAX_AGE). Nothing is saved once the context is done, since the
+// statements may be closed by then. It returns the json (a list of API
+// structs, one per product) and error.
+func Lookup(ctx context.Context, barcode string, asinLookup, asinInsert, pricesChecked *sql.Stmt) ([]*commerce.API, error) {
 	results := make([]*commerce.API, 0)
 	var resultErr error
 
@@ -54,20 +172,32 @@ func Lookup(barcode string, asinLookup, asinInsert *sql.Stmt) ([]*commerce.API,
 			result.SKU = product.Asin
 			result.ProductName = product.ProductName
 			result.ProductType = product.ProductType
-			result.Vendor = strings.Join([]string{"AMZN", product.Locale}, ":")
+			result.ImageURL = product.ImageURL
+			result.Vendor = strings.Join([]string{VENDOR_ID, product.Locale}, commerce.VENDOR_SEPARATOR)
 			results = append(results, result)
 		}
+		if pricesChecked != nil && pricesStale(products) {
+			// (recorded even if the refresh fails or finds no prices, so
+			// that the Product API is not asked again on every lookup)
+			refreshPrices(ctx, barcode, results)
+			if ctx.Err() == nil {
+				_ = barcodes.SetPricesChecked(pricesChecked, barcode)
+			}
+		}
 	} else {
 		// if not, use the API instead, and save any results to the barcodes db
-		api, aerr := apiLookup(barcode)
+		api, aerr := apiLookup(ctx, barcode)
 		resultErr = aerr
-		if aerr == nil {
+		if aerr == nil && ctx.Err() != nil {
+			resultErr = ctx.Err()
+		} else if aerr == nil {
 			// convert the api result string into a json object
 			var apiList []commerce.API
 			jerr := json.Unmarshal([]byte(api), &apiList)
 			if jerr == nil {
-				for _, apiResult := range apiList {
+				for i := range apiList {
 					// save each result for re-marshalling into json
+					apiResult := apiList[i]
 					results = append(results, &apiResult)
 
 					// and save it in the db, for the future
@@ -76,12 +206,11 @@ func Lookup(barcode string, asinLookup, asinInsert *sql.Stmt) ([]*commerce.API,
 					prod.Asin = apiResult.SKU
 					prod.ProductName = apiResult.ProductName
 					prod.ProductType = apiResult.ProductType
-					vendor := strings.Split(apiResult.Vendor, ":")
-					if len(vendor) > 0 {
-						prod.Locale = vendor[1]
-					} else {
+					prod.ImageURL = apiResult.ImageURL
+					_, prod.Locale = commerce.ParseVendorId(apiResult.Vendor)
+					if prod.Locale == "" {
 						// use the default
-						prod.Locale = "us"
+						prod.Locale = DEFAULT_LOCALE
 					}
 					_ = barcodes.InsertAsin(asinInsert, *prod)
 				}
@@ -38,20 +38,48 @@ def _is_duplicate (asin, current_list):
             pass
     return dup
 
+def _lowest_price (item):
+    """Return the lowest new price (in the smallest currency unit,
+    e.g., cents) and currency code for the item, if it has one"""
+
+    try:
+        offer = item.OfferSummary.LowestNewPrice
+        return int(offer.Amount), unicode(offer.CurrencyCode)
+    except AttributeError:
+        return None, None
+
+def _image_url (item):
+    """Return the url of the largest available image of the item"""
+
+    for size in ['LargeImage', 'MediumImage', 'SmallImage']:
+        try:
+            return unicode(getattr(item, size).URL)
+        except AttributeError:
+            pass
+    return None
+
 def lookup (barcode, ID_TYPES=['ISBN', 'UPC','EAN']):
     """Lookup the given barcode and return a list of possible matches"""
 
-    matches = [] # list of {'desc', 'sku', 'type', 'vnd'}
+    matches = [] # list of {'desc', 'sku', 'type', 'vnd', 'price', 'currency', 'img'}
 
     for idtype in ID_TYPES:
         try:
-            result = api.item_lookup(barcode, SearchIndex='All', IdType=idtype)
+            result = api.item_lookup(barcode, SearchIndex='All', IdType=idtype, ResponseGroup='ItemAttributes,OfferSummary,Images')
             for item in result.Items.Item:
                 if not _is_duplicate(item.ASIN, matches):
-                    matches.append({'desc': unicode(item.ItemAttributes.Title),
-                                    'sku':  unicode(item.ASIN),
-                                    'type': idtype,
-                                    'vnd':  'AMZN:'+AMZLOCALE}) # vendor id
+                    match = {'desc': unicode(item.ItemAttributes.Title),
+                             'sku':  unicode(item.ASIN),
+                             'type': idtype,
+                             'vnd':  'AMZN:'+AMZLOCALE} # vendor id
+                    price, currency = _lowest_price(item)
+                    if price is not None:
+                        match['price'] = price
+                        match['currency'] = currency
+                    image = _image_url(item)
+                    if image is not None:
+                        match['img'] = image
+                    matches.append(match)
 
         except (errors.InvalidAccount, errors.InvalidClientTokenId, errors.MissingClientTokenId):
             print >>sys.stderr, "Amazon Product API lookup: bad account credentials"
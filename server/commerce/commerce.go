@@ -6,10 +6,82 @@
 
 package commerce
 
+import "fmt"
+
+// CURRENCY_DECIMALS lists the currencies whose smallest unit is not 1/100
+var CURRENCY_DECIMALS = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"BHD": 3,
+	"KWD": 3,
+}
+
 // API represents the minimum required output from any vendor's API
 type API struct {
 	SKU         string `json:"sku"`
 	ProductName string `json:"desc,omitempty"`
 	ProductType string `json:"type,omitempty"`
 	Vendor      string `json:"vnd,omitempty"`
+	VendorName  string `json:"vndName,omitempty"`
+	BuyURL      string `json:"buy,omitempty"`
+
+	// Optional current price, in the smallest unit of the currency
+	// (e.g., cents), and the ISO 4217 currency code
+	Price    int64  `json:"price,omitempty"`
+	Currency string `json:"currency,omitempty"`
+
+	// Optional product details (from product data providers)
+	Brand       string   `json:"brand,omitempty"`
+	BrandURL    string   `json:"brandUrl,omitempty"`
+	ImageURL    string   `json:"img,omitempty"`
+	Category    string   `json:"category,omitempty"`
+	Ingredients string   `json:"ingredients,omitempty"`
+	Allergens   []string `json:"allergens,omitempty"`
+	NutriScore  string   `json:"nutriscore,omitempty"`
+
+	// Optional book details (when the SKU is an ISBN)
+	Authors   []string `json:"authors,omitempty"`
+	Publisher string   `json:"publisher,omitempty"`
+}
+
+// Supplement fills in any missing product details in this API struct
+// using the values found in the other one
+func (a *API) Supplement(other *API) {
+	if a.Brand == "" {
+		a.Brand = other.Brand
+		a.BrandURL = other.BrandURL
+	}
+	if a.ImageURL == "" {
+		a.ImageURL = other.ImageURL
+	}
+	if a.Category == "" {
+		a.Category = other.Category
+	}
+	if a.Ingredients == "" {
+		a.Ingredients = other.Ingredients
+	}
+	if len(a.Allergens) == 0 {
+		a.Allergens = other.Allergens
+	}
+	if a.NutriScore == "" {
+		a.NutriScore = other.NutriScore
+	}
+}
+
+// FormatPrice presents the price (in the smallest unit of the currency)
+// as a decimal string, followed by the currency code
+func FormatPrice(price int64, currency string) string {
+	decimals, exists := CURRENCY_DECIMALS[currency]
+	if !exists {
+		decimals = 2
+	}
+	if decimals == 0 {
+		return fmt.Sprintf("%d %s", price, currency)
+	}
+
+	unit := int64(1)
+	for i := 0; i < decimals; i++ {
+		unit *= 10
+	}
+	return fmt.Sprintf("%d.%0*d %s", price/unit, decimals, price%unit, currency)
 }
@@ -0,0 +1,194 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package openfoodfacts provides methods for looking up barcodes and
+// finding their associated brand, ingredient, allergen, and nutrition
+// information, either by using the Open Food Facts API, or, if the
+// particular barcode has been found before, from the barcodes database
+
+package openfoodfacts
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/Banrai/PiScan/server/commerce"
+	"github.com/Banrai/PiScan/server/database/barcodes"
+	"net/http"
+	"strings"
+)
+
+const (
+	PROVIDER_ID    = "OFF"
+	PROVIDER_NAME  = "Open Food Facts"
+	DEFAULT_LOCALE = "world"
+
+	// the API replies with this status when the barcode is known
+	PRODUCT_FOUND = 1
+)
+
+var (
+	// API_URL is the product lookup endpoint, where the first parameter is
+	// the locale (country subdomain), and the second is the barcode
+	API_URL = "http://%s.openfoodfacts.org/api/v0/product/%s.json"
+
+	// USER_AGENT identifies this app to the Open Food Facts API, as they ask
+	USER_AGENT = "PiScan - https://github.com/Banrai/PiScan"
+
+	// the http client for API requests
+	client = &http.Client{Timeout: commerce.DEFAULT_TIMEOUT}
+)
+
+// apiProduct is the subset of the API reply used by this package
+type apiProduct struct {
+	Status  int `json:"status"`
+	Product struct {
+		ProductName   string   `json:"product_name"`
+		Brands        string   `json:"brands"`
+		ImageURL      string   `json:"image_url"`
+		Categories    string   `json:"categories"`
+		Ingredients   string   `json:"ingredients_text"`
+		AllergensTags []string `json:"allergens_tags"`
+		NutriScore    string   `json:"nutriscore_grade"`
+	} `json:"product"`
+}
+
+// firstOf returns the first item in a comma-separated list string
+func firstOf(list string) string {
+	return strings.TrimSpace(strings.Split(list, ",")[0])
+}
+
+// stripLanguage removes the language prefix from an API tag,
+// e.g., "en:milk" becomes "milk"
+func stripLanguage(tag string) string {
+	if i := strings.Index(tag, ":"); i >= 0 {
+		return tag[i+1:]
+	}
+	return tag
+}
+
+// apiLookup queries the Open Food Facts API for the given barcode, and
+// returns the result as an OPENFOODFACTS struct, or nil if not found;
+// the request is abandoned once the context is done
+func apiLookup(ctx context.Context, barcode, locale string) (*barcodes.OPENFOODFACTS, error) {
+	req, reqErr := http.NewRequest("GET", fmt.Sprintf(API_URL, locale, barcode), nil)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	req.Header.Set("User-Agent", USER_AGENT)
+
+	res, resErr := client.Do(req.WithContext(ctx))
+	if resErr != nil {
+		return nil, resErr
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Open Food Facts API lookup error: %s", res.Status)
+	}
+
+	reply := new(apiProduct)
+	if err := json.NewDecoder(res.Body).Decode(reply); err != nil {
+		return nil, err
+	}
+	if reply.Status != PRODUCT_FOUND || reply.Product.ProductName == "" {
+		return nil, nil
+	}
+
+	result := new(barcodes.OPENFOODFACTS)
+	result.Barcode = barcode
+	result.ProductName = reply.Product.ProductName
+	result.Brand = firstOf(reply.Product.Brands)
+	result.ImageURL = reply.Product.ImageURL
+	result.Category = firstOf(reply.Product.Categories)
+	result.Ingredients = reply.Product.Ingredients
+	result.Allergens = make([]string, 0)
+	for _, tag := range reply.Product.AllergensTags {
+		result.Allergens = append(result.Allergens, stripLanguage(tag))
+	}
+	result.NutriScore = strings.ToLower(reply.Product.NutriScore)
+	result.Locale = locale
+
+	return result, nil
+}
+
+// convert turns an OPENFOODFACTS struct into a commerce.API one, leaving
+// the vendor empty, since there is nothing to buy
+func convert(product *barcodes.OPENFOODFACTS) *commerce.API {
+	result := new(commerce.API)
+	result.SKU = product.Barcode
+	result.ProductName = product.ProductName
+	result.Brand = product.Brand
+	result.ImageURL = product.ImageURL
+	result.Category = product.Category
+	result.Ingredients = product.Ingredients
+	result.Allergens = product.Allergens
+	result.NutriScore = product.NutriScore
+	return result
+}
+
+// The Lookup function first looks for the given barcode in the barcodes
+// database. If not found there, it tries the Open Food Facts API, and
+// saves any result into the barcodes database for future reference
+// (unless the context is done by then, since the statements may be closed).
+func Lookup(ctx context.Context, barcode string, offLookup, offInsert *sql.Stmt) ([]*commerce.API, error) {
+	results := make([]*commerce.API, 0)
+
+	// see if the barcode already exists in the db
+	products, err := barcodes.LookupOpenFoodFacts(offLookup, barcode)
+	if err == nil && len(products) > 0 {
+		for _, product := range products {
+			results = append(results, convert(product))
+		}
+		return results, nil
+	}
+
+	// if not, use the API instead, and save any result to the barcodes db
+	product, apiErr := apiLookup(ctx, barcode, DEFAULT_LOCALE)
+	if apiErr != nil || product == nil {
+		return results, apiErr
+	}
+	if ctx.Err() != nil {
+		return results, ctx.Err()
+	}
+	results = append(results, convert(product))
+	_ = barcodes.InsertOpenFoodFacts(offInsert, *product)
+
+	return results, nil
+}
+
+// Provider implements the commerce.Provider interface for Open Food Facts
+type Provider struct{}
+
+func init() {
+	commerce.Register(new(Provider), commerce.DEFAULT_TIMEOUT)
+}
+
+func (p *Provider) Id() string {
+	return PROVIDER_ID
+}
+
+func (p *Provider) DisplayName() string {
+	return PROVIDER_NAME
+}
+
+func (p *Provider) Locales() []string {
+	return []string{DEFAULT_LOCALE}
+}
+
+// Lookup uses the OFF_LOOKUP and OFF_INSERT prepared statements to find
+// the barcode in either the barcodes database or the Open Food Facts API
+func (p *Provider) Lookup(ctx context.Context, barcode string, statements map[string]*sql.Stmt) ([]*commerce.API, error) {
+	offLookup, offLookupExists := statements[barcodes.OFF_LOOKUP]
+	offInsert, offInsertExists := statements[barcodes.OFF_INSERT]
+	if !offLookupExists || !offInsertExists {
+		return make([]*commerce.API, 0), nil
+	}
+	return Lookup(ctx, barcode, offLookup, offInsert)
+}
+
+// BuyURL is always empty: Open Food Facts has product data, not products
+func (p *Provider) BuyURL(locale string, skus []string) string {
+	return ""
+}
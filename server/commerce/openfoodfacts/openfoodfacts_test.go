@@ -0,0 +1,149 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package openfoodfacts
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/Banrai/PiScan/server/database/barcodes"
+	"github.com/Banrai/PiScan/server/database/dbtest"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+const (
+	// a recorded (and trimmed) API reply
+	FOUND_REPLY = `{
+  "code": "3017620422003",
+  "status": 1,
+  "status_verbose": "product found",
+  "product": {
+    "product_name": "Nutella",
+    "brands": "Ferrero, Nutella",
+    "image_url": "https://images.openfoodfacts.org/images/products/301/762/042/2003/front_en.jpg",
+    "categories": "Spreads, Sweet spreads, Hazelnut spreads",
+    "ingredients_text": "Sugar, palm oil, hazelnuts 13%, skimmed milk powder 8.7%",
+    "allergens_tags": ["en:milk", "en:nuts", "en:soybeans"],
+    "nutriscore_grade": "E"
+  }
+}`
+
+	NOT_FOUND_REPLY = `{"code": "0000000000000", "status": 0, "status_verbose": "product not found"}`
+)
+
+// stubAPI serves the reply for every lookup, and counts the requests
+func stubAPI(t *testing.T, status int, reply string) *int {
+	requests := new(int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if r.Header.Get("User-Agent") != USER_AGENT {
+			t.Errorf("User-Agent = %q", r.Header.Get("User-Agent"))
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(reply))
+	}))
+	t.Cleanup(server.Close)
+
+	original := API_URL
+	API_URL = server.URL + "/%s/api/v0/product/%s.json"
+	t.Cleanup(func() { API_URL = original })
+	return requests
+}
+
+func TestApiLookup(t *testing.T) {
+	stubAPI(t, http.StatusOK, FOUND_REPLY)
+
+	product, err := apiLookup(context.Background(), "3017620422003", DEFAULT_LOCALE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &barcodes.OPENFOODFACTS{
+		Barcode:     "3017620422003",
+		ProductName: "Nutella",
+		Brand:       "Ferrero",
+		ImageURL:    "https://images.openfoodfacts.org/images/products/301/762/042/2003/front_en.jpg",
+		Category:    "Spreads",
+		Ingredients: "Sugar, palm oil, hazelnuts 13%, skimmed milk powder 8.7%",
+		Allergens:   []string{"milk", "nuts", "soybeans"},
+		NutriScore:  "e",
+		Locale:      DEFAULT_LOCALE}
+	if !reflect.DeepEqual(product, expected) {
+		t.Errorf("apiLookup = %+v, expected %+v", product, expected)
+	}
+}
+
+func TestApiLookupNotFound(t *testing.T) {
+	stubAPI(t, http.StatusOK, NOT_FOUND_REPLY)
+
+	product, err := apiLookup(context.Background(), "0000000000000", DEFAULT_LOCALE)
+	if err != nil || product != nil {
+		t.Errorf("apiLookup = %+v, %v, expected nothing", product, err)
+	}
+}
+
+func TestApiLookupError(t *testing.T) {
+	stubAPI(t, http.StatusServiceUnavailable, "")
+
+	if _, err := apiLookup(context.Background(), "3017620422003", DEFAULT_LOCALE); err == nil {
+		t.Error("apiLookup succeeded, expected an error")
+	}
+}
+
+func TestLookupCaches(t *testing.T) {
+	requests := stubAPI(t, http.StatusOK, FOUND_REPLY)
+
+	// the openfoodfacts table, as saved by OFF_INSERT
+	db := dbtest.New(t)
+	cached := make([][]driver.Value, 0)
+	db.Handle(barcodes.OFF_INSERT, func(args []driver.Value) (*dbtest.Result, error) {
+		// (id, barcode, product, brand, image_url, category, ingredients, allergens, nutriscore, locale)
+		cached = append(cached, args[2:])
+		return &dbtest.Result{RowsAffected: 1}, nil
+	})
+	db.Handle(barcodes.OFF_LOOKUP, func(args []driver.Value) (*dbtest.Result, error) {
+		return &dbtest.Result{Columns: []string{"product", "brand", "image_url", "category", "ingredients", "allergens", "nutriscore", "locale"}, Rows: cached}, nil
+	})
+	offLookup := db.Stmt(t, barcodes.OFF_LOOKUP)
+	offInsert := db.Stmt(t, barcodes.OFF_INSERT)
+
+	first, err := Lookup(context.Background(), "3017620422003", offLookup, offInsert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *requests != 1 || db.Count(barcodes.OFF_INSERT) != 1 {
+		t.Fatalf("the first lookup made %d API requests and %d inserts, expected 1 of each", *requests, db.Count(barcodes.OFF_INSERT))
+	}
+	if cached[0][5] != "milk,nuts,soybeans" {
+		t.Errorf("cached allergens = %v", cached[0][5])
+	}
+
+	second, err := Lookup(context.Background(), "3017620422003", offLookup, offInsert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *requests != 1 || db.Count(barcodes.OFF_INSERT) != 1 {
+		t.Errorf("the second lookup made an API request or insert, instead of using the cached product")
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("the cached product %+v differs from the API one %+v", second[0], first[0])
+	}
+}
+
+func TestLookupNotFoundIsNotCached(t *testing.T) {
+	requests := stubAPI(t, http.StatusOK, NOT_FOUND_REPLY)
+
+	db := dbtest.New(t)
+	db.Handle(barcodes.OFF_LOOKUP, dbtest.Rows(nil))
+	db.Handle(barcodes.OFF_INSERT, dbtest.Affected(1))
+
+	results, err := Lookup(context.Background(), "0000000000000", db.Stmt(t, barcodes.OFF_LOOKUP), db.Stmt(t, barcodes.OFF_INSERT))
+	if err != nil || len(results) != 0 {
+		t.Errorf("Lookup = %v, %v, expected nothing", results, err)
+	}
+	if *requests != 1 || db.Count(barcodes.OFF_INSERT) != 0 {
+		t.Errorf("made %d API requests and %d inserts, expected 1 and 0", *requests, db.Count(barcodes.OFF_INSERT))
+	}
+}
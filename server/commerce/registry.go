@@ -0,0 +1,246 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package commerce provides general objects and functions for any product
+// vendor API or website
+
+package commerce
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long to wait for any one provider to reply, unless a different
+	// timeout was given when it was registered
+	DEFAULT_TIMEOUT = 10 * time.Second
+
+	// API.Vendor strings are composed as "[provider id]:[locale]"
+	VENDOR_SEPARATOR = ":"
+)
+
+// Provider is implemented by every vendor module (amazon, etc.) so that it
+// can be registered here, and included in every barcode lookup. Providers
+// of product data only (i.e., with nothing to buy) leave API.Vendor empty.
+type Provider interface {
+	// Id is the short vendor code which prefixes the API.Vendor string,
+	// e.g., "AMZN"
+	Id() string
+
+	// DisplayName is the human-readable vendor name, for the client UI
+	DisplayName() string
+
+	// Locales lists the vendor catalogs this provider can search
+	Locales() []string
+
+	// Lookup finds the given barcode in the vendor catalog, using the
+	// prepared statements for any local caching of the results; once the
+	// context is done (i.e., its timeout has passed), it should give up,
+	// and no longer use the statements, which are about to be closed
+	Lookup(ctx context.Context, barcode string, statements map[string]*sql.Stmt) ([]*API, error)
+
+	// BuyURL returns the link for buying the list of skus from the vendor
+	// catalog corresponding to the given locale
+	BuyURL(locale string, skus []string) string
+}
+
+type registration struct {
+	provider Provider
+	timeout  time.Duration
+	enabled  bool
+}
+
+var (
+	registry      = map[string]*registration{}
+	registryOrder = make([]string, 0)
+	registryLock  sync.RWMutex
+)
+
+// Register makes the Provider available for barcode lookups; a timeout of
+// zero means the DEFAULT_TIMEOUT is used. Registering the same Provider
+// id twice replaces the earlier one.
+func Register(p Provider, timeout time.Duration) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+	if _, exists := registry[p.Id()]; !exists {
+		registryOrder = append(registryOrder, p.Id())
+	}
+	registry[p.Id()] = &registration{provider: p, timeout: timeout, enabled: true}
+}
+
+// SetTimeout changes the lookup timeout for the registered Provider id
+func SetTimeout(id string, timeout time.Duration) error {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	reg, exists := registry[id]
+	if !exists {
+		return fmt.Errorf("unknown commerce provider: %s", id)
+	}
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+	reg.timeout = timeout
+	return nil
+}
+
+// EnableOnly enables the registered Providers in the list of ids, and
+// disables all the others
+func EnableOnly(ids []string) error {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	wanted := make(map[string]bool)
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if _, exists := registry[id]; !exists {
+			return fmt.Errorf("unknown commerce provider: %s", id)
+		}
+		wanted[id] = true
+	}
+	for id, reg := range registry {
+		reg.enabled = wanted[id]
+	}
+	return nil
+}
+
+// GetProvider returns the registered Provider for the given id, if any
+func GetProvider(id string) (Provider, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	reg, exists := registry[id]
+	if !exists {
+		return nil, false
+	}
+	return reg.provider, true
+}
+
+// BuyURL returns the link for buying the list of skus from the vendor (an
+// API.Vendor string), or the empty string if its Provider is unknown
+func BuyURL(vendor string, skus []string) string {
+	id, locale := ParseVendorId(vendor)
+	p, exists := GetProvider(id)
+	if !exists {
+		return ""
+	}
+	return p.BuyURL(locale, skus)
+}
+
+// RegisteredIds returns the ids of every registered Provider, in the
+// order they were registered
+func RegisteredIds() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	ids := make([]string, len(registryOrder))
+	copy(ids, registryOrder)
+	return ids
+}
+
+// enabledRegistrations returns the currently-enabled Providers, in the
+// order they were registered
+func enabledRegistrations() []registration {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	results := make([]registration, 0)
+	for _, id := range registryOrder {
+		if reg := registry[id]; reg.enabled {
+			results = append(results, *reg)
+		}
+	}
+	return results
+}
+
+// VendorId returns the API.Vendor string for the given Provider and locale
+func VendorId(p Provider, locale string) string {
+	return strings.Join([]string{p.Id(), locale}, VENDOR_SEPARATOR)
+}
+
+// ParseVendorId splits an API.Vendor string into its Provider id and
+// locale components (the locale is empty if the string does not have one)
+func ParseVendorId(vendor string) (string, string) {
+	parts := strings.SplitN(vendor, VENDOR_SEPARATOR, 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// LookupAll queries every enabled Provider for the given barcode
+// concurrently, and returns the combined list of results. Any Provider
+// which fails, or does not reply within its timeout, is skipped: its
+// context is cancelled, and LookupAll waits for it to give up before
+// returning, so that no Provider uses the statements after that.
+func LookupAll(ctx context.Context, barcode string, statements map[string]*sql.Stmt) []*API {
+	type reply struct {
+		products []*API
+		err      error
+	}
+
+	regs := enabledRegistrations()
+	replies := make([]chan reply, len(regs))
+	contexts := make([]context.Context, len(regs))
+	cancels := make([]context.CancelFunc, len(regs))
+	var running sync.WaitGroup
+	for i, reg := range regs {
+		// each timeout runs from the start of the lookup
+		providerCtx, cancel := context.WithTimeout(ctx, reg.timeout)
+		contexts[i], cancels[i] = providerCtx, cancel
+
+		replies[i] = make(chan reply, 1) // buffered, so late replies never block
+		running.Add(1)
+		go func(p Provider, c chan reply) {
+			defer running.Done()
+			prods, err := p.Lookup(providerCtx, barcode, statements)
+			c <- reply{prods, err}
+		}(reg.provider, replies[i])
+	}
+
+	results := make([]*API, 0)
+	for i, reg := range regs {
+		select {
+		case r := <-replies[i]:
+			if r.err != nil {
+				continue
+			}
+			for _, prod := range r.products {
+				if prod.Vendor == "" {
+					// product data only, with nothing to buy
+					results = append(results, prod)
+					continue
+				}
+
+				// fill in the client-facing vendor details
+				if prod.VendorName == "" {
+					prod.VendorName = reg.provider.DisplayName()
+				}
+				if prod.BuyURL == "" {
+					_, locale := ParseVendorId(prod.Vendor)
+					prod.BuyURL = reg.provider.BuyURL(locale, []string{prod.SKU})
+				}
+				results = append(results, prod)
+			}
+		case <-contexts[i].Done():
+			// this provider took too long, so ignore it
+		}
+	}
+
+	// cancel the providers which are still running, and wait for them
+	for _, cancel := range cancels {
+		cancel()
+	}
+	running.Wait()
+
+	return results
+}
@@ -0,0 +1,66 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package commerce
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testProvider replies with a single product after the delay, unless its
+// context is done first
+type testProvider struct {
+	id       string
+	delay    time.Duration
+	finished int32 // set once Lookup has returned
+}
+
+func (p *testProvider) Id() string          { return p.id }
+func (p *testProvider) DisplayName() string { return p.id + " shop" }
+func (p *testProvider) Locales() []string   { return []string{"us"} }
+
+func (p *testProvider) BuyURL(locale string, skus []string) string {
+	return "https://example.com/" + p.id + "/" + skus[0]
+}
+
+func (p *testProvider) Lookup(ctx context.Context, barcode string, statements map[string]*sql.Stmt) ([]*API, error) {
+	defer atomic.StoreInt32(&p.finished, 1)
+	select {
+	case <-time.After(p.delay):
+		return []*API{{SKU: barcode, ProductName: p.id, Vendor: VendorId(p, "us")}}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestLookupAllTimeout(t *testing.T) {
+	fast := &testProvider{id: "FAST", delay: 0}
+	slow := &testProvider{id: "SLOW", delay: time.Minute}
+	Register(fast, time.Second)
+	Register(slow, 50*time.Millisecond)
+	if err := EnableOnly([]string{"FAST", "SLOW"}); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	results := LookupAll(context.Background(), "0012345678905", nil)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("LookupAll took %v, waiting for the slow provider", elapsed)
+	}
+
+	if len(results) != 1 || results[0].ProductName != "FAST" {
+		t.Fatalf("LookupAll = %v, expected the fast provider only", results)
+	}
+	if results[0].VendorName != "FAST shop" || results[0].BuyURL != "https://example.com/FAST/0012345678905" {
+		t.Errorf("vendor details = %q, %q", results[0].VendorName, results[0].BuyURL)
+	}
+
+	// the slow provider was cancelled, and is no longer running
+	if atomic.LoadInt32(&slow.finished) != 1 {
+		t.Error("LookupAll returned while the slow provider was still running")
+	}
+}
@@ -13,13 +13,63 @@ const (
 	// Prepared Queries (POD contributor accounts)
 
 	// Create/Update/Delete
-	ACCOUNT_INSERT = "insert into account (id, email, verify_code) values (unhex(?), ?, ?)"
+	ACCOUNT_INSERT = "insert into account (id, email, verify_code, language) values (unhex(?), ?, ?, ?)"
 	ACCOUNT_UPDATE = "update account set email = ?, verified = ?, enabled = ?, date_verified=NOW() where id = unhex(?)"
 	ACCOUNT_DELETE = "delete from account where id = unhex(?)"
 
+	ACCOUNT_SET_CODE     = "update account set verify_code = ? where id = unhex(?)"
+	ACCOUNT_SET_ENABLED  = "update account set enabled = ? where id = unhex(?)"
+	ACCOUNT_SET_LANGUAGE = "update account set language = ? where id = unhex(?)"
+
+	// Email verification tokens (the expiry is given in seconds from now)
+	ACCOUNT_SET_VERIFY_TOKEN = "update account set verify_token = ?, token_expires = date_add(NOW(), interval ? second) where id = unhex(?)"
+	ACCOUNT_VERIFY           = "update account set verified = true, date_verified = NOW() where id = unhex(?)"
+
+	// Removing an Account's contributions, either by anonymizing them
+	// (they stay in the database, without the account reference), or by
+	// deleting them outright; the statements in each list must be executed
+	// in order, since the later ones refer to the rows the earlier ones keep
+	ACCOUNT_DELETE_VOTES          = "delete from contribution_vote where account_id = unhex(?)"
+	ACCOUNT_ANONYMIZE_BARCODES    = "update barcode set account_id = null where account_id = unhex(?)"
+	ACCOUNT_ANONYMIZE_BRANDS      = "update contributed_brand set account_id = null where account_id = unhex(?)"
+	ACCOUNT_ANONYMIZE_BOOKS       = "update book set account_id = null where account_id = unhex(?)"
+	ACCOUNT_DELETE_BARCODE_VOTES  = "delete from contribution_vote where contribution_id in (select id from barcode where account_id = unhex(?))"
+	ACCOUNT_DELETE_BRAND_VOTES    = "delete from contribution_vote where contribution_id in (select id from contributed_brand where account_id = unhex(?))"
+	ACCOUNT_DELETE_BOOK_VOTES     = "delete from contribution_vote where contribution_id in (select id from book where account_id = unhex(?))"
+	ACCOUNT_DELETE_BARCODE_BRANDS = "delete from barcode_brand where barcode_id in (select id from barcode where account_id = unhex(?))"
+	ACCOUNT_DELETE_BRAND_BARCODES = "delete from barcode_brand where contributed_brand_id in (select id from contributed_brand where account_id = unhex(?))"
+	ACCOUNT_DELETE_BARCODES       = "delete from barcode where account_id = unhex(?)"
+	ACCOUNT_DELETE_BRANDS         = "delete from contributed_brand where account_id = unhex(?)"
+	ACCOUNT_DELETE_BOOK_AUTHORS   = "delete from book_author where book_id in (select id from book where account_id = unhex(?))"
+	ACCOUNT_DELETE_BOOKS          = "delete from book where account_id = unhex(?)"
+
 	// Lookup
-	ACCOUNT_LOOKUP_BY_EMAIL = "select hex(id), verify_code, verified, enabled from account where email = ?"
-	ACCOUNT_LOOKUP_BY_ID    = "select email, verify_code, verified, enabled from account where id = unhex(?)"
+	ACCOUNT_LOOKUP_BY_EMAIL = "select hex(id), verify_code, verified, enabled, role, language from account where email = ?"
+	ACCOUNT_LOOKUP_BY_ID    = "select email, verify_code, verified, enabled, role, language from account where id = unhex(?)"
+	ACCOUNT_LOOKUP_BY_TOKEN = "select hex(id), email, verified, enabled, token_expires > NOW() from account where verify_token = ?"
+
+	// Account roles
+	ROLE_CONTRIBUTOR = "contributor"
+	ROLE_TRUSTED     = "trusted"
+	ROLE_ADMIN       = "admin"
+)
+
+var (
+	ACCOUNT_ANONYMIZE_CONTRIBUTIONS = []string{ACCOUNT_DELETE_VOTES,
+		ACCOUNT_ANONYMIZE_BARCODES,
+		ACCOUNT_ANONYMIZE_BRANDS,
+		ACCOUNT_ANONYMIZE_BOOKS}
+
+	ACCOUNT_DELETE_CONTRIBUTIONS = []string{ACCOUNT_DELETE_VOTES,
+		ACCOUNT_DELETE_BARCODE_VOTES,
+		ACCOUNT_DELETE_BRAND_VOTES,
+		ACCOUNT_DELETE_BOOK_VOTES,
+		ACCOUNT_DELETE_BARCODE_BRANDS,
+		ACCOUNT_DELETE_BRAND_BARCODES,
+		ACCOUNT_DELETE_BARCODES,
+		ACCOUNT_DELETE_BRANDS,
+		ACCOUNT_DELETE_BOOK_AUTHORS,
+		ACCOUNT_DELETE_BOOKS}
 )
 
 // Data structure (POD contributor accounts)
@@ -30,6 +80,8 @@ type ACCOUNT struct {
 	APICode  string `json:"code"`
 	Verified bool   `json:"verified,omitempty"`
 	Enabled  bool   `json:"enabled,omitempty"`
+	Role     string `json:"role,omitempty"`
+	Language string `json:"lang,omitempty"` // for emails (the default if empty)
 }
 
 // Query Functions
@@ -48,11 +100,11 @@ func LookupAccount(stmt *sql.Stmt, param string, usingId bool) (*ACCOUNT, error)
 
 	for rows.Next() {
 		var (
-			n, cd sql.NullString
-			v, e  sql.NullBool
+			n, cd, ro, l sql.NullString
+			v, e         sql.NullBool
 		)
 
-		err := rows.Scan(&n, &cd, &v, &e)
+		err := rows.Scan(&n, &cd, &v, &e, &ro, &l)
 		if err != nil {
 			return result, err
 		} else {
@@ -66,6 +118,11 @@ func LookupAccount(stmt *sql.Stmt, param string, usingId bool) (*ACCOUNT, error)
 			result.APICode = cd.String
 			result.Verified = v.Bool
 			result.Enabled = e.Bool
+			result.Role = ROLE_CONTRIBUTOR
+			if ro.Valid {
+				result.Role = ro.String
+			}
+			result.Language = l.String
 
 			break
 		}
@@ -74,11 +131,60 @@ func LookupAccount(stmt *sql.Stmt, param string, usingId bool) (*ACCOUNT, error)
 	return result, nil
 }
 
+// LookupAccountByToken searches for the Account with the given email
+// verification token, also returning whether or not the token is still
+// current (the Account Id is empty if no Account has that token)
+func LookupAccountByToken(stmt *sql.Stmt, token string) (*ACCOUNT, bool, error) {
+	result := new(ACCOUNT)
+
+	rows, err := stmt.Query(token)
+	if err != nil {
+		return result, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			i, n    sql.NullString
+			v, e, c sql.NullBool
+		)
+
+		err := rows.Scan(&i, &n, &v, &e, &c)
+		if err != nil {
+			return result, false, err
+		} else {
+			result.Id = i.String
+			result.Email = n.String
+			result.Verified = v.Bool
+			result.Enabled = e.Bool
+
+			return result, c.Bool, nil
+		}
+	}
+
+	return result, false, nil
+}
+
+// CanVote is true if the Account may upvote or flag contributions
+func (a *ACCOUNT) CanVote() bool {
+	return a.Id != "" && a.Verified
+}
+
+// CanModerate is true if the Account may approve or reject contributions
+func (a *ACCOUNT) CanModerate() bool {
+	return a.CanVote() && (a.Role == ROLE_TRUSTED || a.Role == ROLE_ADMIN)
+}
+
+// IsAdmin is true if the Account may change the roles of other Accounts
+func (a *ACCOUNT) IsAdmin() bool {
+	return a.CanVote() && a.Role == ROLE_ADMIN
+}
+
 // Add, Update, and Delete
 
 func (a *ACCOUNT) Add(stmt *sql.Stmt) (string, error) {
 	pk := GenerateUUID(UndashedUUID)
-	_, err := stmt.Exec(pk, a.Email, a.APICode)
+	_, err := stmt.Exec(pk, a.Email, a.APICode, a.Language)
 
 	return pk, err
 }
@@ -94,3 +200,76 @@ func (a *ACCOUNT) Update(stmt *sql.Stmt) error {
 
 	return err
 }
+
+// SetAPICode replaces the Account's api code, so that requests signed
+// with the old one are no longer accepted
+func (a *ACCOUNT) SetAPICode(stmt *sql.Stmt, code string) error {
+	_, err := stmt.Exec(code, a.Id)
+	if err == nil {
+		a.APICode = code
+	}
+
+	return err
+}
+
+// IssueVerificationToken replaces any existing email verification token
+// for the Account with a new (random) one, which expires after the given
+// number of seconds
+func (a *ACCOUNT) IssueVerificationToken(stmt *sql.Stmt, expiry int) (string, error) {
+	token := GenerateUUID(UndashedUUID)
+	_, err := stmt.Exec(token, expiry, a.Id)
+
+	return token, err
+}
+
+// Verify marks the Account as verified; its token is kept (until it is
+// replaced), so that following the verification link again says that the
+// Account is already verified, rather than that the link is unknown
+func (a *ACCOUNT) Verify(stmt *sql.Stmt) error {
+	_, err := stmt.Exec(a.Id)
+	if err == nil {
+		a.Verified = true
+	}
+
+	return err
+}
+
+// SetLanguage changes the locale of the emails sent to the Account
+func (a *ACCOUNT) SetLanguage(stmt *sql.Stmt, language string) error {
+	_, err := stmt.Exec(language, a.Id)
+	if err == nil {
+		a.Language = language
+	}
+
+	return err
+}
+
+// SetEnabled disables (or re-enables) the Account: disabled Accounts
+// cannot make any signed requests
+func (a *ACCOUNT) SetEnabled(stmt *sql.Stmt, enabled bool) error {
+	_, err := stmt.Exec(enabled, a.Id)
+	if err == nil {
+		a.Enabled = enabled
+	}
+
+	return err
+}
+
+// Remove executes each of the removal statements (in order) against the
+// Account, i.e., those of either ACCOUNT_ANONYMIZE_CONTRIBUTIONS or
+// ACCOUNT_DELETE_CONTRIBUTIONS, and then deletes the Account itself (with
+// the ACCOUNT_DELETE statement), all in one transaction, so that nothing
+// is removed unless everything is
+func (a *ACCOUNT) Remove(db *sql.DB, removal []*sql.Stmt, deleteStmt *sql.Stmt) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range append(removal, deleteStmt) {
+		if _, err = tx.Stmt(stmt).Exec(a.Id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
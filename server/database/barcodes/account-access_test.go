@@ -0,0 +1,133 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package barcodes
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/Banrai/PiScan/server/database/dbtest"
+	"reflect"
+	"testing"
+)
+
+// queries returns the Query of each of the calls, in order
+func queries(calls []dbtest.Call) []string {
+	results := make([]string, 0)
+	for _, c := range calls {
+		results = append(results, c.Query)
+	}
+	return results
+}
+
+func TestAccountRemove(t *testing.T) {
+	db := dbtest.New(t)
+	for _, query := range append(ACCOUNT_DELETE_CONTRIBUTIONS, ACCOUNT_DELETE) {
+		db.Handle(query, dbtest.Affected(1))
+	}
+	statements := db.Statements(t, append(ACCOUNT_DELETE_CONTRIBUTIONS, ACCOUNT_DELETE)...)
+	removal := make([]*sql.Stmt, 0)
+	for _, query := range ACCOUNT_DELETE_CONTRIBUTIONS {
+		removal = append(removal, statements[query])
+	}
+
+	acc := &ACCOUNT{Id: ACCOUNT_ID}
+	if err := acc.Remove(db.DB, removal, statements[ACCOUNT_DELETE]); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := append(append([]string{dbtest.BEGIN}, ACCOUNT_DELETE_CONTRIBUTIONS...), ACCOUNT_DELETE, dbtest.COMMIT)
+	if calls := queries(db.Calls()); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("calls = %q, expected %q", calls, expected)
+	}
+	for _, c := range db.Calls() {
+		if c.Args != nil && !reflect.DeepEqual(c.Args, []driver.Value{ACCOUNT_ID}) {
+			t.Errorf("%s args = %v", c.Query, c.Args)
+		}
+	}
+}
+
+func TestAccountRemoveRollsBack(t *testing.T) {
+	db := dbtest.New(t)
+	db.Handle(ACCOUNT_DELETE_VOTES, dbtest.Affected(2))
+	db.Handle(ACCOUNT_ANONYMIZE_BARCODES, func(args []driver.Value) (*dbtest.Result, error) {
+		return nil, errors.New("lock wait timeout exceeded")
+	})
+	db.Handle(ACCOUNT_ANONYMIZE_BRANDS, dbtest.Affected(1))
+	db.Handle(ACCOUNT_ANONYMIZE_BOOKS, dbtest.Affected(1))
+	db.Handle(ACCOUNT_DELETE, dbtest.Affected(1))
+	statements := db.Statements(t, append(ACCOUNT_ANONYMIZE_CONTRIBUTIONS, ACCOUNT_DELETE)...)
+	removal := make([]*sql.Stmt, 0)
+	for _, query := range ACCOUNT_ANONYMIZE_CONTRIBUTIONS {
+		removal = append(removal, statements[query])
+	}
+
+	acc := &ACCOUNT{Id: ACCOUNT_ID}
+	if err := acc.Remove(db.DB, removal, statements[ACCOUNT_DELETE]); err == nil {
+		t.Fatal("Remove succeeded, expected the anonymizing error")
+	}
+
+	// the account is kept, and the votes already deleted are rolled back
+	expected := []string{dbtest.BEGIN, ACCOUNT_DELETE_VOTES, ACCOUNT_ANONYMIZE_BARCODES, dbtest.ROLLBACK}
+	if calls := queries(db.Calls()); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("calls = %q, expected %q", calls, expected)
+	}
+}
+
+func TestIssueVerificationToken(t *testing.T) {
+	db := dbtest.New(t)
+	db.Handle(ACCOUNT_SET_VERIFY_TOKEN, dbtest.Affected(1))
+	stmt := db.Stmt(t, ACCOUNT_SET_VERIFY_TOKEN)
+	acc := &ACCOUNT{Id: ACCOUNT_ID}
+
+	first, err := acc.IssueVerificationToken(stmt, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := acc.IssueVerificationToken(stmt, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 32 || first == second {
+		t.Errorf("tokens %q and %q, expected two different 32 character ones", first, second)
+	}
+
+	calls := db.Calls()
+	for i, token := range []string{first, second} {
+		if expected := []driver.Value{token, int64(3600), ACCOUNT_ID}; !reflect.DeepEqual(calls[i].Args, expected) {
+			t.Errorf("update %d args = %v, expected %v", i, calls[i].Args, expected)
+		}
+	}
+}
+
+func TestLookupAccountByToken(t *testing.T) {
+	const token = "00112233445566778899AABBCCDDEEFF"
+
+	tests := []struct {
+		name     string
+		rows     [][]driver.Value
+		expected *ACCOUNT
+		current  bool
+	}{
+		{"current", [][]driver.Value{{ACCOUNT_ID, "someone@example.org", false, true, true}}, &ACCOUNT{Id: ACCOUNT_ID, Email: "someone@example.org", Enabled: true}, true},
+		{"expired", [][]driver.Value{{ACCOUNT_ID, "someone@example.org", false, true, false}}, &ACCOUNT{Id: ACCOUNT_ID, Email: "someone@example.org", Enabled: true}, false},
+		{"no expiry", [][]driver.Value{{ACCOUNT_ID, "someone@example.org", true, false, nil}}, &ACCOUNT{Id: ACCOUNT_ID, Email: "someone@example.org", Verified: true}, false},
+		{"unknown", nil, &ACCOUNT{}, false},
+	}
+	for _, test := range tests {
+		db := dbtest.New(t)
+		db.Handle(ACCOUNT_LOOKUP_BY_TOKEN, dbtest.Rows(nil, test.rows...))
+
+		acc, current, err := LookupAccountByToken(db.Stmt(t, ACCOUNT_LOOKUP_BY_TOKEN), token)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(acc, test.expected) || current != test.current {
+			t.Errorf("%s: LookupAccountByToken = %+v, %v, expected %+v, %v", test.name, acc, current, test.expected, test.current)
+		}
+		if args := db.Calls()[0].Args; !reflect.DeepEqual(args, []driver.Value{token}) {
+			t.Errorf("%s: query args = %v", test.name, args)
+		}
+	}
+}
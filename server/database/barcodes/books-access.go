@@ -0,0 +1,215 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package barcodes provides access to the database holding product data,
+// sourced from both from the Open Product Database (POD) and every supported
+// commerce API/site
+
+package barcodes
+
+import (
+	"database/sql"
+	"strings"
+)
+
+const (
+	// Prepared Statements
+
+	// Books
+	BOOK_LOOKUP        = "select hex(b.id), b.title, b.publisher, b.src, hex(b.account_id), b.status, a.full_name from book b left join book_author ba on ba.book_id = b.id left join author a on a.id = ba.author_id where b.isbn = ? and (b.status = 'approved' or b.account_id = unhex(?)) order by b.posted"
+	BOOK_INSERT        = "insert into book (id, title, isbn, is_isbn10, publisher, src, account_id, status) values (unhex(?), ?, ?, ?, ?, ?, unhex(?), ?)"
+	AUTHOR_LOOKUP      = "select hex(id) from author where full_name = ? and src = ?"
+	AUTHOR_INSERT      = "insert into author (id, full_name, src) values (unhex(?), ?, ?)"
+	BOOK_AUTHOR_INSERT = "insert into book_author (id, book_id, author_id) values (unhex(?), unhex(?), unhex(?))"
+
+	// Book sources
+	OPEN_LIBRARY_SRC = "OL"
+	CONTRIBUTED_SRC  = "PiScan"
+)
+
+// Data structures
+
+type BOOK struct {
+	Id        string   `json:"id"`
+	Title     string   `json:"title"`
+	ISBN      string   `json:"isbn"`
+	Publisher string   `json:"publisher,omitempty"`
+	Authors   []string `json:"authors,omitempty"`
+	Source    string   `json:"src"`
+	AccountID string   `json:"account,omitempty"`
+	Status    string   `json:"status,omitempty"`
+}
+
+// ISBN detection
+
+// isDigits confirms the string contains only the numbers 0-9
+func isDigits(code string) bool {
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(code) > 0
+}
+
+// IsISBN13 confirms the barcode is a "Bookland" EAN, i.e., a 13 digit code
+// with a 978 or 979 prefix, and a valid check digit
+func IsISBN13(code string) bool {
+	if len(code) != 13 || !isDigits(code) {
+		return false
+	}
+	if !strings.HasPrefix(code, "978") && !strings.HasPrefix(code, "979") {
+		return false
+	}
+
+	sum := 0
+	for i, c := range code[:12] {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += int(c-'0') * weight
+	}
+	return (10-sum%10)%10 == int(code[12]-'0')
+}
+
+// IsISBN10 confirms the barcode is a 10 character ISBN, whose final check
+// character may be an 'X'
+func IsISBN10(code string) bool {
+	code = strings.ToUpper(code)
+	if len(code) != 10 || !isDigits(code[:9]) {
+		return false
+	}
+
+	sum := 0
+	for i, c := range code[:9] {
+		sum += int(c-'0') * (10 - i)
+	}
+	if code[9] == 'X' {
+		sum += 10
+	} else if code[9] >= '0' && code[9] <= '9' {
+		sum += int(code[9] - '0')
+	} else {
+		return false
+	}
+	return sum%11 == 0
+}
+
+// IsISBN is true if the barcode is either an ISBN-13 or ISBN-10 code
+func IsISBN(code string) bool {
+	return IsISBN13(code) || IsISBN10(code)
+}
+
+// Query Functions
+
+// LookupBook takes a prepared statement (using the BOOK_LOOKUP string),
+// an isbn string, and looks it up in the book tables, returning a list of
+// matching BOOK structs, including all their authors. Only the approved
+// books are returned, along with any (still pending) ones contributed by
+// the account with the callerId primary key.
+func LookupBook(stmt *sql.Stmt, isbn, callerId string) ([]*BOOK, error) {
+	results := make([]*BOOK, 0)
+
+	rows, err := stmt.Query(isbn, callerId)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	books := make(map[string]*BOOK)
+	for rows.Next() {
+		var i, t, p, s, c, st, a sql.NullString
+
+		err := rows.Scan(&i, &t, &p, &s, &c, &st, &a)
+		if err != nil {
+			return results, err
+		} else {
+			// the query returns one row per author, so
+			// combine them into a single result per book
+			book, exists := books[i.String]
+			if !exists {
+				book = new(BOOK)
+				book.Id = i.String
+				book.Title = t.String
+				book.ISBN = isbn
+				book.Publisher = p.String
+				book.Source = s.String
+				book.AccountID = c.String
+				book.Status = st.String
+				book.Authors = make([]string, 0)
+				books[i.String] = book
+				results = append(results, book)
+			}
+			if a.Valid {
+				book.Authors = append(book.Authors, a.String)
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// lookupAuthor returns the primary key of the author with the given name
+// and source, or the empty string if not found
+func lookupAuthor(stmt *sql.Stmt, name, src string) (string, error) {
+	var pk sql.NullString
+	err := stmt.QueryRow(name, src).Scan(&pk)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return pk.String, err
+}
+
+// Write functions (user contributions)
+
+// ContributeBook adds the BOOK contributed by the given ACCOUNT (pending
+// moderation, unless the account can approve it), creating any of its
+// authors which do not already exist, and returns the new book primary key;
+// the book and its authors are saved in a single transaction, so that a
+// failure part of the way through leaves nothing behind
+func ContributeBook(db *sql.DB, bookInsert, authorLookup, authorInsert, bookAuthorInsert *sql.Stmt, rec *BOOK, acc *ACCOUNT) (string, error) {
+	if rec.Id == "" {
+		rec.Id = GenerateUUID(UndashedUUID)
+	}
+	rec.Source = CONTRIBUTED_SRC
+	rec.AccountID = acc.Id
+	rec.Status = InitialStatus(acc)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return rec.Id, err
+	}
+
+	_, err = tx.Stmt(bookInsert).Exec(rec.Id, rec.Title, rec.ISBN, IsISBN10(rec.ISBN), rec.Publisher, rec.Source, acc.Id, rec.Status)
+	if err != nil {
+		tx.Rollback()
+		return rec.Id, err
+	}
+
+	for _, name := range rec.Authors {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		authorPk, authorErr := lookupAuthor(tx.Stmt(authorLookup), name, rec.Source)
+		if authorErr != nil {
+			tx.Rollback()
+			return rec.Id, authorErr
+		}
+		if authorPk == "" {
+			authorPk = GenerateUUID(UndashedUUID)
+			_, authorErr = tx.Stmt(authorInsert).Exec(authorPk, name, rec.Source)
+			if authorErr != nil {
+				tx.Rollback()
+				return rec.Id, authorErr
+			}
+		}
+		_, err = tx.Stmt(bookAuthorInsert).Exec(GenerateUUID(UndashedUUID), rec.Id, authorPk)
+		if err != nil {
+			tx.Rollback()
+			return rec.Id, err
+		}
+	}
+
+	return rec.Id, tx.Commit()
+}
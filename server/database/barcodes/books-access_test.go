@@ -0,0 +1,78 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package barcodes
+
+import (
+	"database/sql/driver"
+	"errors"
+	"github.com/Banrai/PiScan/server/database/dbtest"
+	"reflect"
+	"testing"
+)
+
+const AUTHOR_ID = "00112233445566778899AABBCCDDEEFF"
+
+// contributeBook runs ContributeBook with the statements of the fake db
+func contributeBook(t *testing.T, db *dbtest.DB, book *BOOK) error {
+	statements := db.Statements(t, BOOK_INSERT, AUTHOR_LOOKUP, AUTHOR_INSERT, BOOK_AUTHOR_INSERT)
+	acc := &ACCOUNT{Id: ACCOUNT_ID, Verified: true}
+	_, err := ContributeBook(db.DB, statements[BOOK_INSERT], statements[AUTHOR_LOOKUP], statements[AUTHOR_INSERT], statements[BOOK_AUTHOR_INSERT], book, acc)
+	return err
+}
+
+func TestContributeBook(t *testing.T) {
+	db := dbtest.New(t)
+	db.Handle(BOOK_INSERT, dbtest.Affected(1))
+	db.Handle(AUTHOR_LOOKUP, func(args []driver.Value) (*dbtest.Result, error) {
+		// only the first author is known already
+		if args[0] == "Gaiman, Neil" {
+			return &dbtest.Result{Rows: [][]driver.Value{{AUTHOR_ID}}}, nil
+		}
+		return &dbtest.Result{}, nil
+	})
+	db.Handle(AUTHOR_INSERT, dbtest.Affected(1))
+	db.Handle(BOOK_AUTHOR_INSERT, dbtest.Affected(1))
+
+	book := &BOOK{Title: "Good Omens", ISBN: "9780060853983", Authors: []string{"Gaiman, Neil", " ", "Pratchett, Terry"}}
+	if err := contributeBook(t, db, book); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{dbtest.BEGIN, BOOK_INSERT,
+		AUTHOR_LOOKUP, BOOK_AUTHOR_INSERT,
+		AUTHOR_LOOKUP, AUTHOR_INSERT, BOOK_AUTHOR_INSERT,
+		dbtest.COMMIT}
+	calls := db.Calls()
+	if queries := queries(calls); !reflect.DeepEqual(queries, expected) {
+		t.Fatalf("calls = %q, expected %q", queries, expected)
+	}
+	// (id, book_id, author_id)
+	if args := calls[3].Args; args[1] != book.Id || args[2] != AUTHOR_ID {
+		t.Errorf("known author args = %v", args)
+	}
+	if args := calls[6].Args; args[1] != book.Id || args[2] != calls[5].Args[0] {
+		t.Errorf("new author args = %v, author %v", args, calls[5].Args)
+	}
+}
+
+func TestContributeBookRollsBack(t *testing.T) {
+	db := dbtest.New(t)
+	db.Handle(BOOK_INSERT, dbtest.Affected(1))
+	db.Handle(AUTHOR_LOOKUP, dbtest.Rows(nil))
+	db.Handle(AUTHOR_INSERT, dbtest.Affected(1))
+	db.Handle(BOOK_AUTHOR_INSERT, func(args []driver.Value) (*dbtest.Result, error) {
+		return nil, errors.New("lock wait timeout exceeded")
+	})
+
+	book := &BOOK{Title: "Dubliners", ISBN: "9780140186475", Authors: []string{"Joyce, James"}}
+	if err := contributeBook(t, db, book); err == nil {
+		t.Fatal("ContributeBook succeeded, expected the book_author error")
+	}
+
+	// the book without its author is not kept
+	expected := []string{dbtest.BEGIN, BOOK_INSERT, AUTHOR_LOOKUP, AUTHOR_INSERT, BOOK_AUTHOR_INSERT, dbtest.ROLLBACK}
+	if calls := queries(db.Calls()); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("calls = %q, expected %q", calls, expected)
+	}
+}
@@ -7,14 +7,32 @@
 
 package barcodes
 
-import "database/sql"
+import (
+	"database/sql"
+	"strings"
+)
 
 const (
 	// Prepared Statements
 
 	// Amazon
-	ASIN_LOOKUP = "select asin, product, is_upc, is_ean, is_isbn, locale from amazon where barcode = ?"
-	ASIN_INSERT = "insert into amazon (id, barcode, asin, product, is_upc, is_ean, is_isbn, locale) values (unhex(?), ?, ?, ?, ?, ?, ?, ?)"
+	ASIN_LOOKUP = "select asin, product, is_upc, is_ean, is_isbn, locale, image_url, unix_timestamp(prices_checked) from amazon where barcode = ?"
+	ASIN_INSERT = "insert into amazon (id, barcode, asin, product, is_upc, is_ean, is_isbn, locale, image_url, prices_checked) values (unhex(?), ?, ?, ?, ?, ?, ?, ?, ?, NOW())"
+
+	// when the Product API was last asked for the current prices of the
+	// barcode's products (whether or not it had any)
+	ASIN_PRICES_CHECKED = "update amazon set prices_checked = NOW() where barcode = ?"
+
+	// Open Food Facts
+	OFF_LOOKUP = "select product, brand, image_url, category, ingredients, allergens, nutriscore, locale from openfoodfacts where barcode = ?"
+	OFF_INSERT = "insert into openfoodfacts (id, barcode, product, brand, image_url, category, ingredients, allergens, nutriscore, locale) values (unhex(?), ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+
+	// Prices
+	PRICE_INSERT = "insert into price_history (id, vendor, sku, price, currency) values (unhex(?), ?, ?, ?, ?)"
+	PRICE_LOOKUP = "select price, currency, unix_timestamp(posted) from price_history where vendor = ? and sku = ? order by posted desc limit ?"
+
+	// separator for lists stored in a single column
+	LIST_SEPARATOR = ","
 )
 
 // Data structures
@@ -27,6 +45,32 @@ type AMAZON struct {
 	ProductName string `json:"product,omitempty"`
 	ProductType string `json:"type,omitempty"`
 	Locale      string `json:"locale"`
+	ImageURL    string `json:"img,omitempty"`
+	Checked     int64  `json:"checked,omitempty"` // unix time the prices were last checked
+}
+
+// Prices
+
+type PRICE struct {
+	Vendor   string `json:"vnd"`
+	SKU      string `json:"sku"`
+	Price    int64  `json:"price"`
+	Currency string `json:"currency"`
+	Posted   int64  `json:"posted,omitempty"` // unix time
+}
+
+// Open Food Facts
+
+type OPENFOODFACTS struct {
+	Barcode     string   `json:"barcode"`
+	ProductName string   `json:"product,omitempty"`
+	Brand       string   `json:"brand,omitempty"`
+	ImageURL    string   `json:"img,omitempty"`
+	Category    string   `json:"category,omitempty"`
+	Ingredients string   `json:"ingredients,omitempty"`
+	Allergens   []string `json:"allergens,omitempty"`
+	NutriScore  string   `json:"nutriscore,omitempty"`
+	Locale      string   `json:"locale"`
 }
 
 // Query Functions
@@ -47,11 +91,12 @@ func LookupAsin(stmt *sql.Stmt, barcode string) ([]*AMAZON, error) {
 
 	for rows.Next() {
 		var (
-			a, p, l        sql.NullString
+			a, p, l, img   sql.NullString
 			upc, ean, isbn sql.NullBool
+			checked        sql.NullInt64
 		)
 
-		err := rows.Scan(&a, &p, &upc, &ean, &isbn, &l)
+		err := rows.Scan(&a, &p, &upc, &ean, &isbn, &l, &img, &checked)
 		if err != nil {
 			return results, err
 		} else {
@@ -61,6 +106,8 @@ func LookupAsin(stmt *sql.Stmt, barcode string) ([]*AMAZON, error) {
 				result.Asin = a.String
 				result.ProductName = p.String
 				result.Locale = l.String
+				result.ImageURL = img.String
+				result.Checked = checked.Int64
 				if upc.Valid && upc.Bool {
 					result.ProductType = UPC
 				} else if ean.Valid && ean.Bool {
@@ -94,7 +141,115 @@ func InsertAsin(stmt *sql.Stmt, rec AMAZON) error {
 		isIsbn = true
 	}
 
-	_, err := stmt.Exec(GenerateUUID(UndashedUUID), rec.Barcode, rec.Asin, rec.ProductName, isUpc, isEan, isIsbn, rec.Locale)
+	_, err := stmt.Exec(GenerateUUID(UndashedUUID), rec.Barcode, rec.Asin, rec.ProductName, isUpc, isEan, isIsbn, rec.Locale, rec.ImageURL)
+
+	return err
+}
+
+// SetPricesChecked takes a prepared statement (using the
+// ASIN_PRICES_CHECKED string), and records that the current prices of
+// the barcode's products were just checked
+func SetPricesChecked(stmt *sql.Stmt, barcode string) error {
+	_, err := stmt.Exec(barcode)
+
+	return err
+}
+
+// Open Food Facts
+
+// LookupOpenFoodFacts takes a prepared statement (using the OFF_LOOKUP
+// string), a barcode string, and looks it up in the openfoodfacts table
+// (sourced from querying the Open Food Facts API), returning a list of
+// matching OPENFOODFACTS structs
+func LookupOpenFoodFacts(stmt *sql.Stmt, barcode string) ([]*OPENFOODFACTS, error) {
+	results := make([]*OPENFOODFACTS, 0)
+
+	rows, err := stmt.Query(barcode)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p, b, img, c, i, a, n, l sql.NullString
+
+		err := rows.Scan(&p, &b, &img, &c, &i, &a, &n, &l)
+		if err != nil {
+			return results, err
+		} else {
+			if p.Valid {
+				result := new(OPENFOODFACTS)
+				result.Barcode = barcode
+				result.ProductName = p.String
+				result.Brand = b.String
+				result.ImageURL = img.String
+				result.Category = c.String
+				result.Ingredients = i.String
+				if a.Valid && len(a.String) > 0 {
+					result.Allergens = strings.Split(a.String, LIST_SEPARATOR)
+				}
+				result.NutriScore = n.String
+				result.Locale = l.String
+				results = append(results, result)
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// InsertOpenFoodFacts takes a prepared statement corresponding to an
+// insert, an OPENFOODFACTS data struct, and inserts the data from the
+// struct as a new record in the database
+func InsertOpenFoodFacts(stmt *sql.Stmt, rec OPENFOODFACTS) error {
+	_, err := stmt.Exec(GenerateUUID(UndashedUUID), rec.Barcode, rec.ProductName, rec.Brand, rec.ImageURL, rec.Category, rec.Ingredients, strings.Join(rec.Allergens, LIST_SEPARATOR), rec.NutriScore, rec.Locale)
+
+	return err
+}
+
+// Prices
+
+// LookupPrices takes a prepared statement (using the PRICE_LOOKUP string),
+// a vendor id and sku, and returns up to limit PRICE structs for that
+// product, most recent first
+func LookupPrices(stmt *sql.Stmt, vendor, sku string, limit int) ([]*PRICE, error) {
+	results := make([]*PRICE, 0)
+
+	rows, err := stmt.Query(vendor, sku, limit)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			p, t sql.NullInt64
+			c    sql.NullString
+		)
+
+		err := rows.Scan(&p, &c, &t)
+		if err != nil {
+			return results, err
+		} else {
+			if p.Valid && c.Valid {
+				result := new(PRICE)
+				result.Vendor = vendor
+				result.SKU = sku
+				result.Price = p.Int64
+				result.Currency = c.String
+				result.Posted = t.Int64
+				results = append(results, result)
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// InsertPrice takes a prepared statement corresponding to an insert, a
+// PRICE data struct, and adds it to the price history
+func InsertPrice(stmt *sql.Stmt, rec PRICE) error {
+	_, err := stmt.Exec(GenerateUUID(UndashedUUID), rec.Vendor, rec.SKU, rec.Price, rec.Currency)
 
 	return err
 }
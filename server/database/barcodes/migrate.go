@@ -0,0 +1,203 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package barcodes provides access to the database holding product data,
+// sourced from both from the Open Product Database (POD) and every supported
+// commerce API/site
+
+package barcodes
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Banrai/PiScan/server/database/migrations"
+	"github.com/go-sql-driver/mysql"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Schema versions
+	CREATE_SCHEMA_VERSION = "create table if not exists schema_version (version bigint primary key NOT NULL, name varchar(128) NOT NULL, applied datetime NOT NULL)"
+	GET_SCHEMA_VERSION    = "select coalesce(max(version), 0) from schema_version"
+	SET_SCHEMA_VERSION    = "insert into schema_version (version, name, applied) values (?, ?, now())"
+	COUNT_SCHEMA_VERSION  = "select count(*) from information_schema.tables where table_schema = database() and table_name = 'schema_version'"
+
+	// the named lock, so that only one APIServer migrates at a time
+	GET_MIGRATION_LOCK     = "select get_lock('piscan_migration', ?)"
+	RELEASE_MIGRATION_LOCK = "select release_lock('piscan_migration')"
+
+	// how long to wait for another APIServer to finish migrating, in seconds
+	MIGRATION_TIMEOUT = 60
+
+	// the mysql error for "add column" statements of columns which already
+	// exist (see migrations/0006_upgrades.sql)
+	DUPLICATE_COLUMN = 1060
+)
+
+var (
+	// the versions of the Migrations which add the columns that databases
+	// created from the old sql files may have already (0006_upgrades), and
+	// so the only ones where DUPLICATE_COLUMN errors are skipped
+	UPGRADE_MIGRATIONS = map[int64]bool{6: true}
+)
+
+// Migration is one of the schema changes in the migrations package
+type Migration struct {
+	Version int64
+	Name    string
+	SQL     string
+}
+
+// Statements splits the Migration into its sql statements, after removing
+// the comments (so the comments can contain semicolons, but the string
+// values in the statements cannot have any, or a "--")
+func (m *Migration) Statements() []string {
+	lines := strings.Split(m.SQL, "\n")
+	for i, line := range lines {
+		if comment := strings.Index(line, "--"); comment >= 0 {
+			lines[i] = line[:comment]
+		}
+	}
+	results := make([]string, 0)
+	for _, statement := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			results = append(results, statement)
+		}
+	}
+	return results
+}
+
+// apply runs each of the Migration statements, except for adding any
+// columns which are already there (in the UPGRADE_MIGRATIONS only), and
+// then records its version
+func (m *Migration) apply(ctx context.Context, conn *sql.Conn) error {
+	for _, statement := range m.Statements() {
+		_, err := conn.ExecContext(ctx, statement)
+		var mysqlErr *mysql.MySQLError
+		if err != nil && !(UPGRADE_MIGRATIONS[m.Version] && errors.As(err, &mysqlErr) && mysqlErr.Number == DUPLICATE_COLUMN) {
+			return fmt.Errorf("Migration %d (%s) failed: %s", m.Version, m.Name, err)
+		}
+	}
+	_, err := conn.ExecContext(ctx, SET_SCHEMA_VERSION, m.Version, m.Name)
+	return err
+}
+
+// Migrations returns all the Migrations, in version order
+func Migrations() ([]*Migration, error) {
+	results := make([]*Migration, 0)
+	files, err := fs.Glob(migrations.Files, "*.sql")
+	if err != nil {
+		return results, err
+	}
+	versions := make(map[int64]string)
+	for _, file := range files {
+		name := strings.TrimSuffix(file, ".sql")
+		parts := strings.SplitN(name, "_", 2)
+		version, versionErr := strconv.ParseInt(parts[0], 10, 64)
+		if versionErr != nil || version <= 0 || len(parts) < 2 {
+			return results, fmt.Errorf("Invalid migration file name: '%s'", file)
+		}
+		if other, exists := versions[version]; exists {
+			return results, fmt.Errorf("Migrations '%s' and '%s' have the same version", other, file)
+		}
+		versions[version] = file
+
+		content, readErr := migrations.Files.ReadFile(file)
+		if readErr != nil {
+			return results, readErr
+		}
+		results = append(results, &Migration{Version: version, Name: parts[1], SQL: string(content)})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Version < results[j].Version })
+	return results, nil
+}
+
+// SchemaVersion returns the version of the last Migration applied to the
+// database, or zero if there is none (including when the database has
+// never been migrated, and so has no schema_version table)
+func SchemaVersion(db *sql.DB) (int64, error) {
+	var version int64
+	var n int64
+	if err := db.QueryRow(COUNT_SCHEMA_VERSION).Scan(&n); err != nil || n == 0 {
+		return version, err
+	}
+	err := db.QueryRow(GET_SCHEMA_VERSION).Scan(&version)
+	return version, err
+}
+
+// PendingMigrations returns the Migrations which the database has yet to
+// have, without changing anything
+func PendingMigrations(db *sql.DB) ([]*Migration, error) {
+	pending := make([]*Migration, 0)
+	all, err := Migrations()
+	if err != nil {
+		return pending, err
+	}
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return pending, err
+	}
+	for _, m := range all {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// MigrateDB brings the database up to date, by applying the Migrations it
+// has yet to have, in order, and returns the ones it applied; if one of
+// them fails, the ones before it stay applied, and running MigrateDB
+// again (once the problem is fixed) resumes with the one which failed
+func MigrateDB(db *sql.DB) ([]*Migration, error) {
+	applied := make([]*Migration, 0)
+
+	all, err := Migrations()
+	if err != nil {
+		return applied, err
+	}
+
+	// the lock belongs to the connection which took it, so every statement
+	// runs on that one
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return applied, err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, CREATE_SCHEMA_VERSION); err != nil {
+		return applied, err
+	}
+
+	// wait for any other APIServer migrating at the same time, which
+	// leaves nothing more to do here
+	var locked sql.NullInt64
+	if err = conn.QueryRowContext(ctx, GET_MIGRATION_LOCK, MIGRATION_TIMEOUT).Scan(&locked); err != nil {
+		return applied, err
+	}
+	if locked.Int64 != 1 {
+		return applied, fmt.Errorf("Timed out waiting for another migration to finish, after %d seconds", MIGRATION_TIMEOUT)
+	}
+	defer conn.ExecContext(ctx, RELEASE_MIGRATION_LOCK)
+
+	var version int64
+	if err = conn.QueryRowContext(ctx, GET_SCHEMA_VERSION).Scan(&version); err != nil {
+		return applied, err
+	}
+	for _, m := range all {
+		if m.Version <= version {
+			continue
+		}
+		if err = m.apply(ctx, conn); err != nil {
+			return applied, err
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
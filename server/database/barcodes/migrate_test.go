@@ -0,0 +1,136 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package barcodes
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/Banrai/PiScan/server/database/dbtest"
+	"github.com/go-sql-driver/mysql"
+	"reflect"
+	"testing"
+)
+
+// duplicateColumn is how mysql fails to add a column which already exists
+func duplicateColumn(args []driver.Value) (*dbtest.Result, error) {
+	return nil, &mysql.MySQLError{Number: DUPLICATE_COLUMN, Message: "Duplicate column name 'role'"}
+}
+
+// migrationDB is a fake database at the given schema version, which
+// accepts every statement of the Migrations after it
+func migrationDB(t *testing.T, version int64) (*dbtest.DB, []*Migration) {
+	all, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := dbtest.New(t)
+	db.Handle(CREATE_SCHEMA_VERSION, dbtest.Affected(0))
+	db.Handle(GET_MIGRATION_LOCK, dbtest.Rows(nil, []driver.Value{int64(1)}))
+	db.Handle(RELEASE_MIGRATION_LOCK, dbtest.Rows(nil, []driver.Value{int64(1)}))
+	db.Handle(GET_SCHEMA_VERSION, dbtest.Rows(nil, []driver.Value{version}))
+	db.Handle(SET_SCHEMA_VERSION, dbtest.Affected(1))
+	pending := make([]*Migration, 0)
+	for _, m := range all {
+		if m.Version > version {
+			pending = append(pending, m)
+			for _, statement := range m.Statements() {
+				db.Handle(statement, dbtest.Affected(0))
+			}
+		}
+	}
+	return db, pending
+}
+
+func TestServerMigrations(t *testing.T) {
+	all, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range all {
+		if m.Version != int64(i+1) || m.Name == "" || len(m.Statements()) == 0 {
+			t.Errorf("migration %d = version %d, %q, %d statements", i, m.Version, m.Name, len(m.Statements()))
+		}
+	}
+	for version := range UPGRADE_MIGRATIONS {
+		if version < 1 || version > int64(len(all)) {
+			t.Errorf("the upgrade migration %d does not exist", version)
+		}
+	}
+}
+
+func TestMigrateDB(t *testing.T) {
+	all, _ := Migrations()
+	last := all[len(all)-1]
+	db, pending := migrationDB(t, last.Version-1)
+
+	applied, err := MigrateDB(db.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 || applied[0].Version != last.Version || len(pending) != 1 {
+		t.Fatalf("MigrateDB applied %d migrations, expected only %d", len(applied), last.Version)
+	}
+
+	// the statements all run under the lock, followed by the new version
+	expected := []string{CREATE_SCHEMA_VERSION, GET_MIGRATION_LOCK, GET_SCHEMA_VERSION}
+	expected = append(expected, last.Statements()...)
+	expected = append(expected, SET_SCHEMA_VERSION, RELEASE_MIGRATION_LOCK)
+	calls := db.Calls()
+	if queries := queries(calls); !reflect.DeepEqual(queries, expected) {
+		t.Errorf("calls = %q, expected %q", queries, expected)
+	}
+	if args := calls[len(calls)-2].Args; !reflect.DeepEqual(args, []driver.Value{last.Version, last.Name}) {
+		t.Errorf("schema version args = %v", args)
+	}
+}
+
+func TestMigrateDBUpToDate(t *testing.T) {
+	all, _ := Migrations()
+	db, _ := migrationDB(t, all[len(all)-1].Version)
+
+	applied, err := MigrateDB(db.DB)
+	if err != nil || len(applied) != 0 {
+		t.Errorf("MigrateDB = %d migrations, %v, expected none", len(applied), err)
+	}
+	if n := db.Count(SET_SCHEMA_VERSION); n != 0 {
+		t.Errorf("%d schema versions recorded, expected none", n)
+	}
+}
+
+func TestMigrateDBLocked(t *testing.T) {
+	db, _ := migrationDB(t, 0)
+	db.Handle(GET_MIGRATION_LOCK, dbtest.Rows(nil, []driver.Value{int64(0)}))
+
+	if applied, err := MigrateDB(db.DB); err == nil || len(applied) != 0 {
+		t.Errorf("MigrateDB = %d migrations, %v, expected the lock timeout", len(applied), err)
+	}
+	if n := db.Count(GET_SCHEMA_VERSION); n != 0 {
+		t.Error("MigrateDB went on without the lock")
+	}
+}
+
+func TestMigrationDuplicateColumn(t *testing.T) {
+	addRole := "ALTER TABLE account ADD COLUMN role varchar(16)"
+	db := dbtest.New(t)
+	db.Handle(addRole, duplicateColumn)
+	db.Handle(SET_SCHEMA_VERSION, dbtest.Affected(1))
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// only the upgrade migration may add a column which is already there
+	if err = (&Migration{Version: 6, Name: "upgrades", SQL: addRole + ";"}).apply(ctx, conn); err != nil {
+		t.Errorf("the upgrade migration failed: %v", err)
+	}
+	if err = (&Migration{Version: 99, Name: "role_again", SQL: addRole + ";"}).apply(ctx, conn); err == nil {
+		t.Error("a later migration added a column which is already there")
+	}
+	if n := db.Count(SET_SCHEMA_VERSION); n != 1 {
+		t.Errorf("%d schema versions recorded, expected 1", n)
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package barcodes provides access to the database holding product data,
+// sourced from both from the Open Product Database (POD) and every supported
+// commerce API/site
+
+package barcodes
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+const (
+	// Contribution states
+	STATUS_PENDING  = "pending"
+	STATUS_APPROVED = "approved"
+	STATUS_REJECTED = "rejected"
+
+	// Contribution types
+	CONTRIBUTION_BARCODE = "barcode"
+	CONTRIBUTION_BRAND   = "brand"
+	CONTRIBUTION_BOOK    = "book"
+
+	// Vote values
+	VOTE_UP   = 1
+	VOTE_FLAG = -1
+
+	// Prepared Queries (moderation)
+	PENDING_BARCODES   = "select hex(b.id), b.barcode, b.product_name, b.product_desc, b.is_edit, b.original_nm, hex(b.account_id), b.status, coalesce(sum(v.vote > 0), 0), coalesce(sum(v.vote < 0), 0) from barcode b left join contribution_vote v on v.contribution_id = b.id where b.status = ? group by b.id order by b.posted limit ?"
+	PENDING_BRANDS     = "select hex(b.id), b.brand_name, b.brand_url, hex(b.account_id), b.status, coalesce(sum(v.vote > 0), 0), coalesce(sum(v.vote < 0), 0) from contributed_brand b left join contribution_vote v on v.contribution_id = b.id where b.status = ? group by b.id order by b.posted limit ?"
+	PENDING_BOOKS      = "select hex(b.id), b.title, b.isbn, b.publisher, hex(b.account_id), b.status, (select group_concat(a.full_name order by a.full_name separator '\\n') from book_author ba join author a on a.id = ba.author_id where ba.book_id = b.id), coalesce(sum(v.vote > 0), 0), coalesce(sum(v.vote < 0), 0) from book b left join contribution_vote v on v.contribution_id = b.id where b.src = 'PiScan' and b.status = ? group by b.id order by b.posted limit ?"
+	BARCODE_SET_STATUS = "update barcode set status = ? where id = unhex(?)"
+	BRAND_SET_STATUS   = "update contributed_brand set status = ? where id = unhex(?)"
+	BOOK_SET_STATUS    = "update book set status = ? where id = unhex(?) and src = 'PiScan'"
+	BARCODE_COUNT      = "select count(*) from barcode where id = unhex(?)"
+	BRAND_COUNT        = "select count(*) from contributed_brand where id = unhex(?)"
+	BOOK_COUNT         = "select count(*) from book where id = unhex(?) and src = 'PiScan'"
+	VOTE_INSERT        = "insert into contribution_vote (id, contribution_id, account_id, vote) values (unhex(?), unhex(?), unhex(?), ?) on duplicate key update vote = values(vote)"
+	ACCOUNT_SET_ROLE   = "update account set role = ? where id = unhex(?)"
+)
+
+// Data structures (moderation)
+
+type PENDING_BARCODE struct {
+	BARCODE
+	Upvotes int64 `json:"upvotes"`
+	Flags   int64 `json:"flags"`
+}
+
+type PENDING_BRAND struct {
+	CONTRIBUTED_BRAND
+	Upvotes int64 `json:"upvotes"`
+	Flags   int64 `json:"flags"`
+}
+
+type PENDING_BOOK struct {
+	BOOK
+	Upvotes int64 `json:"upvotes"`
+	Flags   int64 `json:"flags"`
+}
+
+// InitialStatus returns the moderation status for a new contribution
+// made by the given account: trusted contributors and admins do not need
+// to wait for approval
+func InitialStatus(acc *ACCOUNT) string {
+	if acc.CanModerate() {
+		return STATUS_APPROVED
+	}
+	return STATUS_PENDING
+}
+
+// IsValidStatus confirms the status string is one of the known states
+func IsValidStatus(status string) bool {
+	return status == STATUS_PENDING || status == STATUS_APPROVED || status == STATUS_REJECTED
+}
+
+// IsValidRole confirms the role string is one of the known account roles
+func IsValidRole(role string) bool {
+	return role == ROLE_CONTRIBUTOR || role == ROLE_TRUSTED || role == ROLE_ADMIN
+}
+
+// Query Functions (moderation)
+
+// LookupContributedBarcodesByStatus takes a prepared statement (using the
+// PENDING_BARCODES string), and returns up to limit contributed barcodes
+// in the given status, oldest first, along with their vote tallies
+func LookupContributedBarcodesByStatus(stmt *sql.Stmt, status string, limit int) ([]*PENDING_BARCODE, error) {
+	results := make([]*PENDING_BARCODE, 0)
+
+	rows, err := stmt.Query(status, limit)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			i, c, n, d, o, a, s sql.NullString
+			e                   sql.NullBool
+			up, fl              int64
+		)
+		err := rows.Scan(&i, &c, &n, &d, &e, &o, &a, &s, &up, &fl)
+		if err != nil {
+			return results, err
+		} else {
+			result := new(PENDING_BARCODE)
+			result.Uuid = i.String
+			result.Barcode = c.String
+			result.ProductName = n.String
+			result.ProductDesc = d.String
+			result.GtinEdit = e.Bool
+			result.OriginalName = o.String
+			result.AccountID = a.String
+			result.Status = s.String
+			result.Upvotes = up
+			result.Flags = fl
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
+// LookupContributedBrandsByStatus takes a prepared statement (using the
+// PENDING_BRANDS string), and returns up to limit contributed brands in
+// the given status, oldest first, along with their vote tallies
+func LookupContributedBrandsByStatus(stmt *sql.Stmt, status string, limit int) ([]*PENDING_BRAND, error) {
+	results := make([]*PENDING_BRAND, 0)
+
+	rows, err := stmt.Query(status, limit)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			i, n, u, a, s sql.NullString
+			up, fl        int64
+		)
+		err := rows.Scan(&i, &n, &u, &a, &s, &up, &fl)
+		if err != nil {
+			return results, err
+		} else {
+			result := new(PENDING_BRAND)
+			result.Uuid = i.String
+			result.Name = n.String
+			result.URL = u.String
+			result.AccountID = a.String
+			result.Status = s.String
+			result.Upvotes = up
+			result.Flags = fl
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
+// LookupContributedBooksByStatus takes a prepared statement (using the
+// PENDING_BOOKS string), and returns up to limit contributed books in the
+// given status, oldest first, along with their vote tallies
+func LookupContributedBooksByStatus(stmt *sql.Stmt, status string, limit int) ([]*PENDING_BOOK, error) {
+	results := make([]*PENDING_BOOK, 0)
+
+	rows, err := stmt.Query(status, limit)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			i, t, c, p, a, s, n sql.NullString
+			up, fl              int64
+		)
+		err := rows.Scan(&i, &t, &c, &p, &a, &s, &n, &up, &fl)
+		if err != nil {
+			return results, err
+		} else {
+			result := new(PENDING_BOOK)
+			result.Id = i.String
+			result.Title = t.String
+			result.ISBN = c.String
+			result.Publisher = p.String
+			result.Source = CONTRIBUTED_SRC
+			result.AccountID = a.String
+			result.Status = s.String
+			result.Authors = make([]string, 0)
+			// the author names are concatenated one per line
+			if n.Valid && len(n.String) > 0 {
+				result.Authors = strings.Split(n.String, "\n")
+			}
+			result.Upvotes = up
+			result.Flags = fl
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
+// Write functions (moderation)
+
+// SetContributionStatus takes a pair of prepared statements (using the
+// BARCODE_SET_STATUS and BARCODE_COUNT, BRAND_SET_STATUS and BRAND_COUNT,
+// or BOOK_SET_STATUS and BOOK_COUNT strings, matching the contribution),
+// and changes the moderation status of that contribution
+func SetContributionStatus(stmt, countStmt *sql.Stmt, contributionId, status string) error {
+	if !IsValidStatus(status) {
+		return fmt.Errorf("Invalid contribution status: '%s'", status)
+	}
+
+	res, err := stmt.Exec(status, contributionId)
+	if err != nil {
+		return err
+	}
+
+	// MySQL counts the rows changed, not those found, so an update to the
+	// status the contribution already has affects none
+	if n, nErr := res.RowsAffected(); nErr == nil && n == 0 {
+		var found int64
+		if countErr := countStmt.QueryRow(contributionId).Scan(&found); countErr != nil {
+			return countErr
+		}
+		if found == 0 {
+			return fmt.Errorf("No such contribution: '%s'", contributionId)
+		}
+	}
+
+	return nil
+}
+
+// VoteOnContribution records the account's upvote (VOTE_UP) or flag
+// (VOTE_FLAG) for the contribution, replacing any earlier vote the same
+// account made on it
+func VoteOnContribution(stmt *sql.Stmt, contributionId string, vote int, acc *ACCOUNT) error {
+	if vote != VOTE_UP && vote != VOTE_FLAG {
+		return fmt.Errorf("Invalid vote: '%d'", vote)
+	}
+
+	_, err := stmt.Exec(GenerateUUID(UndashedUUID), contributionId, acc.Id, vote)
+
+	return err
+}
+
+// SetAccountRole takes a prepared statement (using the ACCOUNT_SET_ROLE
+// string), and changes the given account's role
+func SetAccountRole(stmt *sql.Stmt, acc *ACCOUNT, role string) error {
+	if !IsValidRole(role) {
+		return fmt.Errorf("Invalid account role: '%s'", role)
+	}
+
+	_, err := stmt.Exec(role, acc.Id)
+	if err == nil {
+		acc.Role = role
+	}
+
+	return err
+}
@@ -0,0 +1,230 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package barcodes
+
+import (
+	"database/sql/driver"
+	"github.com/Banrai/PiScan/server/database/dbtest"
+	"reflect"
+	"testing"
+)
+
+const (
+	CONTRIBUTION_ID = "0123456789ABCDEF0123456789ABCDEF"
+	ACCOUNT_ID      = "FEDCBA9876543210FEDCBA9876543210"
+)
+
+func TestAccountPermissions(t *testing.T) {
+	tests := []struct {
+		name                  string
+		acc                   *ACCOUNT
+		vote, moderate, admin bool
+		initialStatus         string
+	}{
+		{"unsaved", &ACCOUNT{Verified: true, Role: ROLE_ADMIN}, false, false, false, STATUS_PENDING},
+		{"unverified", &ACCOUNT{Id: ACCOUNT_ID, Role: ROLE_ADMIN}, false, false, false, STATUS_PENDING},
+		{"contributor", &ACCOUNT{Id: ACCOUNT_ID, Verified: true, Role: ROLE_CONTRIBUTOR}, true, false, false, STATUS_PENDING},
+		{"no role", &ACCOUNT{Id: ACCOUNT_ID, Verified: true}, true, false, false, STATUS_PENDING},
+		{"trusted", &ACCOUNT{Id: ACCOUNT_ID, Verified: true, Role: ROLE_TRUSTED}, true, true, false, STATUS_APPROVED},
+		{"admin", &ACCOUNT{Id: ACCOUNT_ID, Verified: true, Role: ROLE_ADMIN}, true, true, true, STATUS_APPROVED},
+	}
+	for _, test := range tests {
+		if test.acc.CanVote() != test.vote {
+			t.Errorf("%s: CanVote = %v", test.name, !test.vote)
+		}
+		if test.acc.CanModerate() != test.moderate {
+			t.Errorf("%s: CanModerate = %v", test.name, !test.moderate)
+		}
+		if test.acc.IsAdmin() != test.admin {
+			t.Errorf("%s: IsAdmin = %v", test.name, !test.admin)
+		}
+		if status := InitialStatus(test.acc); status != test.initialStatus {
+			t.Errorf("%s: InitialStatus = %q, expected %q", test.name, status, test.initialStatus)
+		}
+	}
+}
+
+func TestIsValidStatus(t *testing.T) {
+	for _, status := range []string{STATUS_PENDING, STATUS_APPROVED, STATUS_REJECTED} {
+		if !IsValidStatus(status) {
+			t.Errorf("IsValidStatus(%q) = false", status)
+		}
+	}
+	for _, status := range []string{"", "deleted", "Approved"} {
+		if IsValidStatus(status) {
+			t.Errorf("IsValidStatus(%q) = true", status)
+		}
+	}
+}
+
+func TestSetContributionStatus(t *testing.T) {
+	db := dbtest.New(t)
+	db.Handle(BARCODE_SET_STATUS, dbtest.Affected(1))
+	stmt, countStmt := db.Stmt(t, BARCODE_SET_STATUS), db.Stmt(t, BARCODE_COUNT)
+
+	// any state can be changed to any other, e.g. to undo a review
+	transitions := []string{STATUS_APPROVED, STATUS_REJECTED, STATUS_PENDING, STATUS_APPROVED}
+	for _, status := range transitions {
+		if err := SetContributionStatus(stmt, countStmt, CONTRIBUTION_ID, status); err != nil {
+			t.Errorf("SetContributionStatus(%q): %v", status, err)
+		}
+	}
+
+	calls := db.Calls()
+	if len(calls) != len(transitions) {
+		t.Fatalf("%d updates, expected %d", len(calls), len(transitions))
+	}
+	for i, status := range transitions {
+		if expected := []driver.Value{status, CONTRIBUTION_ID}; !reflect.DeepEqual(calls[i].Args, expected) {
+			t.Errorf("update %d args = %v, expected %v", i, calls[i].Args, expected)
+		}
+	}
+}
+
+func TestSetContributionStatusInvalid(t *testing.T) {
+	db := dbtest.New(t)
+	db.Handle(BRAND_SET_STATUS, dbtest.Affected(1))
+
+	if err := SetContributionStatus(db.Stmt(t, BRAND_SET_STATUS), db.Stmt(t, BRAND_COUNT), CONTRIBUTION_ID, "deleted"); err == nil {
+		t.Error("SetContributionStatus accepted an unknown status")
+	}
+	if n := db.Count(BRAND_SET_STATUS); n != 0 {
+		t.Errorf("an unknown status made %d updates", n)
+	}
+}
+
+func TestSetContributionStatusUnknown(t *testing.T) {
+	db := dbtest.New(t)
+	db.Handle(BOOK_SET_STATUS, dbtest.Affected(0))
+	db.Handle(BOOK_COUNT, dbtest.Rows([]string{"count(*)"}, []driver.Value{int64(0)}))
+
+	if err := SetContributionStatus(db.Stmt(t, BOOK_SET_STATUS), db.Stmt(t, BOOK_COUNT), CONTRIBUTION_ID, STATUS_APPROVED); err == nil {
+		t.Error("SetContributionStatus succeeded for a contribution which does not exist")
+	}
+}
+
+func TestSetContributionStatusUnchanged(t *testing.T) {
+	// MySQL reports no rows affected when the status is the same already
+	db := dbtest.New(t)
+	db.Handle(BARCODE_SET_STATUS, dbtest.Affected(0))
+	db.Handle(BARCODE_COUNT, dbtest.Rows([]string{"count(*)"}, []driver.Value{int64(1)}))
+
+	if err := SetContributionStatus(db.Stmt(t, BARCODE_SET_STATUS), db.Stmt(t, BARCODE_COUNT), CONTRIBUTION_ID, STATUS_APPROVED); err != nil {
+		t.Errorf("re-approving an approved contribution: %v", err)
+	}
+	if n := db.Count(BARCODE_COUNT); n != 1 {
+		t.Errorf("%d counts, expected 1", n)
+	}
+}
+
+func TestVoteOnContribution(t *testing.T) {
+	db := dbtest.New(t)
+	db.Handle(VOTE_INSERT, dbtest.Affected(1))
+	stmt := db.Stmt(t, VOTE_INSERT)
+	acc := &ACCOUNT{Id: ACCOUNT_ID, Verified: true}
+
+	for _, vote := range []int{VOTE_UP, VOTE_FLAG} {
+		if err := VoteOnContribution(stmt, CONTRIBUTION_ID, vote, acc); err != nil {
+			t.Errorf("VoteOnContribution(%d): %v", vote, err)
+		}
+	}
+	for _, vote := range []int{0, 2, -2} {
+		if err := VoteOnContribution(stmt, CONTRIBUTION_ID, vote, acc); err == nil {
+			t.Errorf("VoteOnContribution accepted the vote %d", vote)
+		}
+	}
+
+	calls := db.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("%d votes saved, expected 2", len(calls))
+	}
+	for i, vote := range []int64{VOTE_UP, VOTE_FLAG} {
+		// (id, contribution_id, account_id, vote)
+		if expected := []driver.Value{CONTRIBUTION_ID, ACCOUNT_ID, vote}; !reflect.DeepEqual(calls[i].Args[1:], expected) {
+			t.Errorf("vote %d args = %v, expected %v", i, calls[i].Args[1:], expected)
+		}
+	}
+}
+
+func TestLookupContributedBarcodesByStatus(t *testing.T) {
+	db := dbtest.New(t)
+	db.Handle(PENDING_BARCODES, dbtest.Rows(nil,
+		[]driver.Value{CONTRIBUTION_ID, "0012345678905", "Oat Milk", "1 l carton", false, nil, ACCOUNT_ID, STATUS_PENDING, int64(3), int64(1)},
+		[]driver.Value{ACCOUNT_ID, "0098765432109", "Rye Bread", nil, true, "Rye Loaf", nil, STATUS_PENDING, int64(0), int64(0)}))
+
+	results, err := LookupContributedBarcodesByStatus(db.Stmt(t, PENDING_BARCODES), STATUS_PENDING, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := db.Calls()[0].Args; !reflect.DeepEqual(args, []driver.Value{STATUS_PENDING, int64(50)}) {
+		t.Errorf("query args = %v", args)
+	}
+	if len(results) != 2 {
+		t.Fatalf("%d results, expected 2", len(results))
+	}
+	if results[0].Upvotes != 3 || results[0].Flags != 1 || results[0].AccountID != ACCOUNT_ID {
+		t.Errorf("first result = %+v", results[0])
+	}
+	if results[1].Upvotes != 0 || results[1].Flags != 0 || !results[1].GtinEdit || results[1].OriginalName != "Rye Loaf" || results[1].AccountID != "" {
+		t.Errorf("second result = %+v", results[1])
+	}
+}
+
+func TestLookupContributedBooksByStatus(t *testing.T) {
+	db := dbtest.New(t)
+	db.Handle(PENDING_BOOKS, dbtest.Rows(nil,
+		[]driver.Value{CONTRIBUTION_ID, "Dubliners", "9780140186475", "Penguin", ACCOUNT_ID, STATUS_REJECTED, "Joyce, James", int64(0), int64(4)},
+		[]driver.Value{ACCOUNT_ID, "Good Omens", "9780060853983", nil, nil, STATUS_REJECTED, "Gaiman, Neil\nPratchett, Terry", int64(2), int64(0)}))
+
+	results, err := LookupContributedBooksByStatus(db.Stmt(t, PENDING_BOOKS), STATUS_REJECTED, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("%d results, expected 2", len(results))
+	}
+	if !reflect.DeepEqual(results[0].Authors, []string{"Joyce, James"}) || results[0].Flags != 4 || results[0].Source != CONTRIBUTED_SRC {
+		t.Errorf("first result = %+v", results[0])
+	}
+	if !reflect.DeepEqual(results[1].Authors, []string{"Gaiman, Neil", "Pratchett, Terry"}) || results[1].Upvotes != 2 {
+		t.Errorf("second result = %+v", results[1])
+	}
+}
+
+func TestContributeBookStatus(t *testing.T) {
+	for _, acc := range []*ACCOUNT{
+		{Id: ACCOUNT_ID, Verified: true, Role: ROLE_CONTRIBUTOR},
+		{Id: ACCOUNT_ID, Verified: true, Role: ROLE_TRUSTED}} {
+		db := dbtest.New(t)
+		db.Handle(BOOK_INSERT, dbtest.Affected(1))
+
+		book := &BOOK{Title: "Dubliners", ISBN: "9780140186475"}
+		if _, err := ContributeBook(db.DB, db.Stmt(t, BOOK_INSERT), db.Stmt(t, AUTHOR_LOOKUP), db.Stmt(t, AUTHOR_INSERT), db.Stmt(t, BOOK_AUTHOR_INSERT), book, acc); err != nil {
+			t.Fatal(err)
+		}
+		// (id, title, isbn, is_isbn10, publisher, src, account_id, status),
+		// after the BEGIN
+		args := db.Calls()[1].Args
+		if expected := InitialStatus(acc); args[7] != expected || book.Status != expected {
+			t.Errorf("%s contributed a book with the status %v, expected %q", acc.Role, args[7], expected)
+		}
+	}
+}
+
+func TestSetAccountRole(t *testing.T) {
+	db := dbtest.New(t)
+	db.Handle(ACCOUNT_SET_ROLE, dbtest.Affected(1))
+	stmt := db.Stmt(t, ACCOUNT_SET_ROLE)
+	acc := &ACCOUNT{Id: ACCOUNT_ID, Verified: true, Role: ROLE_CONTRIBUTOR}
+
+	if err := SetAccountRole(stmt, acc, ROLE_TRUSTED); err != nil || acc.Role != ROLE_TRUSTED || !acc.CanModerate() {
+		t.Errorf("SetAccountRole(%q) = %v, role %q", ROLE_TRUSTED, err, acc.Role)
+	}
+	if err := SetAccountRole(stmt, acc, "moderator"); err == nil || acc.Role != ROLE_TRUSTED {
+		t.Errorf("SetAccountRole accepted an unknown role, role %q", acc.Role)
+	}
+	if n := db.Count(ACCOUNT_SET_ROLE); n != 1 {
+		t.Errorf("%d role updates, expected 1", n)
+	}
+}
@@ -10,6 +10,7 @@ package barcodes
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 )
 
 const (
@@ -17,13 +18,18 @@ const (
 	GTIN_LOOKUP       = "select gtin_nm, bsin from gtin where gtin_cd = ?"
 	BRAND_LOOKUP      = "select brand_nm, brand_link from brand where bsin = ?"
 	BRAND_NAME_LOOKUP = "select bsin, brand_nm, brand_link from brand where brand_nm like ?"
+	BRAND_SUGGEST     = "select bsin, brand_nm, brand_link from brand where brand_nm like ? order by brand_nm limit ?"
 
 	// User contributions
-	BARCODE_LOOKUP           = "select hex(id), product_name, product_desc, is_edit, hex(account_id) from barcode where barcode = ?"
-	BARCODE_INSERT           = "insert into barcode (id, barcode, product_name, product_desc, is_edit, account_id) values (unhex(?), ?, ?, ?, ?, unhex(?))"
-	BARCODE_BRAND_INSERT     = "insert into barcode_brand (id, bsin, barcode_id) values (unhex(?), ?, unhex(?))"
-	CONTRIBUTED_BRAND_LOOKUP = "select hex(id), brand_name, brand_url, hex(account_id) from contributed_brand where brand_name like ?"
-	CONTRIBUTED_BRAND_INSERT = "insert into contributed_brand (id, brand_name, brand_url, account_id) values (unhex(?), ?, ?, unhex(?))"
+	BARCODE_LOOKUP            = "select hex(id), product_name, product_desc, is_edit, hex(account_id), status from barcode where barcode = ? and (status = 'approved' or account_id = unhex(?)) order by posted desc"
+	BARCODE_INSERT            = "insert into barcode (id, barcode, product_name, product_desc, is_edit, original_nm, account_id, status) values (unhex(?), ?, ?, ?, ?, ?, unhex(?), ?)"
+	BARCODE_BRAND_INSERT      = "insert into barcode_brand (id, bsin, barcode_id) values (unhex(?), ?, unhex(?))"
+	BARCODE_CONTRIB_INSERT    = "insert into barcode_brand (id, contributed_brand_id, barcode_id) values (unhex(?), unhex(?), unhex(?))"
+	BARCODE_BRAND_LOOKUP      = "select b.bsin, b.brand_nm, b.brand_link from barcode_brand bb, brand b where b.bsin = bb.bsin and bb.barcode_id = unhex(?) union select null, cb.brand_name, cb.brand_url from barcode_brand bb, contributed_brand cb where cb.id = bb.contributed_brand_id and bb.barcode_id = unhex(?) and (cb.status = 'approved' or cb.account_id = unhex(?))"
+	CONTRIBUTED_BRAND_LOOKUP  = "select hex(id), brand_name, brand_url, hex(account_id) from contributed_brand where brand_name like ? and status = 'approved'"
+	CONTRIBUTED_BRAND_BY_ID   = "select hex(id), brand_name, brand_url, hex(account_id) from contributed_brand where id = unhex(?) and (status = 'approved' or account_id = unhex(?))"
+	CONTRIBUTED_BRAND_SUGGEST = "select hex(id), brand_name, brand_url, hex(account_id) from contributed_brand where brand_name like ? and status = 'approved' order by brand_name limit ?"
+	CONTRIBUTED_BRAND_INSERT  = "insert into contributed_brand (id, brand_name, brand_url, account_id, status) values (unhex(?), ?, ?, unhex(?), ?)"
 )
 
 // Data structures (POD)
@@ -43,12 +49,14 @@ type BRAND struct {
 // Data structures (user contributions)
 
 type BARCODE struct {
-	Uuid        string `json:"id"`
-	Barcode     string `json:"barcode"`
-	ProductName string `json:"product,omitempty"`
-	ProductDesc string `json:"desc,omitempty"`
-	GtinEdit    bool   `json:"gtinCorrection,omitempty"`
-	AccountID   string `json:"account"`
+	Uuid         string `json:"id"`
+	Barcode      string `json:"barcode"`
+	ProductName  string `json:"product,omitempty"`
+	ProductDesc  string `json:"desc,omitempty"`
+	GtinEdit     bool   `json:"gtinCorrection,omitempty"`
+	OriginalName string `json:"original,omitempty"`
+	AccountID    string `json:"account"`
+	Status       string `json:"status,omitempty"`
 }
 
 type CONTRIBUTED_BRAND struct {
@@ -56,6 +64,7 @@ type CONTRIBUTED_BRAND struct {
 	Name      string `json:"brand,omitempty"`
 	URL       string `json:"url,omitempty"`
 	AccountID string `json:"account"`
+	Status    string `json:"status,omitempty"`
 }
 
 // Query Functions (POD)
@@ -162,12 +171,88 @@ func LookupBrandByName(stmt *sql.Stmt, brandName string) ([]*BRAND, error) {
 	return results, nil
 }
 
+// likeContaining returns the pattern for a 'like' clause which matches
+// any string containing text, escaping its own wildcard characters
+func likeContaining(text string) string {
+	escaped := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(text)
+	return fmt.Sprintf("%%%s%%", escaped)
+}
+
+// SuggestBrand takes a prepared statement (using the BRAND_SUGGEST
+// string), and returns up to limit POD brands whose names contain the
+// given text, for autocomplete
+func SuggestBrand(stmt *sql.Stmt, text string, limit int) ([]*BRAND, error) {
+	results := make([]*BRAND, 0)
+
+	rows, err := stmt.Query(likeContaining(text), limit)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i, n, u sql.NullString
+		err := rows.Scan(&i, &n, &u)
+		if err != nil {
+			return results, err
+		} else {
+			if n.Valid {
+				result := new(BRAND)
+				result.Id = i.String
+				result.Name = n.String
+				result.URL = u.String
+				results = append(results, result)
+			}
+		}
+	}
+
+	return results, nil
+}
+
 // Query Functions (user contributions)
 
-func LookupContributedBarcode(stmt *sql.Stmt, code string) ([]*BARCODE, error) {
+// LookupBarcodeBrand takes a prepared statement (using the
+// BARCODE_BRAND_LOOKUP string), the primary key of a contributed barcode,
+// and returns the list of brands (from either POD or contributions)
+// associated with it; contributed brands have no Id (bsin), and are
+// included only if approved, or contributed by the given account id
+func LookupBarcodeBrand(stmt *sql.Stmt, barcodeId, accountId string) ([]*BRAND, error) {
+	results := make([]*BRAND, 0)
+
+	rows, err := stmt.Query(barcodeId, barcodeId, accountId)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i, n, u sql.NullString
+		err := rows.Scan(&i, &n, &u)
+		if err != nil {
+			return results, err
+		} else {
+			if n.Valid {
+				result := new(BRAND)
+				result.Id = i.String
+				result.Name = n.String
+				result.URL = u.String
+				results = append(results, result)
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// LookupContributedBarcode takes a prepared statement (using the
+// BARCODE_LOOKUP string), a barcode string, and returns the list of
+// approved contributions for it (most recent first), along with any
+// still pending ones made by the given account id (which can be empty,
+// for anonymous lookups)
+func LookupContributedBarcode(stmt *sql.Stmt, code, accountId string) ([]*BARCODE, error) {
 	results := make([]*BARCODE, 0)
 
-	rows, err := stmt.Query(code)
+	rows, err := stmt.Query(code, accountId)
 	if err != nil {
 		return results, err
 	}
@@ -175,10 +260,10 @@ func LookupContributedBarcode(stmt *sql.Stmt, code string) ([]*BARCODE, error) {
 
 	for rows.Next() {
 		var (
-			i, n, d, a sql.NullString
-			e          sql.NullBool
+			i, n, d, a, s sql.NullString
+			e             sql.NullBool
 		)
-		err := rows.Scan(&i, &n, &d, &e, &a)
+		err := rows.Scan(&i, &n, &d, &e, &a, &s)
 		if err != nil {
 			return results, err
 		} else {
@@ -188,6 +273,7 @@ func LookupContributedBarcode(stmt *sql.Stmt, code string) ([]*BARCODE, error) {
 			result.ProductName = n.String
 			result.GtinEdit = e.Bool
 			result.AccountID = a.String
+			result.Status = s.String
 			if d.Valid {
 				result.ProductDesc = d.String
 			}
@@ -199,9 +285,14 @@ func LookupContributedBarcode(stmt *sql.Stmt, code string) ([]*BARCODE, error) {
 }
 
 func LookupContributedBrand(stmt *sql.Stmt, brandName string) ([]*CONTRIBUTED_BRAND, error) {
+	return scanContributedBrands(stmt.Query(fmt.Sprintf("%s%%", brandName))) // like 'brandName%'
+}
+
+// scanContributedBrands converts the result of any of the contributed
+// brand queries into a list of CONTRIBUTED_BRAND structs
+func scanContributedBrands(rows *sql.Rows, err error) ([]*CONTRIBUTED_BRAND, error) {
 	results := make([]*CONTRIBUTED_BRAND, 0)
 
-	rows, err := stmt.Query(fmt.Sprintf("%s%%", brandName)) // like 'brandName%'
 	if err != nil {
 		return results, err
 	}
@@ -227,6 +318,20 @@ func LookupContributedBrand(stmt *sql.Stmt, brandName string) ([]*CONTRIBUTED_BR
 	return results, nil
 }
 
+// LookupContributedBrandById takes a prepared statement (using the
+// CONTRIBUTED_BRAND_BY_ID string), and returns the contributed brand with
+// that id, as long as it is approved, or was contributed by the account
+func LookupContributedBrandById(stmt *sql.Stmt, brandId, accountId string) ([]*CONTRIBUTED_BRAND, error) {
+	return scanContributedBrands(stmt.Query(brandId, accountId))
+}
+
+// SuggestContributedBrand takes a prepared statement (using the
+// CONTRIBUTED_BRAND_SUGGEST string), and returns up to limit approved
+// contributed brands whose names contain the given text, for autocomplete
+func SuggestContributedBrand(stmt *sql.Stmt, text string, limit int) ([]*CONTRIBUTED_BRAND, error) {
+	return scanContributedBrands(stmt.Query(likeContaining(text), limit))
+}
+
 // Write functions (user contributions)
 
 func ContributeBarcode(stmt *sql.Stmt, rec BARCODE, acc *ACCOUNT) (string, error) {
@@ -234,7 +339,12 @@ func ContributeBarcode(stmt *sql.Stmt, rec BARCODE, acc *ACCOUNT) (string, error
 		rec.Uuid = GenerateUUID(UndashedUUID)
 	}
 
-	_, err := stmt.Exec(rec.Uuid, rec.Barcode, rec.ProductName, rec.ProductDesc, rec.GtinEdit, acc.Id)
+	var original interface{} // null unless this is a correction
+	if rec.GtinEdit {
+		original = rec.OriginalName
+	}
+
+	_, err := stmt.Exec(rec.Uuid, rec.Barcode, rec.ProductName, rec.ProductDesc, rec.GtinEdit, original, acc.Id, InitialStatus(acc))
 
 	return rec.Uuid, err
 }
@@ -245,8 +355,20 @@ func ContributeBarcodeBrand(stmt *sql.Stmt, rec BARCODE, brand *BRAND) error {
 	return err
 }
 
-func ContributeBrand(stmt *sql.Stmt, rec *CONTRIBUTED_BRAND, acc *ACCOUNT) error {
-	_, err := stmt.Exec(GenerateUUID(UndashedUUID), rec.Name, rec.URL, acc.Id)
+func ContributeBrand(stmt *sql.Stmt, rec *CONTRIBUTED_BRAND, acc *ACCOUNT) (string, error) {
+	if rec.Uuid == "" {
+		rec.Uuid = GenerateUUID(UndashedUUID)
+	}
+
+	_, err := stmt.Exec(rec.Uuid, rec.Name, rec.URL, acc.Id, InitialStatus(acc))
+
+	return rec.Uuid, err
+}
+
+// ContributeBarcodeContributedBrand marks the contributed barcode as
+// belonging to the (also contributed) brand
+func ContributeBarcodeContributedBrand(stmt *sql.Stmt, rec BARCODE, brand *CONTRIBUTED_BRAND) error {
+	_, err := stmt.Exec(GenerateUUID(UndashedUUID), brand.Uuid, rec.Uuid)
 
 	return err
 }
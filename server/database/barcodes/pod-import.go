@@ -0,0 +1,303 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package barcodes provides access to the database holding product data,
+// sourced from both from the Open Product Database (POD) and every supported
+// commerce API/site
+
+package barcodes
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// POD csv imports
+	POD_IMPORT_LOOKUP = "select rows_done, finished from pod_import where source = ?"
+	POD_IMPORT_SAVE   = "insert into pod_import (source, table_name, rows_done, finished, updated) values (?, ?, ?, ?, now()) on duplicate key update table_name = values(table_name), rows_done = values(rows_done), finished = values(finished), updated = values(updated)"
+	POD_IMPORT_CLEAR  = "delete from pod_import where source = ?"
+
+	// How many csv rows are loaded (and their progress saved) at a time
+	POD_BATCH_SIZE = 1000
+	POD_BATCH_MAX  = 10000
+
+	// How often the import progress is logged
+	POD_PROGRESS_INTERVAL = 10 * time.Second
+
+	// The csv field separators recognized in the header row
+	POD_CSV_SEPARATORS = ",;\t|"
+)
+
+// PODColumn is one of the csv columns loaded into a POD table (with the
+// same name, in any case, in the csv header row)
+type PODColumn struct {
+	Name string
+	Size int // the longest value the table column holds, in characters
+}
+
+// PODTable defines the columns of a POD csv file, and the POD table they
+// are loaded into; the first column is the table primary key
+type PODTable struct {
+	Name    string
+	Columns []*PODColumn
+}
+
+var (
+	// The POD tables used by the barcode lookups (see migrations/0001_pod.sql)
+	POD_TABLES = []*PODTable{
+		{Name: "gtin", Columns: []*PODColumn{{Name: "gtin_cd", Size: 13}, {Name: "gtin_nm", Size: 512}, {Name: "bsin", Size: 6}}},
+		{Name: "brand", Columns: []*PODColumn{{Name: "bsin", Size: 6}, {Name: "brand_nm", Size: 512}, {Name: "brand_link", Size: 1024}}},
+	}
+
+	ERR_POD_UNKNOWN_FILE = errors.New("The file header does not have the columns of any POD table")
+)
+
+// insertSQL returns the statement which loads n rows into the table, and
+// updates any already there
+func (t *PODTable) insertSQL(n int) string {
+	names := make([]string, 0)
+	params := make([]string, 0)
+	updates := make([]string, 0)
+	for i, c := range t.Columns {
+		names = append(names, c.Name)
+		params = append(params, "?")
+		if i > 0 {
+			updates = append(updates, fmt.Sprintf("%s = values(%s)", c.Name, c.Name))
+		}
+	}
+	row := fmt.Sprintf("(%s)", strings.Join(params, ", "))
+	rows := make([]string, n)
+	for i := range rows {
+		rows[i] = row
+	}
+	return fmt.Sprintf("insert into %s (%s) values %s on duplicate key update %s", t.Name, strings.Join(names, ", "), strings.Join(rows, ", "), strings.Join(updates, ", "))
+}
+
+// PODImportResult is the outcome of importing one POD csv file
+type PODImportResult struct {
+	Table   string
+	Rows    int64 // all the rows in the file, including any skipped ones
+	Loaded  int64 // the rows loaded by this import (not counting those resumed past)
+	Skipped int64 // the rows which were malformed, or had values too long for the table
+	Resumed int64 // the rows loaded by an earlier, interrupted, import
+}
+
+// countingReader tracks how much of the file has been read, for the
+// progress reports
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// podHeader reads the csv header row, and returns its field separator, and
+// the POD table whose columns it has, along with their positions
+func podHeader(r *bufio.Reader) (rune, *PODTable, []int, error) {
+	line, err := r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return 0, nil, nil, err
+	}
+	line = strings.TrimPrefix(line, "\ufeff")
+
+	// the separator is whichever one the header row has the most of
+	separator, most := ',', 0
+	for _, s := range POD_CSV_SEPARATORS {
+		if n := strings.Count(line, string(s)); n > most {
+			separator, most = s, n
+		}
+	}
+
+	header := csv.NewReader(strings.NewReader(line))
+	header.Comma = separator
+	names, err := header.Read()
+	if err != nil {
+		return separator, nil, nil, err
+	}
+	positions := make(map[string]int)
+	for i, name := range names {
+		positions[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	for _, t := range POD_TABLES {
+		columns := make([]int, 0)
+		for _, c := range t.Columns {
+			if i, exists := positions[c.Name]; exists {
+				columns = append(columns, i)
+			}
+		}
+		if len(columns) == len(t.Columns) {
+			return separator, t, columns, nil
+		}
+	}
+	return separator, nil, nil, ERR_POD_UNKNOWN_FILE
+}
+
+// podValues returns the table column values of the csv row, with empty
+// values as null, or false if the row cannot be loaded
+func podValues(t *PODTable, columns []int, row []string) ([]interface{}, bool) {
+	values := make([]interface{}, 0)
+	for i, c := range t.Columns {
+		if columns[i] >= len(row) {
+			return values, false
+		}
+		value := strings.TrimSpace(strings.ToValidUTF8(row[columns[i]], ""))
+		switch {
+		case utf8.RuneCountInString(value) > c.Size:
+			return values, false
+		case value == "" && i == 0:
+			return values, false
+		case value == "":
+			values = append(values, nil)
+		default:
+			values = append(values, value)
+		}
+	}
+	return values, true
+}
+
+// podBatch loads the rows into the table, and saves the import progress,
+// in one transaction, so the progress always matches what was loaded
+func podBatch(db *sql.DB, t *PODTable, rows [][]interface{}, source string, done int64, finished bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if len(rows) > 0 {
+		args := make([]interface{}, 0)
+		for _, row := range rows {
+			args = append(args, row...)
+		}
+		if _, err = tx.Exec(t.insertSQL(len(rows)), args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err = tx.Exec(POD_IMPORT_SAVE, source, t.Name, done, finished); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// ImportPOD loads one of the published POD csv files (the table, gtin or
+// brand, is found from the columns in the header row) in batches of the
+// given size, logging its progress as it goes; the rows already in the
+// table are updated, and an interrupted import resumes after the last
+// batch it finished, unless restart is true
+func ImportPOD(db *sql.DB, filename string, batchSize int, restart bool, logger *log.Logger) (*PODImportResult, error) {
+	result := new(PODImportResult)
+	if batchSize <= 0 || batchSize > POD_BATCH_MAX {
+		return result, fmt.Errorf("Invalid batch size: '%d' (use 1 to %d)", batchSize, POD_BATCH_MAX)
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return result, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return result, err
+	}
+	// a different download of the same file starts over
+	source := fmt.Sprintf("%s (%d bytes)", path.Base(filename), info.Size())
+
+	counter := &countingReader{r: file}
+	in := bufio.NewReader(counter)
+	separator, t, columns, err := podHeader(in)
+	if err != nil {
+		return result, fmt.Errorf("%s: %s", filename, err)
+	}
+	result.Table = t.Name
+
+	if restart {
+		if _, err = db.Exec(POD_IMPORT_CLEAR, source); err != nil {
+			return result, err
+		}
+	}
+	var finished bool
+	err = db.QueryRow(POD_IMPORT_LOOKUP, source).Scan(&result.Resumed, &finished)
+	if err != nil && err != sql.ErrNoRows {
+		return result, err
+	}
+	if finished {
+		result.Rows = result.Resumed
+		logger.Println(fmt.Sprintf("%s: already imported into %s (%d rows)", filename, t.Name, result.Rows))
+		return result, nil
+	}
+	if result.Resumed > 0 {
+		logger.Println(fmt.Sprintf("%s: resuming the import into %s after row %d", filename, t.Name, result.Resumed))
+	} else {
+		logger.Println(fmt.Sprintf("%s: importing into %s", filename, t.Name))
+	}
+
+	r := csv.NewReader(in)
+	r.Comma = separator
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	r.ReuseRecord = true
+
+	progress := func() {
+		logger.Println(fmt.Sprintf("%s: %d rows (%d%%), %d skipped", filename, result.Rows, counter.n*100/(info.Size()+1), result.Skipped))
+	}
+	lastProgress := time.Now()
+
+	batch := make([][]interface{}, 0)
+	for {
+		row, readErr := r.Read()
+		if readErr == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if readErr != nil && !errors.As(readErr, &parseErr) {
+			return result, readErr
+		}
+
+		result.Rows++
+		if result.Rows <= result.Resumed {
+			continue
+		}
+		values, ok := podValues(t, columns, row)
+		if readErr != nil || !ok {
+			result.Skipped++
+			continue
+		}
+		batch = append(batch, values)
+
+		if len(batch) == batchSize {
+			if err = podBatch(db, t, batch, source, result.Rows, false); err != nil {
+				return result, fmt.Errorf("%s: the batch ending at row %d failed: %s", filename, result.Rows, err)
+			}
+			result.Loaded += int64(len(batch))
+			batch = batch[:0]
+
+			if time.Since(lastProgress) >= POD_PROGRESS_INTERVAL {
+				progress()
+				lastProgress = time.Now()
+			}
+		}
+	}
+
+	if err = podBatch(db, t, batch, source, result.Rows, true); err != nil {
+		return result, fmt.Errorf("%s: the batch ending at row %d failed: %s", filename, result.Rows, err)
+	}
+	result.Loaded += int64(len(batch))
+	progress()
+	return result, nil
+}
@@ -0,0 +1,221 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package barcodes
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/Banrai/PiScan/server/database/dbtest"
+	"io/ioutil"
+	"log"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// GTIN_CSV has five rows: three loadable, one without a gtin_cd, and one
+// with a bsin too long for the table
+const GTIN_CSV = `GTIN_CD,GTIN_NM,BSIN
+0000000000017,Oat Milk,ABCDEF
+0000000000024,Rye Bread,
+,No Code,ABCDEF
+0000000000031,Coffee,ABCDEFG
+0000000000048,Tea,XYZ123
+`
+
+// podFile writes the csv into a temporary file, and returns its name and
+// the source ImportPOD records its progress under
+func podFile(t *testing.T, contents string) (string, string) {
+	filename := path.Join(t.TempDir(), "gtin.csv")
+	if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename, fmt.Sprintf("gtin.csv (%d bytes)", len(contents))
+}
+
+// podDB is a fake database where the last import of the file loaded the
+// given rows (none, if done is negative)
+func podDB(t *testing.T, done int64, finished bool) *dbtest.DB {
+	gtin := POD_TABLES[0]
+	db := dbtest.New(t)
+	if done < 0 {
+		db.Handle(POD_IMPORT_LOOKUP, dbtest.Rows(nil))
+	} else {
+		db.Handle(POD_IMPORT_LOOKUP, dbtest.Rows(nil, []driver.Value{done, finished}))
+	}
+	db.Handle(POD_IMPORT_SAVE, dbtest.Affected(1))
+	db.Handle(POD_IMPORT_CLEAR, dbtest.Affected(1))
+	db.Handle(gtin.insertSQL(1), dbtest.Affected(1))
+	db.Handle(gtin.insertSQL(2), dbtest.Affected(2))
+	return db
+}
+
+func importPOD(db *dbtest.DB, filename string, restart bool) (*PODImportResult, error) {
+	return ImportPOD(db.DB, filename, 2, restart, log.New(ioutil.Discard, "", 0))
+}
+
+func TestPODHeader(t *testing.T) {
+	tests := []struct {
+		header    string
+		separator rune
+		table     string
+		columns   []int
+	}{
+		{"gtin_cd,gtin_nm,bsin\n", ',', "gtin", []int{0, 1, 2}},
+		{"\ufeffGTIN_CD;GTIN_NM;BSIN\r\n", ';', "gtin", []int{0, 1, 2}},
+		{"bsin\tgtin_nm\t gtin_cd \textra\n", '\t', "gtin", []int{2, 1, 0}},
+		{"BSIN|BRAND_NM|BRAND_TYPE_CD|BRAND_LINK", '|', "brand", []int{0, 1, 3}},
+	}
+	for _, test := range tests {
+		separator, table, columns, err := podHeader(bufio.NewReader(strings.NewReader(test.header)))
+		if err != nil {
+			t.Errorf("%q: %v", test.header, err)
+			continue
+		}
+		if separator != test.separator || table.Name != test.table || !reflect.DeepEqual(columns, test.columns) {
+			t.Errorf("%q = %q, %s, %v, expected %q, %s, %v", test.header, separator, table.Name, columns, test.separator, test.table, test.columns)
+		}
+	}
+
+	for _, header := range []string{"gtin_cd,gtin_nm\n", "name,email\n", ""} {
+		if _, table, _, err := podHeader(bufio.NewReader(strings.NewReader(header))); err == nil || table != nil {
+			t.Errorf("%q = %v, %v, expected an error", header, table, err)
+		}
+	}
+}
+
+func TestPODValues(t *testing.T) {
+	gtin := POD_TABLES[0]
+	columns := []int{0, 1, 2}
+	tests := []struct {
+		row      []string
+		expected []interface{}
+		ok       bool
+	}{
+		{[]string{" 0000000000017 ", "Oat Milk", "ABCDEF"}, []interface{}{"0000000000017", "Oat Milk", "ABCDEF"}, true},
+		{[]string{"0000000000024", "Rye \xffBread", ""}, []interface{}{"0000000000024", "Rye Bread", nil}, true},
+		{[]string{"", "No Code", "ABCDEF"}, nil, false},
+		{[]string{"0000000000031", "Coffee", "ABCDEFG"}, nil, false},
+		{[]string{"00000000000480", "Tea", "XYZ123"}, nil, false},
+		{[]string{"0000000000048", "Tea"}, nil, false},
+	}
+	for _, test := range tests {
+		values, ok := podValues(gtin, columns, test.row)
+		if ok != test.ok || (ok && !reflect.DeepEqual(values, test.expected)) {
+			t.Errorf("%q = %v, %v, expected %v, %v", test.row, values, ok, test.expected, test.ok)
+		}
+	}
+}
+
+func TestImportPOD(t *testing.T) {
+	filename, source := podFile(t, GTIN_CSV)
+	db := podDB(t, -1, false)
+
+	result, err := importPOD(db, filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := PODImportResult{Table: "gtin", Rows: 5, Loaded: 3, Skipped: 2}
+	if *result != expected {
+		t.Errorf("ImportPOD = %+v, expected %+v", *result, expected)
+	}
+
+	// each batch is loaded along with the progress, in its own transaction
+	gtin := POD_TABLES[0]
+	expectedCalls := []string{POD_IMPORT_LOOKUP,
+		dbtest.BEGIN, gtin.insertSQL(2), POD_IMPORT_SAVE, dbtest.COMMIT,
+		dbtest.BEGIN, gtin.insertSQL(1), POD_IMPORT_SAVE, dbtest.COMMIT}
+	calls := db.Calls()
+	if queries := queries(calls); !reflect.DeepEqual(queries, expectedCalls) {
+		t.Fatalf("calls = %q, expected %q", queries, expectedCalls)
+	}
+	if args := calls[2].Args; !reflect.DeepEqual(args, []driver.Value{"0000000000017", "Oat Milk", "ABCDEF", "0000000000024", "Rye Bread", nil}) {
+		t.Errorf("first batch args = %v", args)
+	}
+	if args := calls[3].Args; !reflect.DeepEqual(args, []driver.Value{source, "gtin", int64(2), false}) {
+		t.Errorf("first progress args = %v", args)
+	}
+	if args := calls[7].Args; !reflect.DeepEqual(args, []driver.Value{source, "gtin", int64(5), true}) {
+		t.Errorf("last progress args = %v", args)
+	}
+}
+
+func TestImportPODResume(t *testing.T) {
+	filename, _ := podFile(t, GTIN_CSV)
+	db := podDB(t, 2, false)
+
+	result, err := importPOD(db, filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := PODImportResult{Table: "gtin", Rows: 5, Loaded: 1, Skipped: 2, Resumed: 2}
+	if *result != expected {
+		t.Errorf("ImportPOD = %+v, expected %+v", *result, expected)
+	}
+	calls := db.Calls()
+	if n := db.Count(POD_TABLES[0].insertSQL(1)); n != 1 || calls[2].Args[0] != "0000000000048" {
+		t.Errorf("%d batches loaded, starting with %v, expected only the last row", n, calls[2].Args)
+	}
+}
+
+func TestImportPODFinished(t *testing.T) {
+	filename, _ := podFile(t, GTIN_CSV)
+	db := podDB(t, 5, true)
+
+	result, err := importPOD(db, filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := PODImportResult{Table: "gtin", Rows: 5, Resumed: 5}
+	if *result != expected {
+		t.Errorf("ImportPOD = %+v, expected %+v", *result, expected)
+	}
+	if calls := queries(db.Calls()); !reflect.DeepEqual(calls, []string{POD_IMPORT_LOOKUP}) {
+		t.Errorf("calls = %q, expected the lookup only", calls)
+	}
+}
+
+func TestImportPODRestart(t *testing.T) {
+	filename, source := podFile(t, GTIN_CSV)
+	db := podDB(t, -1, false)
+
+	if _, err := importPOD(db, filename, true); err != nil {
+		t.Fatal(err)
+	}
+	calls := db.Calls()
+	if calls[0].Query != POD_IMPORT_CLEAR || calls[0].Args[0] != source || calls[1].Query != POD_IMPORT_LOOKUP {
+		t.Errorf("calls = %q, expected the progress cleared first", queries(calls))
+	}
+}
+
+func TestImportPODFailedBatch(t *testing.T) {
+	filename, _ := podFile(t, GTIN_CSV)
+	db := podDB(t, -1, false)
+	db.Handle(POD_TABLES[0].insertSQL(2), func(args []driver.Value) (*dbtest.Result, error) {
+		return nil, errors.New("lock wait timeout exceeded")
+	})
+
+	if _, err := importPOD(db, filename, false); err == nil {
+		t.Fatal("ImportPOD succeeded, expected the batch error")
+	}
+	expected := []string{POD_IMPORT_LOOKUP, dbtest.BEGIN, POD_TABLES[0].insertSQL(2), dbtest.ROLLBACK}
+	if calls := queries(db.Calls()); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("calls = %q, expected %q", calls, expected)
+	}
+	if n := db.Count(POD_IMPORT_SAVE); n != 0 {
+		t.Error("the progress was saved for a batch which failed")
+	}
+}
+
+func TestImportPODBatchSize(t *testing.T) {
+	db := dbtest.New(t)
+	for _, size := range []int{0, -1, POD_BATCH_MAX + 1} {
+		if _, err := ImportPOD(db.DB, "gtin.csv", size, false, log.New(ioutil.Discard, "", 0)); err == nil {
+			t.Errorf("batch size %d was accepted", size)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package dbtest provides a scripted, in-memory database/sql driver, so
+// that the functions using the barcodes prepared statements can be
+// tested without a mysql server: each test defines how the statements it
+// uses respond, and checks the calls they received
+
+package dbtest
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+const (
+	// the driver name, as registered with database/sql
+	DRIVER = "dbtest"
+
+	// the Call.Query values recorded for transactions
+	BEGIN    = "BEGIN"
+	COMMIT   = "COMMIT"
+	ROLLBACK = "ROLLBACK"
+)
+
+var (
+	ERR_UNEXPECTED_QUERY = errors.New("dbtest: unexpected query")
+
+	registry = struct {
+		sync.Mutex
+		dbs  map[string]*DB
+		next int
+	}{dbs: make(map[string]*DB)}
+)
+
+func init() {
+	sql.Register(DRIVER, new(fakeDriver))
+}
+
+// Result is the response of a statement: either the rows of a query, or
+// the number of rows changed by an exec
+type Result struct {
+	Columns      []string
+	Rows         [][]driver.Value
+	RowsAffected int64
+}
+
+// Handler responds to one execution of a statement, given its arguments
+type Handler func(args []driver.Value) (*Result, error)
+
+// Call records one execution of a statement (or a transaction step)
+type Call struct {
+	Query string
+	Args  []driver.Value
+}
+
+// DB is the fake database, with the Handlers for each of the statements
+// the test expects, and the Calls made so far
+type DB struct {
+	*sql.DB
+
+	mu       sync.Mutex
+	handlers map[string]Handler
+	calls    []Call
+}
+
+// New opens a new, empty, fake database, which is closed when the test ends
+func New(t testing.TB) *DB {
+	db := &DB{handlers: make(map[string]Handler)}
+
+	registry.Lock()
+	registry.next++
+	name := fmt.Sprintf("db%d", registry.next)
+	registry.dbs[name] = db
+	registry.Unlock()
+
+	conn, err := sql.Open(DRIVER, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.DB = conn
+	t.Cleanup(func() {
+		conn.Close()
+		registry.Lock()
+		delete(registry.dbs, name)
+		registry.Unlock()
+	})
+	return db
+}
+
+// Handle sets the Handler for the query
+func (db *DB) Handle(query string, fn Handler) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.handlers[query] = fn
+}
+
+// Rows is a Handler which always returns the given rows
+func Rows(columns []string, rows ...[]driver.Value) Handler {
+	return func(args []driver.Value) (*Result, error) {
+		return &Result{Columns: columns, Rows: rows}, nil
+	}
+}
+
+// Affected is a Handler which always reports n rows changed
+func Affected(n int64) Handler {
+	return func(args []driver.Value) (*Result, error) {
+		return &Result{RowsAffected: n}, nil
+	}
+}
+
+// Stmt prepares the query (which fails when executed, unless it has a
+// Handler by then)
+func (db *DB) Stmt(t testing.TB, query string) *sql.Stmt {
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stmt
+}
+
+// Statements prepares each of the queries, as a map like the one
+// api.WithServerDatabase passes to its functions
+func (db *DB) Statements(t testing.TB, queries ...string) map[string]*sql.Stmt {
+	statements := make(map[string]*sql.Stmt)
+	for _, query := range queries {
+		statements[query] = db.Stmt(t, query)
+	}
+	return statements
+}
+
+// Calls returns the Calls made so far, in order
+func (db *DB) Calls() []Call {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]Call{}, db.calls...)
+}
+
+// Count returns how many times the query was executed
+func (db *DB) Count(query string) int {
+	n := 0
+	for _, c := range db.Calls() {
+		if c.Query == query {
+			n++
+		}
+	}
+	return n
+}
+
+func (db *DB) record(query string, args []driver.Value) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.calls = append(db.calls, Call{Query: query, Args: args})
+}
+
+func (db *DB) run(query string, args []driver.Value) (*Result, error) {
+	db.record(query, args)
+	db.mu.Lock()
+	fn, exists := db.handlers[query]
+	db.mu.Unlock()
+	if !exists {
+		return nil, fmt.Errorf("%s: %s", ERR_UNEXPECTED_QUERY, query)
+	}
+	result, err := fn(args)
+	if result == nil {
+		result = new(Result)
+	}
+	return result, err
+}
+
+// The database/sql/driver implementation
+
+type fakeDriver struct{}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	registry.Lock()
+	defer registry.Unlock()
+	db, exists := registry.dbs[name]
+	if !exists {
+		return nil, fmt.Errorf("dbtest: unknown database '%s'", name)
+	}
+	return &fakeConn{db: db}, nil
+}
+
+type fakeConn struct {
+	db *DB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.db.record(BEGIN, nil)
+	return &fakeTx{db: c.db}, nil
+}
+
+type fakeTx struct {
+	db *DB
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.db.record(COMMIT, nil)
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.db.record(ROLLBACK, nil)
+	return nil
+}
+
+type fakeStmt struct {
+	db    *DB
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	result, err := s.db.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(result.RowsAffected), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	result, err := s.db.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{result: result}, nil
+}
+
+type fakeRows struct {
+	result *Result
+	i      int
+}
+
+func (r *fakeRows) Columns() []string {
+	if r.result.Columns == nil && len(r.result.Rows) > 0 {
+		// unnamed columns, for the handlers which only return values
+		columns := make([]string, len(r.result.Rows[0]))
+		for i := range columns {
+			columns[i] = fmt.Sprintf("c%d", i)
+		}
+		return columns
+	}
+	return r.result.Columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.i >= len(r.result.Rows) {
+		return io.EOF
+	}
+	copy(dest, r.result.Rows[r.i])
+	r.i++
+	return nil
+}
@@ -0,0 +1,21 @@
+-- The Open Product Data (POD) tables used for the barcode lookups:
+-- loaded either from the POD sql download (which defines these, with
+-- more columns, and so takes precedence when loaded first), or from the
+-- POD csv files, by "APIServer importpod"
+
+-- `gtin` defines the product name and brand of each barcode
+
+CREATE TABLE IF NOT EXISTS gtin (
+	gtin_cd varchar(13) primary key NOT NULL,
+	gtin_nm varchar(512),
+	bsin    varchar(6) -- corresponds to BRAND.BSIN
+);
+
+
+-- `brand` defines the name and web site of each product brand
+
+CREATE TABLE IF NOT EXISTS brand (
+	bsin       varchar(6) primary key NOT NULL,
+	brand_nm   varchar(512),
+	brand_link varchar(1024)
+);
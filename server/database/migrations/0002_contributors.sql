@@ -12,17 +12,22 @@
 
 -- `account` defines the person contributing product information
 
-CREATE TABLE account (
+CREATE TABLE IF NOT EXISTS account (
 	id            binary(16) primary key NOT NULL,
 	email         varchar(512) NOT NULL,
 	date_joined   datetime, -- automatically filled in by trigger, below
-	verify_code   varchar(32),
+	verify_code   varchar(32), -- the api code, which signs the account's requests
+	verify_token  varchar(32), -- the secret in the email verification link
+	token_expires datetime, -- when the verify_token stops working
 	verified      boolean DEFAULT false,
 	date_verified datetime,
-	enabled       boolean DEFAULT false,
+	enabled       boolean DEFAULT true, -- false once disabled (by its owner or an admin)
+	role          varchar(16) DEFAULT 'contributor', -- or 'trusted', or 'admin' (who can moderate contributions)
+	language      varchar(16), -- the locale for emails (e.g., 'de'), or null for the default
 	UNIQUE(email, id)
 );
 
+DROP TRIGGER IF EXISTS account_on_insert;
 CREATE TRIGGER account_on_insert BEFORE INSERT ON `account`
     FOR EACH ROW SET NEW.date_joined = IFNULL(NEW.date_joined, NOW());
 
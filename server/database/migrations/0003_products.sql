@@ -17,40 +17,67 @@
 -- bsin code (any more information via individual user
 -- contribution is unlikely/unexpected)
 
-CREATE TABLE barcode (
+CREATE TABLE IF NOT EXISTS barcode (
 	id           binary(16) primary key NOT NULL,
 	barcode      varchar(13) NOT NULL,     -- corresponds to GTIN.GTIN_CD
 	product_name varchar(512) NOT NULL,    -- corresponds to GTIN.GTIN_NM
 	product_desc varchar(512),             -- additional description (if any, optional)
 	is_edit      boolean DEFAULT false, -- if this represents a correction vs a new addition to GTIN
+	original_nm  varchar(512),          -- the GTIN.GTIN_NM being corrected (if is_edit)
+	status       varchar(16) DEFAULT 'pending', -- or 'approved', or 'rejected' (see contribution_vote, below)
 	posted       datetime, -- automatically filled in by trigger, below
 	account_id   binary(16) REFERENCES account(id)
 ); 
 
+DROP TRIGGER IF EXISTS barcode_on_insert;
 CREATE TRIGGER barcode_on_insert BEFORE INSERT ON `barcode`
     FOR EACH ROW SET NEW.posted = IFNULL(NEW.posted, NOW());
 
 -- `contributed_brand` is for user-contributed brands which do not already
 -- exist in the BRAND table of the POD database
 
-CREATE TABLE contributed_brand (
+CREATE TABLE IF NOT EXISTS contributed_brand (
 	id         binary(16) primary key NOT NULL,
 	brand_name varchar(512) NOT NULL, -- corresponds to BRAND.BRAND_NM
 	brand_url  varchar(512),          -- corresponds to BRAND.BRAND_LINK
+	status     varchar(16) DEFAULT 'pending', -- or 'approved', or 'rejected'
 	posted     datetime, -- automatically filled in by trigger, below
 	account_id binary(16) REFERENCES account(id)
 );
 
+DROP TRIGGER IF EXISTS contributed_brand_on_insert;
 CREATE TRIGGER contributed_brand_on_insert BEFORE INSERT ON `contributed_brand`
     FOR EACH ROW SET NEW.posted = IFNULL(NEW.posted, NOW());
 
 -- `barcode_brand` associates user-contributed barcode information with
--- the corresponding product brand, when the brand already exists in the
--- BRAND table of the POD database
+-- the corresponding product brand, either when the brand already exists
+-- in the BRAND table of the POD database (bsin), or when it was also
+-- contributed (contributed_brand_id)
 
-CREATE TABLE barcode_brand (
-	id         binary(16) primary key NOT NULL,
-	bsin       varchar(6) NOT NULL, -- corresponds to BRAND.BSIN
-	barcode_id binary(16) REFERENCES barcode(id)
+CREATE TABLE IF NOT EXISTS barcode_brand (
+	id                   binary(16) primary key NOT NULL,
+	bsin                 varchar(6),  -- corresponds to BRAND.BSIN
+	contributed_brand_id binary(16) REFERENCES contributed_brand(id),
+	barcode_id           binary(16) REFERENCES barcode(id)
 );
 
+
+-- Moderation
+
+-- `contribution_vote` records the upvotes (+1) and flags (-1) made by
+-- verified accounts on pending user contributions (either a barcode or a
+-- contributed_brand), which moderators use when approving or rejecting
+-- them; each account gets at most one vote per contribution
+
+CREATE TABLE IF NOT EXISTS contribution_vote (
+	id              binary(16) primary key NOT NULL,
+	contribution_id binary(16) NOT NULL, -- barcode.id or contributed_brand.id
+	account_id      binary(16) REFERENCES account(id),
+	vote            tinyint NOT NULL,
+	posted          datetime, -- automatically filled in by trigger, below
+	UNIQUE(contribution_id, account_id)
+);
+
+DROP TRIGGER IF EXISTS contribution_vote_on_insert;
+CREATE TRIGGER contribution_vote_on_insert BEFORE INSERT ON `contribution_vote`
+    FOR EACH ROW SET NEW.posted = IFNULL(NEW.posted, NOW());
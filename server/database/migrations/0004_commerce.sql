@@ -0,0 +1,79 @@
+
+-- Additional Tables for the POD database:
+-- used to track user contributions to the core POD data
+
+-- n.b. this schema uses uuid as binary for the primary keys,
+-- since mysql's support for varchar/strings as primaty keys
+-- is poor compared to binary fields
+-- source: http://stackoverflow.com/a/10951183
+
+
+-- Commerce: support for scan-to-buy actions from the UI
+
+-- `amazon` defines the product information according to 
+-- what's needed to place an order there, i.e., primarily
+-- an ASIN code for each barcode
+
+CREATE TABLE IF NOT EXISTS amazon (
+	id         binary(16) primary key NOT NULL,
+	barcode    varchar(13) NOT NULL, -- either GTIN.GTIN_CD (POD) or barcode.barcode (user-contributed)
+	asin       varchar(10) NOT NULL, -- the corresponding Amazon product code, as selected by the contributing user
+	product    varchar(512) NOT NULL,
+	image_url  varchar(1024),
+	locale     varchar(2) NOT NULL DEFAULT 'us',
+	is_upc     boolean DEFAULT false,
+	is_ean     boolean DEFAULT false,
+	is_isbn    boolean DEFAULT false,
+	posted     datetime, -- automatically filled in by trigger, below
+	UNIQUE(barcode, asin)
+);
+
+DROP TRIGGER IF EXISTS amazon_on_insert;
+CREATE TRIGGER amazon_on_insert BEFORE INSERT ON `amazon`
+    FOR EACH ROW SET NEW.posted = IFNULL(NEW.posted, NOW());
+
+
+
+-- Product data: supplementary information for the UI
+
+-- `openfoodfacts` caches the product details found by querying the
+-- Open Food Facts (http://world.openfoodfacts.org/) API
+
+CREATE TABLE IF NOT EXISTS openfoodfacts (
+	id          binary(16) primary key NOT NULL,
+	barcode     varchar(13) NOT NULL, -- either GTIN.GTIN_CD (POD) or barcode.barcode (user-contributed)
+	product     varchar(512) NOT NULL,
+	brand       varchar(512),
+	image_url   varchar(1024),
+	category    varchar(256),
+	ingredients text,
+	allergens   varchar(1024), -- comma-separated list
+	nutriscore  char(1),       -- 'a' through 'e'
+	locale      varchar(8) NOT NULL DEFAULT 'world',
+	posted      datetime, -- automatically filled in by trigger, below
+	UNIQUE(barcode, locale)
+);
+
+DROP TRIGGER IF EXISTS openfoodfacts_on_insert;
+CREATE TRIGGER openfoodfacts_on_insert BEFORE INSERT ON `openfoodfacts`
+    FOR EACH ROW SET NEW.posted = IFNULL(NEW.posted, NOW());
+
+
+-- Prices: the history of every price found for each vendor product
+
+-- `price_history` defines the price of a vendor's product (sku) at
+-- the time of each barcode lookup
+
+CREATE TABLE IF NOT EXISTS price_history (
+	id         binary(16) primary key NOT NULL,
+	vendor     varchar(32) NOT NULL, -- the commerce API vendor id, e.g., 'AMZN:us'
+	sku        varchar(64) NOT NULL, -- the vendor product code, e.g., the ASIN
+	price      bigint NOT NULL,      -- in the smallest unit of the currency (e.g., cents)
+	currency   char(3) NOT NULL,     -- ISO 4217 currency code
+	posted     datetime, -- automatically filled in by trigger, below
+	INDEX(vendor, sku, posted)
+);
+
+DROP TRIGGER IF EXISTS price_history_on_insert;
+CREATE TRIGGER price_history_on_insert BEFORE INSERT ON `price_history`
+    FOR EACH ROW SET NEW.posted = IFNULL(NEW.posted, NOW());
@@ -11,23 +11,26 @@
 -- `book` defines basic title and barcode (isbn) information, and the
 -- corresponding source
 
-CREATE TABLE book (
+CREATE TABLE IF NOT EXISTS book (
 	id        binary(16) primary key NOT NULL,
 	title     varchar(512) NOT NULL,
 	isbn      varchar(13) NOT NULL,
 	is_isbn10 boolean DEFAULT false,
-	src       varchar(32) NOT NULL DEFAULT 'OL', -- open library
+	publisher varchar(512),
+	src       varchar(32) NOT NULL DEFAULT 'OL', -- open library, or 'PiScan' for user contributions
 	posted    datetime, -- automatically filled in by trigger, below
+	account_id binary(16) REFERENCES account(id), -- the contributor (if src is 'PiScan')
 	UNIQUE(title, isbn, src) -- an isbn *should* be unique but sources may differ
 );
 
+DROP TRIGGER IF EXISTS book_on_insert;
 CREATE TRIGGER book_on_insert BEFORE INSERT ON `book`
     FOR EACH ROW SET NEW.posted = IFNULL(NEW.posted, NOW());
 
 
 -- `author` defines author names, and the corresponding source information
 
-CREATE TABLE author (
+CREATE TABLE IF NOT EXISTS author (
 	id        binary(16) primary key NOT NULL,
 	full_name varchar(512) NOT NULL,
 	src       varchar(32) NOT NULL DEFAULT 'OL', -- open library
@@ -37,7 +40,7 @@ CREATE TABLE author (
 
 -- `book_author` defines which author(s) are credited with which books
 
-CREATE TABLE book_author (
+CREATE TABLE IF NOT EXISTS book_author (
 	id        binary(16) primary key NOT NULL,
 	book_id   binary(16) references book(id),
 	author_id binary(16) references author(id),
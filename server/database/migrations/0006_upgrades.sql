@@ -0,0 +1,23 @@
+-- The columns added to the original tables before the migrations were
+-- available (databases created by hand from the earlier sql files may have
+-- any number of them already, and MigrateDB skips those)
+
+-- n.b. accounts created before the enabled flag was enforced have it false,
+-- which 0010_enable_accounts.sql fixes
+
+ALTER TABLE account ADD COLUMN verify_token varchar(32);
+ALTER TABLE account ADD COLUMN token_expires datetime;
+ALTER TABLE account ADD COLUMN role varchar(16) DEFAULT 'contributor';
+ALTER TABLE account ADD COLUMN language varchar(16);
+ALTER TABLE account ALTER enabled SET DEFAULT true;
+
+ALTER TABLE barcode ADD COLUMN original_nm varchar(512);
+ALTER TABLE barcode ADD COLUMN status varchar(16) DEFAULT 'pending';
+ALTER TABLE contributed_brand ADD COLUMN status varchar(16) DEFAULT 'pending';
+ALTER TABLE barcode_brand MODIFY bsin varchar(6);
+ALTER TABLE barcode_brand ADD COLUMN contributed_brand_id binary(16);
+
+ALTER TABLE amazon ADD COLUMN image_url varchar(1024);
+
+ALTER TABLE book ADD COLUMN publisher varchar(512);
+ALTER TABLE book ADD COLUMN account_id binary(16);
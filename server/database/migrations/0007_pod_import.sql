@@ -0,0 +1,11 @@
+-- `pod_import` records how far "APIServer importpod" got through each POD
+-- csv file, so that an interrupted import resumes after the last batch
+-- it finished
+
+CREATE TABLE IF NOT EXISTS pod_import (
+	source     varchar(255) primary key NOT NULL, -- the file name and size
+	table_name varchar(16) NOT NULL, -- 'gtin' or 'brand'
+	rows_done  bigint NOT NULL DEFAULT 0,
+	finished   boolean DEFAULT false,
+	updated    datetime
+);
@@ -0,0 +1,5 @@
+-- `amazon.prices_checked` records when the Product API was last asked for
+-- the current prices of each product, so that products with no price are
+-- not checked again on every lookup (see amazon.PRICE_MAX_AGE)
+
+ALTER TABLE amazon ADD COLUMN prices_checked datetime;
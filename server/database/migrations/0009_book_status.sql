@@ -0,0 +1,8 @@
+-- Books contributed by users are moderated like the other contributions
+-- (see moderation-access.go), so the book table gets the same status column
+
+-- n.b. the books already in the table (from Open Library, or contributed
+-- before this column existed) were being returned by the lookups, so they
+-- stay approved; ContributeBook sets the status of each new contribution
+
+ALTER TABLE book ADD COLUMN status varchar(16) DEFAULT 'approved';
@@ -0,0 +1,10 @@
+-- Signed requests are refused for disabled accounts, but the accounts
+-- created before that was enforced have enabled = false (the original
+-- column default), so they are all enabled once here, when upgrading to
+-- the version which enforces it
+
+-- n.b. any account disabled (with /account/disable) by an APIServer run
+-- before this migration existed is enabled again too, and has to be
+-- disabled again by its owner
+
+UPDATE account SET enabled = true WHERE enabled = false OR enabled IS NULL;
@@ -0,0 +1,23 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package migrations holds the schema of the mysql database on the server,
+// as the ordered series of changes which build it up, compiled into the
+// APIServer binary so that "APIServer migrate" can create or upgrade it
+
+package migrations
+
+import "embed"
+
+// Files are the *.sql files in this folder, named <version>_<name>.sql,
+// and applied in version order (see barcodes.MigrateDB); once released,
+// a migration must never change, so every schema change is a new file
+//
+// mysql cannot roll back schema changes, so each statement has to be safe
+// to run again (create ... if not exists, drop trigger if exists, and add
+// column, which MigrateDB skips for columns already there), in case a
+// migration fails part way, or the database was created by hand from the
+// sql files which these replace
+//
+//go:embed *.sql
+var Files embed.FS
@@ -10,7 +10,21 @@ package digest
 import (
 	"crypto/hmac"
 	"crypto/sha512"
+	"encoding/hex"
 	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	// The current signing scheme version
+	VERSION = "2"
+
+	// Request parameters added by the Signer
+	PARAM_VERSION   = "sigv"
+	PARAM_TIMESTAMP = "ts"
+	PARAM_NONCE     = "nonce"
+	PARAM_SIGNATURE = "sig"
 )
 
 func GenerateDigest(privateKey string, message string) string {
@@ -19,6 +33,28 @@ func GenerateDigest(privateKey string, message string) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
+// DigestMatches compares the digests in constant time, so that the
+// comparison does not reveal how much of the given digest was correct
 func DigestMatches(privateKey, messagePlainText, messageDigest string) bool {
-	return (messageDigest == GenerateDigest(privateKey, messagePlainText))
+	expected, _ := hex.DecodeString(GenerateDigest(privateKey, messagePlainText))
+	given, givenErr := hex.DecodeString(messageDigest)
+	if givenErr != nil {
+		return false
+	}
+	return hmac.Equal(expected, given)
+}
+
+// CanonicalRequest is the string which gets signed: the scheme version,
+// the http method and path, the timestamp and nonce, and the rest of the
+// request parameters, sorted by name (the signature parameters excluded)
+func CanonicalRequest(method, path, timestamp, nonce string, params url.Values) string {
+	payload := url.Values{}
+	for k, v := range params {
+		switch k {
+		case PARAM_VERSION, PARAM_TIMESTAMP, PARAM_NONCE, PARAM_SIGNATURE:
+			continue
+		}
+		payload[k] = v
+	}
+	return strings.Join([]string{VERSION, strings.ToUpper(method), path, timestamp, nonce, payload.Encode()}, "\n")
 }
@@ -0,0 +1,71 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package digest
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDigestMatches(t *testing.T) {
+	key, message := "0123456789abcdef", "the canonical request"
+	digest := GenerateDigest(key, message)
+
+	if !DigestMatches(key, message, digest) {
+		t.Error("the digest does not match its own message")
+	}
+	if !DigestMatches(key, message, strings.ToUpper(digest)) {
+		t.Error("the upper case digest does not match")
+	}
+
+	// flip the last hex digit
+	last := "0"
+	if strings.HasSuffix(digest, "0") {
+		last = "1"
+	}
+	mismatches := map[string]string{
+		"other key":     GenerateDigest("fedcba9876543210", message),
+		"other message": GenerateDigest(key, message+"."),
+		"last digit":    digest[:len(digest)-1] + last,
+		"truncated":     digest[:len(digest)-2],
+		"not hex":       strings.Repeat("z", len(digest)),
+		"empty":         "",
+	}
+	for name, given := range mismatches {
+		if DigestMatches(key, message, given) {
+			t.Errorf("%s: the digest matches", name)
+		}
+	}
+}
+
+func TestCanonicalRequest(t *testing.T) {
+	params := url.Values{
+		"email":         {"zoe@example.com"},
+		"barcode":       {"0012345678905"},
+		"author":        {"Pratchett, Terry", "Gaiman, Neil"},
+		PARAM_VERSION:   {VERSION},
+		PARAM_TIMESTAMP: {"1700000000"},
+		PARAM_NONCE:     {"abc"},
+		PARAM_SIGNATURE: {"def"},
+	}
+	expected := "2\nPOST\n/contribute/\n1700000000\nn0nce\nauthor=Pratchett%2C+Terry&author=Gaiman%2C+Neil&barcode=0012345678905&email=zoe%40example.com"
+	if canonical := CanonicalRequest("post", "/contribute/", "1700000000", "n0nce", params); canonical != expected {
+		t.Errorf("CanonicalRequest = %q, expected %q", canonical, expected)
+	}
+
+	// the parameter order makes no difference, but the order of the
+	// values of each parameter does
+	reordered := url.Values{}
+	for _, k := range []string{"barcode", "email", "author"} {
+		reordered[k] = params[k]
+	}
+	if CanonicalRequest("POST", "/contribute/", "1700000000", "n0nce", reordered) != expected {
+		t.Error("the parameter order changes the canonical request")
+	}
+	reordered["author"] = []string{"Gaiman, Neil", "Pratchett, Terry"}
+	if CanonicalRequest("POST", "/contribute/", "1700000000", "n0nce", reordered) == expected {
+		t.Error("the order of the parameter values does not change the canonical request")
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package digest provides methods for hmac creation and checking, so
+// that the client can present its requests with a digest that can be
+// authenticated and evaluated by the server
+
+package digest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Signer adds the timestamp, nonce, and signature parameters to client
+// requests, using the account's secret api code as the key
+type Signer struct {
+	Key    string
+	Client *http.Client
+	Now    func() time.Time
+}
+
+func NewSigner(key string) *Signer {
+	return &Signer{Key: key, Client: http.DefaultClient, Now: time.Now}
+}
+
+// newNonce returns a random, single-use request identifier
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Sign returns a copy of the request parameters, with the signature
+// parameters added, for the given http method and url path
+func (s *Signer) Sign(method, path string, params url.Values) url.Values {
+	signed := url.Values{}
+	for k, v := range params {
+		signed[k] = v
+	}
+	timestamp := strconv.FormatInt(s.Now().Unix(), 10)
+	nonce := newNonce()
+	signed.Set(PARAM_VERSION, VERSION)
+	signed.Set(PARAM_TIMESTAMP, timestamp)
+	signed.Set(PARAM_NONCE, nonce)
+	signed.Set(PARAM_SIGNATURE, GenerateDigest(s.Key, CanonicalRequest(method, path, timestamp, nonce, params)))
+	return signed
+}
+
+// Get makes a signed GET request to the url, with the parameters in the
+// query string
+func (s *Signer) Get(rawurl string, params url.Values) (*http.Response, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = s.Sign("GET", u.Path, params).Encode()
+	return s.Client.Get(u.String())
+}
+
+// PostForm makes a signed POST request to the url, with the parameters
+// in the form body
+func (s *Signer) PostForm(rawurl string, params url.Values) (*http.Response, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return s.Client.PostForm(rawurl, s.Sign("POST", u.Path, params))
+}
@@ -0,0 +1,206 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package digest provides methods for hmac creation and checking, so
+// that the client can present its requests with a digest that can be
+// authenticated and evaluated by the server
+
+package digest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// How far the request timestamp may be from the server clock
+	DEFAULT_SKEW = 5 * time.Minute
+
+	// how many nonces the NonceCache holds before sweeping out expired ones
+	NONCE_SWEEP_THRESHOLD = 10000
+
+	// Reply when a request is refused
+	UNAUTHORIZED = `{"err":"Invalid or expired request signature"}`
+)
+
+var (
+	ERR_MISSING_SIGNATURE = errors.New("Missing request signature")
+	ERR_BAD_VERSION       = errors.New("Unsupported request signature version")
+	ERR_BAD_TIMESTAMP     = errors.New("Request timestamp is outside the allowed window")
+	ERR_REPLAYED_NONCE    = errors.New("Request nonce has already been used")
+	ERR_BAD_SIGNATURE     = errors.New("Invalid request signature")
+)
+
+// NonceCache remembers the nonces of recently verified requests, so that
+// none of them can be replayed while their timestamp is still valid
+type NonceCache struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time // nonce -> when it can be forgotten
+}
+
+func NewNonceCache() *NonceCache {
+	return &NonceCache{nonces: make(map[string]time.Time)}
+}
+
+// Add records the nonce until the expiry time, returning false if it had
+// already been seen
+func (c *NonceCache) Add(nonce string, expiry, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// the expiry time itself is still within the timestamp window
+	if until, exists := c.nonces[nonce]; exists && !now.After(until) {
+		return false
+	}
+	if len(c.nonces) >= NONCE_SWEEP_THRESHOLD {
+		for n, until := range c.nonces {
+			if now.After(until) {
+				delete(c.nonces, n)
+			}
+		}
+	}
+	c.nonces[nonce] = expiry
+	return true
+}
+
+// verifiedKey is the request context key for the verified parameters
+type verifiedKey struct{}
+
+// VerifiedParams returns the parameters of the request, if its signature
+// was verified by a Verifier handler, or nil otherwise
+func VerifiedParams(r *http.Request) url.Values {
+	params, _ := r.Context().Value(verifiedKey{}).(url.Values)
+	return params
+}
+
+// KeyFunc returns the secret key which should have signed the request,
+// given its parameters (e.g., by looking up the account api code)
+type KeyFunc func(params url.Values) (string, error)
+
+// Verifier checks the signature parameters of server requests
+type Verifier struct {
+	Keys   KeyFunc
+	Skew   time.Duration
+	Nonces *NonceCache
+	Now    func() time.Time
+}
+
+func NewVerifier(keys KeyFunc, skew time.Duration, nonces *NonceCache) *Verifier {
+	return &Verifier{Keys: keys, Skew: skew, Nonces: nonces, Now: time.Now}
+}
+
+// requestParams returns the query (for GET) or form (for POST) parameters
+func requestParams(r *http.Request) (url.Values, error) {
+	if "POST" == r.Method {
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		return r.PostForm, nil
+	}
+	return url.ParseQuery(r.URL.RawQuery)
+}
+
+// Verify confirms the request is signed with the current scheme, within
+// the allowed clock skew, with a nonce not used before, and by the right
+// key; if so, the signature parameters are removed from the request, so
+// that the handlers only see the rest
+func (v *Verifier) Verify(r *http.Request) error {
+	_, err := v.verify(r)
+	return err
+}
+
+// verify is Verify, also returning the (remaining) request parameters
+func (v *Verifier) verify(r *http.Request) (url.Values, error) {
+	params, err := requestParams(r)
+	if err != nil {
+		return nil, err
+	}
+
+	signature := params.Get(PARAM_SIGNATURE)
+	timestamp := params.Get(PARAM_TIMESTAMP)
+	nonce := params.Get(PARAM_NONCE)
+	if signature == "" || timestamp == "" || nonce == "" {
+		return nil, ERR_MISSING_SIGNATURE
+	}
+	if params.Get(PARAM_VERSION) != VERSION {
+		return nil, ERR_BAD_VERSION
+	}
+
+	now := v.Now()
+	seconds, secondsErr := strconv.ParseInt(timestamp, 10, 64)
+	if secondsErr != nil {
+		return nil, ERR_BAD_TIMESTAMP
+	}
+	signedAt := time.Unix(seconds, 0)
+	if signedAt.Before(now.Add(-v.Skew)) || signedAt.After(now.Add(v.Skew)) {
+		return nil, ERR_BAD_TIMESTAMP
+	}
+
+	key, keyErr := v.Keys(params)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	if key == "" || !DigestMatches(key, CanonicalRequest(r.Method, r.URL.Path, timestamp, nonce, params), signature) {
+		return nil, ERR_BAD_SIGNATURE
+	}
+
+	// only remember the nonce once the request is known to be genuine,
+	// for as long as its timestamp would still be accepted
+	if !v.Nonces.Add(nonce, signedAt.Add(v.Skew), now) {
+		return nil, ERR_REPLAYED_NONCE
+	}
+
+	for _, p := range []string{PARAM_VERSION, PARAM_TIMESTAMP, PARAM_NONCE, PARAM_SIGNATURE} {
+		params.Del(p)
+	}
+	if "POST" != r.Method {
+		r.URL.RawQuery = params.Encode()
+	}
+
+	return params, nil
+}
+
+// Handler wraps the handler so that it only runs for verified requests,
+// replying with a 401 status otherwise; the handler can get the verified
+// parameters with VerifiedParams
+func (v *Verifier) Handler(fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params, err := v.verify(r)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, UNAUTHORIZED)
+			return
+		}
+		fn(w, r.WithContext(context.WithValue(r.Context(), verifiedKey{}, params)))
+	}
+}
+
+// OptionalHandler wraps the handler so that it runs for every request,
+// but if the request is not verified, the given identifying parameters
+// are removed from it first (so the handler treats it as anonymous)
+func (v *Verifier) OptionalHandler(fn func(http.ResponseWriter, *http.Request), identifiers ...string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		verified, err := v.verify(r)
+		if err != nil {
+			params, paramsErr := requestParams(r)
+			if paramsErr == nil {
+				for _, p := range identifiers {
+					params.Del(p)
+				}
+				if "POST" != r.Method {
+					r.URL.RawQuery = params.Encode()
+				}
+			}
+			fn(w, r)
+			return
+		}
+		fn(w, r.WithContext(context.WithValue(r.Context(), verifiedKey{}, verified)))
+	}
+}
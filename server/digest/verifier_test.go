@@ -0,0 +1,232 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package digest
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	TEST_EMAIL = "zoe@example.com"
+	TEST_KEY   = "0123456789abcdef"
+)
+
+var errUnknownAccount = errors.New("Unknown account")
+
+// testKeys looks up the api code of the account named by the "email"
+// parameter, as the server does
+func testKeys(params url.Values) (string, error) {
+	if params.Get("email") == TEST_EMAIL {
+		return TEST_KEY, nil
+	}
+	return "", errUnknownAccount
+}
+
+// testClock is the time on both sides, unless a test moves one of them
+var testClock = time.Date(2024, time.March, 9, 8, 0, 0, 0, time.UTC)
+
+func testVerifier() *Verifier {
+	v := NewVerifier(testKeys, DEFAULT_SKEW, NewNonceCache())
+	v.Now = func() time.Time { return testClock }
+	return v
+}
+
+func testSigner(key string, offset time.Duration) *Signer {
+	s := NewSigner(key)
+	s.Now = func() time.Time { return testClock.Add(offset) }
+	return s
+}
+
+// signedRequest makes the request the Signer would send, with the
+// parameters in the query string (GET) or form body (POST)
+func signedRequest(method, path string, signed url.Values) *http.Request {
+	if "POST" == method {
+		r := httptest.NewRequest(method, path, strings.NewReader(signed.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+	return httptest.NewRequest(method, path+"?"+signed.Encode(), nil)
+}
+
+func TestVerify(t *testing.T) {
+	params := url.Values{"email": {TEST_EMAIL}, "barcode": {"0012345678905"}}
+	for _, method := range []string{"GET", "POST"} {
+		v := testVerifier()
+		r := signedRequest(method, "/lookup/", testSigner(TEST_KEY, 0).Sign(method, "/lookup/", params))
+		if err := v.Verify(r); err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+
+		// the handlers only see the request parameters
+		remaining, _ := requestParams(r)
+		if len(remaining) != len(params) || remaining.Get("barcode") != "0012345678905" || remaining.Get(PARAM_SIGNATURE) != "" {
+			t.Errorf("%s: parameters after Verify = %v", method, remaining)
+		}
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	params := url.Values{"email": {TEST_EMAIL}, "barcode": {"0012345678905"}}
+	signed := func() url.Values {
+		return testSigner(TEST_KEY, 0).Sign("POST", "/contribute/", params)
+	}
+	tests := []struct {
+		name     string
+		path     string
+		modify   func(url.Values)
+		expected error
+	}{
+		{"unsigned", "/contribute/", func(p url.Values) { p.Del(PARAM_SIGNATURE) }, ERR_MISSING_SIGNATURE},
+		{"no nonce", "/contribute/", func(p url.Values) { p.Del(PARAM_NONCE) }, ERR_MISSING_SIGNATURE},
+		{"version 1", "/contribute/", func(p url.Values) { p.Set(PARAM_VERSION, "1") }, ERR_BAD_VERSION},
+		{"bad timestamp", "/contribute/", func(p url.Values) { p.Set(PARAM_TIMESTAMP, "yesterday") }, ERR_BAD_TIMESTAMP},
+		{"tampered", "/contribute/", func(p url.Values) { p.Set("barcode", "0098765432109") }, ERR_BAD_SIGNATURE},
+		{"added parameter", "/contribute/", func(p url.Values) { p.Set("correction", "true") }, ERR_BAD_SIGNATURE},
+		{"other path", "/delete/", func(p url.Values) {}, ERR_BAD_SIGNATURE},
+		{"unknown account", "/contribute/", func(p url.Values) { p.Set("email", "sam@example.com") }, errUnknownAccount},
+	}
+	for _, test := range tests {
+		p := signed()
+		test.modify(p)
+		if err := testVerifier().Verify(signedRequest("POST", test.path, p)); err != test.expected {
+			t.Errorf("%s: Verify = %v, expected %v", test.name, err, test.expected)
+		}
+	}
+
+	// signed with the wrong key
+	r := signedRequest("POST", "/contribute/", testSigner("fedcba9876543210", 0).Sign("POST", "/contribute/", params))
+	if err := testVerifier().Verify(r); err != ERR_BAD_SIGNATURE {
+		t.Errorf("wrong key: Verify = %v, expected %v", err, ERR_BAD_SIGNATURE)
+	}
+}
+
+func TestVerifySkew(t *testing.T) {
+	params := url.Values{"email": {TEST_EMAIL}}
+	tests := map[time.Duration]error{
+		0:                           nil,
+		-DEFAULT_SKEW:               nil,
+		DEFAULT_SKEW:                nil,
+		-DEFAULT_SKEW - time.Second: ERR_BAD_TIMESTAMP,
+		DEFAULT_SKEW + time.Second:  ERR_BAD_TIMESTAMP,
+		-24 * time.Hour:             ERR_BAD_TIMESTAMP,
+	}
+	for offset, expected := range tests {
+		r := signedRequest("GET", "/lookup/", testSigner(TEST_KEY, offset).Sign("GET", "/lookup/", params))
+		if err := testVerifier().Verify(r); err != expected {
+			t.Errorf("client clock %v off: Verify = %v, expected %v", offset, err, expected)
+		}
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	v := testVerifier()
+	params := url.Values{"email": {TEST_EMAIL}}
+	signed := testSigner(TEST_KEY, 0).Sign("POST", "/delete/", params)
+
+	// a forgery with the same nonce does not use it up
+	forged := url.Values{}
+	for k, val := range signed {
+		forged[k] = val
+	}
+	forged.Set(PARAM_SIGNATURE, GenerateDigest("guess", "work"))
+	if err := v.Verify(signedRequest("POST", "/delete/", forged)); err != ERR_BAD_SIGNATURE {
+		t.Errorf("forged: Verify = %v, expected %v", err, ERR_BAD_SIGNATURE)
+	}
+
+	if err := v.Verify(signedRequest("POST", "/delete/", signed)); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if err := v.Verify(signedRequest("POST", "/delete/", signed)); err != ERR_REPLAYED_NONCE {
+		t.Errorf("replayed: Verify = %v, expected %v", err, ERR_REPLAYED_NONCE)
+	}
+
+	// the nonce is remembered for as long as the timestamp is accepted
+	v.Now = func() time.Time { return testClock.Add(DEFAULT_SKEW) }
+	if err := v.Verify(signedRequest("POST", "/delete/", signed)); err != ERR_REPLAYED_NONCE {
+		t.Errorf("replayed at the end of the window: Verify = %v, expected %v", err, ERR_REPLAYED_NONCE)
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	c := NewNonceCache()
+	if !c.Add("a", testClock.Add(time.Minute), testClock) {
+		t.Error("a new nonce was refused")
+	}
+	if c.Add("a", testClock.Add(time.Minute), testClock.Add(time.Minute)) {
+		t.Error("a nonce was accepted twice before it expired")
+	}
+	if !c.Add("a", testClock.Add(2*time.Minute), testClock.Add(time.Minute+time.Second)) {
+		t.Error("an expired nonce was refused")
+	}
+}
+
+// handled records what the wrapped handler saw of the request
+type handled struct {
+	called   bool
+	email    string
+	verified url.Values
+}
+
+func (h *handled) handler(w http.ResponseWriter, r *http.Request) {
+	h.called = true
+	params, _ := requestParams(r)
+	h.email = params.Get("email")
+	h.verified = VerifiedParams(r)
+	w.Write([]byte(`{"ack":"ok"}`))
+}
+
+func TestHandler(t *testing.T) {
+	v := testVerifier()
+	params := url.Values{"email": {TEST_EMAIL}}
+
+	h := new(handled)
+	w := httptest.NewRecorder()
+	v.Handler(h.handler)(w, signedRequest("POST", "/contribute/", testSigner(TEST_KEY, 0).Sign("POST", "/contribute/", params)))
+	if w.Code != http.StatusOK || !h.called || h.verified.Get("email") != TEST_EMAIL {
+		t.Errorf("signed: status %d, handled %+v", w.Code, h)
+	}
+
+	h = new(handled)
+	w = httptest.NewRecorder()
+	v.Handler(h.handler)(w, signedRequest("POST", "/contribute/", params))
+	body, _ := ioutil.ReadAll(w.Body)
+	if w.Code != http.StatusUnauthorized || h.called || string(body) != UNAUTHORIZED {
+		t.Errorf("unsigned: status %d, body %q, handler called %v", w.Code, body, h.called)
+	}
+}
+
+func TestOptionalHandler(t *testing.T) {
+	v := testVerifier()
+	params := url.Values{"email": {TEST_EMAIL}, "barcode": {"0012345678905"}}
+
+	// a verified request keeps the account
+	h := new(handled)
+	r := signedRequest("GET", "/lookup/", testSigner(TEST_KEY, 0).Sign("GET", "/lookup/", params))
+	v.OptionalHandler(h.handler, "email")(httptest.NewRecorder(), r)
+	if !h.called || h.email != TEST_EMAIL || h.verified.Get("email") != TEST_EMAIL {
+		t.Errorf("signed: handled %+v", h)
+	}
+
+	// others are still handled, but anonymously
+	unverified := map[string]url.Values{
+		"unsigned":  params,
+		"wrong key": testSigner("fedcba9876543210", 0).Sign("GET", "/lookup/", params),
+	}
+	for name, p := range unverified {
+		for _, method := range []string{"GET", "POST"} {
+			h = new(handled)
+			v.OptionalHandler(h.handler, "email")(httptest.NewRecorder(), signedRequest(method, "/lookup/", p))
+			if !h.called || h.email != "" || h.verified != nil {
+				t.Errorf("%s %s: handled %+v", name, method, h)
+			}
+		}
+	}
+}
@@ -11,27 +11,44 @@ import (
 	"bytes"
 	"encoding/base64"
 	"fmt"
+	"html"
 	"io/ioutil"
-	"net/smtp"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
 	"os"
-	"text/template"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 )
 
 const (
 	MAIL_SERVER = "localhost"
 	MAIL_PORT   = 25
 
-	LINE_MAX_LEN = 500 // for splitting encoded attachment data
-
-	// templates for generating the message components
-	ADDRESS    = "\"{{.DisplayName}}\" <{{.Address}}>"
-	HEADERS    = "From: {{.Sender}}\r\nTo: {{.Recipient}}\r\nSubject: {{.Subject}}\r\nMIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=\"{{.Boundary}}\"\r\n"
-	BODY       = "\r\n--{{.Boundary}}\r\nContent-Type: {{.ContentType}}\r\n\r\n{{.MessageBody}}"
-	ATTACHMENT = "\r\n--{{.Boundary}}\r\nContent-Type: {{.ContentType}}; name=\"{{.FileLocation}}\"\r\nContent-Transfer-Encoding:base64\r\nContent-Disposition: attachment; filename=\"{{.FileName}}\"\r\n\r\n{{.EncodedFileData}}"
+	LINE_MAX_LEN = 76 // for splitting encoded attachment data (RFC 2045)
 
 	// message body mime types
 	TEXT_MIME = "text/plain"
 	HTML_MIME = "text/html"
+
+	// default attachment mime type
+	BINARY_MIME = "application/octet-stream"
+
+	CHARSET = "utf-8"
+	CRLF    = "\r\n"
+)
+
+var (
+	// for deriving the plain text alternative of html message bodies
+	htmlBreaks     = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|</h[1-6]>|</li>|</tr>`)
+	htmlLinks      = regexp.MustCompile(`(?is)<a\s[^>]*href="([^"]*)"[^>]*>(.*?)</a>`)
+	htmlTags       = regexp.MustCompile(`(?s)<[^>]*>`)
+	extraBlankLine = regexp.MustCompile(`\n{3,}`)
 )
 
 type EmailAddress struct {
@@ -39,25 +56,35 @@ type EmailAddress struct {
 	Address     string
 }
 
-type EmailHeaders struct {
-	Sender    string
-	Recipient string
-	Subject   string
-	Boundary  string
+// EmailAttachment is attached from either its Data, if defined, or else
+// the contents of the file at FileLocation
+type EmailAttachment struct {
+	ContentType  string
+	FileLocation string
+	FileName     string // defaults to the base name of FileLocation
+	Data         []byte
 }
 
-type EmailBody struct {
-	ContentType string
-	MessageBody string
-	Boundary    string
+// Message defines an email with plain text and/or html bodies (sent as
+// alternatives if both are given), optional attachments, and any number
+// of recipients
+type Message struct {
+	From        *EmailAddress
+	To          []*EmailAddress
+	Cc          []*EmailAddress
+	Bcc         []*EmailAddress // not listed in the headers
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []*EmailAttachment
+	Date        time.Time // defaults to the time Bytes is called
+	MessageId   string    // generated by Bytes, if empty
 }
 
-type EmailAttachment struct {
-	ContentType     string
-	FileLocation    string
-	FileName        string
-	EncodedFileData string
-	Boundary        string
+// entity is one node of the MIME tree: its headers and (encoded) body
+type entity struct {
+	header textproto.MIMEHeader
+	body   []byte
 }
 
 // GenerateBoundary produces a random string that can be used for the email
@@ -75,120 +102,260 @@ func GenerateBoundary() string {
 	}
 }
 
-func GenerateAddress(context *EmailAddress) (string, error) {
-	var doc bytes.Buffer
-	t := template.Must(template.New("ADDRESS").Parse(ADDRESS))
-	err := t.Execute(&doc, context)
-	return doc.String(), err
+// GenerateAddress formats the address for a header, encoding the display
+// name if need be (RFC 2047)
+func GenerateAddress(address *EmailAddress) string {
+	a := mail.Address{Name: address.DisplayName, Address: address.Address}
+	return a.String()
 }
 
-func GenerateHeaders(sender, recipient, subject, boundary string) (string, error) {
-	var doc bytes.Buffer
-	context := &EmailHeaders{sender, recipient, subject, boundary}
-	t := template.Must(template.New("HEADERS").Parse(HEADERS))
-	err := t.Execute(&doc, context)
-	return doc.String(), err
+func generateAddressList(addresses []*EmailAddress) string {
+	list := make([]string, 0)
+	for _, a := range addresses {
+		list = append(list, GenerateAddress(a))
+	}
+	return strings.Join(list, ", ")
 }
 
-func GenerateBody(message, contentType, boundary string) (string, error) {
-	var doc bytes.Buffer
-	context := &EmailBody{contentType, message, boundary}
-	t := template.Must(template.New("BODY").Parse(BODY))
-	err := t.Execute(&doc, context)
-	return doc.String(), err
+// HTMLToText derives a plain text version of the html message body
+func HTMLToText(body string) string {
+	text := htmlLinks.ReplaceAllString(body, "$2 ($1)")
+	text = htmlBreaks.ReplaceAllString(text, "$0\n")
+	text = htmlTags.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.TrimSpace(extraBlankLine.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
 }
 
-func GenerateAttachment(attachment *EmailAttachment) (string, error) {
-	var doc, buf bytes.Buffer
+// textEntity encodes the message body as quoted-printable
+func textEntity(contentType, content string) (*entity, error) {
+	var buf bytes.Buffer
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(strings.Replace(content, "\n", CRLF, -1))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", mime.FormatMediaType(contentType, map[string]string{"charset": CHARSET}))
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	return &entity{header: header, body: buf.Bytes()}, nil
+}
 
-	// read and encode the file attachment
-	content, contentErr := ioutil.ReadFile(attachment.FileLocation)
-	if contentErr != nil {
-		return "", contentErr
+// attachmentEntity encodes the attachment as base64
+func attachmentEntity(attachment *EmailAttachment) (*entity, error) {
+	content := attachment.Data
+	if content == nil {
+		fileContent, fileErr := ioutil.ReadFile(attachment.FileLocation)
+		if fileErr != nil {
+			return nil, fileErr
+		}
+		content = fileContent
+	}
+	name := attachment.FileName
+	if name == "" {
+		name = filepath.Base(attachment.FileLocation)
+	}
+	contentType := attachment.ContentType
+	if contentType == "" {
+		contentType = BINARY_MIME
 	}
-	encoded := base64.StdEncoding.EncodeToString(content)
 
 	// split the encoded data into individual lines
-	// and append them to the byte buffer
-	lines := len(encoded) / LINE_MAX_LEN
-	for i := 0; i < lines; i++ {
-		buf.WriteString(encoded[i*LINE_MAX_LEN:(i+1)*LINE_MAX_LEN] + "\n")
+	var buf bytes.Buffer
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > LINE_MAX_LEN {
+		buf.WriteString(encoded[:LINE_MAX_LEN] + CRLF)
+		encoded = encoded[LINE_MAX_LEN:]
 	}
-	// don't forget the last line in the buffer
-	buf.WriteString(encoded[lines*LINE_MAX_LEN:])
-	attachment.EncodedFileData = buf.String()
+	buf.WriteString(encoded)
 
-	// can now process the template
-	t := template.Must(template.New("ATTACHMENT").Parse(ATTACHMENT))
-	err := t.Execute(&doc, attachment)
-	return doc.String(), err
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", mime.FormatMediaType(contentType, map[string]string{"name": name}))
+	header.Set("Content-Transfer-Encoding", "base64")
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	return &entity{header: header, body: buf.Bytes()}, nil
 }
 
-// SendFromServer transmits the given message, with optional attachments,
-// via the defined mail server and port
-func SendFromServer(subject, message, messageType, server string, sender, recipient *EmailAddress, attachments []*EmailAttachment, port int) error {
+// multipartEntity combines the parts into a multipart entity of the
+// given subtype (e.g., "alternative" or "mixed")
+func multipartEntity(subtype string, parts []*entity) (*entity, error) {
 	var buf bytes.Buffer
-	boundary := GenerateBoundary()
+	w := multipart.NewWriter(&buf)
+	for _, part := range parts {
+		pw, err := w.CreatePart(part.header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = pw.Write(part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
 
-	from, fromErr := GenerateAddress(sender)
-	if fromErr != nil {
-		return fromErr
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": w.Boundary()}))
+	return &entity{header: header, body: buf.Bytes()}, nil
+}
+
+// writeHeader writes the header fields in a consistent order
+func writeHeader(buf *bytes.Buffer, header textproto.MIMEHeader) {
+	keys := make([]string, 0)
+	for k := range header {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range header[k] {
+			buf.WriteString(k + ": " + v + CRLF)
+		}
+	}
+}
 
-	to, toErr := GenerateAddress(recipient)
-	if toErr != nil {
-		return toErr
+// Recipients returns every To, Cc, and Bcc address
+func (m *Message) Recipients() []string {
+	list := make([]string, 0)
+	for _, group := range [][]*EmailAddress{m.To, m.Cc, m.Bcc} {
+		for _, a := range group {
+			list = append(list, a.Address)
+		}
 	}
+	return list
+}
 
-	hdr, hdrErr := GenerateHeaders(from, to, subject, boundary)
-	if hdrErr != nil {
-		return hdrErr
+// Bytes generates the complete message: the headers, and the MIME tree
+// of the bodies (as alternatives), nested with any attachments
+func (m *Message) Bytes() ([]byte, error) {
+	if len(m.Recipients()) == 0 {
+		return nil, ERR_NO_RECIPIENTS
 	}
-	buf.WriteString(hdr)
 
-	body, bodyErr := GenerateBody(message, messageType, boundary)
-	if bodyErr != nil {
-		return bodyErr
+	bodies := make([]*entity, 0)
+	if m.Text != "" || m.HTML == "" {
+		text, err := textEntity(TEXT_MIME, m.Text)
+		if err != nil {
+			return nil, err
+		}
+		bodies = append(bodies, text)
+	}
+	if m.HTML != "" {
+		h, err := textEntity(HTML_MIME, m.HTML)
+		if err != nil {
+			return nil, err
+		}
+		bodies = append(bodies, h)
 	}
-	buf.WriteString(body)
 
-	for _, a := range attachments {
-		a.Boundary = boundary
-		attach, attachErr := GenerateAttachment(a)
-		if attachErr != nil {
-			return attachErr
+	content := bodies[0]
+	if len(bodies) > 1 {
+		alternative, err := multipartEntity("alternative", bodies)
+		if err != nil {
+			return nil, err
 		}
-		buf.WriteString(attach)
+		content = alternative
 	}
 
-	// add the closing boundary marker
-	buf.WriteString("\r\n--")
-	buf.WriteString(boundary)
-	buf.WriteString("--")
+	if len(m.Attachments) > 0 {
+		parts := []*entity{content}
+		for _, a := range m.Attachments {
+			attachment, err := attachmentEntity(a)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, attachment)
+		}
+		mixed, err := multipartEntity("mixed", parts)
+		if err != nil {
+			return nil, err
+		}
+		content = mixed
+	}
 
-	// connect to the mail server + port
-	c, cErr := smtp.Dial(fmt.Sprintf("%s:%d", server, port))
-	if cErr != nil {
-		return cErr
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	if m.MessageId == "" {
+		domain := "localhost"
+		if at := strings.LastIndex(m.From.Address, "@"); at >= 0 {
+			domain = m.From.Address[at+1:]
+		}
+		m.MessageId = fmt.Sprintf("<%s@%s>", GenerateBoundary(), domain)
 	}
 
-	// set the sender and recipient (raw email address strings)
-	c.Mail(sender.Address)
-	c.Rcpt(recipient.Address)
+	var buf bytes.Buffer
+	buf.WriteString("From: " + GenerateAddress(m.From) + CRLF)
+	if len(m.To) > 0 {
+		buf.WriteString("To: " + generateAddressList(m.To) + CRLF)
+	}
+	if len(m.Cc) > 0 {
+		buf.WriteString("Cc: " + generateAddressList(m.Cc) + CRLF)
+	}
+	buf.WriteString("Subject: " + mime.QEncoding.Encode(CHARSET, m.Subject) + CRLF)
+	buf.WriteString("Date: " + date.Format(time.RFC1123Z) + CRLF)
+	buf.WriteString("Message-ID: " + m.MessageId + CRLF)
+	buf.WriteString("MIME-Version: 1.0" + CRLF)
+	writeHeader(&buf, content.header)
+	buf.WriteString(CRLF)
+	buf.Write(content.body)
+
+	return buf.Bytes(), nil
+}
+
+// NewMessage defines the Message for a single recipient, from a body of
+// the given type: html bodies also get a plain text alternative
+func NewMessage(subject, message, messageType string, sender, recipient *EmailAddress, attachments []*EmailAttachment) *Message {
+	m := &Message{From: sender, To: []*EmailAddress{recipient}, Subject: subject, Attachments: attachments}
+	if messageType == HTML_MIME {
+		m.HTML = message
+		m.Text = HTMLToText(message)
+	} else {
+		m.Text = message
+	}
+	return m
+}
+
+// Compose generates the complete message (headers, body, and attachments)
+// for a single recipient, from a body of the given type
+func Compose(subject, message, messageType string, sender, recipient *EmailAddress, attachments []*EmailAttachment) ([]byte, error) {
+	return NewMessage(subject, message, messageType, sender, recipient, attachments).Bytes()
+}
 
-	// stream the full email data
-	wc, err := c.Data()
+// SendFromServer transmits the given message, with optional attachments,
+// via the defined mail server and port, immediately
+func SendFromServer(subject, message, messageType, server string, sender, recipient *EmailAddress, attachments []*EmailAttachment, port int) error {
+	data, err := Compose(subject, message, messageType, sender, recipient, attachments)
 	if err != nil {
 		return err
 	}
-	defer wc.Close()
+	t := &SMTPTransport{Host: server, Port: port}
+	return t.Deliver(sender.Address, []string{recipient.Address}, data)
+}
 
-	_, err = buf.WriteTo(wc)
-	return err
+// SendMessage transmits the message via the DefaultOutbox, if there is
+// one, or else immediately via the DefaultTransport
+func SendMessage(m *Message) error {
+	data, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	if DefaultOutbox != nil {
+		return DefaultOutbox.Enqueue(m.From.Address, m.Recipients(), data)
+	}
+	return DefaultTransport.Deliver(m.From.Address, m.Recipients(), data)
 }
 
 // Send transmits the given message, with optional attachments, via the
-// default mail server (localhost) and port (25)
+// DefaultOutbox, if there is one, or else immediately via the
+// DefaultTransport (by default, the local mail server on port 25)
 func Send(subject, message, messageType string, sender, recipient *EmailAddress, attachments []*EmailAttachment) error {
-	return SendFromServer(subject, message, messageType, MAIL_SERVER, sender, recipient, attachments, MAIL_PORT)
+	return SendMessage(NewMessage(subject, message, messageType, sender, recipient, attachments))
 }
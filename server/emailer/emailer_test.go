@@ -0,0 +1,232 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package emailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var messageId = regexp.MustCompile(`^<[0-9a-f]{32}@example\.org>$`)
+
+// parseMessage reads the generated message back, as a mail client would
+func parseMessage(t *testing.T, m *Message) (*mail.Message, []byte) {
+	data, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg, data
+}
+
+// mediaType parses the Content-Type header value
+func mediaType(t *testing.T, value string) (string, map[string]string) {
+	mt, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		t.Fatalf("Content-Type %q: %v", value, err)
+	}
+	return mt, params
+}
+
+// readParts returns each of the (raw, i.e., still encoded) parts of the
+// multipart body, along with their contents
+func readParts(t *testing.T, body io.Reader, boundary string) ([]*multipart.Part, [][]byte) {
+	parts := make([]*multipart.Part, 0)
+	contents := make([][]byte, 0)
+	r := multipart.NewReader(body, boundary)
+	for {
+		part, err := r.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, part)
+		contents = append(contents, content)
+	}
+	return parts, contents
+}
+
+// decodeText checks the body is quoted-printable (with no line longer
+// than RFC 2045 allows), and returns it decoded
+func decodeText(t *testing.T, encoding string, content []byte) string {
+	if encoding != "quoted-printable" {
+		t.Errorf("Content-Transfer-Encoding = %q", encoding)
+	}
+	for _, line := range strings.Split(string(content), CRLF) {
+		if len(line) > LINE_MAX_LEN {
+			t.Errorf("line of %d characters: %q", len(line), line)
+		}
+	}
+	decoded, err := ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(decoded)
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	date := time.Date(2024, time.March, 9, 7, 30, 0, 0, time.FixedZone("CET", 3600))
+	attachment := []byte("barcode,product\n0012345678905,Hafermilch\n")
+	html := `<p>Diese Artikel laufen bald ab: <a href="https://example.org/items">Hafermilch, Roggenbrot, Käse</a> und noch viele andere, die auf eine Zeile nicht passen würden.</p>`
+
+	m := &Message{
+		From:        &EmailAddress{DisplayName: "PiScan Küche", Address: "noreply@example.org"},
+		To:          []*EmailAddress{{DisplayName: "Zoë Müller", Address: "zoe@example.com"}, {Address: "sam@example.com"}},
+		Cc:          []*EmailAddress{{DisplayName: "Ana", Address: "ana@example.com"}},
+		Bcc:         []*EmailAddress{{DisplayName: "Archive", Address: "archive@example.net"}},
+		Subject:     "Ihre Artikel – bald abgelaufen",
+		HTML:        html,
+		Text:        HTMLToText(html),
+		Attachments: []*EmailAttachment{{ContentType: "text/csv", FileName: "items.csv", Data: attachment}},
+		Date:        date}
+	msg, data := parseMessage(t, m)
+
+	// headers
+	from, err := msg.Header.AddressList("From")
+	if err != nil || len(from) != 1 || from[0].Name != "PiScan Küche" || from[0].Address != "noreply@example.org" {
+		t.Errorf("From = %v, %v", from, err)
+	}
+	to, err := msg.Header.AddressList("To")
+	if err != nil || len(to) != 2 || to[0].Name != "Zoë Müller" || to[0].Address != "zoe@example.com" || to[1].Address != "sam@example.com" {
+		t.Errorf("To = %v, %v", to, err)
+	}
+	if !strings.Contains(msg.Header.Get("To"), "=?utf-8?") {
+		t.Errorf("the To display name is not RFC 2047 encoded: %q", msg.Header.Get("To"))
+	}
+	cc, err := msg.Header.AddressList("Cc")
+	if err != nil || len(cc) != 1 || cc[0].Address != "ana@example.com" {
+		t.Errorf("Cc = %v, %v", cc, err)
+	}
+	if _, exists := msg.Header["Bcc"]; exists || bytes.Contains(data, []byte("archive@example.net")) {
+		t.Error("the Bcc recipient is listed in the message")
+	}
+	if raw := msg.Header.Get("Subject"); !strings.HasPrefix(raw, "=?utf-8?q?") {
+		t.Errorf("the Subject is not RFC 2047 encoded: %q", raw)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != m.Subject {
+		t.Errorf("Subject = %q, %v", subject, err)
+	}
+	if sent, err := msg.Header.Date(); err != nil || !sent.Equal(date) {
+		t.Errorf("Date = %v, %v, expected %v", sent, err, date)
+	}
+	if id := msg.Header.Get("Message-Id"); !messageId.MatchString(id) || id != m.MessageId {
+		t.Errorf("Message-ID = %q", id)
+	}
+	if v := msg.Header.Get("Mime-Version"); v != "1.0" {
+		t.Errorf("MIME-Version = %q", v)
+	}
+
+	// multipart/mixed: the bodies, then the attachment
+	mt, params := mediaType(t, msg.Header.Get("Content-Type"))
+	if mt != "multipart/mixed" {
+		t.Fatalf("Content-Type = %q, expected multipart/mixed", mt)
+	}
+	parts, contents := readParts(t, msg.Body, params["boundary"])
+	if len(parts) != 2 {
+		t.Fatalf("%d mixed parts, expected 2", len(parts))
+	}
+
+	// multipart/alternative: text, then html
+	mt, params = mediaType(t, parts[0].Header.Get("Content-Type"))
+	if mt != "multipart/alternative" {
+		t.Fatalf("first part Content-Type = %q, expected multipart/alternative", mt)
+	}
+	alternatives, bodies := readParts(t, bytes.NewReader(contents[0]), params["boundary"])
+	if len(alternatives) != 2 {
+		t.Fatalf("%d alternatives, expected 2", len(alternatives))
+	}
+	for i, expected := range []struct{ mediaType, content string }{{TEXT_MIME, m.Text}, {HTML_MIME, m.HTML}} {
+		mt, params = mediaType(t, alternatives[i].Header.Get("Content-Type"))
+		if mt != expected.mediaType || params["charset"] != CHARSET {
+			t.Errorf("alternative %d Content-Type = %q, %v", i, mt, params)
+		}
+		body := decodeText(t, alternatives[i].Header.Get("Content-Transfer-Encoding"), bodies[i])
+		if body != strings.Replace(expected.content, "\n", CRLF, -1) {
+			t.Errorf("alternative %d body = %q, expected %q", i, body, expected.content)
+		}
+	}
+
+	mt, params = mediaType(t, parts[1].Header.Get("Content-Type"))
+	if mt != "text/csv" || params["name"] != "items.csv" || parts[1].FileName() != "items.csv" {
+		t.Errorf("attachment Content-Type = %q, %v, file name %q", mt, params, parts[1].FileName())
+	}
+	if encoding := parts[1].Header.Get("Content-Transfer-Encoding"); encoding != "base64" {
+		t.Errorf("attachment Content-Transfer-Encoding = %q", encoding)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.Replace(string(contents[1]), CRLF, "", -1))
+	if err != nil || !bytes.Equal(decoded, attachment) {
+		t.Errorf("attachment = %q, %v", decoded, err)
+	}
+}
+
+func TestMessageTextOnly(t *testing.T) {
+	text := strings.Repeat("Roggenbrot läuft ab = bald wegwerfen. ", 5) + "\nZweite Zeile"
+	m := &Message{
+		From:    &EmailAddress{Address: "noreply@example.org"},
+		Bcc:     []*EmailAddress{{Address: "archive@example.net"}},
+		Subject: "Plain ASCII subject",
+		Text:    text}
+	msg, data := parseMessage(t, m)
+
+	if _, exists := msg.Header["To"]; exists {
+		t.Errorf("To = %q, expected none", msg.Header.Get("To"))
+	}
+	if bytes.Contains(data, []byte("archive@example.net")) {
+		t.Error("the Bcc recipient is listed in the message")
+	}
+	if subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); err != nil || subject != m.Subject {
+		t.Errorf("Subject = %q, %v", subject, err)
+	}
+	if _, err := msg.Header.Date(); err != nil {
+		t.Errorf("Date: %v", err)
+	}
+
+	// a single body is not wrapped in a multipart entity
+	mt, params := mediaType(t, msg.Header.Get("Content-Type"))
+	if mt != TEXT_MIME || params["charset"] != CHARSET {
+		t.Fatalf("Content-Type = %q, %v", mt, params)
+	}
+	content, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := decodeText(t, msg.Header.Get("Content-Transfer-Encoding"), content); body != strings.Replace(text, "\n", CRLF, -1) {
+		t.Errorf("body = %q, expected %q", body, text)
+	}
+}
+
+func TestMessageRecipients(t *testing.T) {
+	m := &Message{
+		From: &EmailAddress{Address: "noreply@example.org"},
+		To:   []*EmailAddress{{Address: "zoe@example.com"}},
+		Cc:   []*EmailAddress{{Address: "ana@example.com"}},
+		Bcc:  []*EmailAddress{{Address: "archive@example.net"}}}
+	if recipients := m.Recipients(); strings.Join(recipients, " ") != "zoe@example.com ana@example.com archive@example.net" {
+		t.Errorf("Recipients = %v", recipients)
+	}
+
+	if _, err := (&Message{From: m.From, Text: "hello"}).Bytes(); err != ERR_NO_RECIPIENTS {
+		t.Errorf("Bytes with no recipients: %v, expected %v", err, ERR_NO_RECIPIENTS)
+	}
+}
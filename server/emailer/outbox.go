@@ -0,0 +1,193 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package emailer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Outbox delivery defaults
+	OUTBOX_MAX_ATTEMPTS = 10
+	OUTBOX_BACKOFF      = time.Minute   // doubled after each failed attempt
+	OUTBOX_MAX_BACKOFF  = 6 * time.Hour // but never longer than this
+	OUTBOX_INTERVAL     = 15 * time.Second
+
+	// where undeliverable messages end up, under the outbox folder
+	OUTBOX_FAILED = "failed"
+
+	OUTBOX_SUFFIX = ".json"
+)
+
+var (
+	// The Outbox used by Send, if defined (so that requests do not wait
+	// for the mail server)
+	DefaultOutbox *Outbox
+)
+
+// OutboxMessage is a queued message, along with its delivery attempts
+type OutboxMessage struct {
+	From      string    `json:"from"`
+	To        []string  `json:"to"`
+	Data      []byte    `json:"data"`
+	Queued    time.Time `json:"queued"`
+	Attempts  int       `json:"attempts"`
+	NextTry   time.Time `json:"next"`
+	LastError string    `json:"error,omitempty"`
+}
+
+// Outbox keeps messages in a folder (one json file each) until the
+// Transport delivers them, retrying failed deliveries with an increasing
+// delay, so that queued messages survive server restarts
+type Outbox struct {
+	Dir         string
+	Transport   Transport
+	MaxAttempts int
+	Backoff     time.Duration
+	Now         func() time.Time
+
+	mu sync.Mutex // held while delivering, so only one Flush runs at a time
+}
+
+// NewOutbox creates the Outbox in the given folder, which is created if
+// it does not exist yet
+func NewOutbox(dir string, transport Transport) (*Outbox, error) {
+	if err := os.MkdirAll(filepath.Join(dir, OUTBOX_FAILED), 0755); err != nil {
+		return nil, err
+	}
+	return &Outbox{Dir: dir, Transport: transport, MaxAttempts: OUTBOX_MAX_ATTEMPTS, Backoff: OUTBOX_BACKOFF, Now: time.Now}, nil
+}
+
+// save writes the message to the file, atomically
+func (o *Outbox) save(path string, m *OutboxMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	tmp, tmpErr := ioutil.TempFile(o.Dir, ".outbox")
+	if tmpErr != nil {
+		return tmpErr
+	}
+	if _, writeErr := tmp.Write(data); writeErr != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return writeErr
+	}
+	tmp.Close()
+	return os.Rename(tmp.Name(), path)
+}
+
+// Enqueue adds the message to the Outbox, for delivery by the next Flush
+func (o *Outbox) Enqueue(from string, to []string, data []byte) error {
+	if len(to) == 0 {
+		return ERR_NO_RECIPIENTS
+	}
+	now := o.Now()
+	m := &OutboxMessage{From: from, To: to, Data: data, Queued: now, NextTry: now}
+	name := fmt.Sprintf("%020d-%s%s", now.UnixNano(), GenerateBoundary(), OUTBOX_SUFFIX)
+	return o.save(filepath.Join(o.Dir, name), m)
+}
+
+// Pending returns the file names of the queued messages, oldest first
+func (o *Outbox) Pending() ([]string, error) {
+	files, err := ioutil.ReadDir(o.Dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), OUTBOX_SUFFIX) && !strings.HasPrefix(f.Name(), ".") {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// retryDelay is how long to wait after the given number of failed attempts
+func (o *Outbox) retryDelay(attempts int) time.Duration {
+	delay := o.Backoff
+	for i := 1; i < attempts && delay < OUTBOX_MAX_BACKOFF; i++ {
+		delay *= 2
+	}
+	if delay > OUTBOX_MAX_BACKOFF {
+		delay = OUTBOX_MAX_BACKOFF
+	}
+	return delay
+}
+
+// Flush attempts to deliver every queued message which is due, returning
+// how many were delivered; messages which fail MaxAttempts times are moved
+// to the failed folder
+func (o *Outbox) Flush() (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	names, err := o.Pending()
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, name := range names {
+		path := filepath.Join(o.Dir, name)
+		data, readErr := ioutil.ReadFile(path)
+		if readErr != nil {
+			log.Println(readErr)
+			continue
+		}
+		m := new(OutboxMessage)
+		if jsonErr := json.Unmarshal(data, m); jsonErr != nil {
+			log.Println(fmt.Sprintf("Outbox message %s is unreadable: %s", name, jsonErr))
+			os.Rename(path, filepath.Join(o.Dir, OUTBOX_FAILED, name))
+			continue
+		}
+
+		now := o.Now()
+		if now.Before(m.NextTry) {
+			continue
+		}
+
+		deliverErr := o.Transport.Deliver(m.From, m.To, m.Data)
+		if deliverErr == nil {
+			delivered += 1
+			os.Remove(path)
+			continue
+		}
+
+		m.Attempts += 1
+		m.LastError = deliverErr.Error()
+		m.NextTry = now.Add(o.retryDelay(m.Attempts))
+		if saveErr := o.save(path, m); saveErr != nil {
+			log.Println(saveErr)
+		}
+		if m.Attempts >= o.MaxAttempts {
+			log.Println(fmt.Sprintf("Giving up on outbox message %s to %s: %s", name, strings.Join(m.To, ","), m.LastError))
+			os.Rename(path, filepath.Join(o.Dir, OUTBOX_FAILED, name))
+		}
+	}
+
+	return delivered, nil
+}
+
+// Run flushes the Outbox every interval, in the background
+func (o *Outbox) Run(interval time.Duration) {
+	go func() {
+		for _ = range time.Tick(interval) {
+			if _, err := o.Flush(); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,189 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package emailer
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var errUnavailable = errors.New("421 Service not available")
+
+// testOutbox creates an Outbox in a temporary folder, delivering to memory,
+// whose clock only moves when the test advances it
+func testOutbox(t *testing.T) (*Outbox, *MemoryTransport, *time.Time) {
+	transport := new(MemoryTransport)
+	o, err := NewOutbox(t.TempDir(), transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, time.March, 9, 8, 0, 0, 0, time.UTC)
+	o.Now = func() time.Time { return now }
+	return o, transport, &now
+}
+
+// flush runs Flush, checking how many messages it delivered
+func flush(t *testing.T, o *Outbox, expected int) {
+	delivered, err := o.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered != expected {
+		t.Errorf("Flush delivered %d messages, expected %d", delivered, expected)
+	}
+}
+
+// queued returns the single message waiting in the Outbox
+func queued(t *testing.T, o *Outbox) *OutboxMessage {
+	names, err := o.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("%d queued messages, expected 1", len(names))
+	}
+	data, err := ioutil.ReadFile(filepath.Join(o.Dir, names[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(OutboxMessage)
+	if err = json.Unmarshal(data, m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestOutboxFlush(t *testing.T) {
+	o, transport, _ := testOutbox(t)
+	for _, to := range []string{"zoe@example.com", "sam@example.com"} {
+		if err := o.Enqueue("noreply@example.org", []string{to}, []byte("Subject: hello\r\n\r\nhi\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.Enqueue("noreply@example.org", nil, []byte("hi")); err != ERR_NO_RECIPIENTS {
+		t.Errorf("Enqueue with no recipients: %v, expected %v", err, ERR_NO_RECIPIENTS)
+	}
+
+	flush(t, o, 2)
+	messages := transport.Delivered()
+	if len(messages) != 2 {
+		t.Fatalf("%d messages delivered, expected 2", len(messages))
+	}
+	for _, m := range messages {
+		if m.From != "noreply@example.org" || len(m.To) != 1 || string(m.Data) != "Subject: hello\r\n\r\nhi\r\n" {
+			t.Errorf("delivered %+v", m)
+		}
+	}
+	if names, _ := o.Pending(); len(names) != 0 {
+		t.Errorf("%d messages still queued after delivery", len(names))
+	}
+
+	// nothing is delivered twice
+	flush(t, o, 0)
+}
+
+func TestOutboxRetry(t *testing.T) {
+	o, transport, now := testOutbox(t)
+	if err := o.Enqueue("noreply@example.org", []string{"zoe@example.com"}, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	transport.Err = errUnavailable
+	flush(t, o, 0)
+	m := queued(t, o)
+	if m.Attempts != 1 || m.LastError != errUnavailable.Error() || !m.NextTry.Equal(now.Add(o.Backoff)) {
+		t.Errorf("after 1 failure: attempts %d, error %q, next try %v", m.Attempts, m.LastError, m.NextTry)
+	}
+
+	// not retried before the backoff is over
+	*now = now.Add(o.Backoff - time.Second)
+	flush(t, o, 0)
+	if m = queued(t, o); m.Attempts != 1 {
+		t.Errorf("retried %d times before the backoff was over", m.Attempts-1)
+	}
+
+	// and then twice as long after the second failure
+	*now = now.Add(time.Second)
+	flush(t, o, 0)
+	if m = queued(t, o); m.Attempts != 2 || !m.NextTry.Equal(now.Add(2*o.Backoff)) {
+		t.Errorf("after 2 failures: attempts %d, next try %v", m.Attempts, m.NextTry)
+	}
+
+	transport.Err = nil
+	*now = m.NextTry
+	flush(t, o, 1)
+	if len(transport.Delivered()) != 1 {
+		t.Error("the message was not delivered once the transport recovered")
+	}
+	if names, _ := o.Pending(); len(names) != 0 {
+		t.Errorf("%d messages still queued after delivery", len(names))
+	}
+}
+
+func TestOutboxGiveUp(t *testing.T) {
+	o, transport, now := testOutbox(t)
+	o.MaxAttempts = 3
+	transport.Err = errUnavailable
+	if err := o.Enqueue("noreply@example.org", []string{"zoe@example.com"}, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	names, _ := o.Pending()
+
+	for i := 1; i < o.MaxAttempts; i++ {
+		flush(t, o, 0)
+		if m := queued(t, o); m.Attempts != i {
+			t.Fatalf("attempts = %d, expected %d", m.Attempts, i)
+		}
+		*now = now.Add(OUTBOX_MAX_BACKOFF)
+	}
+	flush(t, o, 0)
+
+	if pending, _ := o.Pending(); len(pending) != 0 {
+		t.Errorf("%d messages still queued after the last attempt", len(pending))
+	}
+	data, err := ioutil.ReadFile(filepath.Join(o.Dir, OUTBOX_FAILED, names[0]))
+	if err != nil {
+		t.Fatalf("the message is not in the failed folder: %v", err)
+	}
+	m := new(OutboxMessage)
+	if err = json.Unmarshal(data, m); err != nil || m.Attempts != o.MaxAttempts || m.LastError != errUnavailable.Error() {
+		t.Errorf("failed message = %+v, %v", m, err)
+	}
+}
+
+func TestOutboxUnreadable(t *testing.T) {
+	o, _, _ := testOutbox(t)
+	if err := ioutil.WriteFile(filepath.Join(o.Dir, "broken"+OUTBOX_SUFFIX), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	flush(t, o, 0)
+	if names, _ := o.Pending(); len(names) != 0 {
+		t.Errorf("the unreadable message is still queued")
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(o.Dir, OUTBOX_FAILED, "broken"+OUTBOX_SUFFIX)); err != nil {
+		t.Errorf("the unreadable message is not in the failed folder: %v", err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	o := &Outbox{Backoff: time.Minute}
+	tests := map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		3:  4 * time.Minute,
+		9:  256 * time.Minute,
+		10: OUTBOX_MAX_BACKOFF,
+		50: OUTBOX_MAX_BACKOFF,
+	}
+	for attempts, expected := range tests {
+		if delay := o.retryDelay(attempts); delay != expected {
+			t.Errorf("retryDelay(%d) = %v, expected %v", attempts, delay, expected)
+		}
+	}
+}
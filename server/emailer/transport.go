@@ -0,0 +1,203 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package emailer
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// SMTP connection security
+	SECURITY_AUTO     = "auto"     // use STARTTLS if the server offers it
+	SECURITY_STARTTLS = "starttls" // require STARTTLS
+	SECURITY_TLS      = "tls"      // connect with TLS from the start (e.g., port 465)
+	SECURITY_NONE     = "none"     // never use TLS
+
+	// How long to wait for the mail server to answer
+	SMTP_TIMEOUT = 30 * time.Second
+)
+
+var (
+	ERR_NO_STARTTLS     = errors.New("The mail server does not support STARTTLS")
+	ERR_BAD_SECURITY    = errors.New("Unknown SMTP security setting")
+	ERR_NO_RECIPIENTS   = errors.New("The message has no recipients")
+	ERR_BAD_TRANSPORT   = errors.New("Unknown email transport")
+	ERR_MISSING_MAILDIR = errors.New("The file transport needs a folder to write to")
+
+	// The Transport used by Send (when there is no DefaultOutbox)
+	DefaultTransport Transport = &SMTPTransport{Host: MAIL_SERVER, Port: MAIL_PORT}
+)
+
+// Transport delivers a complete message (see Compose) from the sender to
+// the recipients (raw email address strings)
+type Transport interface {
+	Deliver(from string, to []string, data []byte) error
+}
+
+// SMTPTransport delivers messages to a mail server, authenticating with
+// the Username and Password if they are defined; with no Security, see
+// DefaultSecurity
+type SMTPTransport struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Security string
+}
+
+// DefaultSecurity is SECURITY_NONE for the local mail server, which
+// rarely has a certificate matching its name (so that STARTTLS with
+// verification would fail every delivery), and SECURITY_AUTO for others
+func DefaultSecurity(host string) string {
+	if host == MAIL_SERVER {
+		return SECURITY_NONE
+	}
+	return SECURITY_AUTO
+}
+
+func (t *SMTPTransport) Deliver(from string, to []string, data []byte) error {
+	if len(to) == 0 {
+		return ERR_NO_RECIPIENTS
+	}
+	security := t.Security
+	if len(security) == 0 {
+		security = DefaultSecurity(t.Host)
+	}
+
+	addr := net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+	tlsConfig := &tls.Config{ServerName: t.Host}
+
+	var conn net.Conn
+	var err error
+	switch security {
+	case SECURITY_TLS:
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: SMTP_TIMEOUT}, "tcp", addr, tlsConfig)
+	case SECURITY_AUTO, SECURITY_STARTTLS, SECURITY_NONE:
+		conn, err = net.DialTimeout("tcp", addr, SMTP_TIMEOUT)
+	default:
+		return ERR_BAD_SECURITY
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(SMTP_TIMEOUT))
+
+	c, err := smtp.NewClient(conn, t.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if security != SECURITY_TLS && security != SECURITY_NONE {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err = c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		} else if security == SECURITY_STARTTLS {
+			return ERR_NO_STARTTLS
+		}
+	}
+
+	if len(t.Username) > 0 {
+		if err = c.Auth(smtp.PlainAuth("", t.Username, t.Password, t.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err = c.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+
+	// stream the full email data
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = wc.Write(data); err != nil {
+		wc.Close()
+		return err
+	}
+	if err = wc.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// FileTransport writes each message to a maildir folder (under new/),
+// instead of sending it, for development servers
+type FileTransport struct {
+	Dir string
+}
+
+func (t *FileTransport) Deliver(from string, to []string, data []byte) error {
+	if len(t.Dir) == 0 {
+		return ERR_MISSING_MAILDIR
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(t.Dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+
+	// write the message under tmp/ first, then move it to new/, so
+	// that readers never see a partial message
+	host, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%s.%s", time.Now().UnixNano(), GenerateBoundary(), host)
+	tmp := filepath.Join(t.Dir, "tmp", name)
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(t.Dir, "new", name))
+}
+
+// DeliveredMessage is what the MemoryTransport keeps of each message
+type DeliveredMessage struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// MemoryTransport keeps each message in memory, instead of sending it,
+// for tests; if Err is defined, every delivery fails with it instead
+type MemoryTransport struct {
+	mu       sync.Mutex
+	Messages []*DeliveredMessage
+	Err      error
+}
+
+func (t *MemoryTransport) Deliver(from string, to []string, data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.Err != nil {
+		return t.Err
+	}
+	t.Messages = append(t.Messages, &DeliveredMessage{From: from, To: to, Data: data})
+	return nil
+}
+
+// Delivered returns a copy of the list of messages delivered so far
+func (t *MemoryTransport) Delivered() []*DeliveredMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]*DeliveredMessage{}, t.Messages...)
+}
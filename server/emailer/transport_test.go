@@ -0,0 +1,64 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package emailer
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileTransport(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	transport := &FileTransport{Dir: dir}
+
+	messages := []string{"Subject: one\r\n\r\n1\r\n", "Subject: two\r\n\r\n2\r\n"}
+	for _, data := range messages {
+		if err := transport.Deliver("noreply@example.org", []string{"zoe@example.com"}, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each message is in new/, with nothing left behind in tmp/
+	files, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(messages) {
+		t.Fatalf("%d files in new/, expected %d", len(files), len(messages))
+	}
+	found := make(map[string]bool)
+	for _, f := range files {
+		data, readErr := ioutil.ReadFile(filepath.Join(dir, "new", f.Name()))
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		found[string(data)] = true
+	}
+	for _, data := range messages {
+		if !found[data] {
+			t.Errorf("the message %q is not in new/", data)
+		}
+	}
+	for _, sub := range []string{"tmp", "cur"} {
+		if files, err = ioutil.ReadDir(filepath.Join(dir, sub)); err != nil || len(files) != 0 {
+			t.Errorf("%s/ = %d files, %v", sub, len(files), err)
+		}
+	}
+
+	if err = (&FileTransport{}).Deliver("noreply@example.org", []string{"zoe@example.com"}, []byte("hi")); err != ERR_MISSING_MAILDIR {
+		t.Errorf("Deliver with no folder: %v, expected %v", err, ERR_MISSING_MAILDIR)
+	}
+}
+
+func TestDefaultSecurity(t *testing.T) {
+	for host, expected := range map[string]string{
+		MAIL_SERVER:        SECURITY_NONE,
+		"smtp.example.com": SECURITY_AUTO,
+	} {
+		if security := DefaultSecurity(host); security != expected {
+			t.Errorf("DefaultSecurity(%q) = %q, expected %q", host, security, expected)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package emails holds the default templates for the emails sent by the
+// API server, which are compiled into it; the server can also load its
+// own versions of them, and more locales, from a folder at startup
+
+package emails
+
+import "embed"
+
+// Defaults are the *.tmpl files in this folder, named <template>.tmpl for
+// the default language (English), and <template>.<locale>.tmpl for each
+// translation (e.g., verify.de.tmpl)
+//
+//go:embed *.tmpl
+var Defaults embed.FS
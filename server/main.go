@@ -8,7 +8,16 @@ import (
 	"flag"
 	"fmt"
 	"github.com/Banrai/PiScan/server/api"
+	"github.com/Banrai/PiScan/server/commerce"
+	"github.com/Banrai/PiScan/server/database/barcodes"
+	"github.com/Banrai/PiScan/server/digest"
+	"github.com/Banrai/PiScan/server/emailer"
+	"github.com/Banrai/PiScan/server/ratelimit"
+	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 )
 
 const (
@@ -24,15 +33,73 @@ const (
 	barcodeDBPass   = ""
 	barcodeDBServer = "127.0.0.1"
 	barcodeDBPort   = 3306
+
+	// Vendor lookups (all registered commerce providers are enabled by default)
+	vendorTimeout = 10
+
+	// How often to save the rate limits, if using a persistent store
+	rateStoreInterval = time.Minute
+
+	// How far signed request timestamps may be from the server clock, in seconds
+	signatureSkew = 300
+
+	// Outgoing email
+	mailTransportSMTP = "smtp"
+	mailTransportFile = "file"
+	smtpPasswordEnv   = "SMTP_PASSWORD" // read if -smtpPass is not given
+
+	// Commands, run instead of the API server (with the same flags)
+	migrateCommand   = "migrate"   // create or upgrade the barcodes database
+	importPODCommand = "importpod" // load the POD csv files given after the flags
+)
+
+var (
+	// Default rate limits, per route, as "route:scope=n/unit[:burst]"
+	// (registrations and emails are the strictest, since each one sends
+	// an email to whatever address was given)
+	defaultRateLimits = []string{
+		"/lookup:ip=60/m:30",
+		"/prices:ip=60/m:30",
+		"/brands/suggest:ip=120/m:30",
+		"/register:ip=10/h:5",
+		"/register:account=3/h:1",
+		"/verify/:ip=30/m:10",
+		"/status:ip=30/m:10",
+		"/contribute/:ip=30/m:10",
+		"/contribute/:account=60/h:20",
+		"/vote/:ip=60/m:20",
+		"/moderation/queue:ip=60/m:20",
+		"/moderation/review:ip=60/m:20",
+		"/moderation/role:ip=10/m:5",
+		"/account/rekey:ip=10/m:5",
+		"/account/resend:ip=10/h:5",
+		"/account/resend:account=3/h:1",
+		"/account/disable:ip=10/m:5",
+		"/account/enable:ip=10/m:5",
+		"/account/delete:ip=10/m:5",
+		"/email/:ip=10/m:5",
+		"/email/:account=20/h:5",
+		"/expiring/:ip=10/m:5",
+		"/expiring/:account=3/d:1",
+	}
 )
 
 func main() {
 	var (
-		dbUser, dbPass, dbHost, host, subdomain string
-		dbPort, port, externalPort              int
-		useSSL                                  bool
+		dbUser, dbPass, dbHost, host, subdomain, vendors, rateLimits, rateStore    string
+		mailTransport, smtpHost, smtpUser, smtpPass, smtpSecurity, mailDir, outbox string
+		emailTemplates, previewEmail                                               string
+		dbPort, port, externalPort, vendorWait, skew, smtpPort, podBatch           int
+		useSSL, podRestart                                                         bool
 	)
 
+	// the first argument may be a command (e.g., "APIServer migrate -dbUser=pod")
+	var command string
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	flag.StringVar(&dbUser, "dbUser", barcodeDBUser, fmt.Sprintf("The barcodes database user (defaults to '%s')", barcodeDBUser))
 	flag.StringVar(&dbPass, "dbPass", barcodeDBPass, fmt.Sprintf("The barcodes database password (defaults to '%s')", barcodeDBPass))
 	flag.StringVar(&dbHost, "dbHost", barcodeDBServer, fmt.Sprintf("The barcodes database server (defaults to '%s')", barcodeDBServer))
@@ -42,10 +109,99 @@ func main() {
 	flag.StringVar(&subdomain, "subdomain", apiSubdomain, fmt.Sprintf("The external subdomain of the API server (defaults to '%s')", apiSubdomain))
 	flag.BoolVar(&useSSL, "ssl", apiSSL, fmt.Sprintf("Does the API server use SSL? (defaults to '%t')", apiSSL))
 	flag.IntVar(&externalPort, "extPort", apiExternalPort, fmt.Sprintf("The external API server port (defaults to '%d')", apiExternalPort))
+	flag.StringVar(&vendors, "vendors", "", fmt.Sprintf("Comma-separated list of the vendor providers to use for barcode lookups (defaults to all of '%s')", strings.Join(commerce.RegisteredIds(), ",")))
+	flag.IntVar(&vendorWait, "vendorTimeout", vendorTimeout, fmt.Sprintf("How long to wait for each vendor provider lookup, in seconds (defaults to '%d')", vendorTimeout))
+	flag.IntVar(&skew, "signatureSkew", signatureSkew, fmt.Sprintf("How far signed request timestamps may be from the server clock, in seconds (defaults to '%d')", signatureSkew))
+	flag.StringVar(&rateLimits, "rateLimits", "", "Comma-separated list of rate limits to add or override, as 'route:scope=n/unit[:burst]', where scope is 'ip' or 'account', unit is one of 's', 'm', 'h', or 'd', and n=0 removes the limit (e.g., '/lookup:ip=120/m:60')")
+	flag.StringVar(&rateStore, "rateStore", "", "Path to a file for saving the rate limit state across restarts (defaults to memory only)")
+	flag.StringVar(&mailTransport, "mailTransport", mailTransportSMTP, fmt.Sprintf("How to send outgoing email: '%s', or '%s' to write it to the -mailDir folder instead (defaults to '%s')", mailTransportSMTP, mailTransportFile, mailTransportSMTP))
+	flag.StringVar(&smtpHost, "smtpHost", emailer.MAIL_SERVER, fmt.Sprintf("The mail server (defaults to '%s')", emailer.MAIL_SERVER))
+	flag.IntVar(&smtpPort, "smtpPort", emailer.MAIL_PORT, fmt.Sprintf("The mail server port (defaults to '%d')", emailer.MAIL_PORT))
+	flag.StringVar(&smtpUser, "smtpUser", "", "The mail server user name (defaults to none, i.e., no authentication)")
+	flag.StringVar(&smtpPass, "smtpPass", "", fmt.Sprintf("The mail server password (defaults to the %s environment variable)", smtpPasswordEnv))
+	flag.StringVar(&smtpSecurity, "smtpSecurity", "", fmt.Sprintf("The mail server connection security: '%s', '%s', '%s', or '%s' (defaults to '%s' for '%s', and '%s' for any other server)", emailer.SECURITY_AUTO, emailer.SECURITY_STARTTLS, emailer.SECURITY_TLS, emailer.SECURITY_NONE, emailer.SECURITY_NONE, emailer.MAIL_SERVER, emailer.SECURITY_AUTO))
+	flag.StringVar(&mailDir, "mailDir", "", "The maildir folder for outgoing email, if -mailTransport is 'file'")
+	flag.StringVar(&outbox, "outbox", "", "Path to a folder for queueing outgoing email, which is then delivered (and retried) in the background (defaults to sending it immediately)")
+	flag.StringVar(&emailTemplates, "emailTemplates", "", "Path to a folder of email templates (<template>.tmpl or <template>.<locale>.tmpl files), which override or add to the defaults")
+	flag.StringVar(&previewEmail, "previewEmail", "", fmt.Sprintf("Print the given email template (one of '%s', optionally followed by ':locale') rendered with sample data, and exit", strings.Join(api.EmailTemplateNames(), "', '")))
+	flag.IntVar(&podBatch, "podBatch", barcodes.POD_BATCH_SIZE, fmt.Sprintf("How many rows the %s command loads at a time (defaults to '%d')", importPODCommand, barcodes.POD_BATCH_SIZE))
+	flag.BoolVar(&podRestart, "podRestart", false, fmt.Sprintf("Should the %s command start over, instead of resuming an earlier import of the same files? (defaults to 'false')", importPODCommand))
 	flag.Parse()
 
 	coords := api.DBConnection{Host: dbHost, User: dbUser, Pass: dbPass, Port: dbPort}
 
+	// run the command, if any, instead of the API server
+	switch command {
+	case "":
+	case migrateCommand:
+		if err := api.MigrateServerDatabase(coords); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case importPODCommand:
+		if flag.NArg() == 0 {
+			log.Fatal(fmt.Sprintf("Usage: APIServer %s [flags] <POD csv file> ...", importPODCommand))
+		}
+		if err := api.ImportPODFiles(coords, flag.Args(), podBatch, podRestart); err != nil {
+			log.Fatal(err)
+		}
+		return
+	default:
+		log.Fatal(fmt.Sprintf("Unknown command '%s' (use '%s' or '%s')", command, migrateCommand, importPODCommand))
+	}
+
+	// load the email templates, and preview one, if requested
+	if err := api.LoadEmailTemplates(emailTemplates); err != nil {
+		log.Fatal(err)
+	}
+	if len(previewEmail) > 0 {
+		name, locale := previewEmail, ""
+		if i := strings.Index(previewEmail, ":"); i >= 0 {
+			name, locale = previewEmail[:i], previewEmail[i+1:]
+		}
+		if err := api.PreviewEmail(os.Stdout, name, locale); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// configure outgoing email
+	switch mailTransport {
+	case mailTransportSMTP:
+		if len(smtpPass) == 0 {
+			smtpPass = os.Getenv(smtpPasswordEnv)
+		}
+		emailer.DefaultTransport = &emailer.SMTPTransport{Host: smtpHost, Port: smtpPort, Username: smtpUser, Password: smtpPass, Security: smtpSecurity}
+	case mailTransportFile:
+		if len(mailDir) == 0 {
+			log.Fatal(emailer.ERR_MISSING_MAILDIR)
+		}
+		emailer.DefaultTransport = &emailer.FileTransport{Dir: mailDir}
+	default:
+		log.Fatal(emailer.ERR_BAD_TRANSPORT)
+	}
+	if len(outbox) > 0 {
+		box, boxErr := emailer.NewOutbox(outbox, emailer.DefaultTransport)
+		if boxErr != nil {
+			log.Fatal(boxErr)
+		}
+		box.Run(emailer.OUTBOX_INTERVAL)
+		emailer.DefaultOutbox = box
+	}
+
+	// configure the vendor providers used for barcode lookups
+	for _, id := range commerce.RegisteredIds() {
+		commerce.SetTimeout(id, time.Duration(vendorWait)*time.Second)
+	}
+	if len(vendors) > 0 {
+		if err := commerce.EnableOnly(strings.Split(vendors, ",")); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// warn about any schema changes the barcodes database is missing
+	api.CheckServerDatabase(coords)
+
 	// define the external-facing API server link
 	// for email confirmations, etc.
 	var buffer bytes.Buffer
@@ -76,6 +232,22 @@ func main() {
 		api.Respond("application/json", "utf-8", lookup)(w, r)
 	}
 
+	// respond to vendor product price history requests
+	handlers["/prices"] = func(w http.ResponseWriter, r *http.Request) {
+		prices := func(w http.ResponseWriter, r *http.Request) string {
+			return api.GetPrices(r, coords)
+		}
+		api.Respond("application/json", "utf-8", prices)(w, r)
+	}
+
+	// suggest brands (for autocomplete) matching a partial name
+	handlers["/brands/suggest"] = func(w http.ResponseWriter, r *http.Request) {
+		suggest := func(w http.ResponseWriter, r *http.Request) string {
+			return api.SuggestBrands(r, coords)
+		}
+		api.Respond("application/json", "utf-8", suggest)(w, r)
+	}
+
 	// respond to contributor account creation requests
 	handlers["/register"] = func(w http.ResponseWriter, r *http.Request) {
 		register := func(w http.ResponseWriter, r *http.Request) string {
@@ -108,6 +280,78 @@ func main() {
 		api.Respond("application/json", "utf-8", contribute)(w, r)
 	}
 
+	// accept votes (upvotes or flags) on user-contributed data
+	handlers["/vote/"] = func(w http.ResponseWriter, r *http.Request) {
+		fn := func(w http.ResponseWriter, r *http.Request) string {
+			return api.VoteContribution(r, coords)
+		}
+		api.Respond("application/json", "utf-8", fn)(w, r)
+	}
+
+	// list the user-contributed data awaiting moderation
+	handlers["/moderation/queue"] = func(w http.ResponseWriter, r *http.Request) {
+		fn := func(w http.ResponseWriter, r *http.Request) string {
+			return api.GetModerationQueue(r, coords)
+		}
+		api.Respond("application/json", "utf-8", fn)(w, r)
+	}
+
+	// approve or reject user-contributed data
+	handlers["/moderation/review"] = func(w http.ResponseWriter, r *http.Request) {
+		fn := func(w http.ResponseWriter, r *http.Request) string {
+			return api.ReviewContribution(r, coords)
+		}
+		api.Respond("application/json", "utf-8", fn)(w, r)
+	}
+
+	// change a contributor account's role (admins only)
+	handlers["/moderation/role"] = func(w http.ResponseWriter, r *http.Request) {
+		fn := func(w http.ResponseWriter, r *http.Request) string {
+			return api.SetContributorRole(r, coords)
+		}
+		api.Respond("application/json", "utf-8", fn)(w, r)
+	}
+
+	// replace a contributor account's api code
+	handlers["/account/rekey"] = func(w http.ResponseWriter, r *http.Request) {
+		fn := func(w http.ResponseWriter, r *http.Request) string {
+			return api.RekeyAccount(r, coords)
+		}
+		api.Respond("application/json", "utf-8", fn)(w, r)
+	}
+
+	// resend the email verification link
+	handlers["/account/resend"] = func(w http.ResponseWriter, r *http.Request) {
+		fn := func(w http.ResponseWriter, r *http.Request) string {
+			return api.ResendVerification(r, coords, apiServerLink)
+		}
+		api.Respond("application/json", "utf-8", fn)(w, r)
+	}
+
+	// disable a contributor account (its own, or any, for admins)
+	handlers["/account/disable"] = func(w http.ResponseWriter, r *http.Request) {
+		fn := func(w http.ResponseWriter, r *http.Request) string {
+			return api.DisableAccount(r, coords)
+		}
+		api.Respond("application/json", "utf-8", fn)(w, r)
+	}
+
+	// re-enable a disabled contributor account (admins only)
+	handlers["/account/enable"] = func(w http.ResponseWriter, r *http.Request) {
+		fn := func(w http.ResponseWriter, r *http.Request) string {
+			return api.EnableAccount(r, coords)
+		}
+		api.Respond("application/json", "utf-8", fn)(w, r)
+	}
+
+	// delete a contributor account, anonymizing or deleting its contributions
+	handlers["/account/delete"] = func(w http.ResponseWriter, r *http.Request) {
+		fn := func(w http.ResponseWriter, r *http.Request) string {
+			return api.DeleteAccount(r, coords)
+		}
+		api.Respond("application/json", "utf-8", fn)(w, r)
+	}
+
 	// email items list to a user
 	handlers["/email/"] = func(w http.ResponseWriter, r *http.Request) {
 		fn := func(w http.ResponseWriter, r *http.Request) string {
@@ -116,5 +360,64 @@ func main() {
 		api.Respond("application/json", "utf-8", fn)(w, r)
 	}
 
+	// email the daily reminder of the items about to expire to a user
+	handlers["/expiring/"] = func(w http.ResponseWriter, r *http.Request) {
+		fn := func(w http.ResponseWriter, r *http.Request) string {
+			return api.EmailExpiringItems(r, coords)
+		}
+		api.Respond("application/json", "utf-8", fn)(w, r)
+	}
+
+	// throttle every handler according to its rate limits: the account
+	// limits apply to the account whose signature was verified, so they
+	// wrap each handler inside its verifier (below), while the ip limits
+	// wrap the verifiers themselves, so that they also cover the requests
+	// which fail verification
+	var store ratelimit.Store = ratelimit.NewMemoryStore()
+	if len(rateStore) > 0 {
+		fileStore, fileStoreErr := ratelimit.NewFileStore(rateStore, rateStoreInterval)
+		if fileStoreErr != nil {
+			log.Fatal(fileStoreErr)
+		}
+		store = fileStore
+	}
+	verifiedAccount := func(r *http.Request) string {
+		return digest.VerifiedParams(r).Get("email")
+	}
+	limiter := ratelimit.New(store, verifiedAccount, nil)
+	ruleDefinitions := defaultRateLimits
+	if len(rateLimits) > 0 {
+		ruleDefinitions = append(ruleDefinitions, strings.Split(rateLimits, ",")...)
+	}
+	for _, definition := range ruleDefinitions {
+		rule, ruleErr := ratelimit.ParseRule(definition)
+		if ruleErr != nil {
+			log.Fatal(ruleErr)
+		}
+		limiter.Set(rule)
+	}
+	for pattern, handler := range handlers {
+		handlers[pattern] = limiter.AccountHandler(pattern, handler)
+	}
+
+	// require requests made on behalf of an account to be signed with its
+	// api code (lookups may be anonymous, but only signed ones can see the
+	// account's own pending contributions)
+	nonces := digest.NewNonceCache()
+	accountVerifier := digest.NewVerifier(api.AccountKey(coords), time.Duration(skew)*time.Second, nonces)
+	registrationVerifier := digest.NewVerifier(api.RegistrationKey(coords), time.Duration(skew)*time.Second, nonces)
+	deletionVerifier := digest.NewVerifier(api.DeletionKey(coords), time.Duration(skew)*time.Second, nonces)
+	for _, pattern := range []string{"/status", "/contribute/", "/email/", "/expiring/", "/vote/", "/moderation/queue", "/moderation/review", "/moderation/role", "/account/rekey", "/account/resend", "/account/disable", "/account/enable"} {
+		handlers[pattern] = accountVerifier.Handler(handlers[pattern])
+	}
+	handlers["/account/delete"] = deletionVerifier.Handler(handlers["/account/delete"])
+	handlers["/register"] = registrationVerifier.Handler(handlers["/register"])
+	handlers["/lookup"] = accountVerifier.OptionalHandler(handlers["/lookup"], "email")
+
+	// and the ip limits, in front of the verifiers
+	for pattern, handler := range handlers {
+		handlers[pattern] = limiter.Handler(pattern, handler)
+	}
+
 	api.NewAPIServer(host, api.DefaultServerTransport, port, api.DefaultServerReadTimeout, handlers)
 }
@@ -0,0 +1,180 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package pdf generates simple, text-only, printable PDF documents (such
+// as the emailed item lists), using the standard Helvetica fonts, so that
+// nothing needs to be embedded
+
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	// A4 page size and margins, in points
+	PAGE_WIDTH  = 595
+	PAGE_HEIGHT = 842
+	MARGIN      = 50
+
+	// Font sizes and line heights, in points
+	TEXT_SIZE       = 10
+	TEXT_LEADING    = 14
+	HEADING_SIZE    = 16
+	HEADING_LEADING = 24
+
+	// Approximate number of characters per line, since the widths of the
+	// individual Helvetica glyphs are not measured
+	LINE_CHARS = 95
+
+	// the font resource names
+	FONT_REGULAR = "F1"
+	FONT_BOLD    = "F2"
+)
+
+type line struct {
+	font    string
+	size    int
+	leading int
+	text    string
+}
+
+// Document accumulates lines of text, which Bytes lays out into pages
+type Document struct {
+	Title string
+	lines []*line
+}
+
+func New(title string) *Document {
+	return &Document{Title: title, lines: make([]*line, 0)}
+}
+
+// Heading adds a line of bold, larger, text
+func (d *Document) Heading(text string) {
+	d.lines = append(d.lines, &line{FONT_BOLD, HEADING_SIZE, HEADING_LEADING, text})
+}
+
+// Text adds the text, wrapped into as many lines as it needs
+func (d *Document) Text(text string) {
+	for _, l := range wrap(text, LINE_CHARS) {
+		d.lines = append(d.lines, &line{FONT_REGULAR, TEXT_SIZE, TEXT_LEADING, l})
+	}
+}
+
+// Blank adds an empty line
+func (d *Document) Blank() {
+	d.lines = append(d.lines, &line{FONT_REGULAR, TEXT_SIZE, TEXT_LEADING, ""})
+}
+
+// wrap splits the text into lines of at most width characters, breaking
+// at spaces wherever possible
+func wrap(text string, width int) []string {
+	lines := make([]string, 0)
+	for _, paragraph := range strings.Split(text, "\n") {
+		current := ""
+		for _, word := range strings.Fields(paragraph) {
+			for len([]rune(word)) > width {
+				if current != "" {
+					lines = append(lines, current)
+					current = ""
+				}
+				runes := []rune(word)
+				lines = append(lines, string(runes[:width]))
+				word = string(runes[width:])
+			}
+			if current == "" {
+				current = word
+			} else if len([]rune(current))+1+len([]rune(word)) <= width {
+				current += " " + word
+			} else {
+				lines = append(lines, current)
+				current = word
+			}
+		}
+		lines = append(lines, current)
+	}
+	return lines
+}
+
+// encode converts the text to a PDF string literal in WinAnsiEncoding,
+// which matches Latin-1 for the accented letters; anything else becomes
+// a question mark
+func encode(text string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('(')
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(byte(r))
+		case r >= 0x20 && r < 0x7f:
+			buf.WriteByte(byte(r))
+		case r >= 0xa0 && r <= 0xff:
+			buf.WriteString(fmt.Sprintf("\\%03o", r))
+		default:
+			buf.WriteByte('?')
+		}
+	}
+	buf.WriteByte(')')
+	return buf.String()
+}
+
+// paginate lays out the lines into the content stream of each page
+func (d *Document) paginate() []string {
+	pages := make([]string, 0)
+	var page bytes.Buffer
+	y := PAGE_HEIGHT - MARGIN
+	for _, l := range d.lines {
+		if y-l.leading < MARGIN && page.Len() > 0 {
+			pages = append(pages, page.String())
+			page.Reset()
+			y = PAGE_HEIGHT - MARGIN
+		}
+		y -= l.leading
+		if l.text != "" {
+			page.WriteString(fmt.Sprintf("BT /%s %d Tf %d %d Td %s Tj ET\n", l.font, l.size, MARGIN, y, encode(l.text)))
+		}
+	}
+	return append(pages, page.String())
+}
+
+// Bytes generates the complete PDF file
+func (d *Document) Bytes() []byte {
+	var buf bytes.Buffer
+	offsets := make([]int, 0)
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		buf.WriteString(fmt.Sprintf("%d 0 obj\n%s\nendobj\n", len(offsets), body))
+	}
+
+	pages := d.paginate()
+
+	// objects 1-5 are the catalog, page tree, fonts, and document info,
+	// followed by a page and content stream object for each page
+	kids := make([]string, 0)
+	for i := range pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 6+2*i))
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	object(fmt.Sprintf("<< /Title %s /Producer (PiScan) >>", encode(d.Title)))
+	for i, content := range pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /%s 3 0 R /%s 4 0 R >> >> /Contents %d 0 R >>", PAGE_WIDTH, PAGE_HEIGHT, FONT_REGULAR, FONT_BOLD, 7+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", len(content), content))
+	}
+
+	xref := buf.Len()
+	buf.WriteString(fmt.Sprintf("xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1))
+	for _, offset := range offsets {
+		buf.WriteString(fmt.Sprintf("%010d 00000 n \n", offset))
+	}
+	buf.WriteString(fmt.Sprintf("trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref))
+
+	return buf.Bytes()
+}
@@ -0,0 +1,200 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ratelimit provides token-bucket rate limiting for the API
+// server handlers, per client IP address and per contributor account, so
+// that no single client can flood the lookups or the outgoing emails
+
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Rule scopes: what identifies the client being limited
+	SCOPE_IP      = "ip"
+	SCOPE_ACCOUNT = "account"
+
+	// Reply when a request is refused
+	TOO_MANY_REQUESTS = `{"err":"Too many requests, please try again later"}`
+)
+
+// Limit defines a token bucket: it refills at Rate tokens per second, up
+// to Burst tokens, and each request takes one token
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Per returns the Limit allowing n requests per the given interval, with
+// bursts of up to burst requests at once
+func Per(n int, interval time.Duration, burst int) Limit {
+	return Limit{Rate: float64(n) / interval.Seconds(), Burst: burst}
+}
+
+// Rule applies a Limit to a route, per client IP address or per account
+type Rule struct {
+	Route string
+	Scope string
+	Limit Limit
+}
+
+// ParseRule converts a rule definition string of the form
+// "route:scope=n/unit[:burst]" (e.g., "/register:ip=10/h:5") into a Rule,
+// where unit is one of s, m, h, or d; the burst defaults to n
+func ParseRule(definition string) (*Rule, error) {
+	parts := strings.SplitN(strings.TrimSpace(definition), "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid rate limit rule: '%s'", definition)
+	}
+	target := strings.Split(parts[0], ":")
+	if len(target) != 2 || (target[1] != SCOPE_IP && target[1] != SCOPE_ACCOUNT) {
+		return nil, fmt.Errorf("Invalid rate limit route or scope: '%s'", parts[0])
+	}
+
+	spec := strings.Split(parts[1], ":")
+	rate := strings.Split(spec[0], "/")
+	if len(rate) != 2 || len(spec) > 2 {
+		return nil, fmt.Errorf("Invalid rate limit: '%s'", parts[1])
+	}
+	n, nErr := strconv.Atoi(rate[0])
+	if nErr != nil || n < 0 {
+		return nil, fmt.Errorf("Invalid rate limit count: '%s'", rate[0])
+	}
+	units := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}
+	interval, intervalOk := units[rate[1]]
+	if !intervalOk {
+		return nil, fmt.Errorf("Invalid rate limit unit: '%s'", rate[1])
+	}
+	burst := n
+	if len(spec) == 2 {
+		b, bErr := strconv.Atoi(spec[1])
+		if bErr != nil || b < 1 {
+			return nil, fmt.Errorf("Invalid rate limit burst: '%s'", spec[1])
+		}
+		burst = b
+	}
+
+	return &Rule{Route: target[0], Scope: target[1], Limit: Per(n, interval, burst)}, nil
+}
+
+// AccountFunc returns the account which has been verified (e.g., by its
+// request signature) as making the request, or the empty string if none
+type AccountFunc func(r *http.Request) string
+
+// Limiter applies the rules for each route, using the Store to track
+// every client's token buckets, and the AccountFunc to identify the
+// account of the requests subject to the account rules
+type Limiter struct {
+	store    Store
+	accounts AccountFunc
+	rules    map[string][]*Rule
+}
+
+// New creates a Limiter with the given bucket Store, AccountFunc, and rules
+func New(store Store, accounts AccountFunc, rules []*Rule) *Limiter {
+	l := &Limiter{store: store, accounts: accounts, rules: make(map[string][]*Rule)}
+	for _, rule := range rules {
+		l.Set(rule)
+	}
+	return l
+}
+
+// Set adds the rule to the Limiter, replacing any existing rule for the
+// same route and scope; a rule with a zero Rate removes that limit
+func (l *Limiter) Set(rule *Rule) {
+	current := make([]*Rule, 0)
+	for _, existing := range l.rules[rule.Route] {
+		if existing.Scope != rule.Scope {
+			current = append(current, existing)
+		}
+	}
+	if rule.Limit.Rate > 0 {
+		current = append(current, rule)
+	}
+	l.rules[rule.Route] = current
+}
+
+// clientIP returns the IP address of the client making the request
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientAccount returns the verified account making the request, or the
+// empty string if there is none (so the account rules do not apply)
+func (l *Limiter) clientAccount(r *http.Request) string {
+	if l.accounts == nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(l.accounts(r)))
+}
+
+// Allow checks every rule for the route with the given scope against the
+// request, returning false and how long the client should wait if any of
+// them is exceeded
+func (l *Limiter) Allow(route, scope string, r *http.Request) (bool, time.Duration) {
+	now := time.Now()
+	for _, rule := range l.rules[route] {
+		if rule.Scope != scope {
+			continue
+		}
+		var client string
+		switch rule.Scope {
+		case SCOPE_IP:
+			client = clientIP(r)
+		case SCOPE_ACCOUNT:
+			client = l.clientAccount(r)
+		}
+		if client == "" {
+			continue
+		}
+		key := strings.Join([]string{route, rule.Scope, client}, "|")
+		if ok, wait := l.store.Take(key, rule.Limit, now); !ok {
+			return false, wait
+		}
+	}
+	return true, 0
+}
+
+// Handler wraps the handler for the route, replying with a 429 status
+// and a Retry-After header whenever the client IP address exceeds the
+// route limits
+func (l *Limiter) Handler(route string, fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return l.handler(route, SCOPE_IP, fn)
+}
+
+// AccountHandler wraps the handler for the route like Handler, but for
+// the account limits: since these apply to the account the AccountFunc
+// finds, it has to run after the request has been verified (i.e., wrapped
+// by the digest.Verifier handler), not before
+func (l *Limiter) AccountHandler(route string, fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return l.handler(route, SCOPE_ACCOUNT, fn)
+}
+
+func (l *Limiter) handler(route, scope string, fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := l.Allow(route, scope, r); !ok {
+			seconds := int(math.Ceil(wait.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, TOO_MANY_REQUESTS)
+			return
+		}
+		fn(w, r)
+	}
+}
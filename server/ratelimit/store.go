@@ -0,0 +1,142 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ratelimit provides token-bucket rate limiting for the API
+// server handlers, per client IP address and per contributor account, so
+// that no single client can flood the lookups or the outgoing emails
+
+package ratelimit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// how many buckets the MemoryStore holds before it sweeps out the
+	// ones which have refilled completely (and are no different from new)
+	SWEEP_THRESHOLD = 10000
+)
+
+// Store keeps the token buckets for every client key
+type Store interface {
+	// Take removes one token from the key's bucket, returning false and
+	// the time until the next token is available if it is empty
+	Take(key string, limit Limit, now time.Time) (bool, time.Duration)
+}
+
+type bucket struct {
+	Tokens float64   `json:"tokens"`
+	Last   time.Time `json:"last"`
+	Full   time.Time `json:"full"` // when the bucket will have refilled completely
+}
+
+// MemoryStore holds the token buckets in memory only, so they reset
+// whenever the API server restarts
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket)}
+}
+
+func (m *MemoryStore) Take(key string, limit Limit, now time.Time) (bool, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, exists := m.buckets[key]
+	if !exists {
+		if len(m.buckets) >= SWEEP_THRESHOLD {
+			m.sweep(now)
+		}
+		b = &bucket{Tokens: float64(limit.Burst), Last: now}
+		m.buckets[key] = b
+	}
+
+	// refill according to the time elapsed since the last request
+	b.Tokens += now.Sub(b.Last).Seconds() * limit.Rate
+	if b.Tokens > float64(limit.Burst) {
+		b.Tokens = float64(limit.Burst)
+	}
+	b.Last = now
+
+	if b.Tokens < 1 {
+		wait := time.Duration((1 - b.Tokens) / limit.Rate * float64(time.Second))
+		return false, wait
+	}
+	b.Tokens -= 1
+	b.Full = now.Add(time.Duration((float64(limit.Burst) - b.Tokens) / limit.Rate * float64(time.Second)))
+
+	return true, 0
+}
+
+// sweep removes the buckets which are full by now (callers must hold the lock)
+func (m *MemoryStore) sweep(now time.Time) {
+	for key, b := range m.buckets {
+		if now.After(b.Full) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// FileStore is a MemoryStore which is loaded from, and periodically
+// saved to, a file, so that the limits survive API server restarts
+type FileStore struct {
+	*MemoryStore
+	path string
+}
+
+// NewFileStore creates a FileStore using the (json) file at path, which
+// need not exist yet, and saves it every interval
+func NewFileStore(path string, interval time.Duration) (*FileStore, error) {
+	f := &FileStore{MemoryStore: NewMemoryStore(), path: path}
+
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if jsonErr := json.Unmarshal(data, &f.buckets); jsonErr != nil {
+			return nil, jsonErr
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	go func() {
+		for _ = range time.Tick(interval) {
+			if saveErr := f.Save(); saveErr != nil {
+				log.Println(saveErr)
+			}
+		}
+	}()
+
+	return f, nil
+}
+
+// Save writes the current (non-full) buckets to the file, atomically
+func (f *FileStore) Save() error {
+	f.mu.Lock()
+	f.sweep(time.Now())
+	data, err := json.Marshal(f.buckets)
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, tmpErr := ioutil.TempFile(filepath.Dir(f.path), ".ratelimit")
+	if tmpErr != nil {
+		return tmpErr
+	}
+	if _, writeErr := tmp.Write(data); writeErr != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return writeErr
+	}
+	tmp.Close()
+	return os.Rename(tmp.Name(), f.path)
+}